@@ -0,0 +1,384 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/myselfBZ/go-redis-clone/internal/pubsub"
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+	"github.com/myselfBZ/go-redis-clone/internal/store"
+)
+
+// maximum number of replies and messages waiting to be written to a
+// connection, a subscriber that falls further behind is disconnected
+const clientOutputBuffer = 1024
+
+// client is the state of a connection between two commands
+type client struct {
+	conn    net.Conn
+	storage *store.Storage
+	hub     *pubsub.Hub
+
+	// replies and pushed messages, written in order by writeLoop
+	out       chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// set between MULTI and EXEC/DISCARD
+	multi  bool
+	queued [][][]byte
+	// a command failed to queue, EXEC discards the transaction
+	multiErr bool
+	watch    store.Watch
+
+	// the database selected with SELECT
+	session store.Session
+
+	// what the client is subscribed to, mirrored in the hub
+	channels map[string]struct{}
+	patterns map[string]struct{}
+
+	// set by exec when the command is parked by the storage, see wait
+	blocked *store.Blocked
+	// commands pipelined while the client was blocked
+	pending []*resp.Command
+
+	// set once the connection turned into a replica with PSYNC
+	replica bool
+	// port the replica listens on, from REPLCONF listening-port
+	replicaPort string
+
+	// set by ASKING for the next command only
+	asking bool
+}
+
+func newClient(conn net.Conn, storage *store.Storage, hub *pubsub.Hub) *client {
+	return &client{
+		conn:     conn,
+		storage:  storage,
+		hub:      hub,
+		out:      make(chan []byte, clientOutputBuffer),
+		done:     make(chan struct{}),
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+	}
+}
+
+func (c *client) writeLoop() {
+	for {
+		select {
+		case b := <-c.out:
+			if _, err := c.conn.Write(b); err != nil {
+				slog.Error("connection write error", "err", err)
+				c.kill()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// send queues a reply, returns false once the client is closed
+func (c *client) send(rep resp.RespType) bool {
+	select {
+	case c.out <- rep.ToBytes():
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// Push queues a published message without blocking the publisher
+func (c *client) Push(msg resp.RespType) {
+	select {
+	case c.out <- msg.ToBytes():
+	case <-c.done:
+	default:
+		slog.Warn("closing subscriber, output buffer is full", "addr", c.conn.RemoteAddr())
+		c.kill()
+	}
+}
+
+// Feed queues a chunk of the replication stream, a replica too far behind
+// is disconnected and syncs again
+func (c *client) Feed(b []byte) {
+	select {
+	case c.out <- b:
+	case <-c.done:
+	default:
+		slog.Warn("closing replica, output buffer is full", "addr", c.conn.RemoteAddr())
+		c.kill()
+	}
+}
+
+// Close drops the replica connection
+func (c *client) Close() {
+	c.kill()
+}
+
+// kill stops writing to the connection and closes it, the read loop ends
+// with it
+func (c *client) kill() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *client) close() {
+	c.kill()
+	c.storage.Unwatch(&c.watch)
+	c.unsubscribeAll()
+	if c.replica {
+		c.storage.Detach(c)
+	}
+}
+
+// next returns the next command to run, the ones read while the client was
+// blocked come first
+func (c *client) next(ch <-chan *resp.Command) (*resp.Command, bool) {
+	if len(c.pending) > 0 {
+		command := c.pending[0]
+		c.pending = c.pending[1:]
+		return command, true
+	}
+	command, ok := <-ch
+	return command, ok
+}
+
+// wait returns the reply of the blocked command once it's served. The
+// connection is still read meanwhile so the command is cancelled as soon
+// as it's closed, false is returned then.
+func (c *client) wait(ch <-chan *resp.Command) (resp.RespType, bool) {
+	blocked := c.blocked
+	c.blocked = nil
+	for {
+		select {
+		case rep, ok := <-blocked.Reply():
+			return rep, ok
+		case command, ok := <-ch:
+			if ok && command.Err == nil {
+				c.pending = append(c.pending, command)
+				continue
+			}
+			blocked.Cancel()
+			return nil, false
+		case <-c.done:
+			blocked.Cancel()
+			return nil, false
+		}
+	}
+}
+
+// replies is several replies to a single command, sent back to back
+type replies []resp.RespType
+
+func (r replies) Type() string {
+	return "replies"
+}
+
+func (r replies) ToBytes() []byte {
+	var buf []byte
+	for _, rep := range r {
+		buf = append(buf, rep.ToBytes()...)
+	}
+	return buf
+}
+
+// localCmd is a command handled by the connection rather than the storage
+type localCmd struct {
+	arity int
+	// the command may be queued in a transaction
+	multi bool
+	exec  func(c *client, args [][]byte) resp.RespType
+}
+
+var localCmds map[string]localCmd
+
+func init() {
+	localCmds = map[string]localCmd{
+		"unwatch":      {1, true, (*client).execUnwatch},
+		"subscribe":    {-2, false, (*client).execSubscribe},
+		"psubscribe":   {-2, false, (*client).execPSubscribe},
+		"unsubscribe":  {-1, false, (*client).execUnsubscribe},
+		"punsubscribe": {-1, false, (*client).execPUnsubscribe},
+		"publish":      {3, true, (*client).execPublish},
+		"pubsub":       {-2, true, (*client).execPubsub},
+		"psync":        {3, false, (*client).execPSync},
+		"replconf":     {-1, false, (*client).execReplConf},
+		"asking":       {1, false, (*client).execAsking},
+	}
+}
+
+func validArity(arity, n int) bool {
+	if arity > 0 {
+		return arity == n
+	}
+	return n >= -arity
+}
+
+// exec runs a command for the client. Transaction and pub/sub commands are
+// handled here, the others go to the storage or to the transaction queue.
+func (c *client) exec(args [][]byte) (resp.RespType, error) {
+	name := strings.ToLower(string(args[0]))
+	asking := c.asking
+	c.asking = false
+
+	if c.subscribed() {
+		switch name {
+		case "subscribe", "psubscribe", "unsubscribe", "punsubscribe":
+		case "ping":
+			return c.subscribedPing(args), nil
+		default:
+			return resp.MakeErr("ERR Can't execute '" + name + "': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING are allowed in this context"), nil
+		}
+	}
+
+	switch name {
+	case "multi":
+		return c.execMulti(args), nil
+	case "exec":
+		return c.execExec(args)
+	case "discard":
+		return c.execDiscard(args), nil
+	case "watch":
+		return c.execWatch(args), nil
+	}
+
+	if local, ok := localCmds[name]; ok {
+		if !validArity(local.arity, len(args)) {
+			return c.queueErr(resp.ArgNumErr(name)), nil
+		}
+		if !c.multi {
+			return local.exec(c, args), nil
+		}
+		if !local.multi {
+			return c.queueErr(resp.MakeErr("ERR Command not allowed inside a transaction")), nil
+		}
+		c.queued = append(c.queued, args)
+		return queuedReply(), nil
+	}
+
+	if !c.multi {
+		exec := c.storage.ExecBlocking
+		if asking {
+			exec = c.storage.ExecAsking
+		}
+		rep, blocked, err := exec(&c.session, args)
+		c.blocked = blocked
+		return rep, err
+	}
+	if errReply := c.storage.Check(args); errReply != nil {
+		return c.queueErr(errReply), nil
+	}
+	c.queued = append(c.queued, args)
+	return queuedReply(), nil
+}
+
+func queuedReply() resp.RespType {
+	return &resp.SimpleStr{Data: []byte("QUEUED")}
+}
+
+// queueErr flags the transaction, if any, so EXEC discards it
+func (c *client) queueErr(errReply resp.RespType) resp.RespType {
+	if c.multi {
+		c.multiErr = true
+	}
+	return errReply
+}
+
+func (c *client) discard() {
+	c.multi = false
+	c.multiErr = false
+	c.queued = nil
+}
+
+func (c *client) execMulti(args [][]byte) resp.RespType {
+	if len(args) != 1 {
+		return c.queueErr(resp.ArgNumErr("multi"))
+	}
+	if c.multi {
+		return resp.MakeErr("ERR MULTI calls can not be nested")
+	}
+	c.multi = true
+	return resp.OkReply()
+}
+
+func (c *client) execExec(args [][]byte) (resp.RespType, error) {
+	if len(args) != 1 {
+		return c.queueErr(resp.ArgNumErr("exec")), nil
+	}
+	if !c.multi {
+		return resp.MakeErr("ERR EXEC without MULTI"), nil
+	}
+
+	queued, failed := c.queued, c.multiErr
+	c.discard()
+	if failed {
+		c.storage.Unwatch(&c.watch)
+		return resp.MakeErr("EXECABORT Transaction discarded because of previous errors."), nil
+	}
+
+	// the storage runs its commands atomically, the local ones run right
+	// after it and their replies are put back in place
+	var cmds [][][]byte
+	for _, cmd := range queued {
+		if !isLocal(cmd) {
+			cmds = append(cmds, cmd)
+		}
+	}
+	rep, err := c.storage.ExecMulti(&c.session, cmds, &c.watch)
+	storeReplies, ok := rep.(*resp.Array)
+	if err != nil || !ok || len(cmds) == len(queued) {
+		return rep, err
+	}
+
+	all := &resp.Array{}
+	for _, cmd := range queued {
+		if isLocal(cmd) {
+			all.Append(localCmds[strings.ToLower(string(cmd[0]))].exec(c, cmd))
+			continue
+		}
+		all.Append(storeReplies.Elems[0])
+		storeReplies.Elems = storeReplies.Elems[1:]
+	}
+	return all, nil
+}
+
+func isLocal(cmd [][]byte) bool {
+	_, ok := localCmds[strings.ToLower(string(cmd[0]))]
+	return ok
+}
+
+func (c *client) execDiscard(args [][]byte) resp.RespType {
+	if len(args) != 1 {
+		return c.queueErr(resp.ArgNumErr("discard"))
+	}
+	if !c.multi {
+		return resp.MakeErr("ERR DISCARD without MULTI")
+	}
+	c.discard()
+	c.storage.Unwatch(&c.watch)
+	return resp.OkReply()
+}
+
+func (c *client) execWatch(args [][]byte) resp.RespType {
+	if len(args) < 2 {
+		return c.queueErr(resp.ArgNumErr("watch"))
+	}
+	if c.multi {
+		return resp.MakeErr("ERR WATCH inside MULTI is not allowed")
+	}
+	c.storage.Watch(&c.session, &c.watch, args[1:])
+	return resp.OkReply()
+}
+
+// execUnwatch does nothing in a transaction, EXEC unwatches everything
+// anyway
+func (c *client) execUnwatch(args [][]byte) resp.RespType {
+	c.storage.Unwatch(&c.watch)
+	return resp.OkReply()
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+// execAsking lets the next command run on a slot this node is importing,
+// after the node serving it replied -ASK
+func (c *client) execAsking(args [][]byte) resp.RespType {
+	if !c.storage.ClusterEnabled() {
+		return resp.MakeErr("ERR This instance has cluster support disabled")
+	}
+	c.asking = true
+	return resp.OkReply()
+}
@@ -2,16 +2,20 @@ package main
 
 import (
 	"errors"
+	"flag"
+	"fmt"
 	"log/slog"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
 
+	"github.com/myselfBZ/go-redis-clone/internal/pubsub"
 	"github.com/myselfBZ/go-redis-clone/internal/resp"
 	"github.com/myselfBZ/go-redis-clone/internal/store"
 )
@@ -20,6 +24,8 @@ type server struct {
 	// net.Conn -> placeholder (struct{}{})
 	conns	sync.Map 	
 	storage *store.Storage
+	pubsub  *pubsub.Hub
+	addr    string
 	ln      net.Listener
 
 	closing atomic.Bool
@@ -59,7 +65,7 @@ func (s *server) run() error {
 		close(closeChan)
 	}()
 
-	ln, err := net.Listen("tcp", ":6379")
+	ln, err := net.Listen("tcp", s.addr)
 	if err != nil {
 		return err
 	}
@@ -94,7 +100,9 @@ func (s *server) close() {
 
 	// resetting 
 	s.conns = sync.Map{}
-	s.storage.Close()
+	if err := s.storage.Close(); err != nil {
+		slog.Error("failed to close the storage", "error", err)
+	}
 }
 
 func (s *server) closeClient(conn net.Conn) {
@@ -102,9 +110,11 @@ func (s *server) closeClient(conn net.Conn) {
 	s.conns.Delete(conn)
 }
 
-func newServer(storage *store.Storage) *server {
+func newServer(storage *store.Storage, addr string) *server {
 	return &server{
 		storage: storage,
+		pubsub:  pubsub.NewHub(),
+		addr:    addr,
 		conns: sync.Map{},
 		closing: atomic.Bool{},
 	}
@@ -119,14 +129,21 @@ func (s *server) handle(conn net.Conn) {
 	slog.Info("Connection accepted")
 	s.conns.Store(conn, struct{}{})
 
+	client := newClient(conn, s.storage, s.pubsub)
+	go client.writeLoop()
 	defer func() {
 		slog.Info("Closing client connection")
+		client.close()
 		s.closeClient(conn)
 	}()
 
 	ch := resp.Parse(conn)
 
-	for command := range ch {
+	for {
+		command, ok := client.next(ch)
+		if !ok {
+			return
+		}
 
 		err := command.Err
 
@@ -137,15 +154,20 @@ func (s *server) handle(conn net.Conn) {
 
 		args := command.Args()
 
-		res, err := s.storage.Exec(args)
+		res, err := client.exec(args)
 
 		if err != nil {
 			slog.Error("storage returned an error", "err", err)
 			panic("Fatal error")
 		}
 
-		if _, err := conn.Write(res.ToBytes()); err != nil {
-			slog.Error("connection write error", "err", err)
+		if client.blocked != nil {
+			if res, ok = client.wait(ch); !ok {
+				return
+			}
+		}
+
+		if !client.send(res) {
 			return
 		}
 	}
@@ -153,8 +175,69 @@ func (s *server) handle(conn net.Conn) {
 }
 
 func main() {
-	storage := store.NewStorage()
-	server := newServer(storage)
+	cfg := store.DefaultConfig()
+	var appendFsync, save, replicaOf, maxMemory, maxMemoryPolicy string
+	flag.IntVar(&cfg.Port, "port", cfg.Port, "port to listen on")
+	flag.BoolVar(&cfg.AppendOnly, "appendonly", cfg.AppendOnly, "log every write command to the append only file and replay it on startup")
+	flag.StringVar(&cfg.AppendFilename, "appendfilename", cfg.AppendFilename, "path of the append only file")
+	flag.StringVar(&appendFsync, "appendfsync", cfg.AppendFsync.String(), "how often the append only file is fsynced: always, everysec or no")
+	flag.IntVar(&cfg.AutoAOFRewritePercentage, "auto-aof-rewrite-percentage", cfg.AutoAOFRewritePercentage, "rewrite the append only file once it grew by this percentage, 0 disables it")
+	flag.Int64Var(&cfg.AutoAOFRewriteMinSize, "auto-aof-rewrite-min-size", cfg.AutoAOFRewriteMinSize, "minimum size in bytes of the append only file for an automatic rewrite")
+	flag.StringVar(&cfg.DBFilename, "dbfilename", cfg.DBFilename, "path of the RDB snapshot file")
+	flag.StringVar(&save, "save", "3600 1 300 100 60 10000", "save a snapshot after <seconds> if at least <changes> writes were made, pairs separated by spaces, empty disables it")
+	flag.StringVar(&replicaOf, "replicaof", "", "replicate the master at \"<host> <port>\" on startup")
+	flag.IntVar(&cfg.ReplBacklogSize, "repl-backlog-size", cfg.ReplBacklogSize, "bytes of the replication stream kept for replicas to continue from after a disconnection")
+	flag.BoolVar(&cfg.ClusterEnabled, "cluster-enabled", cfg.ClusterEnabled, "run as a cluster node")
+	flag.StringVar(&cfg.ClusterConfigFile, "cluster-config-file", cfg.ClusterConfigFile, "where the cluster node keeps its id and its view of the cluster")
+	flag.DurationVar(&cfg.ClusterNodeTimeout, "cluster-node-timeout", cfg.ClusterNodeTimeout, "a cluster node that doesn't answer for this long is flagged as failing")
+	flag.StringVar(&cfg.ClusterAnnounceIP, "cluster-announce-ip", cfg.ClusterAnnounceIP, "address announced to clients and other cluster nodes, found out from the links to the other nodes when empty")
+	flag.StringVar(&maxMemory, "maxmemory", "0", "memory the dataset may use before keys are evicted, like 100mb, 0 for no limit")
+	flag.StringVar(&maxMemoryPolicy, "maxmemory-policy", cfg.MaxMemoryPolicy.String(), "which keys are evicted past maxmemory: noeviction, allkeys-lru, allkeys-lfu, allkeys-random, volatile-lru, volatile-lfu, volatile-random or volatile-ttl")
+	flag.IntVar(&cfg.Hz, "hz", cfg.Hz, "how many times a second background tasks like the expiry of keys run, up to 500")
+	flag.IntVar(&cfg.MaxMemorySamples, "maxmemory-samples", cfg.MaxMemorySamples, "keys sampled to pick the one to evict")
+	flag.IntVar(&cfg.Databases, "databases", cfg.Databases, "number of databases, clients pick one with SELECT")
+	flag.Parse()
+
+	policy, err := store.ParseFsyncPolicy(appendFsync)
+	if err != nil {
+		slog.Error("invalid config", "error", err)
+		os.Exit(1)
+	}
+	cfg.AppendFsync = policy
+
+	params, err := store.ParseSaveParams(save)
+	if err != nil {
+		slog.Error("invalid config", "error", err)
+		os.Exit(1)
+	}
+	cfg.SaveParams = params
+
+	cfg.MaxMemory, err = store.ParseMemory(maxMemory)
+	if err != nil {
+		slog.Error("invalid config", "error", err)
+		os.Exit(1)
+	}
+	cfg.MaxMemoryPolicy, err = store.ParseEvictionPolicy(maxMemoryPolicy)
+	if err != nil {
+		slog.Error("invalid config", "error", err)
+		os.Exit(1)
+	}
+
+	if replicaOf != "" {
+		host, port, ok := strings.Cut(strings.TrimSpace(replicaOf), " ")
+		if !ok {
+			slog.Error("invalid config", "error", "replicaof must be \"<host> <port>\"")
+			os.Exit(1)
+		}
+		cfg.ReplicaOf = net.JoinHostPort(host, strings.TrimSpace(port))
+	}
+
+	storage, err := store.Open(cfg)
+	if err != nil {
+		slog.Error("failed to open the storage", "error", err)
+		os.Exit(1)
+	}
+	server := newServer(storage, fmt.Sprintf(":%d", cfg.Port))
 
 	slog.Info("server started...")
 	if err := server.run(); err != nil {
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+func (c *client) subscribed() bool {
+	return len(c.channels)+len(c.patterns) > 0
+}
+
+// subscriptionReply confirms a (un)subscription, count is the number of
+// channels and patterns the client is left subscribed to
+func (c *client) subscriptionReply(kind string, name []byte) resp.RespType {
+	return &resp.Array{Elems: []resp.RespType{
+		&resp.BulkStr{Data: []byte(kind)},
+		&resp.BulkStr{Data: name},
+		&resp.Intiger{Data: int64(len(c.channels) + len(c.patterns))},
+	}}
+}
+
+func (c *client) execSubscribe(args [][]byte) resp.RespType {
+	var reps replies
+	for _, channel := range args[1:] {
+		if c.hub.Subscribe(c, string(channel)) {
+			c.channels[string(channel)] = struct{}{}
+		}
+		reps = append(reps, c.subscriptionReply("subscribe", channel))
+	}
+	return reps
+}
+
+func (c *client) execPSubscribe(args [][]byte) resp.RespType {
+	var reps replies
+	for _, pattern := range args[1:] {
+		if c.hub.PSubscribe(c, string(pattern)) {
+			c.patterns[string(pattern)] = struct{}{}
+		}
+		reps = append(reps, c.subscriptionReply("psubscribe", pattern))
+	}
+	return reps
+}
+
+// unsubscribe removes the client from names, or from everything in subs
+// when names is empty
+func (c *client) unsubscribe(kind string, subs map[string]struct{}, names [][]byte, remove func(string)) resp.RespType {
+	if len(names) == 0 {
+		for _, name := range slices.Sorted(maps.Keys(subs)) {
+			names = append(names, []byte(name))
+		}
+	}
+	if len(names) == 0 {
+		return c.subscriptionReply(kind, nil)
+	}
+
+	var reps replies
+	for _, name := range names {
+		remove(string(name))
+		delete(subs, string(name))
+		reps = append(reps, c.subscriptionReply(kind, name))
+	}
+	return reps
+}
+
+func (c *client) execUnsubscribe(args [][]byte) resp.RespType {
+	return c.unsubscribe("unsubscribe", c.channels, args[1:], func(channel string) {
+		c.hub.Unsubscribe(c, channel)
+	})
+}
+
+func (c *client) execPUnsubscribe(args [][]byte) resp.RespType {
+	return c.unsubscribe("punsubscribe", c.patterns, args[1:], func(pattern string) {
+		c.hub.PUnsubscribe(c, pattern)
+	})
+}
+
+func (c *client) unsubscribeAll() {
+	for channel := range c.channels {
+		c.hub.Unsubscribe(c, channel)
+	}
+	for pattern := range c.patterns {
+		c.hub.PUnsubscribe(c, pattern)
+	}
+	clear(c.channels)
+	clear(c.patterns)
+}
+
+// subscribedPing replies with a push like message, plain replies can't be
+// told apart from messages in subscriber mode
+func (c *client) subscribedPing(args [][]byte) resp.RespType {
+	if len(args) > 2 {
+		return resp.ArgNumErr("ping")
+	}
+	msg := []byte{}
+	if len(args) == 2 {
+		msg = args[1]
+	}
+	pong := &resp.RespBulkStrArr{}
+	pong.Append([]byte("pong"))
+	pong.Append(msg)
+	return pong
+}
+
+func (c *client) execPublish(args [][]byte) resp.RespType {
+	return &resp.Intiger{Data: int64(c.hub.Publish(string(args[1]), args[2]))}
+}
+
+func (c *client) execPubsub(args [][]byte) resp.RespType {
+	sub := strings.ToLower(string(args[1]))
+	switch {
+	case sub == "channels" && len(args) <= 3:
+		pattern := ""
+		if len(args) == 3 {
+			pattern = string(args[2])
+		}
+		channels := &resp.RespBulkStrArr{}
+		for _, channel := range c.hub.Channels(pattern) {
+			channels.Append([]byte(channel))
+		}
+		return channels
+	case sub == "numsub":
+		reply := &resp.Array{}
+		for _, channel := range args[2:] {
+			reply.Append(&resp.BulkStr{Data: channel})
+			reply.Append(&resp.Intiger{Data: int64(c.hub.NumSub(string(channel)))})
+		}
+		return reply
+	case sub == "numpat" && len(args) == 2:
+		return &resp.Intiger{Data: int64(c.hub.NumPat())}
+	}
+	return resp.MakeErr("ERR unknown subcommand or wrong number of arguments for '" + string(args[1]) + "'")
+}
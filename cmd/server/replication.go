@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+// execPSync turns the connection into a replica, the storage writes the
+// sync and the stream to it from then on
+func (c *client) execPSync(args [][]byte) resp.RespType {
+	if c.replica {
+		return resp.MakeErr("ERR the connection is already a replica")
+	}
+	offset, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return resp.MakeErr("ERR value is not an integer or out of range")
+	}
+
+	host, port, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	if c.replicaPort != "" {
+		port = c.replicaPort
+	}
+	c.replica = true
+	if err := c.storage.Sync(c, net.JoinHostPort(host, port), string(args[1]), offset); err != nil {
+		return resp.MakeErr("ERR " + err.Error())
+	}
+	return replies{}
+}
+
+func (c *client) execReplConf(args [][]byte) resp.RespType {
+	if len(args)%2 != 1 {
+		return resp.SyntaxErr()
+	}
+	for i := 1; i < len(args); i += 2 {
+		option, value := strings.ToLower(string(args[i])), string(args[i+1])
+		switch option {
+		case "ack":
+			// acknowledgements are never replied to, the offset on disk
+			// follows when the replica has its AOF on
+			offset, err := strconv.ParseInt(value, 10, 64)
+			var aofOffset int64
+			if i+3 < len(args) && strings.EqualFold(string(args[i+2]), "fack") {
+				aofOffset, _ = strconv.ParseInt(string(args[i+3]), 10, 64)
+			}
+			if err == nil && c.replica {
+				c.storage.Ack(c, offset, aofOffset)
+			}
+			return replies{}
+		case "getack":
+			return replies{}
+		case "listening-port":
+			port, err := strconv.Atoi(value)
+			if err != nil || port < 0 || port > 65535 {
+				return resp.MakeErr("ERR Invalid listening port")
+			}
+			c.replicaPort = value
+		}
+	}
+	return resp.OkReply()
+}
@@ -0,0 +1,153 @@
+// Package pubsub keeps track of the channels and patterns clients are
+// subscribed to and fans published messages out to them. It is
+// independent from the keyspace, publishing never waits on Storage.
+package pubsub
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+	"github.com/myselfBZ/go-redis-clone/pkg/utils"
+)
+
+// Subscriber receives the messages published to what it's subscribed to.
+// Push is called with the hub locked, it must not block.
+type Subscriber interface {
+	Push(msg resp.RespType)
+}
+
+type Hub struct {
+	mu       sync.RWMutex
+	channels map[string]map[Subscriber]struct{}
+	patterns map[string]map[Subscriber]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		channels: make(map[string]map[Subscriber]struct{}),
+		patterns: make(map[string]map[Subscriber]struct{}),
+	}
+}
+
+func add(m map[string]map[Subscriber]struct{}, name string, s Subscriber) bool {
+	subs, ok := m[name]
+	if !ok {
+		subs = make(map[Subscriber]struct{})
+		m[name] = subs
+	}
+	if _, ok := subs[s]; ok {
+		return false
+	}
+	subs[s] = struct{}{}
+	return true
+}
+
+func remove(m map[string]map[Subscriber]struct{}, name string, s Subscriber) bool {
+	subs, ok := m[name]
+	if !ok {
+		return false
+	}
+	if _, ok := subs[s]; !ok {
+		return false
+	}
+	delete(subs, s)
+	if len(subs) == 0 {
+		delete(m, name)
+	}
+	return true
+}
+
+// Subscribe returns false if s is already subscribed to channel
+func (h *Hub) Subscribe(s Subscriber, channel string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return add(h.channels, channel, s)
+}
+
+// Unsubscribe returns false if s was not subscribed to channel
+func (h *Hub) Unsubscribe(s Subscriber, channel string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return remove(h.channels, channel, s)
+}
+
+// PSubscribe returns false if s is already subscribed to pattern
+func (h *Hub) PSubscribe(s Subscriber, pattern string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return add(h.patterns, pattern, s)
+}
+
+// PUnsubscribe returns false if s was not subscribed to pattern
+func (h *Hub) PUnsubscribe(s Subscriber, pattern string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return remove(h.patterns, pattern, s)
+}
+
+// Publish sends msg to the subscribers of channel and of the patterns
+// matching it, returns the number of deliveries
+func (h *Hub) Publish(channel string, msg []byte) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	received := 0
+	if subs := h.channels[channel]; len(subs) > 0 {
+		m := &resp.RespBulkStrArr{}
+		m.Append([]byte("message"))
+		m.Append([]byte(channel))
+		m.Append(msg)
+		for s := range subs {
+			s.Push(m)
+			received++
+		}
+	}
+
+	for pattern, subs := range h.patterns {
+		if !utils.GlobMatch(pattern, channel) {
+			continue
+		}
+		m := &resp.RespBulkStrArr{}
+		m.Append([]byte("pmessage"))
+		m.Append([]byte(pattern))
+		m.Append([]byte(channel))
+		m.Append(msg)
+		for s := range subs {
+			s.Push(m)
+			received++
+		}
+	}
+	return received
+}
+
+// Channels returns the channels with at least one subscriber, sorted. A
+// non empty pattern only keeps the channels matching it.
+func (h *Hub) Channels(pattern string) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var channels []string
+	for channel := range h.channels {
+		if pattern == "" || utils.GlobMatch(pattern, channel) {
+			channels = append(channels, channel)
+		}
+	}
+	slices.Sort(channels)
+	return channels
+}
+
+// NumSub returns the number of subscribers of channel, pattern
+// subscribers are not counted
+func (h *Hub) NumSub(channel string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.channels[channel])
+}
+
+// NumPat returns the number of unique patterns subscribed to
+func (h *Hub) NumPat() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.patterns)
+}
@@ -0,0 +1,79 @@
+package pubsub
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+type recorder struct {
+	msgs []string
+}
+
+func (r *recorder) Push(msg resp.RespType) {
+	r.msgs = append(r.msgs, string(msg.ToBytes()))
+}
+
+func message(kind string, args ...string) string {
+	m := &resp.RespBulkStrArr{}
+	m.Append([]byte(kind))
+	for _, a := range args {
+		m.Append([]byte(a))
+	}
+	return string(m.ToBytes())
+}
+
+func TestHub(t *testing.T) {
+	h := NewHub()
+	a, b := &recorder{}, &recorder{}
+
+	if !h.Subscribe(a, "news") || h.Subscribe(a, "news") {
+		t.Fatalf("a second subscription to the same channel must be a no-op")
+	}
+	h.Subscribe(b, "news")
+	h.Subscribe(b, "sports")
+	h.PSubscribe(a, "n*")
+	h.PSubscribe(b, "n?ws")
+
+	if n := h.Publish("news", []byte("hello")); n != 4 {
+		t.Fatalf("expected 4 deliveries, got %d", n)
+	}
+	if n := h.Publish("weather", []byte("rain")); n != 0 {
+		t.Fatalf("expected no delivery, got %d", n)
+	}
+
+	wantA := []string{message("message", "news", "hello"), message("pmessage", "n*", "news", "hello")}
+	if !slices.Equal(a.msgs, wantA) {
+		t.Fatalf("got %q, want %q", a.msgs, wantA)
+	}
+	wantB := []string{message("message", "news", "hello"), message("pmessage", "n?ws", "news", "hello")}
+	if !slices.Equal(b.msgs, wantB) {
+		t.Fatalf("got %q, want %q", b.msgs, wantB)
+	}
+
+	if got := h.Channels(""); !slices.Equal(got, []string{"news", "sports"}) {
+		t.Fatalf("CHANNELS returned %q", got)
+	}
+	if got := h.Channels("s*"); !slices.Equal(got, []string{"sports"}) {
+		t.Fatalf("CHANNELS s* returned %q", got)
+	}
+	if n := h.NumSub("news"); n != 2 {
+		t.Fatalf("NUMSUB returned %d", n)
+	}
+	if n := h.NumPat(); n != 2 {
+		t.Fatalf("NUMPAT returned %d", n)
+	}
+
+	if !h.Unsubscribe(b, "news") || h.Unsubscribe(b, "news") {
+		t.Fatalf("unsubscribing twice must be a no-op")
+	}
+	h.Unsubscribe(b, "sports")
+	h.PUnsubscribe(a, "n*")
+	if got := h.Channels(""); !slices.Equal(got, []string{"news"}) {
+		t.Fatalf("channels without subscribers were kept: %q", got)
+	}
+	if n := h.NumPat(); n != 1 {
+		t.Fatalf("patterns without subscribers were kept: %d", n)
+	}
+}
@@ -34,3 +34,15 @@ func IncompOptionsErr(option1, option2 string) *RespErr {
 		Data: []byte(msg),
 	}
 }
+
+func WrongTypeErr() *RespErr {
+	return &RespErr{
+		Data: []byte("WRONGTYPE Operation against a key holding the wrong kind of value"),
+	}
+}
+
+func NotFloatErr() *RespErr {
+	return &RespErr{
+		Data: []byte("ERR value is not a valid float"),
+	}
+}
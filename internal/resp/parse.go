@@ -139,7 +139,7 @@ func (p *payload) parseBytes(data []byte) (int, error) {
 				if err != nil {
 					return 0, ErrInvalidHeaderLength
 				}
-				if length <= 0{
+				if length < 0 {
 					// no op for NULL
 					read += len(h) + len(CRLF)
 					p.multiBulk = append(p.multiBulk, &bulk{
@@ -172,8 +172,13 @@ func (p *payload) parseBytes(data []byte) (int, error) {
 					read += len(bulkData) + len(CRLF)
 					p.curIdx++
 				} else {
-					b.data = append(b.data, body[idx+2:]...)
-					read += len(body[idx+2:])
+					// never take the footer, or part of it, as data
+					partial := body[idx+2:]
+					if int64(len(partial)) > length {
+						partial = partial[:length]
+					}
+					b.data = append(b.data, partial...)
+					read += len(partial)
 					p.multiBulk = append(p.multiBulk, b)
 					return read, nil
 				}
@@ -192,34 +197,44 @@ func Parse(stream io.Reader) <-chan *Command {
 }
 
 func parse(stream io.Reader, ch chan<- *Command) {
+	// leftover bytes are kept between commands, a single read may hold
+	// more than one pipelined command
+	buff := make([]byte, 4096)
+	buffLen := 0
+
 	for {
 		p := &payload{
 			state:     payloadStateInit,
 			multiBulk: make([]*bulk, 0),
 		}
 
-		buff := make([]byte, 4096)
-		buffLen := 0
-
-		for p.state != payloadStateDone {
-			n, err := stream.Read(buff[buffLen:])
+		for {
+			readN, err := p.parseBytes(buff[:buffLen])
 
 			if err != nil {
 				ch <- &Command{Err: err}
 				return
 			}
 
-			buffLen += n
+			copy(buff, buff[readN:buffLen])
+			buffLen -= readN
 
-			readN, err := p.parseBytes(buff[:buffLen])
+			if p.state == payloadStateDone {
+				break
+			}
+
+			n, err := stream.Read(buff[buffLen:])
 
 			if err != nil {
+				// the stream ended in the middle of a command
+				if err == io.EOF && (buffLen > 0 || p.state != payloadStateInit) {
+					err = io.ErrUnexpectedEOF
+				}
 				ch <- &Command{Err: err}
 				return
 			}
 
-			copy(buff, buff[readN:buffLen])
-			buffLen -= readN
+			buffLen += n
 		}
 
 		c := &Command{
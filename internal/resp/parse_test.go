@@ -2,6 +2,9 @@ package resp
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"strings"
 	"testing"
 )
 
@@ -75,3 +78,42 @@ func TestParse0(t *testing.T) {
 		t.Errorf("first element expected 'SET', got %s", string(cmd.arr.data[0]))
 	}
 }
+
+func TestParsePipelined(t *testing.T) {
+	r := strings.NewReader("*2\r\n$3\r\nGET\r\n$1\r\nk\r\n*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$0\r\n\r\n*2\r\n$3\r\nGET")
+
+	ch := Parse(r)
+
+	cmd := <-ch
+	if cmd.Err != nil || cmd.arr.Length() != 2 {
+		t.Fatalf("first command: got %v, err %v", cmd.arr, cmd.Err)
+	}
+
+	cmd = <-ch
+	if cmd.Err != nil || cmd.arr.Length() != 3 {
+		t.Fatalf("second command: got %v, err %v", cmd.arr, cmd.Err)
+	}
+	if cmd.arr.data[2] == nil || len(cmd.arr.data[2]) != 0 {
+		t.Errorf("expected an empty string, got %q", cmd.arr.data[2])
+	}
+
+	cmd = <-ch
+	if !errors.Is(cmd.Err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected unexpected EOF for the truncated command, got %v", cmd.Err)
+	}
+}
+
+func TestParseSplitFooter(t *testing.T) {
+	r := &chunkReader{
+		data:            "*1\r\n$3\r\nabc\r\n",
+		numBytesPerRead: 12,
+	}
+
+	cmd := <-Parse(r)
+	if cmd.Err != nil {
+		t.Fatalf("unexpected error: %v", cmd.Err)
+	}
+	if !bytes.Equal(cmd.arr.data[0], []byte("abc")) {
+		t.Errorf("expected 'abc', got %q", cmd.arr.data[0])
+	}
+}
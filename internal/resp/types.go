@@ -11,6 +11,7 @@ var (
 	BULKSTR   = []byte("$")
 	SIMPLESTR = []byte("+")
 	NULLBULKSTR = []byte("$-1\r\n")
+	NULLARRAY   = []byte("*-1\r\n")
 )
 
 var(
@@ -18,6 +19,8 @@ var(
 	_ RespType = (*RespErr)(nil)
 	_ RespType = (*BulkStr)(nil)
 	_ RespType = (*Intiger)(nil)
+	_ RespType = (*NullArray)(nil)
+	_ RespType = (*Array)(nil)
 )
 
 type RespType interface {
@@ -136,3 +139,38 @@ func (rt *RespErr) ToBytes() []byte {
 func (rt *RespErr) Type() string {
 	return "error"
 }
+
+// NullArray is the RESP2 null array reply, "*-1"
+type NullArray struct{}
+
+func (rt *NullArray) Type() string {
+	return "null_array"
+}
+
+func (rt *NullArray) ToBytes() []byte {
+	return NULLARRAY
+}
+
+// Array is a RESP array whose elements can be of any type
+type Array struct {
+	Elems []RespType
+}
+
+func (rt *Array) Append(e RespType) {
+	rt.Elems = append(rt.Elems, e)
+}
+
+func (rt *Array) Type() string {
+	return "array"
+}
+
+func (rt *Array) ToBytes() []byte {
+	buf := make([]byte, 0, 16)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(rt.Elems)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, e := range rt.Elems {
+		buf = append(buf, e.ToBytes()...)
+	}
+	return buf
+}
@@ -0,0 +1,277 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+// FsyncPolicy tells how often the AOF is flushed to disk
+type FsyncPolicy int
+
+const (
+	// fsync once a second in the background, at most a second of writes
+	// is lost on a crash
+	FsyncEverysec FsyncPolicy = iota
+	// fsync after every write command, before the reply is sent
+	FsyncAlways
+	// never fsync, the OS decides when the data is flushed
+	FsyncNo
+)
+
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch strings.ToLower(s) {
+	case "everysec":
+		return FsyncEverysec, nil
+	case "always":
+		return FsyncAlways, nil
+	case "no":
+		return FsyncNo, nil
+	}
+	return 0, fmt.Errorf("invalid appendfsync policy %q, must be one of always, everysec, no", s)
+}
+
+func (p FsyncPolicy) String() string {
+	switch p {
+	case FsyncAlways:
+		return "always"
+	case FsyncNo:
+		return "no"
+	}
+	return "everysec"
+}
+
+// aof is guarded by Storage.mu, except for f which is also used by the
+// fsync loop and is guarded by mu
+type aof struct {
+	mu     sync.Mutex
+	f      *os.File
+	path   string
+	policy FsyncPolicy
+	// there are writes that are not fsynced yet
+	dirty atomic.Bool
+	// replication offset of the last write and of the last write known to
+	// be on disk, fsynced is signaled when the latter moves
+	offset        atomic.Int64
+	fsyncedOffset atomic.Int64
+	fsynced       chan<- struct{}
+	// set when a write fails, write commands are refused from then on
+	// since the file no longer matches the dataset
+	err    error
+	closed bool
+
+	// current size of the file and its size after the last rewrite, an
+	// automatic rewrite starts once it grew by autoRewritePct percent
+	size           int64
+	baseSize       int64
+	autoRewritePct int
+	autoRewriteMin int64
+
+	// non nil while a rewrite is running, closed when it's over
+	rewriteDone chan struct{}
+	// writes made while the rewrite runs, appended to the new file at the swap
+	rewriteBuf []byte
+
+	exit chan struct{}
+	done chan struct{}
+}
+
+func openAOF(cfg Config, fsynced chan<- struct{}) (*aof, error) {
+	f, err := os.OpenFile(cfg.AppendFilename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	a := &aof{
+		f:              f,
+		path:           cfg.AppendFilename,
+		policy:         cfg.AppendFsync,
+		size:           info.Size(),
+		baseSize:       info.Size(),
+		autoRewritePct: cfg.AutoAOFRewritePercentage,
+		autoRewriteMin: cfg.AutoAOFRewriteMinSize,
+		fsynced:        fsynced,
+		exit:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	go a.fsyncLoop()
+	return a, nil
+}
+
+func encodeCommand(cmd [][]byte) []byte {
+	arr := &resp.RespBulkStrArr{}
+	for _, arg := range cmd {
+		arr.Append(arg)
+	}
+	return arr.ToBytes()
+}
+
+// write appends the commands to the file, offset is the replication offset
+// once they are applied. With the always policy the data is on disk when it
+// returns.
+func (a *aof) write(cmds [][][]byte, offset int64) error {
+	var buf []byte
+	for _, cmd := range cmds {
+		buf = append(buf, encodeCommand(cmd)...)
+	}
+
+	if a.rewriteDone != nil {
+		a.rewriteBuf = append(a.rewriteBuf, buf...)
+	}
+
+	n, err := a.f.Write(buf)
+	a.size += int64(n)
+	if err != nil {
+		return err
+	}
+	a.offset.Store(offset)
+
+	if a.policy == FsyncAlways {
+		if err := a.f.Sync(); err != nil {
+			return err
+		}
+		a.fsyncedOffset.Store(offset)
+		return nil
+	}
+	a.dirty.Store(true)
+	return nil
+}
+
+func (a *aof) fsyncLoop() {
+	defer close(a.done)
+	if a.policy != FsyncEverysec {
+		<-a.exit
+		return
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if a.dirty.Swap(false) {
+				offset := a.offset.Load()
+				// a failed fsync is retried on the next tick
+				a.mu.Lock()
+				err := a.f.Sync()
+				a.mu.Unlock()
+				if err != nil {
+					a.dirty.Store(true)
+					continue
+				}
+				a.fsyncedOffset.Store(offset)
+				select {
+				case a.fsynced <- struct{}{}:
+				default:
+				}
+			}
+		case <-a.exit:
+			return
+		}
+	}
+}
+
+func (a *aof) close() error {
+	a.closed = true
+	close(a.exit)
+	<-a.done
+	return errors.Join(a.f.Sync(), a.f.Close())
+}
+
+func misconfErr(err error) *resp.RespErr {
+	return resp.MakeErr(fmt.Sprintf("MISCONF Errors writing to the AOF file: %s", err))
+}
+
+// loadAOF replays the commands logged in the file at path. A command cut
+// in half by a crash is dropped and the file is truncated to the last
+// complete one.
+func (s *Storage) loadAOF(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ch := resp.Parse(f)
+	// the parser only stops after reporting an error, io.EOF included
+	drain := func() {
+		f.Close()
+		for command := range ch {
+			if command.Err != nil {
+				return
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var offset int64
+	// start of the transaction being read and its commands, a transaction
+	// cut in half by a crash is dropped as a whole
+	multiOffset := int64(-1)
+	var multi [][][]byte
+	// the database the commands run on, the SELECTs of the file change it.
+	// Writes appended to the file go on from the one it ends on.
+	var se Session
+	defer func() { s.logDB = se.db }()
+	for command := range ch {
+		if err := command.Err; err != nil {
+			if errors.Is(err, io.EOF) && multiOffset < 0 {
+				return nil
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				if multiOffset >= 0 {
+					offset = multiOffset
+				}
+				return os.Truncate(path, offset)
+			}
+			return fmt.Errorf("bad AOF format at offset %d: %w", offset, err)
+		}
+
+		args := command.Args()
+		if len(args) == 0 {
+			drain()
+			return fmt.Errorf("empty command in AOF at offset %d", offset)
+		}
+		name := strings.ToLower(string(args[0]))
+		switch {
+		case name == "multi" && multiOffset < 0 && len(args) == 1:
+			multiOffset = offset
+		case name == "exec" && multiOffset >= 0 && len(args) == 1:
+			for _, cmd := range multi {
+				s.call(&se, cmdTable[strings.ToLower(string(cmd[0]))], cmd)
+			}
+			multiOffset, multi = -1, nil
+		default:
+			c, errReply := lookupCommand(args)
+			if errReply != nil {
+				drain()
+				return fmt.Errorf("invalid command %q in AOF at offset %d", name, offset)
+			}
+			if multiOffset >= 0 {
+				multi = append(multi, args)
+			} else {
+				s.call(&se, c, args)
+			}
+		}
+		offset += int64(len(encodeCommand(args)))
+	}
+	return nil
+}
@@ -0,0 +1,350 @@
+package store
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+func openTestAOF(t *testing.T, path string, policy FsyncPolicy) *Storage {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.AppendOnly = true
+	cfg.AppendFilename = path
+	cfg.AppendFsync = policy
+	cfg.DBFilename = filepath.Join(filepath.Dir(path), "dump.rdb")
+	cfg.SaveParams = nil
+
+	s, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("failed to open the storage: %v", err)
+	}
+	return s
+}
+
+func mustExec(t *testing.T, s *Storage, args ...string) resp.RespType {
+	t.Helper()
+	rep, err := s.Exec(toBytes(args...))
+	if err != nil {
+		t.Fatalf("%s: unexpected error %v", args[0], err)
+	}
+	return rep
+}
+
+func TestAOFReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	s := openTestAOF(t, path, FsyncAlways)
+	mustExec(t, s, "SET", "name", "bob")
+	mustExec(t, s, "SET", "empty", "")
+	mustExec(t, s, "SET", "session", "abc", "EX", "100")
+	mustExec(t, s, "INCRBY", "counter", "5")
+	mustExec(t, s, "RPUSH", "list", "a", "b", "c")
+	mustExec(t, s, "LPOP", "list")
+	mustExec(t, s, "SADD", "set", "x", "y", "z")
+	popped := mustExec(t, s, "SPOP", "set")
+	mustExec(t, s, "EXPIRE", "counter", "50")
+	mustExec(t, s, "DEL", "missing")
+	mustExec(t, s, "INCR", "name")
+	id := mustExec(t, s, "XADD", "stream", "*", "f", "v")
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "SPOP") || strings.Contains(string(content), "$6\r\nEXPIRE") {
+		t.Fatalf("non deterministic commands were logged as they are:\n%q", content)
+	}
+
+	s = openTestAOF(t, path, FsyncNo)
+	defer s.Close()
+
+	tests := []suite{
+		{"GET", &resp.BulkStr{Data: []byte("bob")}, toBytes("GET", "name")},
+		{"GET empty string", &resp.BulkStr{Data: []byte("")}, toBytes("GET", "empty")},
+		{"GET counter", &resp.BulkStr{Data: []byte("5")}, toBytes("GET", "counter")},
+		{"LRANGE", bulkArr("b", "c"), toBytes("LRANGE", "list", "0", "-1")},
+		{"SISMEMBER popped", &resp.Intiger{Data: 0}, toBytes("SISMEMBER", "set", string(popped.(*resp.BulkStr).Data))},
+		{"SCARD", &resp.Intiger{Data: 2}, toBytes("SCARD", "set")},
+		{"XRANGE", entries(entry(string(id.(*resp.BulkStr).Data), "f", "v")), toBytes("XRANGE", "stream", "-", "+")},
+	}
+	for _, test := range tests {
+		rep, _ := s.Exec(test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+
+	for key, want := range map[string]time.Duration{"session": 100 * time.Second, "counter": 50 * time.Second} {
+		rep := mustExec(t, s, "PTTL", key).(*resp.Intiger)
+		ttl := time.Duration(rep.Data) * time.Millisecond
+		if ttl > want || ttl < want-5*time.Second {
+			t.Fatalf("TTL of %s was not restored, got %v want %v", key, ttl, want)
+		}
+	}
+}
+
+func TestAOFExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	s := openTestAOF(t, path, FsyncAlways)
+	mustExec(t, s, "SET", "kept", "v1", "EX", "100")
+	mustExec(t, s, "SET", "kept", "v2", "KEEPTTL")
+	mustExec(t, s, "SET", "dropped", "v", "EX", "100")
+	mustExec(t, s, "SET", "dropped", "v")
+	mustExec(t, s, "SET", "getex", "v")
+	mustExec(t, s, "GETEX", "getex", "PX", "50000")
+	mustExec(t, s, "SET", "persisted", "v", "PX", "50000")
+	mustExec(t, s, "GETEX", "persisted", "PERSIST")
+	mustExec(t, s, "SET", "gone", "v")
+	mustExec(t, s, "PEXPIRE", "gone", "-1")
+	s.Close()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "GETEX") || strings.Contains(string(content), "$7\r\nPEXPIRE\r\n") {
+		t.Fatalf("relative expiries were logged as they are:\n%q", content)
+	}
+
+	s = openTestAOF(t, path, FsyncNo)
+	defer s.Close()
+	tests := []suite{
+		{"KEEPTTL", &resp.Intiger{Data: 100}, toBytes("TTL", "kept")},
+		{"SET without TTL", &resp.Intiger{Data: -1}, toBytes("TTL", "dropped")},
+		{"GETEX PX", &resp.Intiger{Data: 50}, toBytes("TTL", "getex")},
+		{"GETEX PERSIST", &resp.Intiger{Data: -1}, toBytes("TTL", "persisted")},
+		{"PEXPIRE in the past", &resp.Intiger{Data: -2}, toBytes("TTL", "gone")},
+	}
+	for _, test := range tests {
+		rep, _ := s.Exec(test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+}
+
+func TestAOFTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	valid := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n"
+	if err := os.WriteFile(path, []byte(valid+"*3\r\n$3\r\nSET\r\n$1\r\nx"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := openTestAOF(t, path, FsyncEverysec)
+	rep := mustExec(t, s, "GET", "k")
+	if !slices.Equal(rep.ToBytes(), (&resp.BulkStr{Data: []byte("v")}).ToBytes()) {
+		t.Fatalf("complete command was not replayed, got %q", rep.ToBytes())
+	}
+	mustExec(t, s, "SET", "k2", "v2")
+	s.Close()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := valid + "*3\r\n$3\r\nset\r\n$2\r\nk2\r\n$2\r\nv2\r\n"
+	if strings.ToLower(string(content)) != strings.ToLower(want) {
+		t.Fatalf("truncated command was not dropped, got %q", content)
+	}
+}
+
+func TestAOFInvalidCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	if err := os.WriteFile(path, []byte("*1\r\n$4\r\nNOPE\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.AppendOnly = true
+	cfg.AppendFilename = path
+	cfg.DBFilename = filepath.Join(filepath.Dir(path), "dump.rdb")
+	if _, err := Open(cfg); err == nil {
+		t.Fatalf("expected an error for an unknown command")
+	}
+}
+
+func TestParseFsyncPolicy(t *testing.T) {
+	for _, name := range []string{"always", "everysec", "no"} {
+		p, err := ParseFsyncPolicy(strings.ToUpper(name))
+		if err != nil || p.String() != name {
+			t.Fatalf("%s was parsed as %v, err %v", name, p, err)
+		}
+	}
+	if _, err := ParseFsyncPolicy("sometimes"); err == nil {
+		t.Fatalf("expected an error for an invalid policy")
+	}
+}
+
+// waitAOFRewrite blocks until the running rewrite, if any, is over
+func (s *Storage) waitAOFRewrite() {
+	s.mu.Lock()
+	var done chan struct{}
+	if s.aof != nil {
+		done = s.aof.rewriteDone
+	}
+	s.mu.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+func TestAOFRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	s := openTestAOF(t, path, FsyncEverysec)
+	for range 500 {
+		mustExec(t, s, "INCR", "counter")
+	}
+	mustExec(t, s, "RPUSH", "list", "a", "b", "c")
+	mustExec(t, s, "HSET", "hash", "f", "v")
+	mustExec(t, s, "ZADD", "zset", "1.5", "a", "-inf", "b")
+	mustExec(t, s, "SET", "session", "abc", "EX", "100")
+	mustExec(t, s, "XADD", "stream", "1-0", "f", "v")
+	mustExec(t, s, "XADD", "stream", "2-0", "f", "v")
+	mustExec(t, s, "XDEL", "stream", "2-0")
+	mustExec(t, s, "XGROUP", "CREATE", "stream", "g", "0")
+	mustExec(t, s, "XREADGROUP", "GROUP", "g", "alice", "STREAMS", "stream", ">")
+
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the write made while the rewrite runs must end up in the new file
+	s.mu.Lock()
+	if err := s.startAOFRewrite(); err != nil {
+		t.Fatalf("failed to start the rewrite: %v", err)
+	}
+	if err := s.startAOFRewrite(); err != errRewriteInProgress {
+		t.Fatalf("expected a second rewrite to be refused, got %v", err)
+	}
+	s.call(&Session{}, cmdTable["set"], toBytes("SET", "during", "rewrite"))
+	// the snapshot must not see writes that are appended to it as well
+	s.call(&Session{}, cmdTable["rpush"], toBytes("RPUSH", "list", "d"))
+	s.call(&Session{}, cmdTable["incr"], toBytes("INCR", "counter"))
+	s.mu.Unlock()
+	s.waitAOFRewrite()
+
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() >= before.Size() {
+		t.Fatalf("rewrite did not shrink the file: %d >= %d", after.Size(), before.Size())
+	}
+
+	mustExec(t, s, "SET", "after", "rewrite")
+	s.Close()
+
+	s = openTestAOF(t, path, FsyncNo)
+	defer s.Close()
+
+	tests := []suite{
+		{"GET counter", &resp.BulkStr{Data: []byte("501")}, toBytes("GET", "counter")},
+		{"LRANGE", bulkArr("a", "b", "c", "d"), toBytes("LRANGE", "list", "0", "-1")},
+		{"HGET", &resp.BulkStr{Data: []byte("v")}, toBytes("HGET", "hash", "f")},
+		{"ZRANGE", bulkArr("b", "-inf", "a", "1.5"), toBytes("ZRANGE", "zset", "0", "-1", "WITHSCORES")},
+		{"GET during rewrite", &resp.BulkStr{Data: []byte("rewrite")}, toBytes("GET", "during")},
+		{"GET after rewrite", &resp.BulkStr{Data: []byte("rewrite")}, toBytes("GET", "after")},
+		{"XADD keeps the last ID", resp.MakeErr("ERR The ID specified in XADD is equal or smaller than the target stream top item"), toBytes("XADD", "stream", "2-0", "f", "v")},
+		{"XPENDING", entries(
+			&resp.Intiger{Data: 1},
+			&resp.BulkStr{Data: []byte("1-0")},
+			&resp.BulkStr{Data: []byte("1-0")},
+			entries(bulkArr("alice", "1")),
+		), toBytes("XPENDING", "stream", "g")},
+	}
+	for _, test := range tests {
+		rep, _ := s.Exec(test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+
+	if ttl := mustExec(t, s, "PTTL", "session").(*resp.Intiger).Data; ttl <= 0 {
+		t.Fatalf("TTL was not rewritten, got %d", ttl)
+	}
+}
+
+func TestSnapshotCopyOnWrite(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+	mustExec(t, s, "SET", "str", "a")
+	mustExec(t, s, "RPUSH", "list", "a", "b")
+	mustExec(t, s, "HSET", "hash", "f", "v")
+
+	s.mu.Lock()
+	snap := s.snapshot()
+	s.mu.Unlock()
+
+	mustExec(t, s, "APPEND", "str", "b")
+	mustExec(t, s, "RPUSH", "list", "c")
+	mustExec(t, s, "DEL", "hash")
+	mustExec(t, s, "SET", "new", "v")
+	s.copyKeyspace(snap)
+	mustExec(t, s, "RPUSH", "list", "d")
+
+	data := snap.dbs[0].data
+	if len(data) != 3 || data["hash"] == nil || data["new"] != nil {
+		t.Fatalf("unexpected keys in the snapshot: %v", slices.Sorted(maps.Keys(data)))
+	}
+	if v := data["str"].val.([]byte); string(v) != "a" {
+		t.Fatalf("string modified in the snapshot: %q", v)
+	}
+	if n := data["list"].val.(*quicklist).len(); n != 2 {
+		t.Fatalf("list of %d elements in the snapshot", n)
+	}
+
+	// once released, values are modified in place again
+	s.mu.Lock()
+	s.releaseSnapshot(snap)
+	s.mu.Unlock()
+	d, _ := s.get("list")
+	mustExec(t, s, "RPUSH", "list", "e")
+	if after, _ := s.get("list"); after != d {
+		t.Fatalf("list cloned with no snapshot being written")
+	}
+}
+
+func TestAOFAutoRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	cfg := DefaultConfig()
+	cfg.AppendOnly = true
+	cfg.AppendFilename = path
+	cfg.AutoAOFRewritePercentage = 100
+	cfg.AutoAOFRewriteMinSize = 1024
+	cfg.DBFilename = filepath.Join(filepath.Dir(path), "dump.rdb")
+	cfg.SaveParams = nil
+	s, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// each INCR is logged as 27 bytes, the rewrite starts past 1KB
+	for range 40 {
+		mustExec(t, s, "INCR", "counter")
+	}
+	s.waitAOFRewrite()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() >= 1024 {
+		t.Fatalf("automatic rewrite did not run, file is %d bytes", info.Size())
+	}
+}
@@ -0,0 +1,275 @@
+package store
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+// maximum number of items emitted per variadic command by a rewrite
+const aofRewriteItemsPerCmd = 64
+
+var (
+	errAOFDisabled       = errors.New("Background AOF rewrite requires the append only file to be enabled")
+	errRewriteInProgress = errors.New("Background append only file rewriting already in progress")
+)
+
+func (a *aof) shouldRewrite() bool {
+	if a.rewriteDone != nil || a.autoRewritePct <= 0 || a.size < a.autoRewriteMin {
+		return false
+	}
+	base := max(a.baseSize, 1)
+	growth := a.size*100/base - 100
+	return growth >= int64(a.autoRewritePct)
+}
+
+// startAOFRewrite snapshots the keyspace and writes a minimal AOF for it in
+// the background. Writes made in the meantime go to the current file as
+// usual and are buffered, the buffer is appended to the new file right
+// before it replaces the current one. Must be called with s.mu held.
+func (s *Storage) startAOFRewrite() error {
+	a := s.aof
+	if a == nil {
+		return errAOFDisabled
+	}
+	if a.rewriteDone != nil {
+		return errRewriteInProgress
+	}
+
+	snap := s.snapshot()
+	a.rewriteBuf = nil
+	a.rewriteDone = make(chan struct{})
+	// the writes buffered meanwhile start with a SELECT, whatever database
+	// the new file ends on
+	s.logDB = -1
+	go s.rewriteAOF(a, snap)
+	return nil
+}
+
+func (s *Storage) rewriteAOF(a *aof, snap *snapshot) {
+	s.copyKeyspace(snap)
+	tmpPath := a.path + ".rewrite"
+	f, err := writeRewrite(tmpPath, snap)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseSnapshot(snap)
+
+	done := a.rewriteDone
+	defer close(done)
+	a.rewriteDone = nil
+	buf := a.rewriteBuf
+	a.rewriteBuf = nil
+
+	if err == nil && a.closed {
+		err = errors.New("the append only file was closed")
+	}
+	if err == nil {
+		err = a.swap(f, tmpPath, buf)
+	}
+	if err != nil {
+		slog.Error("background AOF rewrite failed", "error", err)
+		if f != nil {
+			f.Close()
+		}
+		os.Remove(tmpPath)
+		return
+	}
+	s.serveAckWaiters()
+	slog.Info("background AOF rewrite finished", "size", a.size)
+}
+
+// writeRewrite writes the commands rebuilding snap to a new file at path,
+// returns it open for appending
+func writeRewrite(path string, snap *snapshot) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(f)
+	err = writeSnapshotCommands(w, snap)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// swap appends the writes buffered during the rewrite to f and makes it the
+// AOF. The rename is atomic, a crash leaves either the old or the new file.
+func (a *aof) swap(f *os.File, tmpPath string, buf []byte) error {
+	if _, err := f.Write(buf); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, a.path); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	old := a.f
+	a.f = f
+	a.mu.Unlock()
+
+	a.size = info.Size()
+	a.baseSize = info.Size()
+	// the new file holds every write so far and it's on disk
+	a.fsyncedOffset.Store(a.offset.Load())
+	return old.Close()
+}
+
+// seedAOF creates the AOF at path with the commands rebuilding snap
+func seedAOF(path string, snap *snapshot) error {
+	tmpPath := path + ".rewrite"
+	f, err := writeRewrite(tmpPath, snap)
+	if err == nil {
+		err = f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+func writeSnapshotCommands(w io.Writer, snap *snapshot) error {
+	var err error
+	emit := func(cmd [][]byte) {
+		if err == nil {
+			_, err = w.Write(encodeCommand(cmd))
+		}
+	}
+
+	// a replay starts on database 0
+	selected := 0
+	for i, db := range snap.dbs {
+		if len(db.data) == 0 {
+			continue
+		}
+		if i != selected {
+			emit(cmdArgv("select", []byte(strconv.Itoa(i))))
+			selected = i
+		}
+		for _, key := range db.keys() {
+			rewriteEntity(emit, []byte(key), db.data[key])
+			if at, ok := db.expires[key]; ok {
+				emit(cmdArgv("pexpireat", []byte(key), []byte(strconv.FormatInt(at.UnixMilli(), 10))))
+			}
+		}
+	}
+	return err
+}
+
+// emitBatched emits "name key items..." with at most aofRewriteItemsPerCmd
+// items per command, an item is made of perItem arguments
+func emitBatched(emit func([][]byte), name string, key []byte, args [][]byte, perItem int) {
+	batch := aofRewriteItemsPerCmd * perItem
+	for len(args) > 0 {
+		n := min(batch, len(args))
+		emit(append(cmdArgv(name, key), args[:n]...))
+		args = args[n:]
+	}
+}
+
+// rewriteEntity emits the commands that recreate d at key
+func rewriteEntity(emit func([][]byte), key []byte, d *dataEntity) {
+	switch v := d.val.(type) {
+	case []byte:
+		emit(cmdArgv("set", key, v))
+	case *quicklist:
+		items := make([][]byte, 0, v.len())
+		v.iter(func(_ int, e []byte) bool {
+			items = append(items, e)
+			return true
+		})
+		emitBatched(emit, "rpush", key, items, 1)
+	case *hash:
+		items := make([][]byte, 0, v.len()*2)
+		for _, field := range slices.Sorted(maps.Keys(v.fields)) {
+			items = append(items, []byte(field), v.fields[field])
+		}
+		emitBatched(emit, "hset", key, items, 2)
+	case *set:
+		emitBatched(emit, "sadd", key, v.toSlice(), 1)
+	case *zset:
+		items := make([][]byte, 0, v.len()*2)
+		for x := v.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+			items = append(items, formatScore(x.score), []byte(x.member))
+		}
+		emitBatched(emit, "zadd", key, items, 2)
+	case *stream:
+		rewriteStream(emit, key, v)
+	}
+}
+
+func rewriteStream(emit func([][]byte), key []byte, s *stream) {
+	s.log.iter(minStreamID, maxStreamID, func(e *streamEntry) bool {
+		emit(append(cmdArgv("xadd", key, e.id.bytes()), e.fields...))
+		return true
+	})
+
+	// restore the last ID, it's past the last entry if entries were deleted
+	last := s.log.lastEntry()
+	switch {
+	case last == nil && s.lastID == minStreamID:
+		// an empty stream made by XGROUP CREATE MKSTREAM
+		emit(cmdArgv("xgroup", []byte("CREATE"), key, []byte("rewrite"), []byte("0"), []byte("MKSTREAM")))
+		emit(cmdArgv("xgroup", []byte("DESTROY"), key, []byte("rewrite")))
+	case last == nil:
+		emit(cmdArgv("xadd", key, []byte("MAXLEN"), []byte("0"), s.lastID.bytes(), []byte("x"), []byte("y")))
+	case last.id != s.lastID:
+		emit(cmdArgv("xadd", key, s.lastID.bytes(), []byte("x"), []byte("y")))
+		emit(cmdArgv("xdel", key, s.lastID.bytes()))
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(s.groups)) {
+		g := s.groups[name]
+		emit(cmdArgv("xgroup", []byte("CREATE"), key, []byte(name), g.lastID.bytes()))
+		for _, consumer := range slices.Sorted(maps.Keys(g.consumers)) {
+			emit(cmdArgv("xgroup", []byte("CREATECONSUMER"), key, []byte(name), []byte(consumer)))
+		}
+		for _, n := range g.pel {
+			emit(cmdArgv("xclaim", key, []byte(name), []byte(n.consumer.name), []byte("0"), n.id.bytes(),
+				[]byte("TIME"), []byte(strconv.FormatInt(n.deliveryTime.UnixMilli(), 10)),
+				[]byte("RETRYCOUNT"), []byte(strconv.FormatInt(n.deliveryCount, 10)),
+				[]byte("FORCE"), []byte("JUSTID"),
+			))
+		}
+	}
+}
+
+func execBgRewriteAOF(db kVStore, args [][]byte) resp.RespType {
+	s := storageOf(db)
+	if err := s.startAOFRewrite(); err != nil {
+		return resp.MakeErr("ERR " + err.Error())
+	}
+	return &resp.SimpleStr{
+		Data: []byte("Background append only file rewriting started"),
+	}
+}
+
+func init() {
+	registerCommand("bgrewriteaof", 1, 0, execBgRewriteAOF)
+}
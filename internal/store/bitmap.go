@@ -0,0 +1,560 @@
+package store
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+// Bitmaps are strings addressed bit by bit, the most significant bit of
+// the first byte being bit 0. The commands setting bits write the string
+// in place like SETRANGE, see writableString.
+
+func bitOffsetErr() *resp.RespErr {
+	return resp.MakeErr("ERR bit offset is not an integer or out of range")
+}
+
+// parseBitOffset parses the offset of a field of size bits. With hash, an
+// offset like #2 counts fields instead of bits. The field must fit in a
+// 512MB string.
+func parseBitOffset(raw []byte, hash bool, size uint64) (uint64, *resp.RespErr) {
+	mul := uint64(1)
+	if hash && len(raw) > 0 && raw[0] == '#' {
+		raw, mul = raw[1:], size
+	}
+	n, err := strconv.ParseUint(string(raw), 10, 64)
+	if err != nil || n > math.MaxUint64/mul {
+		return 0, bitOffsetErr()
+	}
+	offset := n * mul
+	if offset > math.MaxUint64-size || (offset+size-1)>>3 >= resp.MAX_BULK_SIZE {
+		return 0, bitOffsetErr()
+	}
+	return offset, nil
+}
+
+// getBits reads size bits from offset on, the bits past the end of buf
+// being zero
+func getBits(buf []byte, offset, size uint64) uint64 {
+	var v uint64
+	for i := offset; i < offset+size; i++ {
+		v <<= 1
+		if i>>3 < uint64(len(buf)) {
+			v |= uint64(buf[i>>3]>>(7-i&7)) & 1
+		}
+	}
+	return v
+}
+
+// setBits writes the low size bits of v from offset on, buf must be long
+// enough
+func setBits(buf []byte, offset, size, v uint64) {
+	for i := uint64(0); i < size; i++ {
+		pos := offset + i
+		mask := byte(1) << (7 - pos&7)
+		if v>>(size-1-i)&1 == 1 {
+			buf[pos>>3] |= mask
+		} else {
+			buf[pos>>3] &^= mask
+		}
+	}
+}
+
+func execSetBit(db kVStore, args [][]byte) resp.RespType {
+	key := string(args[0])
+	offset, errReply := parseBitOffset(args[1], false, 1)
+	if errReply != nil {
+		return errReply
+	}
+	bit := string(args[2])
+	if bit != "0" && bit != "1" {
+		return resp.MakeErr("ERR bit is not an integer or out of range")
+	}
+	d, errReply2 := lookupTyped(db, key, typeString)
+	if errReply2 != nil {
+		return errReply2
+	}
+
+	buf := writableString(db, key, d, int64(offset>>3)+1)
+	old := getBits(buf, offset, 1)
+	setBits(buf, offset, 1, uint64(bit[0]-'0'))
+	return &resp.Intiger{Data: int64(old)}
+}
+
+func execGetBit(db kVStore, args [][]byte) resp.RespType {
+	offset, errReply := parseBitOffset(args[1], false, 1)
+	if errReply != nil {
+		return errReply
+	}
+	d, errReply2 := lookupTyped(db, string(args[0]), typeString)
+	if errReply2 != nil {
+		return errReply2
+	}
+	if d == nil {
+		return &resp.Intiger{Data: 0}
+	}
+	return &resp.Intiger{Data: int64(getBits(d.val.([]byte), offset, 1))}
+}
+
+// parseBitRange parses the "start [end [BYTE|BIT]]" of BITCOUNT and BITPOS
+// for a string of n bytes. It returns the inclusive range of bits they
+// select, empty when lo > hi, and whether end was given.
+func parseBitRange(args [][]byte, n int64) (lo, hi int64, endGiven bool, errReply *resp.RespErr) {
+	start, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil {
+		return 0, 0, false, resp.NotInErr()
+	}
+	end := int64(-1)
+	if len(args) > 1 {
+		endGiven = true
+		if end, err = strconv.ParseInt(string(args[1]), 10, 64); err != nil {
+			return 0, 0, false, resp.NotInErr()
+		}
+	}
+	bitMode := false
+	if len(args) > 2 {
+		switch strings.ToUpper(string(args[2])) {
+		case "BYTE":
+		case "BIT":
+			bitMode = true
+		default:
+			return 0, 0, false, resp.SyntaxErr()
+		}
+	}
+	if len(args) > 3 {
+		return 0, 0, false, resp.SyntaxErr()
+	}
+
+	total := n
+	if bitMode {
+		total = n * 8
+	}
+	if start < 0 && end < 0 && start > end {
+		return 1, 0, endGiven, nil
+	}
+	if start < 0 {
+		start = max(total+start, 0)
+	}
+	if end < 0 {
+		end = max(total+end, 0)
+	}
+	end = min(end, total-1)
+	if start > end {
+		return 1, 0, endGiven, nil
+	}
+	if bitMode {
+		return start, end, endGiven, nil
+	}
+	return start * 8, end*8 + 7, endGiven, nil
+}
+
+// popcount counts the bits set in b
+func popcount(b []byte) int64 {
+	var n int
+	for len(b) >= 8 {
+		n += bits.OnesCount64(binary.LittleEndian.Uint64(b))
+		b = b[8:]
+	}
+	for _, c := range b {
+		n += bits.OnesCount8(c)
+	}
+	return int64(n)
+}
+
+func execBitCount(db kVStore, args [][]byte) resp.RespType {
+	if len(args) == 2 {
+		return resp.SyntaxErr()
+	}
+	d, errReply := lookupTyped(db, string(args[0]), typeString)
+	if errReply != nil {
+		return errReply
+	}
+	var val []byte
+	if d != nil {
+		val = d.val.([]byte)
+	}
+	if len(args) == 1 {
+		return &resp.Intiger{Data: popcount(val)}
+	}
+
+	lo, hi, _, errReply2 := parseBitRange(args[1:], int64(len(val)))
+	if errReply2 != nil {
+		return errReply2
+	}
+	if lo > hi {
+		return &resp.Intiger{Data: 0}
+	}
+	first, last := lo>>3, hi>>3
+	n := popcount(val[first : last+1])
+	// the bits of the first and last bytes out of the range
+	n -= int64(bits.OnesCount8(val[first] >> (8 - lo&7)))
+	n -= int64(bits.OnesCount8(val[last] & (1<<(7-hi&7) - 1)))
+	return &resp.Intiger{Data: n}
+}
+
+// execBitPos returns the position of the first bit set to 0 or 1. Looking
+// for a 0 without an end, the string is taken as padded with zeros.
+func execBitPos(db kVStore, args [][]byte) resp.RespType {
+	var bit byte
+	switch string(args[1]) {
+	case "0":
+	case "1":
+		bit = 1
+	default:
+		return resp.MakeErr("ERR The bit argument must be 1 or 0.")
+	}
+	d, errReply := lookupTyped(db, string(args[0]), typeString)
+	if errReply != nil {
+		return errReply
+	}
+	if d == nil {
+		if bit == 1 {
+			return &resp.Intiger{Data: -1}
+		}
+		return &resp.Intiger{Data: 0}
+	}
+
+	val := d.val.([]byte)
+	lo, hi, endGiven := int64(0), int64(len(val))*8-1, false
+	if len(args) > 2 {
+		var errReply2 *resp.RespErr
+		lo, hi, endGiven, errReply2 = parseBitRange(args[2:], int64(len(val)))
+		if errReply2 != nil {
+			return errReply2
+		}
+	}
+	if lo > hi {
+		return &resp.Intiger{Data: -1}
+	}
+
+	// whole bytes without the bit are skipped
+	skip := byte(0)
+	if bit == 0 {
+		skip = 0xff
+	}
+	for i := lo; i <= hi; {
+		if i&7 == 0 && i+7 <= hi && val[i>>3] == skip {
+			i += 8
+			continue
+		}
+		if val[i>>3]>>(7-i&7)&1 == bit {
+			return &resp.Intiger{Data: i}
+		}
+		i++
+	}
+	if bit == 0 && !endGiven {
+		return &resp.Intiger{Data: hi + 1}
+	}
+	return &resp.Intiger{Data: -1}
+}
+
+// execBitOp stores the bitwise AND, OR, XOR or NOT of the source keys at
+// destkey, the shorter strings padded with zeros. It returns the length
+// of the result, an empty one deletes destkey.
+func execBitOp(db kVStore, args [][]byte) resp.RespType {
+	op := strings.ToUpper(string(args[0]))
+	switch op {
+	case "AND", "OR", "XOR":
+	case "NOT":
+		if len(args) != 3 {
+			return resp.MakeErr("ERR BITOP NOT must be called with a single source key.")
+		}
+	default:
+		return resp.SyntaxErr()
+	}
+
+	srcs := make([][]byte, 0, len(args)-2)
+	size := 0
+	for _, k := range args[2:] {
+		d, errReply := lookupTyped(db, string(k), typeString)
+		if errReply != nil {
+			return errReply
+		}
+		var val []byte
+		if d != nil {
+			val = d.val.([]byte)
+		}
+		srcs = append(srcs, val)
+		size = max(size, len(val))
+	}
+
+	res := make([]byte, size)
+	switch op {
+	case "NOT":
+		for i, c := range srcs[0] {
+			res[i] = ^c
+		}
+	case "AND":
+		copy(res, srcs[0])
+		for _, src := range srcs[1:] {
+			for i := range res {
+				if i < len(src) {
+					res[i] &= src[i]
+				} else {
+					res[i] = 0
+				}
+			}
+		}
+	case "OR":
+		for _, src := range srcs {
+			for i, c := range src {
+				res[i] |= c
+			}
+		}
+	case "XOR":
+		for _, src := range srcs {
+			for i, c := range src {
+				res[i] ^= c
+			}
+		}
+	}
+
+	dest := string(args[1])
+	db.remove(dest)
+	if size > 0 {
+		db.put(dest, &dataEntity{typ: typeString, val: res, owned: true})
+	}
+	return &resp.Intiger{Data: int64(size)}
+}
+
+const (
+	overflowWrap = "WRAP"
+	overflowSat  = "SAT"
+	overflowFail = "FAIL"
+)
+
+// bitfieldOp is a GET, SET or INCRBY of BITFIELD
+type bitfieldOp struct {
+	op       string
+	signed   bool
+	size     uint64
+	offset   uint64
+	arg      int64 // the value of SET, the increment of INCRBY
+	overflow string
+}
+
+func parseBitfieldType(raw []byte) (signed bool, size uint64, errReply *resp.RespErr) {
+	errReply = resp.MakeErr("ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	if len(raw) < 2 || (raw[0] != 'i' && raw[0] != 'u' && raw[0] != 'I' && raw[0] != 'U') {
+		return false, 0, errReply
+	}
+	signed = raw[0] == 'i' || raw[0] == 'I'
+	size, err := strconv.ParseUint(string(raw[1:]), 10, 64)
+	if err != nil || size < 1 || (signed && size > 64) || (!signed && size > 63) {
+		return false, 0, errReply
+	}
+	return signed, size, nil
+}
+
+func parseBitfieldOps(args [][]byte, readOnly bool) ([]bitfieldOp, *resp.RespErr) {
+	var ops []bitfieldOp
+	overflow := overflowWrap
+	for i := 0; i < len(args); {
+		sub := strings.ToUpper(string(args[i]))
+		need := 0
+		switch sub {
+		case "GET":
+			need = 2
+		case "SET", "INCRBY":
+			need = 3
+		case "OVERFLOW":
+			need = 1
+		}
+		if need == 0 || i+need >= len(args) {
+			return nil, resp.SyntaxErr()
+		}
+
+		if sub == "OVERFLOW" {
+			overflow = strings.ToUpper(string(args[i+1]))
+			if overflow != overflowWrap && overflow != overflowSat && overflow != overflowFail {
+				return nil, resp.MakeErr("ERR Invalid OVERFLOW type specified")
+			}
+			i += 2
+			continue
+		}
+
+		op := bitfieldOp{op: sub, overflow: overflow}
+		var errReply *resp.RespErr
+		if op.signed, op.size, errReply = parseBitfieldType(args[i+1]); errReply != nil {
+			return nil, errReply
+		}
+		if op.offset, errReply = parseBitOffset(args[i+2], true, op.size); errReply != nil {
+			return nil, errReply
+		}
+		if sub != "GET" {
+			if readOnly {
+				return nil, resp.MakeErr("ERR BITFIELD_RO only supports the GET subcommand")
+			}
+			arg, err := strconv.ParseInt(string(args[i+3]), 10, 64)
+			if err != nil {
+				return nil, resp.NotInErr()
+			}
+			op.arg = arg
+		}
+		ops = append(ops, op)
+		i += need + 1
+	}
+	return ops, nil
+}
+
+// read returns the field as an integer, sign extended for signed types
+func (op *bitfieldOp) read(buf []byte) int64 {
+	v := getBits(buf, op.offset, op.size)
+	if op.signed && op.size < 64 && v>>(op.size-1)&1 == 1 {
+		v |= math.MaxUint64 << op.size
+	}
+	return int64(v)
+}
+
+// add returns value plus incr in the range of the field, following the
+// overflow policy. ok is false when it overflows with FAIL.
+func (op *bitfieldOp) add(value, incr int64) (res int64, ok bool) {
+	if op.signed {
+		return addSigned(value, incr, op.size, op.overflow)
+	}
+	v, ok := addUnsigned(uint64(value), incr, op.size, op.overflow)
+	return int64(v), ok
+}
+
+func addUnsigned(value uint64, incr int64, size uint64, overflow string) (uint64, bool) {
+	max := uint64(1)<<size - 1
+	maxIncr := int64(max - value)
+	minIncr := -int64(value)
+
+	var limit uint64
+	switch {
+	case value > max || (incr > 0 && incr > maxIncr):
+		limit = max
+	case incr < 0 && incr < minIncr:
+		limit = 0
+	default:
+		return value + uint64(incr), true
+	}
+	switch overflow {
+	case overflowWrap:
+		return (value + uint64(incr)) & max, true
+	case overflowSat:
+		return limit, true
+	}
+	return 0, false
+}
+
+func addSigned(value, incr int64, size uint64, overflow string) (int64, bool) {
+	max := int64(math.MaxInt64)
+	if size < 64 {
+		max = 1<<(size-1) - 1
+	}
+	min := -max - 1
+	// these may wrap, they're only used once value is known to be in range
+	maxIncr := int64(uint64(max) - uint64(value))
+	minIncr := min - value
+
+	var limit int64
+	switch {
+	case value > max || (size != 64 && incr > maxIncr) || (value >= 0 && incr > 0 && incr > maxIncr):
+		limit = max
+	case value < min || (size != 64 && incr < minIncr) || (value < 0 && incr < 0 && incr < minIncr):
+		limit = min
+	default:
+		return value + incr, true
+	}
+	switch overflow {
+	case overflowWrap:
+		c := uint64(value) + uint64(incr)
+		if size < 64 {
+			mask := uint64(math.MaxUint64) << size
+			if c>>(size-1)&1 == 1 {
+				c |= mask
+			} else {
+				c &^= mask
+			}
+		}
+		return int64(c), true
+	case overflowSat:
+		return limit, true
+	}
+	return 0, false
+}
+
+func execBitfield(db kVStore, args [][]byte) resp.RespType {
+	return bitfield(db, args, false)
+}
+
+func execBitfieldRO(db kVStore, args [][]byte) resp.RespType {
+	return bitfield(db, args, true)
+}
+
+// bitfield runs the GET, SET and INCRBY of BITFIELD in order, SET replying
+// with the old value and INCRBY with the new one, nil when they overflow
+// with FAIL. A string written to is first grown to hold every field
+// written, like redis does.
+func bitfield(db kVStore, args [][]byte, readOnly bool) resp.RespType {
+	key := string(args[0])
+	ops, errReply := parseBitfieldOps(args[1:], readOnly)
+	if errReply != nil {
+		return errReply
+	}
+	d, errReply2 := lookupTyped(db, key, typeString)
+	if errReply2 != nil {
+		return errReply2
+	}
+
+	writes, size := false, int64(0)
+	for _, op := range ops {
+		if op.op != "GET" {
+			writes = true
+			size = max(size, int64((op.offset+op.size-1)>>3)+1)
+		}
+	}
+	var buf []byte
+	if writes {
+		buf = writableString(db, key, d, size)
+	} else if d != nil {
+		buf = d.val.([]byte)
+	}
+
+	result := &resp.Array{}
+	for _, op := range ops {
+		cur := op.read(buf)
+		switch op.op {
+		case "GET":
+			result.Append(&resp.Intiger{Data: cur})
+			continue
+		case "SET":
+			next, ok := op.add(op.arg, 0)
+			if !ok {
+				result.Append(&resp.BulkStr{Data: nil})
+				continue
+			}
+			setBits(buf, op.offset, op.size, uint64(next))
+			result.Append(&resp.Intiger{Data: cur})
+		case "INCRBY":
+			next, ok := op.add(cur, op.arg)
+			if !ok {
+				result.Append(&resp.BulkStr{Data: nil})
+				continue
+			}
+			setBits(buf, op.offset, op.size, uint64(next))
+			result.Append(&resp.Intiger{Data: next})
+		}
+	}
+
+	if !writes {
+		db.propagate()
+	}
+	return result
+}
+
+func init() {
+	registerCommand("setbit", 4, cmdWrite, execSetBit)
+	registerCommand("getbit", 3, cmdReadOnly, execGetBit)
+	registerCommand("bitcount", -2, cmdReadOnly, execBitCount)
+	registerCommand("bitpos", -3, cmdReadOnly, execBitPos)
+	registerCommand("bitop", -4, cmdWrite, execBitOp).withKeys(2, -1, 1)
+	registerCommand("bitfield", -2, cmdWrite, execBitfield)
+	registerCommand("bitfield_ro", -2, cmdReadOnly, execBitfieldRO)
+}
@@ -0,0 +1,191 @@
+package store
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+	"github.com/myselfBZ/go-redis-clone/pkg/utils"
+)
+
+func TestExecBitmap(t *testing.T) {
+	testDb.mu.Lock()
+	defer testDb.mu.Unlock()
+
+	key := utils.RandString(defaultKeyLength)
+	str := utils.RandString(defaultKeyLength)
+	ones := utils.RandString(defaultKeyLength)
+	listKey := utils.RandString(defaultKeyLength)
+	testDb.put(listKey, &dataEntity{typ: typeList, val: newQuicklist()})
+	testDb.put(str, &dataEntity{typ: typeString, val: []byte("foobar")})
+	testDb.put(ones, &dataEntity{typ: typeString, val: []byte("\xff\xff\xff")})
+
+	tests := []struct {
+		suite
+		exec execCmd
+	}{
+		{suite{"SETBIT", &resp.Intiger{Data: 0}, toBytes(key, "7", "1")}, execSetBit},
+		{suite{"SETBIT old bit", &resp.Intiger{Data: 1}, toBytes(key, "7", "0")}, execSetBit},
+		{suite{"SETBIT grows", &resp.Intiger{Data: 0}, toBytes(key, "17", "1")}, execSetBit},
+		{suite{"SETBIT wrote", &resp.BulkStr{Data: []byte("\x00\x00\x40")}, toBytes(key)}, execGet},
+		{suite{"SETBIT invalid bit", resp.MakeErr("ERR bit is not an integer or out of range"), toBytes(key, "1", "2")}, execSetBit},
+		{suite{"SETBIT negative offset", bitOffsetErr(), toBytes(key, "-1", "1")}, execSetBit},
+		{suite{"SETBIT past 512MB", bitOffsetErr(), toBytes(key, "4294967296", "1")}, execSetBit},
+		{suite{"GETBIT", &resp.Intiger{Data: 1}, toBytes(key, "17")}, execGetBit},
+		{suite{"GETBIT past the end", &resp.Intiger{Data: 0}, toBytes(key, "1000")}, execGetBit},
+		{suite{"GETBIT missing key", &resp.Intiger{Data: 0}, toBytes("missing", "0")}, execGetBit},
+
+		{suite{"BITCOUNT", &resp.Intiger{Data: 26}, toBytes(str)}, execBitCount},
+		{suite{"BITCOUNT bytes", &resp.Intiger{Data: 4}, toBytes(str, "0", "0")}, execBitCount},
+		{suite{"BITCOUNT negative bytes", &resp.Intiger{Data: 7}, toBytes(str, "-2", "-1", "BYTE")}, execBitCount},
+		{suite{"BITCOUNT bits", &resp.Intiger{Data: 17}, toBytes(str, "5", "30", "BIT")}, execBitCount},
+		{suite{"BITCOUNT start after end", &resp.Intiger{Data: 0}, toBytes(str, "3", "1")}, execBitCount},
+		{suite{"BITCOUNT missing key", &resp.Intiger{Data: 0}, toBytes("missing", "0", "-1")}, execBitCount},
+		{suite{"BITCOUNT without end", resp.SyntaxErr(), toBytes(str, "0")}, execBitCount},
+		{suite{"BITCOUNT invalid unit", resp.SyntaxErr(), toBytes(str, "0", "1", "WORD")}, execBitCount},
+
+		{suite{"BITPOS 1", &resp.Intiger{Data: 17}, toBytes(key, "1")}, execBitPos},
+		{suite{"BITPOS 0", &resp.Intiger{Data: 0}, toBytes(str, "0")}, execBitPos},
+		{suite{"BITPOS 0 padded", &resp.Intiger{Data: 24}, toBytes(ones, "0")}, execBitPos},
+		{suite{"BITPOS 0 with an end", &resp.Intiger{Data: -1}, toBytes(ones, "0", "0", "-1")}, execBitPos},
+		{suite{"BITPOS bytes", &resp.Intiger{Data: 17}, toBytes(key, "1", "2")}, execBitPos},
+		{suite{"BITPOS bits", &resp.Intiger{Data: -1}, toBytes(key, "1", "0", "16", "BIT")}, execBitPos},
+		{suite{"BITPOS 1 missing key", &resp.Intiger{Data: -1}, toBytes("missing", "1")}, execBitPos},
+		{suite{"BITPOS 0 missing key", &resp.Intiger{Data: 0}, toBytes("missing", "0")}, execBitPos},
+		{suite{"BITPOS invalid bit", resp.MakeErr("ERR The bit argument must be 1 or 0."), toBytes(key, "2")}, execBitPos},
+
+		{suite{"SETBIT on a list", resp.WrongTypeErr(), toBytes(listKey, "0", "1")}, execSetBit},
+		{suite{"BITCOUNT on a list", resp.WrongTypeErr(), toBytes(listKey)}, execBitCount},
+	}
+
+	for _, test := range tests {
+		rep := test.exec(testDb, test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+}
+
+func TestBitOp(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+	mustExec(t, s, "SET", "a", "\xf0\x0f")
+	mustExec(t, s, "SET", "b", "\xff")
+	mustExec(t, s, "SET", "dest", "old", "EX", "100")
+	mustExec(t, s, "RPUSH", "list", "a")
+
+	tests := []suite{
+		{"AND", &resp.Intiger{Data: 2}, toBytes("BITOP", "AND", "dest", "a", "b")},
+		{"AND pads with zeros", &resp.BulkStr{Data: []byte("\xf0\x00")}, toBytes("GET", "dest")},
+		{"BITOP drops the TTL", &resp.Intiger{Data: -1}, toBytes("TTL", "dest")},
+		{"OR", &resp.Intiger{Data: 2}, toBytes("BITOP", "or", "dest", "a", "b")},
+		{"OR result", &resp.BulkStr{Data: []byte("\xff\x0f")}, toBytes("GET", "dest")},
+		{"XOR", &resp.Intiger{Data: 2}, toBytes("BITOP", "XOR", "dest", "a", "b", "missing")},
+		{"XOR result", &resp.BulkStr{Data: []byte("\x0f\x0f")}, toBytes("GET", "dest")},
+		{"NOT", &resp.Intiger{Data: 2}, toBytes("BITOP", "NOT", "dest", "a")},
+		{"NOT result", &resp.BulkStr{Data: []byte("\x0f\xf0")}, toBytes("GET", "dest")},
+		{"empty result deletes", &resp.Intiger{Data: 0}, toBytes("BITOP", "AND", "dest", "missing", "other")},
+		{"deleted", &resp.Intiger{Data: 0}, toBytes("EXISTS", "dest")},
+		{"NOT with two keys", resp.MakeErr("ERR BITOP NOT must be called with a single source key."), toBytes("BITOP", "NOT", "dest", "a", "b")},
+		{"unknown operation", resp.SyntaxErr(), toBytes("BITOP", "NAND", "dest", "a", "b")},
+		{"on a list", resp.WrongTypeErr(), toBytes("BITOP", "OR", "dest", "a", "list")},
+	}
+	for _, test := range tests {
+		rep, _ := s.Exec(test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+}
+
+func TestBitfield(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+	ints := func(vals ...int64) resp.RespType {
+		arr := &resp.Array{}
+		for _, v := range vals {
+			arr.Append(&resp.Intiger{Data: v})
+		}
+		return arr
+	}
+
+	typeErr := resp.MakeErr("ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	tests := []suite{
+		{"SET and GET", ints(0, 255, -1), toBytes("BITFIELD", "k", "SET", "u8", "0", "255", "GET", "u8", "0", "GET", "i8", "0")},
+		{"SET wrote", &resp.BulkStr{Data: []byte("\xff")}, toBytes("GET", "k")},
+		{"SET returns the old value", ints(255, 1), toBytes("BITFIELD", "k", "SET", "u8", "#0", "1", "GET", "u8", "0")},
+		{"hash offsets", ints(0, 258), toBytes("BITFIELD", "k", "SET", "u8", "#1", "2", "GET", "u16", "0")},
+		{"unaligned", ints(0, 5), toBytes("BITFIELD", "k", "SET", "u3", "20", "5", "GET", "u3", "20")},
+		{"INCRBY wraps", ints(5, -128), toBytes("BITFIELD", "w", "INCRBY", "u4", "0", "5", "INCRBY", "i8", "8", "128")},
+		{"INCRBY wraps around", ints(0), toBytes("BITFIELD", "w", "INCRBY", "u4", "0", "11")},
+		{"INCRBY saturates", ints(15, 0), toBytes("BITFIELD", "w", "OVERFLOW", "SAT", "INCRBY", "u4", "0", "100", "INCRBY", "u4", "0", "-100")},
+		{"signed saturates", ints(127, -128), toBytes("BITFIELD", "w", "OVERFLOW", "sat", "INCRBY", "i8", "8", "1000", "INCRBY", "i8", "8", "-1000")},
+		{"INCRBY fails", entries(&resp.Intiger{Data: 2}, &resp.BulkStr{Data: nil}), toBytes("BITFIELD", "f", "OVERFLOW", "FAIL", "INCRBY", "u2", "0", "2", "INCRBY", "u2", "0", "2")},
+		{"failed INCRBY left the field", ints(2), toBytes("BITFIELD", "f", "GET", "u2", "0")},
+		{"SET fails", entries(&resp.BulkStr{Data: nil}, &resp.Intiger{Data: -8}), toBytes("BITFIELD", "f", "OVERFLOW", "FAIL", "SET", "i4", "0", "8", "SET", "i4", "0", "-8")},
+		{"SET wraps", ints(0), toBytes("BITFIELD", "g", "SET", "u8", "0", "-1")},
+		{"wrapped", ints(255), toBytes("BITFIELD", "g", "GET", "u8", "0")},
+		{"i64", ints(0, -9223372036854775808), toBytes("BITFIELD", "h", "SET", "i64", "0", "9223372036854775807", "INCRBY", "i64", "0", "1")},
+		{"i64 saturates", ints(-9223372036854775808), toBytes("BITFIELD", "h", "OVERFLOW", "SAT", "INCRBY", "i64", "0", "-1")},
+		{"GET of a missing key", ints(0), toBytes("BITFIELD", "missing", "GET", "u8", "100")},
+		{"GET creates nothing", &resp.Intiger{Data: 0}, toBytes("EXISTS", "missing")},
+		{"BITFIELD_RO", ints(255), toBytes("BITFIELD_RO", "g", "GET", "u8", "0")},
+		{"BITFIELD_RO write", resp.MakeErr("ERR BITFIELD_RO only supports the GET subcommand"), toBytes("BITFIELD_RO", "g", "SET", "u8", "0", "1")},
+		{"u64", typeErr, toBytes("BITFIELD", "k", "GET", "u64", "0")},
+		{"i65", typeErr, toBytes("BITFIELD", "k", "GET", "i65", "0")},
+		{"invalid overflow", resp.MakeErr("ERR Invalid OVERFLOW type specified"), toBytes("BITFIELD", "k", "OVERFLOW", "NONE")},
+		{"offset past 512MB", bitOffsetErr(), toBytes("BITFIELD", "k", "GET", "u8", "4294967289")},
+		{"missing argument", resp.SyntaxErr(), toBytes("BITFIELD", "k", "SET", "u8", "0")},
+		{"nothing ran after an error", ints(1), toBytes("BITFIELD", "k", "GET", "u8", "0")},
+	}
+	for _, test := range tests {
+		rep, _ := s.Exec(test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+}
+
+func TestAOFBitmap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	s := openTestAOF(t, path, FsyncAlways)
+	mustExec(t, s, "SETBIT", "b", "9", "1")
+	mustExec(t, s, "BITFIELD", "b", "INCRBY", "u8", "#1", "3")
+	mustExec(t, s, "BITFIELD", "b", "GET", "u8", "0")
+	mustExec(t, s, "BITOP", "NOT", "n", "b")
+	s.Close()
+
+	s = openTestAOF(t, path, FsyncNo)
+	defer s.Close()
+	tests := []suite{
+		{"SETBIT and BITFIELD", &resp.BulkStr{Data: []byte("\x00\x43")}, toBytes("GET", "b")},
+		{"BITOP", &resp.BulkStr{Data: []byte("\xff\xbc")}, toBytes("GET", "n")},
+	}
+	for _, test := range tests {
+		rep, _ := s.Exec(test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+}
+
+func TestSetBitInPlace(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+
+	val := []byte("\x00\x00")
+	if _, err := s.Exec([][]byte{[]byte("SET"), []byte("k"), val}); err != nil {
+		t.Fatal(err)
+	}
+	get := mustExec(t, s, "GET", "k")
+	mustExec(t, s, "SETBIT", "k", "7", "1")
+	mustExec(t, s, "BITFIELD", "k", "SET", "u8", "8", "255")
+	if string(val) != "\x00\x00" || string(get.ToBytes()) != "$2\r\n\x00\x00\r\n" {
+		t.Fatalf("bits set in the argument %q or the reply %q", val, get.ToBytes())
+	}
+	if rep := mustExec(t, s, "GET", "k"); string(rep.ToBytes()) != "$2\r\n\x01\xff\r\n" {
+		t.Fatalf("GET: %q", rep.ToBytes())
+	}
+}
@@ -0,0 +1,217 @@
+package store
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+// blockOn is returned by the executor of a blocking command that can't be
+// served yet. It never reaches a client: Exec replies as if it timed out
+// right away, ExecBlocking parks the command until one of keys is written.
+type blockOn struct {
+	keys [][]byte
+	// set instead of keys for commands waiting on acknowledgements, see
+	// serveAckWaiters. It returns the reply once the wait is over, nil
+	// until then unless timedOut is set.
+	poll         func(timedOut bool) resp.RespType
+	timeout      time.Duration
+	timeoutReply resp.RespType
+}
+
+// expire returns the reply of a command that timed out
+func (b *blockOn) expire() resp.RespType {
+	if b.poll != nil {
+		return b.poll(true)
+	}
+	return b.timeoutReply
+}
+
+func (b *blockOn) Type() string {
+	return "block"
+}
+
+func (b *blockOn) ToBytes() []byte {
+	return b.expire().ToBytes()
+}
+
+// parseTimeout parses the timeout of a blocking command, in seconds, zero
+// blocks forever
+func parseTimeout(raw []byte) (time.Duration, *resp.RespErr) {
+	secs, err := strconv.ParseFloat(string(raw), 64)
+	if err != nil || math.IsNaN(secs) || math.IsInf(secs, 0) || secs > math.MaxInt64/float64(time.Second) {
+		return 0, resp.MakeErr("ERR timeout is not a float or out of range")
+	}
+	if secs < 0 {
+		return 0, resp.MakeErr("ERR timeout is negative")
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// waiter is a command parked until it can be served
+type waiter struct {
+	c   *command
+	cmd [][]byte
+	// the database the command runs on
+	db    int
+	keys  []dbKey
+	poll  func(timedOut bool) resp.RespType
+	timer *time.Timer
+	// receives the reply, closed without one if the storage is closed
+	reply chan resp.RespType
+	done  bool
+}
+
+// Blocked is a blocking command waiting for one of its keys to be written,
+// or for its writes to be acknowledged
+type Blocked struct {
+	s *Storage
+	w *waiter
+}
+
+// Reply receives the reply of the command once it's served or timed out.
+// It's closed without a reply if the storage is closed first.
+func (b *Blocked) Reply() <-chan resp.RespType {
+	return b.w.reply
+}
+
+// Cancel stops waiting, a command that wasn't served yet has no effect
+func (b *Blocked) Cancel() {
+	b.s.mu.Lock()
+	defer b.s.mu.Unlock()
+	b.s.removeWaiter(b.w)
+}
+
+// ExecBlocking is Exec for clients that can wait, on the database of se.
+// A blocking command that can't be served right away is parked and
+// returned as Blocked instead of a reply, waiters on the same key are
+// served in arrival order.
+func (s *Storage) ExecBlocking(se *Session, cmd [][]byte) (resp.RespType, *Blocked, error) {
+	return s.exec(se, cmd, true, false)
+}
+
+func (s *Storage) block(se *Session, c *command, cmd [][]byte, b *blockOn) *Blocked {
+	w := &waiter{
+		c:     c,
+		cmd:   cmd,
+		db:    se.db,
+		poll:  b.poll,
+		reply: make(chan resp.RespType, 1),
+	}
+	if w.poll != nil {
+		s.ackWaiters = append(s.ackWaiters, w)
+	}
+	for _, k := range b.keys {
+		key := dbKey{se.db, string(k)}
+		if slices.Contains(w.keys, key) {
+			continue
+		}
+		w.keys = append(w.keys, key)
+		s.blocked[key] = append(s.blocked[key], w)
+	}
+	if b.timeout > 0 {
+		w.timer = time.AfterFunc(b.timeout, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if !w.done {
+				s.unblock(w, b.expire())
+			}
+		})
+	}
+	return &Blocked{s: s, w: w}
+}
+
+func (s *Storage) removeWaiter(w *waiter) {
+	if w.done {
+		return
+	}
+	w.done = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	if w.poll != nil {
+		s.ackWaiters = slices.DeleteFunc(s.ackWaiters, func(o *waiter) bool {
+			return o == w
+		})
+	}
+	for _, key := range w.keys {
+		waiters := slices.DeleteFunc(s.blocked[key], func(o *waiter) bool {
+			return o == w
+		})
+		if len(waiters) == 0 {
+			delete(s.blocked, key)
+		} else {
+			s.blocked[key] = waiters
+		}
+	}
+}
+
+func (s *Storage) unblock(w *waiter, reply resp.RespType) {
+	s.removeWaiter(w)
+	w.reply <- reply
+}
+
+// markReady queues key to be looked at by serveBlocked if commands are
+// blocked on it
+func (s *Storage) markReady(key dbKey) {
+	if _, ok := s.blocked[key]; ok && !slices.Contains(s.readyKeys, key) {
+		s.readyKeys = append(s.readyKeys, key)
+	}
+}
+
+// serveBlocked runs again the commands blocked on the keys written by the
+// last command, oldest first, for as long as the keys exist. Serving a
+// command may make other keys ready, like the destination of BLMOVE.
+func (s *Storage) serveBlocked() {
+	for len(s.readyKeys) > 0 {
+		key := s.readyKeys[0]
+		s.readyKeys = s.readyKeys[1:]
+		if s.denyWrite() != nil {
+			continue
+		}
+
+		db := s.dbs[key.db]
+		for _, w := range slices.Clone(s.blocked[key]) {
+			db.deleteIfExpired(key.key)
+			if !db.exists(key.key) {
+				break
+			}
+			if w.done {
+				continue
+			}
+			reply := s.call(&Session{db: w.db}, w.c, w.cmd)
+			if _, ok := reply.(*blockOn); ok {
+				continue
+			}
+			s.unblock(w, reply)
+		}
+	}
+}
+
+// serveAckWaiters replies to the commands waiting on acknowledgements
+// that are now covered. Must be called with s.mu held.
+func (s *Storage) serveAckWaiters() {
+	for _, w := range slices.Clone(s.ackWaiters) {
+		if reply := w.poll(false); reply != nil {
+			s.unblock(w, reply)
+		}
+	}
+}
+
+// closeBlocked releases every waiter without a reply
+func (s *Storage) closeBlocked() {
+	all := slices.Clone(s.ackWaiters)
+	for _, waiters := range s.blocked {
+		all = append(all, waiters...)
+	}
+	for _, w := range all {
+		if !w.done {
+			s.removeWaiter(w)
+			close(w.reply)
+		}
+	}
+	s.readyKeys = nil
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+func mustBlock(t *testing.T, s *Storage, args ...string) *Blocked {
+	t.Helper()
+	rep, blocked, err := s.ExecBlocking(&Session{}, toBytes(args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocked == nil {
+		t.Fatalf("%v did not block, got %q", args, rep.ToBytes())
+	}
+	return blocked
+}
+
+func expectReply(t *testing.T, b *Blocked, want resp.RespType) {
+	t.Helper()
+	select {
+	case rep := <-b.Reply():
+		if !slices.Equal(rep.ToBytes(), want.ToBytes()) {
+			t.Fatalf("got %q, want %q", rep.ToBytes(), want.ToBytes())
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("blocked command was not served")
+	}
+}
+
+func TestBlockingPop(t *testing.T) {
+	s := NewStorage()
+	mustExec(t, s, "RPUSH", "b", "x")
+	mustExec(t, s, "SET", "str", "v")
+
+	tests := []suite{
+		{"BLPOP non empty list", bulkArr("b", "x"), toBytes("BLPOP", "a", "b", "0")},
+		{"BLPOP without blocking", &resp.NullArray{}, toBytes("BLPOP", "a", "0")},
+		{"BLMOVE without blocking", &resp.BulkStr{Data: nil}, toBytes("BLMOVE", "a", "b", "LEFT", "RIGHT", "0")},
+		{"BLPOP wrong type", resp.WrongTypeErr(), toBytes("BLPOP", "str", "0")},
+		{"BLPOP negative timeout", resp.MakeErr("ERR timeout is negative"), toBytes("BLPOP", "a", "-1")},
+		{"BLPOP invalid timeout", resp.MakeErr("ERR timeout is not a float or out of range"), toBytes("BLPOP", "a", "soon")},
+		{"BLMOVE invalid direction", resp.SyntaxErr(), toBytes("BLMOVE", "a", "b", "UP", "RIGHT", "0")},
+	}
+	for _, test := range tests {
+		rep, _ := s.Exec(test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+
+	// waiters are served in the order they blocked, each one gets a single
+	// element
+	first := mustBlock(t, s, "BLPOP", "jobs", "0")
+	second := mustBlock(t, s, "BRPOP", "other", "jobs", "0")
+	third := mustBlock(t, s, "BLPOP", "jobs", "0")
+	mustExec(t, s, "RPUSH", "jobs", "1", "2")
+	expectReply(t, first, bulkArr("jobs", "1"))
+	expectReply(t, second, bulkArr("jobs", "2"))
+
+	mustExec(t, s, "LPUSH", "other", "3")
+	select {
+	case rep := <-third.Reply():
+		t.Fatalf("served from a key it does not wait on: %q", rep.ToBytes())
+	default:
+	}
+	third.Cancel()
+	mustExec(t, s, "RPUSH", "jobs", "4")
+	if rep := mustExec(t, s, "LLEN", "jobs"); !slices.Equal(rep.ToBytes(), (&resp.Intiger{Data: 1}).ToBytes()) {
+		t.Fatalf("cancelled command was served")
+	}
+	if len(s.blocked) != 0 {
+		t.Fatalf("waiters were left behind: %v", s.blocked)
+	}
+
+	// pushes in a transaction wake waiters once it's over
+	move := mustBlock(t, s, "BLMOVE", "src", "dst", "RIGHT", "LEFT", "0")
+	s.ExecMulti(&Session{}, [][][]byte{toBytes("RPUSH", "src", "a", "b"), toBytes("LPOP", "src")}, nil)
+	expectReply(t, move, &resp.BulkStr{Data: []byte("b")})
+	if rep := mustExec(t, s, "LRANGE", "dst", "0", "-1"); !slices.Equal(rep.ToBytes(), bulkArr("b").ToBytes()) {
+		t.Fatalf("BLMOVE did not push to the destination, got %q", rep.ToBytes())
+	}
+
+	timedOut := mustBlock(t, s, "BLPOP", "empty", "0.02")
+	expectReply(t, timedOut, &resp.NullArray{})
+
+	closed := mustBlock(t, s, "BLPOP", "empty", "0")
+	s.Close()
+	if _, ok := <-closed.Reply(); ok {
+		t.Fatalf("expected the reply channel to be closed")
+	}
+}
+
+func TestBlockingPopAOF(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	s := openTestAOF(t, path, FsyncAlways)
+
+	b := mustBlock(t, s, "BLPOP", "q", "0")
+	mustExec(t, s, "RPUSH", "q", "a", "b")
+	expectReply(t, b, bulkArr("q", "a"))
+	s.Close()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(strings.ToLower(string(content)), "blpop") {
+		t.Fatalf("blocking command was logged as is:\n%q", content)
+	}
+
+	s = openTestAOF(t, path, FsyncNo)
+	defer s.Close()
+	if rep := mustExec(t, s, "LRANGE", "q", "0", "-1"); !slices.Equal(rep.ToBytes(), bulkArr("b").ToBytes()) {
+		t.Fatalf("got %q after reloading the AOF", rep.ToBytes())
+	}
+}
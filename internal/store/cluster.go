@@ -0,0 +1,947 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+// the keyspace of a cluster is split in this many slots, each served by a
+// single node
+const clusterSlots = 16384
+
+// nodes forgotten with CLUSTER FORGET aren't learned again from the others
+// for this long
+const clusterForgetTTL = time.Minute
+
+var crc16Table [256]uint16
+
+func init() {
+	for i := range crc16Table {
+		crc := uint16(i) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		crc16Table[i] = crc
+	}
+}
+
+// crc16 is CRC16-CCITT (XMODEM), the one redis hashes keys with
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^c]
+	}
+	return crc
+}
+
+// keyHashSlot returns the slot of key. Only the part between the first {
+// and the next } is hashed when it's not empty, so related keys can be put
+// in the same slot.
+func keyHashSlot(key []byte) int {
+	if start := slices.Index(key, '{'); start >= 0 {
+		if end := slices.Index(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) & (clusterSlots - 1))
+}
+
+type clusterNode struct {
+	id   string
+	host string
+	port int
+	// the node was met but didn't tell its id yet
+	handshake   bool
+	configEpoch int64
+
+	// link polled by clusterCron, see pingNode
+	conn     net.Conn
+	br       *bufio.Reader
+	pinging  bool
+	pingSent time.Time
+	pongRecv time.Time
+}
+
+func (n *clusterNode) addr() string {
+	return net.JoinHostPort(n.host, strconv.Itoa(n.port))
+}
+
+// clusterState is the view a node has of the cluster, guarded by
+// Storage.mu. Each node is the authority on the slots it serves, the
+// others learn them by polling it. A node claiming a slot served by
+// another takes it over if its config epoch is greater.
+type clusterState struct {
+	myself       *clusterNode
+	nodes        map[string]*clusterNode
+	currentEpoch int64
+
+	slots [clusterSlots]*clusterNode
+	// where slots are moving to and coming from during a resharding
+	migrating map[int]*clusterNode
+	importing map[int]*clusterNode
+	forgotten map[string]time.Time
+
+	// empty for nodes that don't persist their view
+	configFile  string
+	nodeTimeout time.Duration
+	// fixed address announced to the others, learned from the links to
+	// them when empty
+	announceIP string
+
+	pings   sync.WaitGroup
+	stopped bool
+	exit    chan struct{}
+	done    chan struct{}
+}
+
+// startCluster turns the storage into a cluster node, with the view saved
+// in the config file by a previous run if any
+func (s *Storage) startCluster(cfg Config) error {
+	myself := &clusterNode{id: newReplID(), host: "127.0.0.1", port: cfg.Port}
+	if cfg.ClusterAnnounceIP != "" {
+		myself.host = cfg.ClusterAnnounceIP
+	}
+	cl := &clusterState{
+		myself:      myself,
+		nodes:       map[string]*clusterNode{myself.id: myself},
+		migrating:   make(map[int]*clusterNode),
+		importing:   make(map[int]*clusterNode),
+		forgotten:   make(map[string]time.Time),
+		configFile:  cfg.ClusterConfigFile,
+		nodeTimeout: cfg.ClusterNodeTimeout,
+		announceIP:  cfg.ClusterAnnounceIP,
+		exit:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	if cl.configFile != "" {
+		data, err := os.ReadFile(cl.configFile)
+		if err == nil {
+			err = cl.load(string(data))
+		} else if os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load the cluster config %s: %w", cl.configFile, err)
+		}
+		// the port may have changed since
+		cl.myself.port = cfg.Port
+		if cfg.ClusterAnnounceIP != "" {
+			cl.myself.host = cfg.ClusterAnnounceIP
+		}
+		if err := cl.save(); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	s.cluster = cl
+	s.mu.Unlock()
+	go s.clusterCron()
+	slog.Info("cluster mode enabled", "id", cl.myself.id)
+	return nil
+}
+
+// stopCluster ends the links to the other nodes
+func (s *Storage) stopCluster() {
+	cl := s.cluster
+	close(cl.exit)
+	<-cl.done
+	s.mu.Lock()
+	cl.stopped = true
+	for _, n := range cl.nodes {
+		if n.conn != nil {
+			n.conn.Close()
+		}
+	}
+	s.mu.Unlock()
+	cl.pings.Wait()
+}
+
+// ClusterEnabled tells if the storage runs as a cluster node
+func (s *Storage) ClusterEnabled() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cluster != nil
+}
+
+// ExecAsking is ExecBlocking for a command following ASKING, which is run
+// here if its slot is being imported even though it's not served yet
+func (s *Storage) ExecAsking(se *Session, cmd [][]byte) (resp.RespType, *Blocked, error) {
+	return s.exec(se, cmd, true, true)
+}
+
+// clusterRedirect returns the error sending the client to the node that
+// serves keys, nil if they may be served here. Must be called with s.mu
+// held. While their slot migrates, the keys are looked up once they're
+// locked by migrationRedirect.
+func (s *Storage) clusterRedirect(keys [][]byte, asking bool) *resp.RespErr {
+	cl := s.cluster
+	if cl == nil || len(keys) == 0 {
+		return nil
+	}
+
+	slot := keyHashSlot(keys[0])
+	for _, k := range keys[1:] {
+		if keyHashSlot(k) != slot {
+			return resp.MakeErr("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+	}
+
+	n := cl.slots[slot]
+	switch {
+	case n == nil:
+		return resp.MakeErr("CLUSTERDOWN Hash slot not served")
+	case n == cl.myself, asking && cl.importing[slot] != nil:
+		return nil
+	}
+	return resp.MakeErr(fmt.Sprintf("MOVED %d %s", slot, n.addr()))
+}
+
+// migrationRedirect returns the error sending the client elsewhere while
+// the slot of keys migrates, nil if they're served here. The keys already
+// moved to the target of a migration are asked there, a command on some
+// of them is tried again later. ctx must hold the shards of keys, which
+// clusterRedirect let run here.
+func (s *Storage) migrationRedirect(ctx *callCtx, keys [][]byte, asking bool) *resp.RespErr {
+	cl := s.cluster
+	if cl == nil || len(keys) == 0 {
+		return nil
+	}
+	slot := keyHashSlot(keys[0])
+	target, migrating := cl.migrating[slot]
+	importing := cl.slots[slot] != cl.myself && asking && cl.importing[slot] != nil
+	if !migrating && !importing {
+		return nil
+	}
+
+	missing := 0
+	for _, k := range keys {
+		if !ctx.exists(string(k)) {
+			missing++
+		}
+	}
+	tryAgain := resp.MakeErr("TRYAGAIN Multiple keys request during rehashing of slot")
+
+	if importing {
+		if len(keys) > 1 && missing > 0 {
+			return tryAgain
+		}
+		return nil
+	}
+	switch {
+	case missing == 0:
+		return nil
+	case missing < len(keys):
+		return tryAgain
+	}
+	return resp.MakeErr(fmt.Sprintf("ASK %d %s", slot, target.addr()))
+}
+
+// failing tells if n didn't answer for longer than the node timeout
+func (cl *clusterState) failing(n *clusterNode) bool {
+	return n != cl.myself && !n.pingSent.IsZero() && time.Since(n.pingSent) > cl.nodeTimeout
+}
+
+// slotRanges returns the ranges of slots n serves, in order
+func (cl *clusterState) slotRanges(n *clusterNode) [][2]int {
+	var ranges [][2]int
+	for slot := 0; slot < clusterSlots; slot++ {
+		if cl.slots[slot] != n {
+			continue
+		}
+		end := slot
+		for end+1 < clusterSlots && cl.slots[end+1] == n {
+			end++
+		}
+		ranges = append(ranges, [2]int{slot, end})
+		slot = end
+	}
+	return ranges
+}
+
+// masters returns the nodes serving slots, by their first slot
+func (cl *clusterState) masters() []*clusterNode {
+	var masters []*clusterNode
+	for _, n := range cl.slots {
+		if n != nil && !slices.Contains(masters, n) {
+			masters = append(masters, n)
+		}
+	}
+	return masters
+}
+
+// bumpEpoch gives myself a config epoch greater than any other, so the
+// slots it claims win over the previous owners
+func (cl *clusterState) bumpEpoch() {
+	cl.currentEpoch++
+	cl.myself.configEpoch = cl.currentEpoch
+}
+
+// nodeLine renders n the way CLUSTER NODES does
+func (cl *clusterState) nodeLine(n *clusterNode) string {
+	var b strings.Builder
+	flags := "master"
+	switch {
+	case n == cl.myself:
+		flags = "myself,master"
+	case n.handshake:
+		flags = "handshake"
+	}
+	if cl.failing(n) {
+		flags += ",fail?"
+	}
+	var pingSent, pongRecv int64
+	if !n.pingSent.IsZero() {
+		pingSent = n.pingSent.UnixMilli()
+	}
+	if !n.pongRecv.IsZero() {
+		pongRecv = n.pongRecv.UnixMilli()
+	}
+	link := "disconnected"
+	if n == cl.myself || n.conn != nil {
+		link = "connected"
+	}
+	fmt.Fprintf(&b, "%s %s:%d@%d %s - %d %d %d %s", n.id, n.host, n.port, n.port+10000,
+		flags, pingSent, pongRecv, n.configEpoch, link)
+
+	for _, r := range cl.slotRanges(n) {
+		if r[0] == r[1] {
+			fmt.Fprintf(&b, " %d", r[0])
+		} else {
+			fmt.Fprintf(&b, " %d-%d", r[0], r[1])
+		}
+	}
+	if n == cl.myself {
+		for _, slot := range slices.Sorted(maps.Keys(cl.migrating)) {
+			fmt.Fprintf(&b, " [%d->-%s]", slot, cl.migrating[slot].id)
+		}
+		for _, slot := range slices.Sorted(maps.Keys(cl.importing)) {
+			fmt.Fprintf(&b, " [%d-<-%s]", slot, cl.importing[slot].id)
+		}
+	}
+	return b.String()
+}
+
+// sortedNodes returns myself first, then the others by id
+func (cl *clusterState) sortedNodes() []*clusterNode {
+	nodes := []*clusterNode{cl.myself}
+	for _, id := range slices.Sorted(maps.Keys(cl.nodes)) {
+		if n := cl.nodes[id]; n != cl.myself {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+func (cl *clusterState) nodesText() string {
+	var b strings.Builder
+	for _, n := range cl.sortedNodes() {
+		b.WriteString(cl.nodeLine(n))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// nodeInfo is a line of CLUSTER NODES
+type nodeInfo struct {
+	id    string
+	host  string
+	port  int
+	flags []string
+	epoch int64
+	slots [][2]int
+	// slot -> node id
+	migrating map[int]string
+	importing map[int]string
+}
+
+func parseNodeLine(line string) (*nodeInfo, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 8 {
+		return nil, fmt.Errorf("bad node line %q", line)
+	}
+	addr, _, _ := strings.Cut(fields[1], "@")
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("bad node address %q", fields[1])
+	}
+	info := &nodeInfo{
+		id:        fields[0],
+		host:      host,
+		flags:     strings.Split(fields[2], ","),
+		migrating: make(map[int]string),
+		importing: make(map[int]string),
+	}
+	if info.port, err = strconv.Atoi(port); err != nil {
+		return nil, fmt.Errorf("bad node address %q", fields[1])
+	}
+	if info.epoch, err = strconv.ParseInt(fields[6], 10, 64); err != nil {
+		return nil, fmt.Errorf("bad config epoch %q", fields[6])
+	}
+
+	for _, f := range fields[8:] {
+		if strings.HasPrefix(f, "[") {
+			f = strings.Trim(f, "[]")
+			if slot, id, ok := strings.Cut(f, "->-"); ok {
+				n, err := strconv.Atoi(slot)
+				if err != nil {
+					return nil, fmt.Errorf("bad slot %q", f)
+				}
+				info.migrating[n] = id
+			} else if slot, id, ok := strings.Cut(f, "-<-"); ok {
+				n, err := strconv.Atoi(slot)
+				if err != nil {
+					return nil, fmt.Errorf("bad slot %q", f)
+				}
+				info.importing[n] = id
+			}
+			continue
+		}
+		start, end, isRange := strings.Cut(f, "-")
+		if !isRange {
+			end = start
+		}
+		r, ok := parseSlotRange([]byte(start), []byte(end))
+		if !ok {
+			return nil, fmt.Errorf("bad slot range %q", f)
+		}
+		info.slots = append(info.slots, r)
+	}
+	return info, nil
+}
+
+func (info *nodeInfo) is(flag string) bool {
+	return slices.Contains(info.flags, flag)
+}
+
+func parseSlot(raw []byte) (int, bool) {
+	slot, err := strconv.Atoi(string(raw))
+	if err != nil || slot < 0 || slot >= clusterSlots {
+		return 0, false
+	}
+	return slot, true
+}
+
+func parseSlotRange(start, end []byte) ([2]int, bool) {
+	first, ok1 := parseSlot(start)
+	last, ok2 := parseSlot(end)
+	return [2]int{first, last}, ok1 && ok2 && first <= last
+}
+
+// load restores the view saved by save
+func (cl *clusterState) load(data string) error {
+	infos := make(map[*clusterNode]*nodeInfo)
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "vars" {
+			for i := 1; i+1 < len(fields); i += 2 {
+				if fields[i] == "currentEpoch" {
+					cl.currentEpoch, _ = strconv.ParseInt(fields[i+1], 10, 64)
+				}
+			}
+			continue
+		}
+		info, err := parseNodeLine(line)
+		if err != nil {
+			return err
+		}
+		if info.is("handshake") {
+			continue
+		}
+		n := &clusterNode{id: info.id, host: info.host, port: info.port, configEpoch: info.epoch}
+		if info.is("myself") {
+			delete(cl.nodes, cl.myself.id)
+			cl.myself = n
+		}
+		cl.nodes[n.id] = n
+		infos[n] = info
+	}
+
+	for n, info := range infos {
+		for _, r := range info.slots {
+			for slot := r[0]; slot <= r[1]; slot++ {
+				cl.slots[slot] = n
+			}
+		}
+		if n != cl.myself {
+			continue
+		}
+		for slot, id := range info.migrating {
+			if target, ok := cl.nodes[id]; ok {
+				cl.migrating[slot] = target
+			}
+		}
+		for slot, id := range info.importing {
+			if source, ok := cl.nodes[id]; ok {
+				cl.importing[slot] = source
+			}
+		}
+	}
+	return nil
+}
+
+// save writes the view of the cluster to the config file, which is
+// replaced atomically
+func (cl *clusterState) save() error {
+	if cl.configFile == "" {
+		return nil
+	}
+	var b strings.Builder
+	for _, n := range cl.sortedNodes() {
+		if !n.handshake {
+			b.WriteString(cl.nodeLine(n))
+			b.WriteString("\n")
+		}
+	}
+	fmt.Fprintf(&b, "vars currentEpoch %d lastVoteEpoch 0\n", cl.currentEpoch)
+
+	tmp := cl.configFile + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cl.configFile)
+}
+
+// saveConfig saves the view after a change, a failure is only logged
+func (cl *clusterState) saveConfig() {
+	if err := cl.save(); err != nil {
+		slog.Error("failed to save the cluster config", "file", cl.configFile, "error", err)
+	}
+}
+
+// keysInSlot returns up to count keys of slot in order, all of them when
+// count is negative. Must be called with s.mu held.
+func (s *Storage) keysInSlot(slot int, count int) []string {
+	var keys []string
+	now := time.Now()
+	for _, sh := range s.dbs[0].shards {
+		for key := range sh.data {
+			if !sh.expired(key, now) && keyHashSlot([]byte(key)) == slot {
+				keys = append(keys, key)
+			}
+		}
+	}
+	slices.Sort(keys)
+	if count >= 0 && len(keys) > count {
+		keys = keys[:count]
+	}
+	return keys
+}
+
+// clusterCmd is a subcommand of CLUSTER, arity counts its name
+type clusterCmd struct {
+	arity int
+	exec  func(cl *clusterState, s *Storage, args [][]byte) resp.RespType
+}
+
+var clusterCmds map[string]clusterCmd
+
+func init() {
+	clusterCmds = map[string]clusterCmd{
+		"info":             {1, clusterInfo},
+		"myid":             {1, clusterMyID},
+		"myshardid":        {1, clusterMyID},
+		"nodes":            {1, clusterNodes},
+		"slots":            {1, clusterSlotsCmd},
+		"shards":           {1, clusterShards},
+		"keyslot":          {2, clusterKeySlot},
+		"countkeysinslot":  {2, clusterCountKeysInSlot},
+		"getkeysinslot":    {3, clusterGetKeysInSlot},
+		"addslots":         {-2, clusterAddSlots},
+		"addslotsrange":    {-3, clusterAddSlotsRange},
+		"delslots":         {-2, clusterDelSlots},
+		"delslotsrange":    {-3, clusterDelSlotsRange},
+		"setslot":          {-3, clusterSetSlot},
+		"meet":             {-3, clusterMeet},
+		"forget":           {2, clusterForget},
+		"set-config-epoch": {2, clusterSetConfigEpoch},
+		"saveconfig":       {1, clusterSaveConfig},
+		"ping":             {4, clusterPing},
+	}
+}
+
+func execCluster(db kVStore, args [][]byte) resp.RespType {
+	s := storageOf(db)
+	if s.cluster == nil {
+		return resp.MakeErr("ERR This instance has cluster support disabled")
+	}
+	name := strings.ToLower(string(args[0]))
+	sub, ok := clusterCmds[name]
+	if !ok || !validArity(sub.arity, len(args)) {
+		return resp.MakeErr("ERR unknown subcommand or wrong number of arguments for '" + string(args[0]) + "'. Try CLUSTER HELP.")
+	}
+	return sub.exec(s.cluster, s, args[1:])
+}
+
+func clusterInfo(cl *clusterState, s *Storage, args [][]byte) resp.RespType {
+	assigned, pfail := 0, 0
+	for _, n := range cl.slots {
+		if n == nil {
+			continue
+		}
+		assigned++
+		if cl.failing(n) {
+			pfail++
+		}
+	}
+	state := "ok"
+	if assigned < clusterSlots {
+		state = "fail"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "cluster_enabled:1\r\n")
+	fmt.Fprintf(&b, "cluster_state:%s\r\n", state)
+	fmt.Fprintf(&b, "cluster_slots_assigned:%d\r\n", assigned)
+	fmt.Fprintf(&b, "cluster_slots_ok:%d\r\n", assigned-pfail)
+	fmt.Fprintf(&b, "cluster_slots_pfail:%d\r\n", pfail)
+	fmt.Fprintf(&b, "cluster_slots_fail:0\r\n")
+	fmt.Fprintf(&b, "cluster_known_nodes:%d\r\n", len(cl.nodes))
+	fmt.Fprintf(&b, "cluster_size:%d\r\n", len(cl.masters()))
+	fmt.Fprintf(&b, "cluster_current_epoch:%d\r\n", cl.currentEpoch)
+	fmt.Fprintf(&b, "cluster_my_epoch:%d\r\n", cl.myself.configEpoch)
+	return &resp.BulkStr{Data: []byte(b.String())}
+}
+
+func clusterMyID(cl *clusterState, s *Storage, args [][]byte) resp.RespType {
+	return &resp.BulkStr{Data: []byte(cl.myself.id)}
+}
+
+func clusterNodes(cl *clusterState, s *Storage, args [][]byte) resp.RespType {
+	return &resp.BulkStr{Data: []byte(cl.nodesText())}
+}
+
+// clusterSlotsCmd replies with the slot ranges and the node serving each
+func clusterSlotsCmd(cl *clusterState, s *Storage, args [][]byte) resp.RespType {
+	result := &resp.Array{}
+	for _, n := range cl.masters() {
+		for _, r := range cl.slotRanges(n) {
+			node := &resp.Array{}
+			node.Append(&resp.BulkStr{Data: []byte(n.host)})
+			node.Append(&resp.Intiger{Data: int64(n.port)})
+			node.Append(&resp.BulkStr{Data: []byte(n.id)})
+			result.Append(&resp.Array{Elems: []resp.RespType{
+				&resp.Intiger{Data: int64(r[0])},
+				&resp.Intiger{Data: int64(r[1])},
+				node,
+			}})
+		}
+	}
+	return result
+}
+
+// clusterShards replies with a shard per node serving slots, nodes don't
+// have replicas
+func clusterShards(cl *clusterState, s *Storage, args [][]byte) resp.RespType {
+	bulk := func(v string) resp.RespType {
+		return &resp.BulkStr{Data: []byte(v)}
+	}
+	result := &resp.Array{}
+	for _, n := range cl.masters() {
+		slots := &resp.Array{}
+		for _, r := range cl.slotRanges(n) {
+			slots.Append(&resp.Intiger{Data: int64(r[0])})
+			slots.Append(&resp.Intiger{Data: int64(r[1])})
+		}
+		health := "online"
+		if cl.failing(n) {
+			health = "failed"
+		}
+		offset := int64(0)
+		if n == cl.myself {
+			offset = s.repl.offset
+		}
+		node := &resp.Array{Elems: []resp.RespType{
+			bulk("id"), bulk(n.id),
+			bulk("port"), &resp.Intiger{Data: int64(n.port)},
+			bulk("ip"), bulk(n.host),
+			bulk("endpoint"), bulk(n.host),
+			bulk("role"), bulk("master"),
+			bulk("replication-offset"), &resp.Intiger{Data: offset},
+			bulk("health"), bulk(health),
+		}}
+		result.Append(&resp.Array{Elems: []resp.RespType{
+			bulk("slots"), slots,
+			bulk("nodes"), &resp.Array{Elems: []resp.RespType{node}},
+		}})
+	}
+	return result
+}
+
+func clusterKeySlot(cl *clusterState, s *Storage, args [][]byte) resp.RespType {
+	return &resp.Intiger{Data: int64(keyHashSlot(args[0]))}
+}
+
+func clusterCountKeysInSlot(cl *clusterState, s *Storage, args [][]byte) resp.RespType {
+	slot, ok := parseSlot(args[0])
+	if !ok {
+		return resp.MakeErr("ERR Invalid slot")
+	}
+	return &resp.Intiger{Data: int64(len(s.keysInSlot(slot, -1)))}
+}
+
+func clusterGetKeysInSlot(cl *clusterState, s *Storage, args [][]byte) resp.RespType {
+	slot, ok := parseSlot(args[0])
+	count, err := strconv.Atoi(string(args[1]))
+	if !ok || err != nil || count < 0 {
+		return resp.MakeErr("ERR Invalid slot or number of keys")
+	}
+	result := &resp.RespBulkStrArr{}
+	for _, key := range s.keysInSlot(slot, count) {
+		result.Append([]byte(key))
+	}
+	return result
+}
+
+// parseSlots parses slots, or ranges of slots as pairs when ranges is set
+func parseSlots(args [][]byte, ranges bool) ([]int, *resp.RespErr) {
+	var slots []int
+	if !ranges {
+		for _, arg := range args {
+			slot, ok := parseSlot(arg)
+			if !ok {
+				return nil, resp.MakeErr("ERR Invalid or out of range slot")
+			}
+			slots = append(slots, slot)
+		}
+	} else {
+		if len(args)%2 != 0 {
+			return nil, resp.SyntaxErr()
+		}
+		for i := 0; i < len(args); i += 2 {
+			first, ok1 := parseSlot(args[i])
+			last, ok2 := parseSlot(args[i+1])
+			if !ok1 || !ok2 {
+				return nil, resp.MakeErr("ERR Invalid or out of range slot")
+			}
+			if first > last {
+				return nil, resp.MakeErr(fmt.Sprintf("ERR start slot number %d is greater than end slot number %d", first, last))
+			}
+			for slot := first; slot <= last; slot++ {
+				slots = append(slots, slot)
+			}
+		}
+	}
+
+	seen := make(map[int]bool, len(slots))
+	for _, slot := range slots {
+		if seen[slot] {
+			return nil, resp.MakeErr(fmt.Sprintf("ERR Slot %d specified multiple times", slot))
+		}
+		seen[slot] = true
+	}
+	return slots, nil
+}
+
+func addSlots(cl *clusterState, args [][]byte, ranges bool) resp.RespType {
+	slots, errReply := parseSlots(args, ranges)
+	if errReply != nil {
+		return errReply
+	}
+	for _, slot := range slots {
+		if cl.slots[slot] != nil {
+			return resp.MakeErr(fmt.Sprintf("ERR Slot %d is already busy", slot))
+		}
+	}
+	for _, slot := range slots {
+		cl.slots[slot] = cl.myself
+		delete(cl.importing, slot)
+	}
+	cl.saveConfig()
+	return resp.OkReply()
+}
+
+func delSlots(cl *clusterState, args [][]byte, ranges bool) resp.RespType {
+	slots, errReply := parseSlots(args, ranges)
+	if errReply != nil {
+		return errReply
+	}
+	for _, slot := range slots {
+		if cl.slots[slot] == nil {
+			return resp.MakeErr(fmt.Sprintf("ERR Slot %d is already unassigned", slot))
+		}
+	}
+	for _, slot := range slots {
+		cl.slots[slot] = nil
+		delete(cl.migrating, slot)
+		delete(cl.importing, slot)
+	}
+	cl.saveConfig()
+	return resp.OkReply()
+}
+
+func clusterAddSlots(cl *clusterState, s *Storage, args [][]byte) resp.RespType {
+	return addSlots(cl, args, false)
+}
+
+func clusterAddSlotsRange(cl *clusterState, s *Storage, args [][]byte) resp.RespType {
+	return addSlots(cl, args, true)
+}
+
+func clusterDelSlots(cl *clusterState, s *Storage, args [][]byte) resp.RespType {
+	return delSlots(cl, args, false)
+}
+
+func clusterDelSlotsRange(cl *clusterState, s *Storage, args [][]byte) resp.RespType {
+	return delSlots(cl, args, true)
+}
+
+// clusterSetSlot handles the steps of moving a slot between two nodes:
+// MIGRATING on the source and IMPORTING on the target while the keys are
+// moved, then NODE on both to hand the slot over, or STABLE to give up
+func clusterSetSlot(cl *clusterState, s *Storage, args [][]byte) resp.RespType {
+	slot, ok := parseSlot(args[0])
+	if !ok {
+		return resp.MakeErr("ERR Invalid or out of range slot")
+	}
+	action := strings.ToUpper(string(args[1]))
+
+	if action == "STABLE" && len(args) == 2 {
+		delete(cl.migrating, slot)
+		delete(cl.importing, slot)
+		cl.saveConfig()
+		return resp.OkReply()
+	}
+	if len(args) != 3 || (action != "MIGRATING" && action != "IMPORTING" && action != "NODE") {
+		return resp.MakeErr("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+	}
+	id := string(args[2])
+	n, ok := cl.nodes[id]
+	if !ok || n.handshake {
+		return resp.MakeErr("ERR I don't know about node " + id)
+	}
+
+	switch action {
+	case "MIGRATING":
+		if cl.slots[slot] != cl.myself {
+			return resp.MakeErr(fmt.Sprintf("ERR I'm not the owner of hash slot %d", slot))
+		}
+		if n == cl.myself {
+			return resp.MakeErr("ERR Can't migrate a hash slot to myself")
+		}
+		cl.migrating[slot] = n
+	case "IMPORTING":
+		if cl.slots[slot] == cl.myself {
+			return resp.MakeErr(fmt.Sprintf("ERR I'm already the owner of hash slot %d", slot))
+		}
+		if n == cl.myself {
+			return resp.MakeErr("ERR Can't import a hash slot from myself")
+		}
+		cl.importing[slot] = n
+	case "NODE":
+		if cl.slots[slot] == cl.myself && n != cl.myself && len(s.keysInSlot(slot, 1)) > 0 {
+			return resp.MakeErr(fmt.Sprintf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot))
+		}
+		delete(cl.migrating, slot)
+		if n == cl.myself {
+			// the import is over, the slot must win over its old owner
+			if _, ok := cl.importing[slot]; ok {
+				delete(cl.importing, slot)
+				cl.bumpEpoch()
+			}
+		}
+		cl.slots[slot] = n
+	}
+	cl.saveConfig()
+	return resp.OkReply()
+}
+
+// clusterMeet adds a node, its id is learned once it answers a ping
+func clusterMeet(cl *clusterState, s *Storage, args [][]byte) resp.RespType {
+	port, err := strconv.Atoi(string(args[1]))
+	if err != nil || port < 0 || port > 65535 {
+		return resp.MakeErr("ERR Invalid base port specified: " + string(args[1]))
+	}
+	if net.ParseIP(string(args[0])) == nil {
+		return resp.MakeErr("ERR Invalid node address specified: " + string(args[0]) + ":" + string(args[1]))
+	}
+	n := &clusterNode{id: newReplID(), host: string(args[0]), port: port, handshake: true}
+	for _, other := range cl.nodes {
+		if other.addr() == n.addr() {
+			return resp.OkReply()
+		}
+	}
+	cl.nodes[n.id] = n
+	return resp.OkReply()
+}
+
+func clusterForget(cl *clusterState, s *Storage, args [][]byte) resp.RespType {
+	id := string(args[0])
+	n, ok := cl.nodes[id]
+	if !ok {
+		return resp.MakeErr("ERR Unknown node " + id)
+	}
+	if n == cl.myself {
+		return resp.MakeErr("ERR I tried hard but I can't forget myself...")
+	}
+	cl.removeNode(n)
+	cl.forgotten[id] = time.Now().Add(clusterForgetTTL)
+	cl.saveConfig()
+	return resp.OkReply()
+}
+
+// removeNode forgets n along with the slots it serves
+func (cl *clusterState) removeNode(n *clusterNode) {
+	delete(cl.nodes, n.id)
+	if n.conn != nil {
+		n.conn.Close()
+	}
+	for slot, owner := range cl.slots {
+		if owner == n {
+			cl.slots[slot] = nil
+		}
+	}
+	maps.DeleteFunc(cl.migrating, func(_ int, o *clusterNode) bool { return o == n })
+	maps.DeleteFunc(cl.importing, func(_ int, o *clusterNode) bool { return o == n })
+}
+
+// clusterSetConfigEpoch sets the epoch of a new node, so the nodes of a
+// new cluster don't start with the same one
+func clusterSetConfigEpoch(cl *clusterState, s *Storage, args [][]byte) resp.RespType {
+	epoch, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil {
+		return resp.NotInErr()
+	}
+	switch {
+	case epoch < 0:
+		return resp.MakeErr(fmt.Sprintf("ERR Invalid config epoch specified: %d", epoch))
+	case len(cl.nodes) > 1:
+		return resp.MakeErr("ERR The user can assign a config epoch only when the node does not know any other node.")
+	case cl.myself.configEpoch != 0:
+		return resp.MakeErr("ERR Node config epoch is already non-zero")
+	}
+	cl.myself.configEpoch = epoch
+	cl.currentEpoch = max(cl.currentEpoch, epoch)
+	cl.saveConfig()
+	return resp.OkReply()
+}
+
+func clusterSaveConfig(cl *clusterState, s *Storage, args [][]byte) resp.RespType {
+	if err := cl.save(); err != nil {
+		return resp.MakeErr("ERR error saving the cluster node config: " + err.Error())
+	}
+	return resp.OkReply()
+}
+
+func init() {
+	registerCommand("cluster", -2, 0, execCluster)
+}
@@ -0,0 +1,260 @@
+package store
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+func TestKeyHashSlot(t *testing.T) {
+	if got := crc16([]byte("123456789")); got != 0x31c3 {
+		t.Fatalf("crc16 = %#x, want 0x31c3", got)
+	}
+
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{"foo", 12182},
+		{"bar", 5061},
+		{"{user1000}.following", keyHashSlot([]byte("user1000"))},
+		{"foo{}{bar}", keyHashSlot([]byte("foo{}{bar}"))},
+		{"foo{{bar}}zap", keyHashSlot([]byte("{bar"))},
+		{"foo{bar}{zap}", keyHashSlot([]byte("bar"))},
+	}
+	for _, test := range tests {
+		if got := keyHashSlot([]byte(test.key)); got != test.want {
+			t.Fatalf("keyHashSlot(%q) = %d, want %d", test.key, got, test.want)
+		}
+	}
+}
+
+// serveTestStorage serves the commands of s on a local port, like the
+// server does, and returns its address
+func serveTestStorage(t *testing.T, s *Storage) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for command := range resp.Parse(conn) {
+					if command.Err != nil {
+						return
+					}
+					reply, err := s.Exec(command.Args())
+					if err != nil {
+						return
+					}
+					conn.Write(reply.ToBytes())
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startTestNode serves the commands of a cluster node on a local port
+func startTestNode(t *testing.T) (*Storage, string) {
+	s := NewStorage()
+	addr := serveTestStorage(t, s)
+	_, port, _ := net.SplitHostPort(addr)
+
+	cfg := DefaultConfig()
+	cfg.ClusterConfigFile = ""
+	cfg.Port, _ = strconv.Atoi(port)
+	if err := s.startCluster(cfg); err != nil {
+		t.Fatal(err)
+	}
+	return s, addr
+}
+
+func expectErr(t *testing.T, s *Storage, want string, args ...string) {
+	t.Helper()
+	got := mustExec(t, s, args...)
+	if string(got.ToBytes()) != "-"+want+"\r\n" {
+		t.Fatalf("%v: got %q, want -%s", args, got.ToBytes(), want)
+	}
+}
+
+func TestClusterRedirect(t *testing.T) {
+	s, _ := startTestNode(t)
+	defer s.Close()
+	mustExec(t, s, "CLUSTER", "ADDSLOTSRANGE", "0", "8191")
+
+	// foo is in 12182, bar in 5061
+	expectErr(t, s, "CLUSTERDOWN Hash slot not served", "GET", "foo")
+	mustExec(t, s, "SET", "bar", "1")
+	expectErr(t, s, "CROSSSLOT Keys in request don't hash to the same slot", "DEL", "bar", "foo")
+	mustExec(t, s, "DEL", "{bar}1", "{bar}2")
+
+	s.mu.Lock()
+	other := &clusterNode{id: strings.Repeat("b", 40), host: "10.0.0.2", port: 7000}
+	s.cluster.nodes[other.id] = other
+	for slot := 8192; slot < clusterSlots; slot++ {
+		s.cluster.slots[slot] = other
+	}
+	s.mu.Unlock()
+	expectErr(t, s, "MOVED 12182 10.0.0.2:7000", "GET", "foo")
+	if got := mustExec(t, s, "CLUSTER", "COUNTKEYSINSLOT", "5061"); got.(*resp.Intiger).Data != 1 {
+		t.Fatalf("COUNTKEYSINSLOT = %d, want 1", got.(*resp.Intiger).Data)
+	}
+
+	// bar's slot is moving to the other node, only missing keys are asked there
+	mustExec(t, s, "CLUSTER", "SETSLOT", "5061", "MIGRATING", other.id)
+	mustExec(t, s, "GET", "bar")
+	expectErr(t, s, "ASK 5061 10.0.0.2:7000", "GET", "{bar}new")
+	expectErr(t, s, "TRYAGAIN Multiple keys request during rehashing of slot", "DEL", "bar", "{bar}new")
+	expectErr(t, s, "ERR Can't assign hashslot 5061 to a different node while I still hold keys for this hash slot.",
+		"CLUSTER", "SETSLOT", "5061", "NODE", other.id)
+
+	// foo's slot is coming here, it's served to clients asking for it
+	mustExec(t, s, "CLUSTER", "SETSLOT", "12182", "IMPORTING", other.id)
+	expectErr(t, s, "MOVED 12182 10.0.0.2:7000", "SET", "foo", "1")
+	if rep, _, _ := s.ExecAsking(&Session{}, toBytes("SET", "foo", "1")); string(rep.ToBytes()) != "+OK\r\n" {
+		t.Fatalf("asking: %q", rep.ToBytes())
+	}
+	// what MIGRATE sends to the target of a resharding
+	payload := string(mustExec(t, s, "DUMP", "bar").(*resp.BulkStr).Data)
+	if rep := mustExec(t, s, "RESTORE-ASKING", "{foo}2", "0", payload); string(rep.ToBytes()) != "+OK\r\n" {
+		t.Fatalf("RESTORE-ASKING: %q", rep.ToBytes())
+	}
+	mustExec(t, s, "CLUSTER", "SETSLOT", "12182", "NODE", s.cluster.myself.id)
+	if got := mustExec(t, s, "GET", "foo"); string(got.ToBytes()) != "$1\r\n1\r\n" {
+		t.Fatalf("GET foo = %q", got.ToBytes())
+	}
+	if s.cluster.myself.configEpoch != 1 {
+		t.Fatalf("taking an imported slot over must bump the epoch, got %d", s.cluster.myself.configEpoch)
+	}
+
+	// transactions are checked as a whole
+	rep, _ := s.ExecMulti(&Session{}, [][][]byte{toBytes("GET", "bar"), toBytes("GET", "foo")}, nil)
+	if !strings.HasPrefix(string(rep.ToBytes()), "-CROSSSLOT") {
+		t.Fatalf("EXEC across slots: %q", rep.ToBytes())
+	}
+}
+
+// keys are only looked up for redirections once their shards are locked,
+// next to the commands running on other shards
+func TestClusterRedirectConcurrent(t *testing.T) {
+	s, _ := startTestNode(t)
+	defer s.Close()
+	mustExec(t, s, "CLUSTER", "ADDSLOTSRANGE", "0", "16383")
+
+	run := func() {
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 200; i++ {
+					key := fmt.Sprintf("{x}k%d", i%8)
+					s.Exec(toBytes("SET", key, "v", "PX", "1"))
+					s.Exec(toBytes("GET", key))
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	run()
+
+	// while {x} migrates, missing keys are asked to the target
+	s.mu.Lock()
+	other := &clusterNode{id: strings.Repeat("b", 40), host: "10.0.0.2", port: 7000}
+	s.cluster.nodes[other.id] = other
+	s.mu.Unlock()
+	mustExec(t, s, "CLUSTER", "SETSLOT", strconv.Itoa(int(keyHashSlot([]byte("x")))), "MIGRATING", other.id)
+	run()
+}
+
+func TestClusterGossip(t *testing.T) {
+	a, addrA := startTestNode(t)
+	defer a.Close()
+	b, addrB := startTestNode(t)
+	defer b.Close()
+	mustExec(t, a, "CLUSTER", "ADDSLOTSRANGE", "0", "8191")
+	mustExec(t, b, "CLUSTER", "ADDSLOTSRANGE", "8192", "16383")
+
+	host, port, _ := net.SplitHostPort(addrB)
+	mustExec(t, a, "CLUSTER", "MEET", host, port)
+
+	converged := func(s *Storage) bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, n := range s.cluster.slots {
+			if n == nil {
+				return false
+			}
+		}
+		return len(s.cluster.nodes) == 2
+	}
+	waitFor(t, "the nodes to learn each other", func() bool { return converged(a) && converged(b) })
+
+	expectErr(t, a, fmt.Sprintf("MOVED 12182 %s", addrB), "GET", "foo")
+	expectErr(t, b, fmt.Sprintf("MOVED 5061 %s", addrA), "GET", "bar")
+
+	info := mustExec(t, a, "CLUSTER", "INFO").(*resp.BulkStr).String()
+	if !strings.Contains(info, "cluster_state:ok") || !strings.Contains(info, "cluster_known_nodes:2") {
+		t.Fatalf("unexpected CLUSTER INFO %q", info)
+	}
+
+	slots := mustExec(t, a, "CLUSTER", "SLOTS").(*resp.Array)
+	if len(slots.Elems) != 2 {
+		t.Fatalf("expected 2 slot ranges, got %q", slots.ToBytes())
+	}
+
+	// a slot handed over with a greater epoch is taken from its old owner
+	mustExec(t, b, "CLUSTER", "SETSLOT", "100", "IMPORTING", a.cluster.myself.id)
+	mustExec(t, b, "CLUSTER", "SETSLOT", "100", "NODE", b.cluster.myself.id)
+	waitFor(t, "the slot to move", func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.cluster.slots[100] != a.cluster.myself
+	})
+}
+
+func TestClusterConfig(t *testing.T) {
+	s, _ := startTestNode(t)
+	defer s.Close()
+	mustExec(t, s, "CLUSTER", "ADDSLOTS", "1", "2", "3", "10")
+
+	s.mu.Lock()
+	other := &clusterNode{id: strings.Repeat("c", 40), host: "10.0.0.3", port: 7001, configEpoch: 4}
+	s.cluster.nodes[other.id] = other
+	s.cluster.slots[20] = other
+	s.cluster.migrating[10] = other
+	s.cluster.currentEpoch = 4
+	saved := s.cluster.nodesText() + "vars currentEpoch 4 lastVoteEpoch 0\n"
+	s.mu.Unlock()
+
+	cl := &clusterState{
+		myself:    &clusterNode{id: "x"},
+		migrating: make(map[int]*clusterNode),
+		importing: make(map[int]*clusterNode),
+	}
+	cl.nodes = map[string]*clusterNode{"x": cl.myself}
+	if err := cl.load(saved); err != nil {
+		t.Fatal(err)
+	}
+	if cl.myself.id != s.cluster.myself.id || len(cl.nodes) != 2 || cl.currentEpoch != 4 {
+		t.Fatalf("loaded %d nodes, myself %s, epoch %d", len(cl.nodes), cl.myself.id, cl.currentEpoch)
+	}
+	if cl.slots[3] != cl.myself || cl.slots[20] == nil || cl.slots[20].id != other.id || cl.slots[4] != nil {
+		t.Fatalf("slots weren't restored")
+	}
+	if cl.migrating[10] == nil || cl.migrating[10].id != other.id {
+		t.Fatalf("migrating slots weren't restored")
+	}
+}
@@ -0,0 +1,291 @@
+package store
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+// Nodes talk over the client port: every second each node sends
+// CLUSTER PING to the others, which reply with their CLUSTER NODES. The
+// ping makes the receiver learn about the sender, the reply tells the
+// sender which slots the receiver serves and which nodes it knows.
+
+const (
+	clusterPingPeriod = time.Second
+	// bounds dialing a node and waiting for its answer
+	clusterLinkTimeout = 2 * time.Second
+)
+
+func (s *Storage) clusterCron() {
+	cl := s.cluster
+	defer close(cl.done)
+
+	ticker := time.NewTicker(clusterPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for id, until := range cl.forgotten {
+				if now.After(until) {
+					delete(cl.forgotten, id)
+				}
+			}
+			for _, n := range cl.nodes {
+				if n == cl.myself || n.pinging {
+					continue
+				}
+				n.pinging = true
+				// kept until the answer, the node fails once it's too old
+				if n.pingSent.IsZero() {
+					n.pingSent = now
+				}
+				cl.pings.Add(1)
+				go s.pingNode(n, n.addr(), n.conn, n.br)
+			}
+			s.mu.Unlock()
+		case <-cl.exit:
+			return
+		}
+	}
+}
+
+// pingNode pings n at addr, dialing it first when there's no link yet,
+// and merges what it answers
+func (s *Storage) pingNode(n *clusterNode, addr string, conn net.Conn, br *bufio.Reader) {
+	defer s.cluster.pings.Done()
+
+	var err error
+	if conn == nil {
+		conn, err = net.DialTimeout("tcp", addr, clusterLinkTimeout)
+		if err == nil {
+			br = bufio.NewReader(conn)
+		}
+	}
+	var nodes string
+	if err == nil {
+		nodes, err = s.sendPing(conn, br)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cl := s.cluster
+	n.pinging = false
+	if cl.nodes[n.id] != n || cl.stopped {
+		// forgotten meanwhile, or the storage is closing
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		if n.conn != nil {
+			slog.Warn("lost link with cluster node", "node", n.id, "addr", addr, "error", err)
+		}
+		n.conn, n.br = nil, nil
+		return
+	}
+
+	n.conn, n.br = conn, br
+	n.pingSent, n.pongRecv = time.Time{}, time.Now()
+	changed := false
+	if cl.announceIP == "" {
+		// the others see us at the address our links come from
+		if host, _, err := net.SplitHostPort(conn.LocalAddr().String()); err == nil && host != cl.myself.host {
+			cl.myself.host = host
+			changed = true
+		}
+	}
+	if s.mergeGossip(n, nodes) || changed {
+		cl.saveConfig()
+	}
+}
+
+// sendPing sends CLUSTER PING on a link and returns the answer
+func (s *Storage) sendPing(conn net.Conn, br *bufio.Reader) (string, error) {
+	s.mu.Lock()
+	myself := s.cluster.myself
+	host := myself.host
+	if s.cluster.announceIP == "" {
+		host, _, _ = net.SplitHostPort(conn.LocalAddr().String())
+	}
+	ping := cmdArgv("cluster", []byte("ping"), []byte(myself.id), []byte(host), []byte(strconv.Itoa(myself.port)))
+	s.mu.Unlock()
+
+	conn.SetDeadline(time.Now().Add(clusterLinkTimeout))
+	if _, err := conn.Write(encodeCommand(ping)); err != nil {
+		return "", err
+	}
+	return readBulk(br)
+}
+
+// readBulk reads a bulk string reply, error replies are returned as errors
+func readBulk(br *bufio.Reader) (string, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	switch {
+	case strings.HasPrefix(line, "-"):
+		return "", errors.New(line[1:])
+	case !strings.HasPrefix(line, "$"):
+		return "", fmt.Errorf("unexpected reply %q", line)
+	}
+	size, err := strconv.Atoi(line[1:])
+	if err != nil || size < 0 {
+		return "", fmt.Errorf("bad bulk length %q", line)
+	}
+	buf := make([]byte, size+2)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return "", err
+	}
+	return string(buf[:size]), nil
+}
+
+// mergeGossip updates the view with the CLUSTER NODES of n and tells if
+// it changed. Must be called with s.mu held.
+func (s *Storage) mergeGossip(n *clusterNode, nodes string) bool {
+	cl := s.cluster
+	changed := false
+	for _, line := range strings.Split(nodes, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		info, err := parseNodeLine(line)
+		if err != nil {
+			slog.Warn("bad gossip from cluster node", "node", n.id, "error", err)
+			return changed
+		}
+		if info.is("myself") {
+			if n = cl.identify(n, info.id); n == nil {
+				return true
+			}
+			changed = cl.mergeClaims(n, info) || changed
+			continue
+		}
+		// a node we don't know about yet
+		_, known := cl.nodes[info.id]
+		_, forgotten := cl.forgotten[info.id]
+		if known || forgotten || info.is("handshake") || info.id == cl.myself.id {
+			continue
+		}
+		cl.nodes[info.id] = &clusterNode{id: info.id, host: info.host, port: info.port, configEpoch: info.epoch}
+		changed = true
+	}
+	return changed
+}
+
+// identify records id as the id of n, which answered a ping. A node met
+// with CLUSTER MEET gets its real id here, it's dropped if it was known
+// already under it. nil is returned when n is dropped.
+func (cl *clusterState) identify(n *clusterNode, id string) *clusterNode {
+	if n.id == id {
+		return n
+	}
+	if !n.handshake || id == cl.myself.id {
+		// the node at this address changed, or it's ourselves
+		cl.removeNode(n)
+		return nil
+	}
+	delete(cl.nodes, n.id)
+	if other, ok := cl.nodes[id]; ok {
+		other.host, other.port = n.host, n.port
+		if n.conn != nil {
+			n.conn.Close()
+		}
+		return nil
+	}
+	if _, forgotten := cl.forgotten[id]; forgotten {
+		if n.conn != nil {
+			n.conn.Close()
+		}
+		return nil
+	}
+	n.id, n.handshake = id, false
+	cl.nodes[id] = n
+	slog.Info("met cluster node", "node", id, "addr", n.addr())
+	return n
+}
+
+// mergeClaims applies the slots n says it serves. It takes over the slots
+// served by nodes with a smaller config epoch, and those it no longer
+// claims are unassigned until their new owner says so.
+func (cl *clusterState) mergeClaims(n *clusterNode, info *nodeInfo) bool {
+	changed := n.configEpoch != info.epoch
+	n.configEpoch = info.epoch
+	cl.currentEpoch = max(cl.currentEpoch, info.epoch)
+
+	var claimed [clusterSlots]bool
+	for _, r := range info.slots {
+		for slot := r[0]; slot <= r[1]; slot++ {
+			claimed[slot] = true
+		}
+	}
+	for slot, owner := range cl.slots {
+		switch {
+		case claimed[slot] && owner != n && (owner == nil || cl.wins(n, owner)):
+			if owner == cl.myself {
+				slog.Info("slot taken over by another node", "slot", slot, "node", n.id)
+				delete(cl.migrating, slot)
+			}
+			cl.slots[slot] = n
+			delete(cl.importing, slot)
+			changed = true
+		case !claimed[slot] && owner == n:
+			cl.slots[slot] = nil
+			changed = true
+		}
+	}
+	return changed
+}
+
+// wins tells if a claim of n on a slot wins over the one of owner. Ties
+// are broken by the ids so every node picks the same.
+func (cl *clusterState) wins(n, owner *clusterNode) bool {
+	if n.configEpoch != owner.configEpoch {
+		return n.configEpoch > owner.configEpoch
+	}
+	return n.id < owner.id
+}
+
+// clusterPing handles the ping of another node, which is learned if it's
+// new, and replies with our view of the cluster
+func clusterPing(cl *clusterState, s *Storage, args [][]byte) resp.RespType {
+	id, host := string(args[0]), string(args[1])
+	port, err := strconv.Atoi(string(args[2]))
+	if err != nil {
+		return resp.NotInErr()
+	}
+	_, forgotten := cl.forgotten[id]
+	if id != cl.myself.id && !forgotten {
+		n, ok := cl.nodes[id]
+		switch {
+		case !ok:
+			cl.nodes[id] = &clusterNode{id: id, host: host, port: port}
+			slog.Info("met cluster node", "node", id, "addr", net.JoinHostPort(host, string(args[2])))
+			cl.saveConfig()
+		case n.host != host || n.port != port:
+			n.host, n.port = host, port
+			if n.conn != nil {
+				n.conn.Close()
+				n.conn, n.br = nil, nil
+			}
+			cl.saveConfig()
+		}
+	}
+	return &resp.BulkStr{Data: []byte(cl.nodesText())}
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"fmt"
 	"math"
 	"strconv"
 	"strings"
@@ -13,117 +14,243 @@ var cmdTable = map[string]*command{}
 
 type execCmd func(db kVStore, args [][]byte) resp.RespType
 
+type cmdFlag uint8
+
+const (
+	// the command may modify the keyspace, it's logged to the AOF
+	cmdWrite cmdFlag = 1 << iota
+	// the command only reads data
+	cmdReadOnly
+	// the command runs as if it followed ASKING, see ExecAsking
+	cmdAsking
+	// the command only frees memory, it's allowed past maxmemory
+	cmdFreesMemory
+	// the command works on more than its keys, like whole databases, it
+	// runs with nothing else running
+	cmdAlone
+)
+
 type command struct {
 	arity int
+	flags cmdFlag
 	exec  execCmd
+	// positions of the keys in the command, its name being at 0. A
+	// negative last key counts from the end. Commands whose keys depend on
+	// their arguments set getKeys instead.
+	firstKey, lastKey, keyStep int
+	getKeys                    func(cmd [][]byte) [][]byte
 }
 
-func execExpire(db kVStore, args [][]byte) resp.RespType {
-	key := string(args[0])
-	seconds, err := strconv.ParseInt(string(args[1]), 10, 64)
-	if err != nil {
-		return resp.NotInErr()
-	}
-
-	incompatibleErr := resp.MakeErr("ERR NX and XX, GT or LT options at the same time are not compatible")
+// withKeys sets where the keys of the command are
+func (c *command) withKeys(first, last, step int) *command {
+	c.firstKey, c.lastKey, c.keyStep = first, last, step
+	return c
+}
 
-	opt := ""
+func (c *command) withGetKeys(getKeys func(cmd [][]byte) [][]byte) *command {
+	c.getKeys = getKeys
+	return c
+}
 
-	for i := 2; i < len(args); i++ {
-		switch strings.ToUpper(string(args[i])) {
-		case "NX":
-			if opt != "" {
-				return incompatibleErr
-			}
-			opt = "NX"
+// keys returns the keys cmd accesses
+func (c *command) keys(cmd [][]byte) [][]byte {
+	if c.getKeys != nil {
+		return c.getKeys(cmd)
+	}
+	if c.keyStep == 0 {
+		return nil
+	}
+	last := c.lastKey
+	if last < 0 {
+		last += len(cmd)
+	}
+	var keys [][]byte
+	for i := c.firstKey; i <= last && i < len(cmd); i += c.keyStep {
+		keys = append(keys, cmd[i])
+	}
+	return keys
+}
 
-		case "XX":
-			if opt != "" {
-				return incompatibleErr
-			}
-			opt = "XX"
+func (c *command) is(flag cmdFlag) bool {
+	return c.flags&flag != 0
+}
 
-		case "GT":
-			if opt != "" {
-				return incompatibleErr
-			}
+func execExpire(db kVStore, args [][]byte) resp.RespType {
+	return expireGeneric(db, args, "EX", "expire")
+}
 
-			opt = "GT"
-		case "LT":
-			if opt != "" {
-				return incompatibleErr
-			}
+func execPExpire(db kVStore, args [][]byte) resp.RespType {
+	return expireGeneric(db, args, "PX", "pexpire")
+}
 
-			opt = "LT"
-		default:
-			return resp.SyntaxErr()
-		}
-	}
-	result := &resp.Intiger{Data: 0}
+func execExpireAt(db kVStore, args [][]byte) resp.RespType {
+	return expireGeneric(db, args, "EXAT", "expireat")
+}
 
-	_, ok := db.get(key)
+func execPExpireAt(db kVStore, args [][]byte) resp.RespType {
+	return expireGeneric(db, args, "PXAT", "pexpireat")
+}
 
-	if ok {
-		newExpiry := time.Now().Add(time.Duration(seconds) * time.Second)
-		at, expires := db.getExpiresAt(key)
+// expireGeneric runs EXPIRE and its variants, the expiry is given like
+// with the opt option of SET
+func expireGeneric(db kVStore, args [][]byte, opt string, name string) resp.RespType {
+	ms, errReply := parseExpire(args[1], opt, name, false)
+	if errReply != nil {
+		return errReply
+	}
+	cond, errReply := parseExpireCond(args[2:])
+	if errReply != nil {
+		return errReply
+	}
+	return expireAt(db, string(args[0]), time.UnixMilli(ms), cond)
+}
 
-		if opt == "" {
-			db.expire(key, newExpiry)
-			result.Data = 1
-		}
+// expireUnits tells for each option giving an expiry its unit and if
+// it's a unix time rather than a TTL
+var expireUnits = map[string]struct {
+	unit time.Duration
+	abs  bool
+}{
+	"EX":   {time.Second, false},
+	"PX":   {time.Millisecond, false},
+	"EXAT": {time.Second, true},
+	"PXAT": {time.Millisecond, true},
+}
 
-		if opt == "NX" && !expires {
-			db.expire(key, newExpiry)
-			result.Data = 1
-		}
+// parseExpire parses an expiry given like with opt, one of expireUnits,
+// and returns it as a unix time in milliseconds. Unless positive is set
+// it may be in the past, the commands setting it delete the key then.
+func parseExpire(raw []byte, opt string, name string, positive bool) (int64, *resp.RespErr) {
+	n, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil {
+		return 0, resp.NotInErr()
+	}
+	invalidErr := resp.MakeErr(fmt.Sprintf("ERR invalid expire time in '%s' command", name))
+	if positive && n <= 0 {
+		return 0, invalidErr
+	}
 
-		if opt == "XX" && expires {
-			db.expire(key, newExpiry)
-			result.Data = 1
+	u := expireUnits[opt]
+	if u.unit == time.Second {
+		if n > math.MaxInt64/1000 || n < math.MinInt64/1000 {
+			return 0, invalidErr
 		}
-
-		if opt == "GT" && (newExpiry.Sub(at).Milliseconds() > 0) {
-			db.expire(key, newExpiry)
-			result.Data = 1
+		n *= 1000
+	}
+	if !u.abs {
+		now := time.Now().UnixMilli()
+		if n > math.MaxInt64-now {
+			return 0, invalidErr
 		}
+		n += now
+	}
+	return n, nil
+}
 
-		if opt == "LT" && (newExpiry.Sub(at).Milliseconds() < 0) {
-			db.expire(key, newExpiry)
-			result.Data = 1
+// parseExpireCond parses the NX/XX/GT/LT options of EXPIRE and its
+// variants, at most one of them
+func parseExpireCond(args [][]byte) (string, *resp.RespErr) {
+	cond := ""
+	for _, arg := range args {
+		opt := strings.ToUpper(string(arg))
+		switch opt {
+		case "NX", "XX", "GT", "LT":
+			if cond != "" {
+				return "", resp.MakeErr("ERR NX and XX, GT or LT options at the same time are not compatible")
+			}
+			cond = opt
+		default:
+			return "", resp.SyntaxErr()
 		}
+	}
+	return cond, nil
+}
 
-		return result
+// expireAt sets the expiry of key to newExpiry if cond allows it. A key
+// without a TTL counts as never expiring for GT and LT. A newExpiry in
+// the past deletes the key. It's logged as PEXPIREAT so a replay doesn't
+// extend the TTL.
+func expireAt(db kVStore, key string, newExpiry time.Time, cond string) resp.RespType {
+	if _, ok := db.get(key); !ok {
+		db.propagate()
+		return &resp.Intiger{Data: 0}
+	}
+
+	at, volatile := db.getExpiresAt(key)
+	ok := true
+	switch cond {
+	case "NX":
+		ok = !volatile
+	case "XX":
+		ok = volatile
+	case "GT":
+		ok = volatile && newExpiry.UnixMilli() > at.UnixMilli()
+	case "LT":
+		ok = !volatile || newExpiry.UnixMilli() < at.UnixMilli()
+	}
+	if !ok {
+		db.propagate()
+		return &resp.Intiger{Data: 0}
 	}
 
-	return &resp.Intiger{
-		Data: 0,
+	if !newExpiry.After(time.Now()) {
+		db.remove(key)
+		db.propagate(cmdArgv("del", []byte(key)))
+		return &resp.Intiger{Data: 1}
 	}
+	db.expire(key, newExpiry)
+	db.propagate(cmdArgv("pexpireat", []byte(key), []byte(strconv.FormatInt(newExpiry.UnixMilli(), 10))))
+	return &resp.Intiger{Data: 1}
 }
 
-func execDecrBy(db kVStore, args [][]byte) resp.RespType {
-	key := string(args[0])
+func execExpireTime(db kVStore, args [][]byte) resp.RespType {
+	return expireTime(db, string(args[0]), time.Second)
+}
 
-	rawDelta := string(args[1])
-	delta, err := strconv.ParseInt(rawDelta, 10, 64)
-	delta = -delta
-	if err != nil {
-		return resp.NotInErr()
-	}
+func execPExpireTime(db kVStore, args [][]byte) resp.RespType {
+	return expireTime(db, string(args[0]), time.Millisecond)
+}
 
-	d, ok := db.get(key)
+// expireTime returns the unix time key expires at in unit, -1 when it
+// has no TTL and -2 when it doesn't exist
+func expireTime(db kVStore, key string, unit time.Duration) resp.RespType {
+	if _, ok := db.get(key); !ok {
+		return &resp.Intiger{Data: -2}
+	}
+	at, ok := db.getExpiresAt(key)
 	if !ok {
+		return &resp.Intiger{Data: -1}
+	}
+	if unit == time.Second {
+		return &resp.Intiger{Data: at.Unix()}
+	}
+	return &resp.Intiger{Data: at.UnixMilli()}
+}
+
+// incrBy adds delta to the integer stored at key, a missing key counts as 0
+func incrBy(db kVStore, key string, delta int64) resp.RespType {
+	d, errReply := lookupTyped(db, key, typeString)
+	if errReply != nil {
+		return errReply
+	}
+
+	if d == nil {
 		db.put(key, &dataEntity{
-			val: args[1],
+			typ: typeString,
+			val: []byte(strconv.FormatInt(delta, 10)),
 		})
 		return &resp.Intiger{Data: delta}
 	}
 
-	// TODO: caution with type cast, as new types (lists, hashes) might be introduced
 	intVal, err := strconv.ParseInt(string(d.val.([]byte)), 10, 64)
 	if err != nil {
 		return resp.NotInErr()
 	}
 
+	if (delta > 0 && intVal > math.MaxInt64-delta) || (delta < 0 && intVal < math.MinInt64-delta) {
+		return resp.MakeErr("ERR increment or decrement would overflow")
+	}
+
 	intVal += delta
 
 	d.val = []byte(strconv.FormatInt(intVal, 10))
@@ -132,35 +259,20 @@ func execDecrBy(db kVStore, args [][]byte) resp.RespType {
 	}
 }
 
-func execIncrBy(db kVStore, args [][]byte) resp.RespType {
-	key := string(args[0])
-
-	rawDelta := string(args[1])
-	delta, err := strconv.ParseInt(rawDelta, 10, 64)
-	if err != nil {
+func execDecrBy(db kVStore, args [][]byte) resp.RespType {
+	delta, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil || delta == math.MinInt64 {
 		return resp.NotInErr()
 	}
+	return incrBy(db, string(args[0]), -delta)
+}
 
-	d, ok := db.get(key)
-	if !ok {
-		db.put(key, &dataEntity{
-			val: args[1],
-		})
-		return &resp.Intiger{Data: delta}
-	}
-
-	// TODO: caution with type cast, as new types (lists, hashes) might be introduced
-	intVal, err := strconv.ParseInt(string(d.val.([]byte)), 10, 64)
+func execIncrBy(db kVStore, args [][]byte) resp.RespType {
+	delta, err := strconv.ParseInt(string(args[1]), 10, 64)
 	if err != nil {
 		return resp.NotInErr()
 	}
-
-	intVal += delta
-
-	d.val = []byte(strconv.FormatInt(intVal, 10))
-	return &resp.Intiger{
-		Data: intVal,
-	}
+	return incrBy(db, string(args[0]), delta)
 }
 
 func execPtl(db kVStore, args [][]byte) resp.RespType {
@@ -227,51 +339,11 @@ func execTtl(db kVStore, args [][]byte) resp.RespType {
 }
 
 func execDecr(db kVStore, args [][]byte) resp.RespType {
-	key := string(args[0])
-	d, ok := db.get(key)
-	if !ok {
-		db.put(key, &dataEntity{
-			val: []byte("-1"),
-		})
-		return &resp.Intiger{Data: -1}
-	}
-
-	// TODO: caution with type cast, as new types (lists, hashes) might be introduced
-	intVal, err := strconv.ParseInt(string(d.val.([]byte)), 10, 64)
-	if err != nil {
-		return resp.NotInErr()
-	}
-
-	intVal--
-
-	d.val = []byte(strconv.FormatInt(intVal, 10))
-	return &resp.Intiger{
-		Data: intVal,
-	}
+	return incrBy(db, string(args[0]), -1)
 }
 
 func execIncr(db kVStore, args [][]byte) resp.RespType {
-	key := string(args[0])
-	d, ok := db.get(key)
-	if !ok {
-		db.put(key, &dataEntity{
-			val: []byte("1"),
-		})
-		return &resp.Intiger{Data: 1}
-	}
-
-	// TODO: caution with type cast, as new types (lists, hashes) might be introduced
-	intVal, err := strconv.ParseInt(string(d.val.([]byte)), 10, 64)
-	if err != nil {
-		return resp.NotInErr()
-	}
-
-	intVal++
-
-	d.val = []byte(strconv.FormatInt(intVal, 10))
-	return &resp.Intiger{
-		Data: intVal,
-	}
+	return incrBy(db, string(args[0]), 1)
 }
 
 func execPing(db kVStore, args[][]byte) resp.RespType {
@@ -293,13 +365,16 @@ func execPing(db kVStore, args[][]byte) resp.RespType {
 
 func execGet(db kVStore, args [][]byte) resp.RespType {
 	key := string(args[0])
-	data, ok := db.get(key)
-	if !ok {
+	data, errReply := lookupTyped(db, key, typeString)
+	if errReply != nil {
+		return errReply
+	}
+	if data == nil {
 		return &resp.BulkStr{Data: nil}
 	}
 	payload := data.val.([]byte)
 	return &resp.BulkStr{
-		Data: payload,
+		Data: stringReply(data, payload),
 	}
 }
 
@@ -308,70 +383,62 @@ func execSet(db kVStore, args [][]byte) resp.RespType {
 	key, val := string(args[0]), args[1]
 
 	insertOpt := ""
-	// ms
-	var ttl int64 = 0
-
-	if len(args) > 2 {
-		for i := 2; i < len(args); i++ {
-
-			switch strings.ToUpper(string(args[i])) {
-			case "XX":
-				if insertOpt == "NX" {
-					return resp.IncompOptionsErr("PX", "XX")
-				}
-				insertOpt = "XX"
-			case "NX":
-				if insertOpt == "XX" {
-					return resp.IncompOptionsErr("XX", "PX")
-				}
-				insertOpt = "NX"
-			case "PX":
-				if ttl > 0 {
-					return resp.SyntaxErr()
-				}
-
-				if i+1 >= len(args) {
-					return resp.SyntaxErr()
-				}
-
-				ttlVal, err := strconv.ParseInt(string(args[i+1]), 10, 64)
-
-				if err != nil {
-					return resp.SyntaxErr()
-				}
-
-				if ttlVal <= 0 {
-					return resp.MakeErr("ERR invalid expire time in set")
-				}
-				ttl = ttlVal
-				i++
-			case "EX":
-				if ttl > 0 {
-					return resp.SyntaxErr()
-				}
-
-				if i+1 >= len(args) {
-					return resp.SyntaxErr()
-				}
-
-				ttlVal, err := strconv.ParseInt(string(args[i+1]), 10, 64)
-
-				if err != nil {
-					return resp.SyntaxErr()
-				}
-
-				if ttlVal <= 0 {
-					return resp.MakeErr("ERR invalid expire time in set")
-				}
-				ttl = ttlVal * 1000
-				i++
-			default:
+	// EX, PX, EXAT, PXAT or KEEPTTL
+	expireOpt := ""
+	// unix time in ms
+	var expiresAt int64
+	get := false
+
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		switch opt {
+		case "XX", "NX":
+			if insertOpt != "" && insertOpt != opt {
+				return resp.IncompOptionsErr("XX", "NX")
+			}
+			insertOpt = opt
+		case "GET":
+			get = true
+		case "KEEPTTL":
+			if expireOpt != "" {
 				return resp.SyntaxErr()
 			}
+			expireOpt = opt
+		case "EX", "PX", "EXAT", "PXAT":
+			if expireOpt != "" || i+1 >= len(args) {
+				return resp.SyntaxErr()
+			}
+			ms, errReply := parseExpire(args[i+1], opt, "set", true)
+			if errReply != nil {
+				return errReply
+			}
+			expireOpt, expiresAt = opt, ms
+			i++
+		default:
+			return resp.SyntaxErr()
 		}
 	}
+	return setGeneric(db, key, val, insertOpt, expireOpt, expiresAt, get)
+}
+
+// setGeneric stores val at key with the options of SET already parsed,
+// expiresAt being the unix time in ms of the EX, PX, EXAT or PXAT ones
+func setGeneric(db kVStore, key string, val []byte, insertOpt, expireOpt string, expiresAt int64, get bool) resp.RespType {
+	// the reply of GET, the old value
+	var old resp.RespType = &resp.BulkStr{Data: nil}
+	if get {
+		d, errReply := lookupTyped(db, key, typeString)
+		if errReply != nil {
+			return errReply
+		}
+		if d != nil {
+			old = &resp.BulkStr{Data: stringReply(d, d.val.([]byte))}
+		}
+	}
+
 	result := 0
 	entity := &dataEntity{
+		typ: typeString,
 		val: val,
 	}
 
@@ -383,18 +450,89 @@ func execSet(db kVStore, args [][]byte) resp.RespType {
 		result = db.putIfAbsent(key, entity)
 	}
 
-	if result > 0 {
-		if ttl > 0 {
-			expiresAt := time.Now().Add(time.Millisecond * time.Duration(ttl))
-			db.expire(key, expiresAt)
+	if result == 0 {
+		if get {
+			return old
 		}
+		return &resp.BulkStr{
+			Data: nil,
+		}
+	}
 
-		return resp.OkReply()
+	switch expireOpt {
+	case "":
+		db.persist(key)
+	case "KEEPTTL":
+	default:
+		db.expire(key, time.UnixMilli(expiresAt))
+		db.propagate(
+			cmdArgv("set", []byte(key), val),
+			cmdArgv("pexpireat", []byte(key), []byte(strconv.FormatInt(expiresAt, 10))),
+		)
 	}
+	if get {
+		return old
+	}
+	return resp.OkReply()
+}
 
-	return &resp.BulkStr{
-		Data: nil,
+// execGetEx returns the value of key like GET and sets or removes its TTL
+// with the options of SET
+func execGetEx(db kVStore, args [][]byte) resp.RespType {
+	key := string(args[0])
+	// EX, PX, EXAT, PXAT or PERSIST
+	expireOpt := ""
+	var expiresAt int64
+	for i := 1; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		switch opt {
+		case "PERSIST":
+			if expireOpt != "" {
+				return resp.SyntaxErr()
+			}
+			expireOpt = opt
+		case "EX", "PX", "EXAT", "PXAT":
+			if expireOpt != "" || i+1 >= len(args) {
+				return resp.SyntaxErr()
+			}
+			ms, errReply := parseExpire(args[i+1], opt, "getex", true)
+			if errReply != nil {
+				return errReply
+			}
+			expireOpt, expiresAt = opt, ms
+			i++
+		default:
+			return resp.SyntaxErr()
+		}
 	}
+
+	d, errReply := lookupTyped(db, key, typeString)
+	if errReply != nil {
+		return errReply
+	}
+	if d == nil {
+		db.propagate()
+		return &resp.BulkStr{Data: nil}
+	}
+
+	switch expireOpt {
+	case "":
+		db.propagate()
+	case "PERSIST":
+		if db.persist(key) == 1 {
+			db.propagate(cmdArgv("persist", []byte(key)))
+		} else {
+			db.propagate()
+		}
+	default:
+		expireAt(db, key, time.UnixMilli(expiresAt), "")
+	}
+	return &resp.BulkStr{Data: stringReply(d, d.val.([]byte))}
+}
+
+// cmdArgv builds a command to propagate
+func cmdArgv(name string, args ...[]byte) [][]byte {
+	return append([][]byte{[]byte(name)}, args...)
 }
 
 func validArity(arity int, actual int) bool {
@@ -411,27 +549,38 @@ func abs(x int) int {
 	return x
 }
 
-func registerCommand(name string, arity int, exec execCmd) *command {
+func registerCommand(name string, arity int, flags cmdFlag, exec execCmd) *command {
 	c := &command{
 		arity: arity,
+		flags: flags,
 		exec:  exec,
 	}
+	// most data commands take a single key first, the others say otherwise
+	if flags != 0 {
+		c.withKeys(1, 1, 1)
+	}
 
 	cmdTable[name] = c
 	return c
 }
 
 func init() {
-	registerCommand("set", -3, execSet)
-	registerCommand("get", 2, execGet)
-	registerCommand("ttl", 2, execTtl)
-	registerCommand("pttl", 2, execPtl)
-	registerCommand("del", -2, execDel)
-	registerCommand("persist", 2, execPersist)
-	registerCommand("incr", 2, execIncr)
-	registerCommand("decr", 2, execDecr)
-	registerCommand("incrby", 3, execIncrBy)
-	registerCommand("decrby", 3, execDecrBy)
-	registerCommand("expire", -3, execExpire)
-	registerCommand("ping", -1, execPing)
+	registerCommand("set", -3, cmdWrite, execSet)
+	registerCommand("get", 2, cmdReadOnly, execGet)
+	registerCommand("ttl", 2, cmdReadOnly, execTtl)
+	registerCommand("pttl", 2, cmdReadOnly, execPtl)
+	registerCommand("del", -2, cmdWrite|cmdFreesMemory, execDel).withKeys(1, -1, 1)
+	registerCommand("persist", 2, cmdWrite|cmdFreesMemory, execPersist)
+	registerCommand("incr", 2, cmdWrite, execIncr)
+	registerCommand("decr", 2, cmdWrite, execDecr)
+	registerCommand("incrby", 3, cmdWrite, execIncrBy)
+	registerCommand("decrby", 3, cmdWrite, execDecrBy)
+	registerCommand("expire", -3, cmdWrite, execExpire)
+	registerCommand("pexpire", -3, cmdWrite, execPExpire)
+	registerCommand("expireat", -3, cmdWrite, execExpireAt)
+	registerCommand("pexpireat", -3, cmdWrite, execPExpireAt)
+	registerCommand("expiretime", 2, cmdReadOnly, execExpireTime)
+	registerCommand("pexpiretime", 2, cmdReadOnly, execPExpireTime)
+	registerCommand("getex", -2, cmdWrite, execGetEx)
+	registerCommand("ping", -1, cmdReadOnly, execPing).withKeys(0, 0, 0)
 }
@@ -548,3 +548,182 @@ func TestExpire(t *testing.T) {
 		}
 	}
 }
+
+func TestExpireVariants(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+	mustExec(t, s, "SET", "key", "v")
+	mustExec(t, s, "SET", "plain", "v")
+	mustExec(t, s, "SET", "gone", "v")
+	future := time.Now().Add(time.Hour)
+
+	tests := []suite{
+		{"GT on a key without TTL", &resp.Intiger{Data: 0}, toBytes("PEXPIRE", "key", "100000", "GT")},
+		{"LT on a key without TTL", &resp.Intiger{Data: 1}, toBytes("PEXPIRE", "key", "100000", "LT")},
+		{"GT", &resp.Intiger{Data: 1}, toBytes("EXPIREAT", "key", strconv.FormatInt(future.Unix(), 10), "GT")},
+		{"LT with a later time", &resp.Intiger{Data: 0}, toBytes("PEXPIREAT", "key", strconv.FormatInt(future.UnixMilli()+1000, 10), "LT")},
+		{"EXPIRETIME", &resp.Intiger{Data: future.Unix()}, toBytes("EXPIRETIME", "key")},
+		{"PEXPIRETIME", &resp.Intiger{Data: future.Unix() * 1000}, toBytes("PEXPIRETIME", "key")},
+		{"EXPIRETIME without TTL", &resp.Intiger{Data: -1}, toBytes("EXPIRETIME", "plain")},
+		{"PEXPIRETIME of a missing key", &resp.Intiger{Data: -2}, toBytes("PEXPIRETIME", "missing")},
+		{"NX and GT", resp.MakeErr("ERR NX and XX, GT or LT options at the same time are not compatible"), toBytes("PEXPIRE", "key", "10", "NX", "GT")},
+		{"unknown option", resp.SyntaxErr(), toBytes("EXPIREAT", "key", "10", "EQ")},
+		{"not an integer", resp.NotInErr(), toBytes("PEXPIRE", "key", "1.5")},
+		{"overflow", resp.MakeErr("ERR invalid expire time in 'expire' command"), toBytes("EXPIRE", "key", "9223372036854775807")},
+		{"in the past", &resp.Intiger{Data: 1}, toBytes("EXPIREAT", "gone", "1")},
+		{"deletes the key", &resp.Intiger{Data: 0}, toBytes("EXISTS", "gone")},
+	}
+	for _, test := range tests {
+		rep, _ := s.Exec(test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+	mustExec(t, s, "SET", "key", "v1", "EX", "100")
+	mustExec(t, s, "RPUSH", "list", "a")
+	at := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+
+	tests := []suite{
+		{"KEEPTTL", resp.OkReply(), toBytes("SET", "key", "v2", "KEEPTTL")},
+		{"TTL kept", &resp.Intiger{Data: 100}, toBytes("TTL", "key")},
+		{"GET", &resp.BulkStr{Data: []byte("v2")}, toBytes("SET", "key", "v3", "GET")},
+		{"SET drops the TTL", &resp.Intiger{Data: -1}, toBytes("TTL", "key")},
+		{"GET on a missing key", &resp.BulkStr{Data: nil}, toBytes("SET", "new", "v", "GET", "PXAT", at)},
+		{"PXAT", &resp.Intiger{Data: 3600}, toBytes("TTL", "new")},
+		{"NX GET on an existing key", &resp.BulkStr{Data: []byte("v3")}, toBytes("SET", "key", "v4", "NX", "GET")},
+		{"NX GET did not set", &resp.BulkStr{Data: []byte("v3")}, toBytes("GET", "key")},
+		{"GET on another type", resp.WrongTypeErr(), toBytes("SET", "list", "v", "GET")},
+		{"EXAT and KEEPTTL", resp.SyntaxErr(), toBytes("SET", "key", "v", "EXAT", "10", "KEEPTTL")},
+		{"NX and XX", resp.IncompOptionsErr("XX", "NX"), toBytes("SET", "key", "v", "NX", "XX")},
+		{"EXAT zero", resp.MakeErr("ERR invalid expire time in 'set' command"), toBytes("SET", "key", "v", "EXAT", "0")},
+	}
+	for _, test := range tests {
+		rep, _ := s.Exec(test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+}
+
+func TestGetEx(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+	mustExec(t, s, "SET", "key", "v")
+	mustExec(t, s, "RPUSH", "list", "a")
+
+	tests := []suite{
+		{"GETEX", &resp.BulkStr{Data: []byte("v")}, toBytes("GETEX", "key")},
+		{"no TTL", &resp.Intiger{Data: -1}, toBytes("TTL", "key")},
+		{"EX", &resp.BulkStr{Data: []byte("v")}, toBytes("GETEX", "key", "EX", "100")},
+		{"TTL set", &resp.Intiger{Data: 100}, toBytes("TTL", "key")},
+		{"PERSIST", &resp.BulkStr{Data: []byte("v")}, toBytes("GETEX", "key", "PERSIST")},
+		{"TTL removed", &resp.Intiger{Data: -1}, toBytes("TTL", "key")},
+		{"missing key", &resp.BulkStr{Data: nil}, toBytes("GETEX", "missing", "PX", "100")},
+		{"another type", resp.WrongTypeErr(), toBytes("GETEX", "list")},
+		{"EX and PERSIST", resp.SyntaxErr(), toBytes("GETEX", "key", "EX", "10", "PERSIST")},
+		{"negative", resp.MakeErr("ERR invalid expire time in 'getex' command"), toBytes("GETEX", "key", "PX", "-1")},
+		{"PXAT in the past", &resp.BulkStr{Data: []byte("v")}, toBytes("GETEX", "key", "PXAT", "1")},
+		{"deletes the key", &resp.BulkStr{Data: nil}, toBytes("GET", "key")},
+	}
+	for _, test := range tests {
+		rep, _ := s.Exec(test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+}
+
+func TestExecWrongType(t *testing.T) {
+	db := NewStorage()
+	defer db.Close()
+
+	db.Exec(toBytes("SET", "str", "1"))
+	db.Exec(toBytes("RPUSH", "list", "a"))
+	db.Exec(toBytes("HSET", "hash", "f", "v"))
+	db.Exec(toBytes("SADD", "set", "a"))
+	db.Exec(toBytes("ZADD", "zset", "1", "a"))
+
+	tests := []suite{
+		{name: "GET on list", raw: toBytes("GET", "list")},
+		{name: "INCR on hash", raw: toBytes("INCR", "hash")},
+		{name: "DECR on set", raw: toBytes("DECR", "set")},
+		{name: "INCRBY on zset", raw: toBytes("INCRBY", "zset", "5")},
+		{name: "DECRBY on list", raw: toBytes("DECRBY", "list", "5")},
+		{name: "LPUSH on string", raw: toBytes("LPUSH", "str", "a")},
+		{name: "LRANGE on hash", raw: toBytes("LRANGE", "hash", "0", "-1")},
+		{name: "LMOVE to set", raw: toBytes("LMOVE", "list", "set", "LEFT", "LEFT")},
+		{name: "HSET on list", raw: toBytes("HSET", "list", "f", "v")},
+		{name: "HGETALL on zset", raw: toBytes("HGETALL", "zset")},
+		{name: "SADD on hash", raw: toBytes("SADD", "hash", "a")},
+		{name: "SUNION with string", raw: toBytes("SUNION", "set", "str")},
+		{name: "ZADD on set", raw: toBytes("ZADD", "set", "1", "a")},
+		{name: "ZRANGE on list", raw: toBytes("ZRANGE", "list", "0", "-1")},
+		{name: "ZUNIONSTORE with hash", raw: toBytes("ZUNIONSTORE", "dst", "2", "zset", "hash")},
+	}
+
+	for _, test := range tests {
+		rep, err := db.Exec(test.raw)
+		if err != nil {
+			t.Fatalf("%s. unexpected error: %v", test.name, err)
+		}
+		if !slices.Equal(rep.ToBytes(), resp.WrongTypeErr().ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want WRONGTYPE", test.name, string(rep.ToBytes()))
+		}
+	}
+
+	// values must be left untouched by the rejected commands
+	rep, _ := db.Exec(toBytes("GET", "str"))
+	if !slices.Equal(rep.ToBytes(), (&resp.BulkStr{Data: []byte("1")}).ToBytes()) {
+		t.Fatalf("string value changed, got '%q'", string(rep.ToBytes()))
+	}
+}
+
+func TestEntityEncoding(t *testing.T) {
+	s := newSet()
+	s.add([]byte("1"))
+
+	tests := []struct {
+		entity *dataEntity
+		typ    string
+		enc    string
+	}{
+		{&dataEntity{typ: typeString, val: []byte("12")}, "string", "int"},
+		{&dataEntity{typ: typeString, val: []byte("012")}, "string", "raw"},
+		{&dataEntity{typ: typeList, val: newQuicklist()}, "list", "quicklist"},
+		{&dataEntity{typ: typeHash, val: newHash()}, "hash", "hashtable"},
+		{&dataEntity{typ: typeSet, val: s}, "set", "intset"},
+		{&dataEntity{typ: typeZset, val: newZset()}, "zset", "skiplist"},
+	}
+
+	for _, test := range tests {
+		if test.entity.typ.String() != test.typ || test.entity.encoding().String() != test.enc {
+			t.Fatalf("expected %s/%s, got %s/%s", test.typ, test.enc, test.entity.typ, test.entity.encoding())
+		}
+	}
+}
+
+func TestExecIncrOverflow(t *testing.T) {
+	testDb.mu.Lock()
+	defer testDb.mu.Unlock()
+
+	key := utils.RandString(defaultKeyLength)
+	testDb.put(key, &dataEntity{val: []byte("9223372036854775807")})
+
+	rep := execIncr(testDb, toBytes(key))
+	exp := resp.MakeErr("ERR increment or decrement would overflow")
+	if !slices.Equal(rep.ToBytes(), exp.ToBytes()) {
+		t.Fatalf("Response did not match. got '%q', want '%q'", string(rep.ToBytes()), string(exp.ToBytes()))
+	}
+
+	doesNotExist := utils.RandString(defaultKeyLength)
+	execDecrBy(testDb, toBytes(doesNotExist, "67"))
+	d, _ := testDb.get(doesNotExist)
+	if string(d.val.([]byte)) != "-67" {
+		t.Fatalf("DECRBY on a non-existent key stored %q, want \"-67\"", d.val)
+	}
+}
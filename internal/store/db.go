@@ -0,0 +1,291 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+// The keyspace is made of numbered databases, a connection picks the one
+// its commands run on with SELECT. They only share what's global to the
+// storage: maxmemory counts the keys of all of them, and the AOF and the
+// replication stream log the writes of all of them, with a SELECT in
+// between whenever the database changes. Watches and blocked commands are
+// on a key of a database, a dbKey.
+
+type database struct {
+	s      *Storage
+	id     int
+	shards []*shard
+	// approximate bytes used by the keys of the database, they're part of
+	// s.used as well
+	used atomic.Int64
+}
+
+func newDatabases(s *Storage, n int) []*database {
+	dbs := make([]*database, n)
+	for i := range dbs {
+		dbs[i] = &database{s: s, id: i, shards: newShards()}
+	}
+	return dbs
+}
+
+type dbKey struct {
+	db  int
+	key string
+}
+
+// Session is what the storage keeps for a connection between commands:
+// the database it selected. The zero value is on database 0.
+type Session struct {
+	db int
+}
+
+func (db *database) shardOf(key string) *shard {
+	return db.shards[shardIndex(key)]
+}
+
+// size returns the number of keys, expired ones included. Must be called
+// with s.mu held for writing.
+func (db *database) size() int {
+	n := 0
+	for _, sh := range db.shards {
+		n += len(sh.data)
+	}
+	return n
+}
+
+func (db *database) addUsed(n int64) {
+	db.used.Add(n)
+	db.s.used.Add(n)
+}
+
+// flush deletes every key of the database. The shards are replaced rather
+// than emptied, the garbage collector frees the old ones in the
+// background.
+func (db *database) flush() {
+	db.s.signalDBs(db.id)
+	db.shards = newShards()
+	db.s.used.Add(-db.used.Swap(0))
+}
+
+// selectedDB returns the database the command runs on, the executors
+// called on the storage directly run on database 0
+func selectedDB(db kVStore) *database {
+	if ctx, ok := db.(*callCtx); ok {
+		return ctx.db
+	}
+	return db.(*Storage).dbs[0]
+}
+
+// dbSize returns the number of keys of every database, expired ones
+// included. Must be called with s.mu held for writing.
+func (s *Storage) dbSize() int {
+	n := 0
+	for _, db := range s.dbs {
+		n += db.size()
+	}
+	return n
+}
+
+// signalDBs flags the clients watching the keys of the databases ids and
+// wakes up the commands blocked on them, for the keys that exist. Used
+// when whole databases change at once. Must be called with s.mu held for
+// writing.
+func (s *Storage) signalDBs(ids ...int) {
+	var keys []dbKey
+	for k := range s.watched {
+		keys = append(keys, k)
+	}
+	for k := range s.blocked {
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		for _, id := range ids {
+			if k.db == id && s.dbs[id].exists(k.key) {
+				s.signalModified(k.db, k.key)
+			}
+		}
+	}
+}
+
+// withSelect returns cmds, run on db, preceded by a SELECT if the
+// commands logged before them ran on another database. Must be called
+// with the log held, see ctx.call.
+func (s *Storage) withSelect(db int, cmds [][][]byte) [][][]byte {
+	if db == s.logDB {
+		return cmds
+	}
+	s.logDB = db
+	sel := cmdArgv("select", []byte(strconv.Itoa(db)))
+	return append([][][]byte{sel}, cmds...)
+}
+
+// parseDB parses the index of a database
+func (s *Storage) parseDB(raw []byte) (int, *resp.RespErr) {
+	n, err := strconv.Atoi(string(raw))
+	if err != nil {
+		return 0, resp.NotInErr()
+	}
+	if n < 0 || n >= len(s.dbs) {
+		return 0, resp.MakeErr("ERR DB index is out of range")
+	}
+	return n, nil
+}
+
+func execSelect(db kVStore, args [][]byte) resp.RespType {
+	ctx := db.(*callCtx)
+	n, errReply := ctx.s.parseDB(args[0])
+	if errReply != nil {
+		return errReply
+	}
+	if ctx.s.cluster != nil && n != 0 {
+		return resp.MakeErr("ERR SELECT is not allowed in cluster mode")
+	}
+	ctx.db = ctx.s.dbs[n]
+	return resp.OkReply()
+}
+
+// execMove moves key to another database along with its TTL, unless the
+// key already exists there
+func execMove(db kVStore, args [][]byte) resp.RespType {
+	src := selectedDB(db)
+	s := src.s
+	if s.cluster != nil {
+		return resp.MakeErr("ERR MOVE is not allowed in cluster mode")
+	}
+	n, errReply := s.parseDB(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	if n == src.id {
+		return resp.MakeErr("ERR source and destination objects are the same")
+	}
+
+	key := string(args[0])
+	dst := s.dbs[n]
+	d, ok := src.get(key)
+	if !ok {
+		return &resp.Intiger{Data: 0}
+	}
+	if _, exists := dst.get(key); exists {
+		return &resp.Intiger{Data: 0}
+	}
+	at, hasTTL := src.getExpiresAt(key)
+	src.deleteKey(key)
+	dst.put(key, d)
+	if hasTTL {
+		dst.expire(key, at)
+	}
+	return &resp.Intiger{Data: 1}
+}
+
+func execSwapDB(db kVStore, args [][]byte) resp.RespType {
+	s := storageOf(db)
+	if s.cluster != nil {
+		return resp.MakeErr("ERR SWAPDB is not allowed in cluster mode")
+	}
+	if _, err := strconv.Atoi(string(args[0])); err != nil {
+		return resp.MakeErr("ERR invalid first DB index")
+	}
+	if _, err := strconv.Atoi(string(args[1])); err != nil {
+		return resp.MakeErr("ERR invalid second DB index")
+	}
+	a, errReply := s.parseDB(args[0])
+	if errReply != nil {
+		return errReply
+	}
+	b, errReply := s.parseDB(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	if a == b {
+		return resp.OkReply()
+	}
+
+	// clients on either database see the keys of the other from now on,
+	// the keys there before and after count as modified
+	s.signalDBs(a, b)
+	da, db2 := s.dbs[a], s.dbs[b]
+	da.shards, db2.shards = db2.shards, da.shards
+	used := da.used.Load()
+	da.used.Store(db2.used.Load())
+	db2.used.Store(used)
+	s.signalDBs(a, b)
+	return resp.OkReply()
+}
+
+// parseFlushMode accepts the ASYNC and SYNC options of FLUSHDB and
+// FLUSHALL. Both free the keys the same way, see flush.
+func parseFlushMode(args [][]byte) *resp.RespErr {
+	if len(args) > 1 {
+		return resp.SyntaxErr()
+	}
+	if len(args) == 1 {
+		mode := strings.ToUpper(string(args[0]))
+		if mode != "ASYNC" && mode != "SYNC" {
+			return resp.SyntaxErr()
+		}
+	}
+	return nil
+}
+
+func execFlushDB(db kVStore, args [][]byte) resp.RespType {
+	if errReply := parseFlushMode(args); errReply != nil {
+		return errReply
+	}
+	selectedDB(db).flush()
+	return resp.OkReply()
+}
+
+func execFlushAll(db kVStore, args [][]byte) resp.RespType {
+	if errReply := parseFlushMode(args); errReply != nil {
+		return errReply
+	}
+	for _, d := range storageOf(db).dbs {
+		d.flush()
+	}
+	return resp.OkReply()
+}
+
+func execDBSize(db kVStore, args [][]byte) resp.RespType {
+	return &resp.Intiger{Data: int64(selectedDB(db).size())}
+}
+
+// infoKeyspace lists the databases holding keys
+func (s *Storage) infoKeyspace(b *strings.Builder) {
+	now := time.Now()
+	for _, db := range s.dbs {
+		keys, expires := 0, 0
+		// in milliseconds, nanoseconds would overflow
+		var ttl int64
+		for _, sh := range db.shards {
+			keys += len(sh.data)
+			expires += len(sh.expires)
+			for _, at := range sh.expires {
+				ttl += max(at.Sub(now).Milliseconds(), 0)
+			}
+		}
+		if keys == 0 {
+			continue
+		}
+		avgTTL := int64(0)
+		if expires > 0 {
+			avgTTL = ttl / int64(expires)
+		}
+		fmt.Fprintf(b, "db%d:keys=%d,expires=%d,avg_ttl=%d\r\n", db.id, keys, expires, avgTTL)
+	}
+}
+
+func init() {
+	registerCommand("select", 2, cmdReadOnly, execSelect).withKeys(0, 0, 0)
+	registerCommand("move", 3, cmdWrite|cmdAlone, execMove)
+	registerCommand("swapdb", 3, cmdWrite|cmdAlone, execSwapDB).withKeys(0, 0, 0)
+	registerCommand("flushdb", -1, cmdWrite|cmdAlone|cmdFreesMemory, execFlushDB).withKeys(0, 0, 0)
+	registerCommand("flushall", -1, cmdWrite|cmdAlone|cmdFreesMemory, execFlushAll).withKeys(0, 0, 0)
+	registerCommand("dbsize", 1, 0, execDBSize)
+}
@@ -0,0 +1,163 @@
+package store
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+// sessionExec runs a command on the database selected by se
+func sessionExec(t *testing.T, s *Storage, se *Session, args ...string) resp.RespType {
+	t.Helper()
+	rep, _, err := s.ExecBlocking(se, toBytes(args...))
+	if err != nil {
+		t.Fatalf("%s: unexpected error %v", args[0], err)
+	}
+	return rep
+}
+
+func expectSession(t *testing.T, s *Storage, se *Session, want resp.RespType, args ...string) {
+	t.Helper()
+	if got := sessionExec(t, s, se, args...); !slices.Equal(got.ToBytes(), want.ToBytes()) {
+		t.Fatalf("%v: got %q, want %q", args, got.ToBytes(), want.ToBytes())
+	}
+}
+
+func TestSelect(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+
+	var a, b Session
+	expectSession(t, s, &b, resp.OkReply(), "SELECT", "1")
+	sessionExec(t, s, &a, "SET", "k", "zero")
+	sessionExec(t, s, &b, "SET", "k", "one")
+	sessionExec(t, s, &b, "SET", "only", "one")
+
+	expectSession(t, s, &a, &resp.BulkStr{Data: []byte("zero")}, "GET", "k")
+	expectSession(t, s, &b, &resp.BulkStr{Data: []byte("one")}, "GET", "k")
+	expectSession(t, s, &a, &resp.Intiger{Data: 1}, "DBSIZE")
+	expectSession(t, s, &b, &resp.Intiger{Data: 2}, "DBSIZE")
+	if keys := parseBulkArr(t, sessionExec(t, s, &a, "KEYS", "*")); !slices.Equal(keys, []string{"k"}) {
+		t.Fatalf("KEYS on db 0 = %v", keys)
+	}
+
+	// a transaction runs on the database selected before and within it
+	rep, _ := s.ExecMulti(&b, [][][]byte{toBytes("GET", "only"), toBytes("SELECT", "0"), toBytes("GET", "only")}, nil)
+	want := entries(&resp.BulkStr{Data: []byte("one")}, resp.OkReply(), &resp.BulkStr{Data: nil})
+	if !slices.Equal(rep.ToBytes(), want.ToBytes()) {
+		t.Fatalf("EXEC: got %q", rep.ToBytes())
+	}
+	expectSession(t, s, &b, &resp.BulkStr{Data: []byte("zero")}, "GET", "k")
+
+	expectErr(t, s, "ERR DB index is out of range", "SELECT", "16")
+	expectErr(t, s, "ERR DB index is out of range", "SELECT", "-1")
+	expectErr(t, s, string(resp.NotInErr().Data), "SELECT", "abc")
+}
+
+func TestMoveAndSwapDB(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+
+	var se Session
+	sessionExec(t, s, &se, "SET", "k", "v", "EX", "100")
+	sessionExec(t, s, &se, "SET", "taken", "v")
+	expectSession(t, s, &se, &resp.Intiger{Data: 1}, "MOVE", "k", "2")
+	expectSession(t, s, &se, &resp.Intiger{Data: 0}, "MOVE", "k", "2")
+	expectSession(t, s, &se, &resp.BulkStr{Data: nil}, "GET", "k")
+
+	other := Session{db: 2}
+	sessionExec(t, s, &other, "SET", "taken", "other")
+	expectSession(t, s, &se, &resp.Intiger{Data: 0}, "MOVE", "taken", "2")
+	if ttl := sessionExec(t, s, &other, "TTL", "k").(*resp.Intiger).Data; ttl <= 0 || ttl > 100 {
+		t.Fatalf("MOVE lost the TTL, got %d", ttl)
+	}
+	expectErr(t, s, "ERR source and destination objects are the same", "MOVE", "taken", "0")
+
+	expectSession(t, s, &se, resp.OkReply(), "SWAPDB", "0", "2")
+	expectSession(t, s, &se, &resp.BulkStr{Data: []byte("other")}, "GET", "taken")
+	expectSession(t, s, &other, &resp.BulkStr{Data: []byte("v")}, "GET", "taken")
+	expectSession(t, s, &se, &resp.Intiger{Data: 2}, "DBSIZE")
+	expectErr(t, s, "ERR invalid first DB index", "SWAPDB", "a", "0")
+	expectErr(t, s, "ERR DB index is out of range", "SWAPDB", "0", "16")
+
+	expectSession(t, s, &se, resp.OkReply(), "FLUSHDB", "ASYNC")
+	expectSession(t, s, &se, &resp.Intiger{Data: 0}, "DBSIZE")
+	expectSession(t, s, &other, &resp.Intiger{Data: 1}, "DBSIZE")
+	expectSession(t, s, &se, resp.OkReply(), "FLUSHALL")
+	expectSession(t, s, &other, &resp.Intiger{Data: 0}, "DBSIZE")
+	if used := s.used.Load(); used != 0 {
+		t.Fatalf("%d bytes used after FLUSHALL", used)
+	}
+}
+
+func TestSwapDBWakesBlocked(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+
+	other := Session{db: 1}
+	sessionExec(t, s, &other, "RPUSH", "list", "a")
+	blocked := mustBlock(t, s, "BLPOP", "list", "0")
+	mustExec(t, s, "SWAPDB", "0", "1")
+	expectReply(t, blocked, bulkArr("list", "a"))
+}
+
+func TestDatabasesPersist(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "appendonly.aof")
+
+	s := openTestAOF(t, path, FsyncAlways)
+	var se Session
+	sessionExec(t, s, &se, "SET", "k", "zero")
+	sessionExec(t, s, &se, "SELECT", "3")
+	sessionExec(t, s, &se, "SET", "k", "three")
+	sessionExec(t, s, &se, "RPUSH", "list", "a")
+	mustExec(t, s, "DEL", "missing")
+	mustExec(t, s, "SET", "other", "zero")
+	sessionExec(t, s, &se, "MOVE", "list", "5")
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	check := func(s *Storage) {
+		t.Helper()
+		db0, db3, db5 := Session{}, Session{db: 3}, Session{db: 5}
+		expectSession(t, s, &db0, &resp.BulkStr{Data: []byte("zero")}, "GET", "k")
+		expectSession(t, s, &db0, &resp.BulkStr{Data: []byte("zero")}, "GET", "other")
+		expectSession(t, s, &db3, &resp.BulkStr{Data: []byte("three")}, "GET", "k")
+		expectSession(t, s, &db5, bulkArr("a"), "LRANGE", "list", "0", "-1")
+	}
+
+	s = openTestAOF(t, path, FsyncAlways)
+	check(s)
+	info := string(mustExec(t, s, "INFO", "keyspace").ToBytes())
+	for _, line := range []string{"db0:keys=2,expires=0", "db3:keys=1,expires=0", "db5:keys=1,expires=0"} {
+		if !strings.Contains(info, line) {
+			t.Fatalf("INFO keyspace lacks %s:\n%s", line, info)
+		}
+	}
+
+	// the rewritten AOF and the RDB select the databases as well, the
+	// writes after the rewrite select theirs again
+	s.mu.Lock()
+	if err := s.startAOFRewrite(); err != nil {
+		t.Fatalf("failed to start the rewrite: %v", err)
+	}
+	s.mu.Unlock()
+	s.waitAOFRewrite()
+	db3 := Session{db: 3}
+	sessionExec(t, s, &db3, "SET", "after", "rewrite")
+	mustExec(t, s, "SAVE")
+	s.Close()
+
+	s = openTestAOF(t, path, FsyncNo)
+	check(s)
+	expectSession(t, s, &db3, &resp.BulkStr{Data: []byte("rewrite")}, "GET", "after")
+	s.Close()
+
+	s = openTestRDB(t, filepath.Join(dir, "dump.rdb"))
+	defer s.Close()
+	check(s)
+}
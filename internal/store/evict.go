@@ -0,0 +1,430 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+// EvictionPolicy tells which keys are deleted once the memory used by the
+// dataset reaches maxmemory
+type EvictionPolicy int
+
+const (
+	// nothing is deleted, commands that would use more memory fail
+	NoEviction EvictionPolicy = iota
+	// the least recently used keys
+	AllKeysLRU
+	// the least frequently used keys
+	AllKeysLFU
+	AllKeysRandom
+	// the least recently used keys with a TTL
+	VolatileLRU
+	// the least frequently used keys with a TTL
+	VolatileLFU
+	VolatileRandom
+	// the keys with a TTL expiring the soonest
+	VolatileTTL
+)
+
+var evictionPolicies = []string{
+	"noeviction", "allkeys-lru", "allkeys-lfu", "allkeys-random",
+	"volatile-lru", "volatile-lfu", "volatile-random", "volatile-ttl",
+}
+
+func ParseEvictionPolicy(s string) (EvictionPolicy, error) {
+	for i, name := range evictionPolicies {
+		if strings.EqualFold(s, name) {
+			return EvictionPolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid maxmemory policy %q, must be one of %s", s, strings.Join(evictionPolicies, ", "))
+}
+
+func (p EvictionPolicy) String() string {
+	return evictionPolicies[p]
+}
+
+// volatile tells if the policy only evicts keys with a TTL
+func (p EvictionPolicy) volatile() bool {
+	return p >= VolatileLRU
+}
+
+// ParseMemory parses a number of bytes with an optional unit like redis
+// does: k, m and g are powers of 1000, kb, mb and gb of 1024
+func ParseMemory(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+	num, mul := strings.ToLower(s), int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(num, u.suffix) {
+			num, mul = strings.TrimSuffix(num, u.suffix), u.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/mul {
+		return 0, fmt.Errorf("invalid memory size %q", s)
+	}
+	return n * mul, nil
+}
+
+// bytesToHuman formats a number of bytes like the *_human fields of INFO
+func bytesToHuman(n int64) string {
+	f := float64(n)
+	switch {
+	case n < 1<<10:
+		return fmt.Sprintf("%dB", n)
+	case n < 1<<20:
+		return fmt.Sprintf("%.2fK", f/(1<<10))
+	case n < 1<<30:
+		return fmt.Sprintf("%.2fM", f/(1<<20))
+	case n < 1<<40:
+		return fmt.Sprintf("%.2fG", f/(1<<30))
+	}
+	return fmt.Sprintf("%.2fT", f/(1<<40))
+}
+
+// Memory accounting is approximate: the size of a value is estimated from
+// its length and a few sampled elements, plus fixed overheads for the
+// key, the entity and each element. The total of the dataset is in
+// Storage.used, the total of each database in database.used, entities keep
+// what they're counted for in mem.
+
+const (
+	entityOverhead = 64
+	memSamples     = 5
+	// each element of the scanIndex of a large collection
+	scanIndexOverhead = 64
+)
+
+// memUsage estimates the bytes used by the value at key
+func (d *dataEntity) memUsage(key string) int64 {
+	size := int64(entityOverhead + len(key))
+	switch v := d.val.(type) {
+	case []byte:
+		size += int64(len(v))
+	case *quicklist:
+		var sum, n int
+		for node := v.head; node != nil && n < memSamples; node = node.next {
+			for _, e := range node.entries {
+				if n == memSamples {
+					break
+				}
+				sum, n = sum+len(e), n+1
+			}
+		}
+		size += estimate(v.len(), sum, n, 16) + int64(v.len()/quicklistNodeSize+1)*48
+	case *hash:
+		var sum, n int
+		for field, val := range v.fields {
+			if n == memSamples {
+				break
+			}
+			sum, n = sum+len(field)+len(val), n+1
+		}
+		size += estimate(v.len(), sum, n, 64) + v.scan.memUsage()
+	case *set:
+		if v.isIntset() {
+			size += int64(len(v.ints)) * 8
+			break
+		}
+		var sum, n int
+		for _, m := range v.dense[:min(len(v.dense), memSamples)] {
+			sum, n = sum+len(m), n+1
+		}
+		size += estimate(len(v.dense), sum, n, 64) + v.scan.memUsage()
+	case *zset:
+		var sum, n int
+		for x := v.zsl.header.level[0].forward; x != nil && n < memSamples; x = x.level[0].forward {
+			sum, n = sum+len(x.member), n+1
+		}
+		size += estimate(v.len(), sum, n, 96) + v.scan.memUsage()
+	case *stream:
+		var sum, n int
+		for _, chunk := range v.log.chunks {
+			for _, e := range chunk.entries {
+				if n == memSamples {
+					break
+				}
+				for _, f := range e.fields {
+					sum += len(f) + 24
+				}
+				n++
+			}
+			if n == memSamples {
+				break
+			}
+		}
+		size += estimate(v.len(), sum, n, 40)
+		for _, g := range v.groups {
+			size += int64(len(g.pel)) * 64
+		}
+	}
+	return size
+}
+
+// estimate extrapolates the size of count elements from n sampled ones
+// summing to sum bytes, each element costing overhead on top
+func estimate(count, sum, n int, overhead int64) int64 {
+	if n == 0 {
+		return 0
+	}
+	return int64(count) * (int64(sum/n) + overhead)
+}
+
+// account updates what the entity at key is counted for once a command
+// wrote it. Must be called with the shard of key held.
+func (db *database) account(key string) {
+	d, ok := db.shardOf(key).data[key]
+	if !ok {
+		return
+	}
+	n := d.memUsage(key)
+	db.addUsed(n - d.mem)
+	d.mem = n
+}
+
+// values with more elements than this are freed in the background by
+// UNLINK, like redis does
+const lazyfreeThreshold = 64
+
+// freeEffort returns the number of elements of the value, what freeing it
+// takes time proportional to
+func (d *dataEntity) freeEffort() int {
+	switch v := d.val.(type) {
+	case *quicklist:
+		return v.len()
+	case *hash:
+		return v.len()
+	case *set:
+		return v.len()
+	case *zset:
+		return v.len()
+	case *stream:
+		return v.len()
+	}
+	return 1
+}
+
+// free drops everything the value holds. It must be unreachable from the
+// keyspace.
+func (d *dataEntity) free() {
+	switch v := d.val.(type) {
+	case *quicklist:
+		for n := v.head; n != nil; {
+			next := n.next
+			n.prev, n.next, n.entries = nil, nil, nil
+			n = next
+		}
+	case *hash:
+		clear(v.fields)
+		v.scan = nil
+	case *set:
+		clear(v.members)
+		v.dense, v.scan = nil, nil
+	case *zset:
+		clear(v.dict)
+	case *stream:
+		v.log.chunks = nil
+		clear(v.groups)
+	}
+	d.val = nil
+}
+
+// lazyFree frees a value deleted from the keyspace on a goroutine of its
+// own when it's big, the command deleting it doesn't wait for it
+func (s *Storage) lazyFree(d *dataEntity) {
+	if d.freeEffort() <= lazyfreeThreshold {
+		return
+	}
+	s.lazyfreePending.Add(1)
+	go func() {
+		d.free()
+		s.lazyfreePending.Add(-1)
+		s.lazyfreed.Add(1)
+	}()
+}
+
+// LFU counters grow logarithmically with the accesses and decay with the
+// time since the last one, like the ones of redis
+const (
+	lfuInitVal   = 5
+	lfuLogFactor = 10
+	lfuDecayTime = time.Minute
+)
+
+// touch records an access to the entity, for the LRU and LFU policies.
+// Readers sharing a shard touch the same entities, the fields are atomic.
+func (d *dataEntity) touch(now time.Time) {
+	ms := now.UnixMilli()
+	counter := uint32(lfuInitVal)
+	if last := d.atime.Load(); last != 0 {
+		counter = lfuIncr(lfuDecay(d.freq.Load(), ms-last))
+	}
+	d.freq.Store(counter)
+	d.atime.Store(ms)
+}
+
+// lfu returns the LFU counter of the entity decayed up to now
+func (d *dataEntity) lfu(now time.Time) uint32 {
+	return lfuDecay(d.freq.Load(), now.UnixMilli()-d.atime.Load())
+}
+
+func lfuIncr(counter uint32) uint32 {
+	if counter == 255 {
+		return counter
+	}
+	base := float64(max(int(counter)-lfuInitVal, 0))
+	if rand.Float64() < 1/(base*lfuLogFactor+1) {
+		counter++
+	}
+	return counter
+}
+
+func lfuDecay(counter uint32, idleMs int64) uint32 {
+	periods := idleMs / lfuDecayTime.Milliseconds()
+	if periods >= int64(counter) {
+		return 0
+	}
+	return counter - uint32(periods)
+}
+
+func oomErr() *resp.RespErr {
+	return resp.MakeErr("OOM command not allowed when used memory > 'maxmemory'.")
+}
+
+// denyOOM evicts keys if the dataset outgrew maxmemory before c runs. It
+// returns the error c is refused with when there's nothing more to
+// evict, commands freeing memory are always allowed. Must be called with
+// s.mu held, for reading at least, and no shard lock.
+func (s *Storage) denyOOM(c *command) *resp.RespErr {
+	if s.evict() || c.is(cmdFreesMemory) {
+		return nil
+	}
+	return oomErr()
+}
+
+// evict deletes keys picked by the policy until the dataset fits in
+// maxmemory, it tells if it does. Replicas leave it to their master,
+// they get its deletions.
+func (s *Storage) evict() bool {
+	if s.maxMemory <= 0 || s.used.Load() <= s.maxMemory || s.repl.master != nil {
+		return true
+	}
+	if s.evictPolicy == NoEviction {
+		return false
+	}
+	for s.used.Load() > s.maxMemory {
+		db, key, ok := s.evictionCandidate()
+		if !ok {
+			return false
+		}
+		s.evictKey(db, key)
+	}
+	return true
+}
+
+// evictionCandidate samples keys from the shards of every database,
+// starting from a random one, and returns the best to evict among them
+func (s *Storage) evictionCandidate() (*database, string, bool) {
+	now := time.Now()
+	var bestDB *database
+	var best string
+	bestScore := int64(math.MinInt64)
+	sampled := 0
+
+	score := func(key string, d *dataEntity, sh *shard) int64 {
+		switch s.evictPolicy {
+		case AllKeysLRU, VolatileLRU:
+			return now.UnixMilli() - d.atime.Load()
+		case AllKeysLFU, VolatileLFU:
+			return 255 - int64(d.lfu(now))
+		case VolatileTTL:
+			return -sh.expires[key].UnixMilli()
+		}
+		return 0
+	}
+
+	// tells if more keys are to be sampled
+	sample := func(db *database, key string, d *dataEntity, sh *shard) bool {
+		if sc := score(key, d, sh); sampled == 0 || sc > bestScore {
+			bestDB, best, bestScore = db, key, sc
+		}
+		sampled++
+		return sampled < s.evictSamples
+	}
+
+	total := len(s.dbs) * numShards
+	start := rand.IntN(total)
+	for i := 0; i < total && sampled < s.evictSamples; i++ {
+		n := (start + i) % total
+		db := s.dbs[n/numShards]
+		sh := db.shards[n%numShards]
+		sh.mu.RLock()
+		if s.evictPolicy.volatile() {
+			for key := range sh.expires {
+				if !sample(db, key, sh.data[key], sh) {
+					break
+				}
+			}
+		} else {
+			for key, d := range sh.data {
+				if !sample(db, key, d, sh) {
+					break
+				}
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return bestDB, best, sampled > 0
+}
+
+// evictKey deletes key of db, replicas and the AOF get a DEL for it
+func (s *Storage) evictKey(db *database, key string) {
+	sh := db.shardOf(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, ok := sh.data[key]; !ok {
+		// deleted meanwhile
+		return
+	}
+	db.deleteKey(key)
+	s.evicted.Add(1)
+
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	del := s.withSelect(db.id, [][][]byte{cmdArgv("del", []byte(key))})
+	s.dirty++
+	s.replicate(del)
+	if s.aof != nil {
+		s.writeAOF(del)
+	}
+}
+
+func (s *Storage) infoMemory(b *strings.Builder) {
+	used := s.used.Load()
+	fmt.Fprintf(b, "used_memory:%d\r\n", used)
+	fmt.Fprintf(b, "used_memory_human:%s\r\n", bytesToHuman(used))
+	fmt.Fprintf(b, "maxmemory:%d\r\n", s.maxMemory)
+	fmt.Fprintf(b, "maxmemory_human:%s\r\n", bytesToHuman(s.maxMemory))
+	fmt.Fprintf(b, "maxmemory_policy:%s\r\n", s.evictPolicy)
+	fmt.Fprintf(b, "lazyfree_pending_objects:%d\r\n", s.lazyfreePending.Load())
+}
+
+func (s *Storage) infoStats(b *strings.Builder) {
+	fmt.Fprintf(b, "expired_keys:%d\r\n", s.expired.Load())
+	fmt.Fprintf(b, "evicted_keys:%d\r\n", s.evicted.Load())
+	fmt.Fprintf(b, "lazyfreed_objects:%d\r\n", s.lazyfreed.Load())
+}
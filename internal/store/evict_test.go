@@ -0,0 +1,143 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMemory(t *testing.T) {
+	tests := map[string]int64{
+		"0":     0,
+		"100":   100,
+		"1k":    1000,
+		"1kb":   1024,
+		"100mb": 100 << 20,
+		"2GB":   2 << 30,
+		"3m":    3000000,
+	}
+	for raw, want := range tests {
+		if got, err := ParseMemory(raw); err != nil || got != want {
+			t.Fatalf("ParseMemory(%q) = %d, %v, want %d", raw, got, err, want)
+		}
+	}
+	for _, raw := range []string{"", "mb", "-1", "1tb", "1.5gb"} {
+		if _, err := ParseMemory(raw); err == nil {
+			t.Fatalf("ParseMemory(%q) should fail", raw)
+		}
+	}
+	if p, err := ParseEvictionPolicy("ALLKEYS-LFU"); err != nil || p != AllKeysLFU {
+		t.Fatalf("ParseEvictionPolicy = %v, %v", p, err)
+	}
+}
+
+func TestMemoryAccounting(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+
+	mustExec(t, s, "SET", "str", strings.Repeat("x", 1000))
+	mustExec(t, s, "RPUSH", "list", "a", "b", "c")
+	mustExec(t, s, "HSET", "hash", "f", "v")
+	mustExec(t, s, "ZADD", "zset", "1", "m")
+	if used := s.used.Load(); used < 1000 {
+		t.Fatalf("used = %d, want at least the size of the string", used)
+	}
+	mustExec(t, s, "SET", "str", "short")
+	mustExec(t, s, "LPOP", "list")
+	if used := s.used.Load(); used >= 1000 {
+		t.Fatalf("used = %d after the string shrank", used)
+	}
+
+	mustExec(t, s, "DEL", "str", "list", "hash", "zset")
+	if used := s.used.Load(); used != 0 {
+		t.Fatalf("used = %d with no keys left", used)
+	}
+}
+
+// fillMemory sets n keys of 100 bytes and returns what a key is counted for
+func fillMemory(t *testing.T, s *Storage, prefix string, n int) int64 {
+	before := s.used.Load()
+	for i := 0; i < n; i++ {
+		mustExec(t, s, "SET", fmt.Sprintf("%s%d", prefix, i), strings.Repeat("v", 100))
+	}
+	return (s.used.Load() - before) / int64(n)
+}
+
+func TestEvictionLRU(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+	s.evictPolicy = AllKeysLRU
+	// sampling every key makes the LRU exact
+	s.evictSamples = 1000
+
+	per := fillMemory(t, s, "cold", 10)
+	time.Sleep(5 * time.Millisecond)
+	mustExec(t, s, "GET", "cold0")
+	time.Sleep(5 * time.Millisecond)
+	s.maxMemory = s.used.Load()
+
+	fillMemory(t, s, "new", 3)
+	if used := s.used.Load(); used > s.maxMemory+per {
+		t.Fatalf("used = %d past maxmemory %d", used, s.maxMemory)
+	}
+	if got := mustExec(t, s, "GET", "cold0"); string(got.ToBytes()) == "$-1\r\n" {
+		t.Fatal("the recently used key was evicted")
+	}
+	for i := 0; i < 3; i++ {
+		if got := mustExec(t, s, "GET", fmt.Sprintf("new%d", i)); string(got.ToBytes()) == "$-1\r\n" {
+			t.Fatal("a new key was evicted before the old ones")
+		}
+	}
+	if s.evicted.Load() == 0 {
+		t.Fatal("evicted_keys wasn't counted")
+	}
+}
+
+func TestEvictionVolatileTTL(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+	s.evictPolicy = VolatileTTL
+	s.evictSamples = 1000
+
+	fillMemory(t, s, "persistent", 5)
+	mustExec(t, s, "SET", "soon", "v", "EX", "100")
+	mustExec(t, s, "SET", "later", "v", "EX", "1000")
+	s.maxMemory = s.used.Load() - 1
+
+	// the dataset is over maxmemory, the next write makes room first
+	mustExec(t, s, "SET", "new", "v")
+	if got := mustExec(t, s, "GET", "soon"); string(got.ToBytes()) != "$-1\r\n" {
+		t.Fatal("the key expiring the soonest wasn't evicted")
+	}
+	if got := mustExec(t, s, "GET", "later"); string(got.ToBytes()) == "$-1\r\n" {
+		t.Fatal("only one key had to be evicted")
+	}
+
+	// keys without a TTL are never evicted
+	fillMemory(t, s, "more", 5)
+	expectErr(t, s, "OOM command not allowed when used memory > 'maxmemory'.", "SET", "k", "v")
+	if got := mustExec(t, s, "GET", "persistent0"); string(got.ToBytes()) == "$-1\r\n" {
+		t.Fatal("a key without a TTL was evicted")
+	}
+}
+
+func TestNoEviction(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+
+	fillMemory(t, s, "k", 5)
+	s.maxMemory = s.used.Load() - 1
+
+	expectErr(t, s, "OOM command not allowed when used memory > 'maxmemory'.", "SET", "k0", "v")
+	expectErr(t, s, "OOM command not allowed when used memory > 'maxmemory'.", "RPUSH", "l", "v")
+	rep, _ := s.ExecMulti(&Session{}, [][][]byte{toBytes("SET", "a", "1")}, nil)
+	if !strings.HasPrefix(string(rep.ToBytes()), "-EXECABORT Transaction discarded because of: OOM") {
+		t.Fatalf("EXEC past maxmemory: %q", rep.ToBytes())
+	}
+
+	// reads and commands freeing memory still run
+	mustExec(t, s, "GET", "k0")
+	mustExec(t, s, "DEL", "k0")
+	mustExec(t, s, "SET", "k0", "v")
+}
@@ -0,0 +1,71 @@
+package store
+
+import "time"
+
+// Expired keys are deleted when they're looked up, and in the background
+// by the janitor like redis does: every cycle samples the keys with a TTL
+// of each shard of each database in turn and deletes the expired ones. A
+// shard is sampled again while a good part of the sample was expired,
+// since more likely are, and a cycle stops once it used its share of CPU
+// time. Only the shard being sampled is locked.
+
+const (
+	maxHz = 500
+	// keys with a TTL sampled at once in a shard
+	expireCycleKeys = 20
+	// a shard is sampled again while more than this percentage of its
+	// sample was expired
+	expireCycleAcceptablePct = 25
+	// percentage of the period between cycles a cycle may run for
+	expireCycleSlowPct = 25
+)
+
+// activeExpireCycle deletes expired keys for up to budget. The next cycle
+// continues from the shard this one stopped at.
+func (s *Storage) activeExpireCycle(budget time.Duration) {
+	start := time.Now()
+	j := s.janitor
+	// a full sync replaces the databases
+	s.mu.RLock()
+	total := len(s.dbs) * numShards
+	s.mu.RUnlock()
+	for i := 0; i < total; i++ {
+		if time.Since(start) > budget {
+			return
+		}
+		for {
+			sampled, expired := s.expireShard(j.next)
+			if sampled == 0 || expired*100 <= sampled*expireCycleAcceptablePct || time.Since(start) > budget {
+				break
+			}
+		}
+		j.next = (j.next + 1) % total
+	}
+}
+
+// expireShard samples the keys with a TTL of the shard at index i, the
+// shards of the databases counted one after the other, and deletes the
+// expired ones. It returns how many keys it looked at and how many were
+// expired.
+func (s *Storage) expireShard(i int) (sampled, expired int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	db := s.dbs[i/numShards]
+	sh := db.shards[i%numShards]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	now := time.Now()
+	for key := range sh.expires {
+		if sampled == expireCycleKeys {
+			break
+		}
+		sampled++
+		if sh.expired(key, now) {
+			db.deleteKey(key)
+			expired++
+		}
+	}
+	s.expired.Add(int64(expired))
+	return sampled, expired
+}
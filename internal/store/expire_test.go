@@ -0,0 +1,27 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestActiveExpire(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+
+	for i := 0; i < 500; i++ {
+		mustExec(t, s, "SET", fmt.Sprintf("key%d", i), "v", "PX", "10")
+	}
+	mustExec(t, s, "SET", "persistent", "v")
+	mustExec(t, s, "SET", "later", "v", "EX", "100")
+
+	// nothing looks the keys up, the janitor has to find them
+	waitFor(t, "the expired keys to be deleted", func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.dbSize() == 2
+	})
+	if got := s.expired.Load(); got != 500 {
+		t.Fatalf("expired_keys = %d, want 500", got)
+	}
+}
@@ -0,0 +1,438 @@
+package store
+
+import (
+	"math"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+	"github.com/myselfBZ/go-redis-clone/pkg/utils"
+)
+
+// hash maps field names to their values. Past scanSmallLen fields it also
+// keeps them in a scanIndex for HSCAN.
+type hash struct {
+	fields map[string][]byte
+	scan   *scanIndex
+}
+
+func newHash() *hash {
+	return &hash{fields: make(map[string][]byte)}
+}
+
+// all returns the fields to read them, nil for a missing hash
+func (h *hash) all() map[string][]byte {
+	if h == nil {
+		return nil
+	}
+	return h.fields
+}
+
+func (h *hash) len() int {
+	return len(h.all())
+}
+
+// set stores val in field, returns true if the field is new
+func (h *hash) set(field string, val []byte) bool {
+	_, ok := h.fields[field]
+	h.fields[field] = val
+	if !ok {
+		h.scan.add(field)
+		h.scan = growScanIndex(h.scan, len(h.fields), h.iter)
+	}
+	return !ok
+}
+
+// del deletes field, returns false if it's not in the hash
+func (h *hash) del(field string) bool {
+	if _, ok := h.fields[field]; !ok {
+		return false
+	}
+	delete(h.fields, field)
+	h.scan.remove(field)
+	return true
+}
+
+// iter calls fn for every field until it returns false
+func (h *hash) iter(fn func(field string) bool) {
+	for f := range h.fields {
+		if !fn(f) {
+			return
+		}
+	}
+}
+
+// lookupHash returns the hash stored at key. If the key holds another type,
+// the returned reply is a WRONGTYPE error. Missing keys yield (nil, nil).
+func lookupHash(db kVStore, key string) (*hash, resp.RespType) {
+	d, errReply := lookupTyped(db, key, typeHash)
+	if d == nil {
+		return nil, errReply
+	}
+	return d.val.(*hash), nil
+}
+
+// lookupOrCreateHash is like lookupHash but creates an empty hash at key if
+// it does not exist yet
+func lookupOrCreateHash(db kVStore, key string) (*hash, resp.RespType) {
+	h, errReply := lookupHash(db, key)
+	if errReply != nil {
+		return nil, errReply
+	}
+	if h == nil {
+		h = newHash()
+		db.put(key, &dataEntity{typ: typeHash, val: h})
+	}
+	return h, nil
+}
+
+func execHSet(db kVStore, args [][]byte) resp.RespType {
+	if len(args)%2 != 1 {
+		return resp.ArgNumErr("hset")
+	}
+
+	h, errReply := lookupOrCreateHash(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+
+	created := 0
+	for i := 1; i < len(args); i += 2 {
+		if h.set(string(args[i]), args[i+1]) {
+			created++
+		}
+	}
+
+	return &resp.Intiger{
+		Data: int64(created),
+	}
+}
+
+func execHMSet(db kVStore, args [][]byte) resp.RespType {
+	if r, ok := execHSet(db, args).(*resp.RespErr); ok {
+		return r
+	}
+	return resp.OkReply()
+}
+
+func execHSetNX(db kVStore, args [][]byte) resp.RespType {
+	h, errReply := lookupOrCreateHash(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+
+	field := string(args[1])
+	if _, ok := h.fields[field]; ok {
+		return &resp.Intiger{Data: 0}
+	}
+	h.set(field, args[2])
+	return &resp.Intiger{Data: 1}
+}
+
+func execHGet(db kVStore, args [][]byte) resp.RespType {
+	h, errReply := lookupHash(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	return &resp.BulkStr{
+		Data: h.all()[string(args[1])],
+	}
+}
+
+func execHMGet(db kVStore, args [][]byte) resp.RespType {
+	h, errReply := lookupHash(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+
+	arr := &resp.RespBulkStrArr{}
+	for _, f := range args[1:] {
+		arr.Append(h.all()[string(f)])
+	}
+	return arr
+}
+
+func execHDel(db kVStore, args [][]byte) resp.RespType {
+	key := string(args[0])
+	h, errReply := lookupHash(db, key)
+	if errReply != nil {
+		return errReply
+	}
+
+	deleted := 0
+	for _, f := range args[1:] {
+		if h != nil && h.del(string(f)) {
+			deleted++
+		}
+	}
+
+	if h != nil && h.len() == 0 {
+		db.remove(key)
+	}
+
+	return &resp.Intiger{
+		Data: int64(deleted),
+	}
+}
+
+func execHGetAll(db kVStore, args [][]byte) resp.RespType {
+	h, errReply := lookupHash(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+
+	arr := &resp.RespBulkStrArr{}
+	for f, v := range h.all() {
+		arr.Append([]byte(f))
+		arr.Append(v)
+	}
+	return arr
+}
+
+func execHKeys(db kVStore, args [][]byte) resp.RespType {
+	h, errReply := lookupHash(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+
+	arr := &resp.RespBulkStrArr{}
+	for f := range h.all() {
+		arr.Append([]byte(f))
+	}
+	return arr
+}
+
+func execHVals(db kVStore, args [][]byte) resp.RespType {
+	h, errReply := lookupHash(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+
+	arr := &resp.RespBulkStrArr{}
+	for _, v := range h.all() {
+		arr.Append(v)
+	}
+	return arr
+}
+
+func execHExists(db kVStore, args [][]byte) resp.RespType {
+	h, errReply := lookupHash(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+
+	if _, ok := h.all()[string(args[1])]; ok {
+		return &resp.Intiger{Data: 1}
+	}
+	return &resp.Intiger{Data: 0}
+}
+
+func execHLen(db kVStore, args [][]byte) resp.RespType {
+	h, errReply := lookupHash(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	return &resp.Intiger{
+		Data: int64(h.len()),
+	}
+}
+
+func execHStrLen(db kVStore, args [][]byte) resp.RespType {
+	h, errReply := lookupHash(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	return &resp.Intiger{
+		Data: int64(len(h.all()[string(args[1])])),
+	}
+}
+
+func execHIncrBy(db kVStore, args [][]byte) resp.RespType {
+	delta, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return resp.NotInErr()
+	}
+
+	h, errReply := lookupOrCreateHash(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+
+	field := string(args[1])
+	var cur int64
+	if raw, ok := h.fields[field]; ok {
+		cur, err = strconv.ParseInt(string(raw), 10, 64)
+		if err != nil {
+			return resp.MakeErr("ERR hash value is not an integer")
+		}
+	}
+
+	if (delta > 0 && cur > math.MaxInt64-delta) || (delta < 0 && cur < math.MinInt64-delta) {
+		return resp.MakeErr("ERR increment or decrement would overflow")
+	}
+
+	cur += delta
+	h.set(field, []byte(strconv.FormatInt(cur, 10)))
+	return &resp.Intiger{
+		Data: cur,
+	}
+}
+
+func execHIncrByFloat(db kVStore, args [][]byte) resp.RespType {
+	incr, ok := parseLongDouble(args[2])
+	if !ok {
+		return resp.NotFloatErr()
+	}
+
+	h, errReply := lookupOrCreateHash(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+
+	field := string(args[1])
+	cur := new(big.Float).SetPrec(longDoublePrec)
+	if raw, ok := h.fields[field]; ok {
+		cur, ok = parseLongDouble(raw)
+		if !ok {
+			return resp.MakeErr("ERR hash value is not a float")
+		}
+	}
+
+	sum, ok := incrByFloat(cur, incr)
+	if !ok {
+		return resp.MakeErr("ERR increment would produce NaN or Infinity")
+	}
+
+	val := formatLongDouble(sum)
+	h.set(field, val)
+	return &resp.BulkStr{
+		Data: val,
+	}
+}
+
+type scanOptions struct {
+	cursor   uint64
+	pattern  string
+	count    int
+	noValues bool
+	typ      string
+}
+
+// parseScanArgs parses "cursor [MATCH pattern] [COUNT count]" shared by the
+// *SCAN family, extra options are accepted only if listed in allowed
+func parseScanArgs(args [][]byte, allowed ...string) (*scanOptions, resp.RespType) {
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return nil, resp.MakeErr("ERR invalid cursor")
+	}
+
+	opts := &scanOptions{
+		cursor: cursor,
+		count:  10,
+	}
+
+	for i := 1; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		switch {
+		case opt == "MATCH" && i+1 < len(args):
+			opts.pattern = string(args[i+1])
+			i++
+		case opt == "COUNT" && i+1 < len(args):
+			count, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return nil, resp.NotInErr()
+			}
+			if count < 1 {
+				return nil, resp.SyntaxErr()
+			}
+			opts.count = int(count)
+			i++
+		case opt == "NOVALUES" && slices.Contains(allowed, opt):
+			opts.noValues = true
+		case opt == "TYPE" && i+1 < len(args) && slices.Contains(allowed, opt):
+			opts.typ = strings.ToLower(string(args[i+1]))
+			i++
+		default:
+			return nil, resp.SyntaxErr()
+		}
+	}
+	return opts, nil
+}
+
+// collections up to this long are returned by a single *SCAN call, like
+// the compact encodings of redis
+const scanSmallLen = 128
+
+// scanElements is the cursor iteration of HSCAN, SSCAN and ZSCAN over a
+// collection walked by iter and indexed by ix. Like SCAN, elements come in
+// the order of their scanHash and the cursor is the hash to resume from,
+// so every element present for the whole iteration is returned. Small
+// collections have no index and are returned at once with cursor 0.
+func scanElements(ix *scanIndex, iter func(fn func(elem string) bool), cursor uint64, count int) (elems []string, next uint64) {
+	if ix != nil {
+		return ix.from(cursor, count)
+	}
+	iter(func(elem string) bool {
+		elems = append(elems, elem)
+		return true
+	})
+	return elems, 0
+}
+
+// execHScan returns about COUNT fields per call, MATCH filters them
+// afterwards
+func execHScan(db kVStore, args [][]byte) resp.RespType {
+	opts, errReply := parseScanArgs(args[1:], "NOVALUES")
+	if errReply != nil {
+		return errReply
+	}
+
+	h, errReply := lookupHash(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+
+	var fields []string
+	var next uint64
+	if h != nil {
+		fields, next = scanElements(h.scan, h.iter, opts.cursor, opts.count)
+	}
+
+	items := &resp.RespBulkStrArr{}
+	for _, f := range fields {
+		if opts.pattern != "" && !utils.GlobMatch(opts.pattern, f) {
+			continue
+		}
+		items.Append([]byte(f))
+		if !opts.noValues {
+			items.Append(h.fields[f])
+		}
+	}
+
+	return &resp.Array{
+		Elems: []resp.RespType{
+			&resp.BulkStr{Data: []byte(strconv.FormatUint(next, 10))},
+			items,
+		},
+	}
+}
+
+func init() {
+	registerCommand("hset", -4, cmdWrite, execHSet)
+	registerCommand("hmset", -4, cmdWrite, execHMSet)
+	registerCommand("hsetnx", 4, cmdWrite, execHSetNX)
+	registerCommand("hget", 3, cmdReadOnly, execHGet)
+	registerCommand("hmget", -3, cmdReadOnly, execHMGet)
+	registerCommand("hdel", -3, cmdWrite|cmdFreesMemory, execHDel)
+	registerCommand("hgetall", 2, cmdReadOnly, execHGetAll)
+	registerCommand("hkeys", 2, cmdReadOnly, execHKeys)
+	registerCommand("hvals", 2, cmdReadOnly, execHVals)
+	registerCommand("hexists", 3, cmdReadOnly, execHExists)
+	registerCommand("hlen", 2, cmdReadOnly, execHLen)
+	registerCommand("hstrlen", 3, cmdReadOnly, execHStrLen)
+	registerCommand("hincrby", 4, cmdWrite, execHIncrBy)
+	registerCommand("hincrbyfloat", 4, cmdWrite, execHIncrByFloat)
+	registerCommand("hscan", -3, cmdReadOnly, execHScan)
+}
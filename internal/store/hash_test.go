@@ -0,0 +1,121 @@
+package store
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+	"github.com/myselfBZ/go-redis-clone/pkg/utils"
+)
+
+func TestExecHash(t *testing.T) {
+	testDb.mu.Lock()
+	defer testDb.mu.Unlock()
+
+	key := utils.RandString(defaultKeyLength)
+	strKey := utils.RandString(defaultKeyLength)
+	testDb.put(strKey, &dataEntity{val: []byte("val")})
+
+	tests := []struct {
+		suite
+		exec execCmd
+	}{
+		{suite{"HSET new fields", &resp.Intiger{Data: 2}, toBytes(key, "name", "bob", "age", "30")}, execHSet},
+		{suite{"HSET existing field", &resp.Intiger{Data: 0}, toBytes(key, "name", "alice")}, execHSet},
+		{suite{"HSET odd arguments", resp.ArgNumErr("hset"), toBytes(key, "name")}, execHSet},
+		{suite{"HSETNX existing field", &resp.Intiger{Data: 0}, toBytes(key, "name", "carol")}, execHSetNX},
+		{suite{"HGET", &resp.BulkStr{Data: []byte("alice")}, toBytes(key, "name")}, execHGet},
+		{suite{"HGET missing field", &resp.BulkStr{Data: nil}, toBytes(key, "missing")}, execHGet},
+		{suite{"HMGET", bulkArr("alice", "30"), toBytes(key, "name", "age")}, execHMGet},
+		{suite{"HEXISTS", &resp.Intiger{Data: 1}, toBytes(key, "age")}, execHExists},
+		{suite{"HLEN", &resp.Intiger{Data: 2}, toBytes(key)}, execHLen},
+		{suite{"HSTRLEN", &resp.Intiger{Data: 5}, toBytes(key, "name")}, execHStrLen},
+		{suite{"HINCRBY", &resp.Intiger{Data: 25}, toBytes(key, "age", "-5")}, execHIncrBy},
+		{suite{"HINCRBY non-integer field", resp.MakeErr("ERR hash value is not an integer"), toBytes(key, "name", "1")}, execHIncrBy},
+		{suite{"HINCRBY overflow", resp.MakeErr("ERR increment or decrement would overflow"), toBytes(key, "age", "9223372036854775807")}, execHIncrBy},
+		{suite{"HINCRBYFLOAT new field", &resp.BulkStr{Data: []byte("10.5")}, toBytes(key, "score", "10.5")}, execHIncrByFloat},
+		{suite{"HINCRBYFLOAT", &resp.BulkStr{Data: []byte("10.6")}, toBytes(key, "score", "0.1")}, execHIncrByFloat},
+		{suite{"HINCRBYFLOAT exponent", &resp.BulkStr{Data: []byte("5000")}, toBytes(key, "total", "5.0e3")}, execHIncrByFloat},
+		{suite{"HINCRBYFLOAT invalid increment", resp.NotFloatErr(), toBytes(key, "score", "abc")}, execHIncrByFloat},
+		{suite{"HDEL", &resp.Intiger{Data: 3}, toBytes(key, "name", "age", "total", "missing")}, execHDel},
+		{suite{"HSCAN with MATCH", &resp.Array{Elems: []resp.RespType{&resp.BulkStr{Data: []byte("0")}, bulkArr("score", "10.6")}}, toBytes(key, "0", "MATCH", "s*")}, execHScan},
+		{suite{"HSCAN invalid cursor", resp.MakeErr("ERR invalid cursor"), toBytes(key, "abc")}, execHScan},
+		{suite{"HDEL last field", &resp.Intiger{Data: 1}, toBytes(key, "score")}, execHDel},
+		{suite{"HGETALL missing key", bulkArr(), toBytes(key)}, execHGetAll},
+		{suite{"HGET on string key", resp.WrongTypeErr(), toBytes(strKey, "f")}, execHGet},
+		{suite{"HSET on string key", resp.WrongTypeErr(), toBytes(strKey, "f", "v")}, execHSet},
+	}
+
+	for _, test := range tests {
+		rep := test.exec(testDb, test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+
+	if _, ok := testDb.get(key); ok {
+		t.Fatalf("deleting every field did not delete the key")
+	}
+}
+
+// scanCollection iterates the collection at key with cmd and COUNT 10,
+// calling between after every call. It returns how many times each
+// element was returned, stride being the number of items per element, and
+// how many calls it took.
+func scanCollection(t *testing.T, s *Storage, cmd, key string, stride int, between func()) (map[string]int, int) {
+	t.Helper()
+	seen := make(map[string]int)
+	cursor, calls := "0", 0
+	for {
+		rep := mustExec(t, s, cmd, key, cursor, "COUNT", "10")
+		arr, ok := rep.(*resp.Array)
+		if !ok {
+			t.Fatalf("%s %s: %q", cmd, cursor, rep.ToBytes())
+		}
+		items := parseBulkArr(t, arr.Elems[1])
+		if len(items) > 20*stride {
+			t.Fatalf("%s returned %d items with COUNT 10", cmd, len(items))
+		}
+		for i := 0; i < len(items); i += stride {
+			seen[items[i]]++
+		}
+		between()
+		calls++
+		if cursor = string(arr.Elems[0].(*resp.BulkStr).Data); cursor == "0" {
+			return seen, calls
+		}
+	}
+}
+
+func TestHScanCursor(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+
+	const n = 500
+	for i := 0; i < n; i++ {
+		mustExec(t, s, "HSET", "h", fmt.Sprintf("f%d", i), "v")
+	}
+	added := 0
+	seen, calls := scanCollection(t, s, "HSCAN", "h", 2, func() {
+		mustExec(t, s, "HSET", "h", fmt.Sprintf("new%d", added), "v")
+		mustExec(t, s, "HDEL", "h", "f0")
+		added++
+	})
+	for i := 1; i < n; i++ {
+		if f := fmt.Sprintf("f%d", i); seen[f] != 1 {
+			t.Fatalf("%s returned %d times", f, seen[f])
+		}
+	}
+	if calls < n/20 {
+		t.Fatalf("%d calls for %d fields with COUNT 10", calls, n)
+	}
+	d, _ := s.get("h")
+	if h := d.val.(*hash); h.scan.zsl.length != h.len() {
+		t.Fatalf("%d fields indexed out of %d", h.scan.zsl.length, h.len())
+	}
+
+	if got := mustExec(t, s, "HSCAN", "h", "0", "MATCH", "f1", "COUNT", "1000"); string(got.ToBytes()) != "*2\r\n$1\r\n0\r\n*2\r\n$2\r\nf1\r\n$1\r\nv\r\n" {
+		t.Fatalf("HSCAN with a large COUNT: %q", got.ToBytes())
+	}
+}
@@ -0,0 +1,117 @@
+package store
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+// infoSection renders one section of INFO, with s.mu held
+type infoSection struct {
+	name   string
+	render func(s *Storage, b *strings.Builder)
+}
+
+var infoSections = []infoSection{
+	{"memory", (*Storage).infoMemory},
+	{"stats", (*Storage).infoStats},
+	{"replication", (*Storage).infoReplication},
+	{"cluster", (*Storage).infoCluster},
+	{"keyspace", (*Storage).infoKeyspace},
+}
+
+func (s *Storage) infoCluster(b *strings.Builder) {
+	enabled := 0
+	if s.cluster != nil {
+		enabled = 1
+	}
+	fmt.Fprintf(b, "cluster_enabled:%d\r\n", enabled)
+}
+
+func (s *Storage) infoReplication(b *strings.Builder) {
+	r := s.repl
+	if m := r.master; m != nil {
+		host, port, _ := net.SplitHostPort(m.addr)
+		status, syncing, lastIO := "down", 0, -1
+		if m.state == "connected" {
+			status, lastIO = "up", int(time.Since(m.lastIO).Seconds())
+		}
+		if m.state == "sync" {
+			syncing = 1
+		}
+		fmt.Fprintf(b, "role:slave\r\n")
+		fmt.Fprintf(b, "master_host:%s\r\nmaster_port:%s\r\n", host, port)
+		fmt.Fprintf(b, "master_link_status:%s\r\n", status)
+		fmt.Fprintf(b, "master_last_io_seconds_ago:%d\r\n", lastIO)
+		fmt.Fprintf(b, "master_sync_in_progress:%d\r\n", syncing)
+		fmt.Fprintf(b, "slave_repl_offset:%d\r\n", r.offset)
+		fmt.Fprintf(b, "slave_read_only:1\r\n")
+	} else {
+		fmt.Fprintf(b, "role:master\r\n")
+	}
+
+	fmt.Fprintf(b, "connected_slaves:%d\r\n", len(r.replicas))
+	for i, st := range r.sortedReplicas() {
+		host, port, _ := net.SplitHostPort(st.addr)
+		state := "online"
+		if st.syncing {
+			state = "wait_bgsave"
+		}
+		fmt.Fprintf(b, "slave%d:ip=%s,port=%s,state=%s,offset=%d,lag=%d\r\n",
+			i, host, port, state, st.ackOffset, int(time.Since(st.ackTime).Seconds()))
+	}
+
+	replID2 := r.replID2
+	if replID2 == "" {
+		replID2 = strings.Repeat("0", 40)
+	}
+	fmt.Fprintf(b, "master_replid:%s\r\n", r.replID)
+	fmt.Fprintf(b, "master_replid2:%s\r\n", replID2)
+	fmt.Fprintf(b, "master_repl_offset:%d\r\n", r.offset)
+	fmt.Fprintf(b, "second_repl_offset:%d\r\n", r.secondOffset)
+
+	active, first, histlen := 0, int64(0), 0
+	if r.backlog != nil {
+		active, histlen = 1, len(r.backlog.data)
+		first = r.offset - int64(histlen) + 1
+	}
+	fmt.Fprintf(b, "repl_backlog_active:%d\r\n", active)
+	fmt.Fprintf(b, "repl_backlog_size:%d\r\n", r.backlogSize)
+	fmt.Fprintf(b, "repl_backlog_first_byte_offset:%d\r\n", first)
+	fmt.Fprintf(b, "repl_backlog_histlen:%d\r\n", histlen)
+}
+
+// execInfo renders the requested sections, all of them by default
+func execInfo(db kVStore, args [][]byte) resp.RespType {
+	s := storageOf(db)
+
+	all := len(args) == 0
+	wanted := map[string]bool{}
+	for _, arg := range args {
+		name := strings.ToLower(string(arg))
+		if name == "all" || name == "default" || name == "everything" {
+			all = true
+		}
+		wanted[name] = true
+	}
+
+	var b strings.Builder
+	for _, section := range infoSections {
+		if !all && !wanted[section.name] {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s\r\n", strings.ToUpper(section.name[:1])+section.name[1:])
+		section.render(s, &b)
+	}
+	return &resp.BulkStr{Data: []byte(b.String())}
+}
+
+func init() {
+	registerCommand("info", -1, 0, execInfo)
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"slices"
+	"strconv"
+)
+
+// intset is a sorted slice of integers, it's the compact encoding of small
+// sets whose members are all integers
+type intset []int64
+
+func (is intset) find(v int64) (int, bool) {
+	return slices.BinarySearch(is, v)
+}
+
+func (is intset) contains(v int64) bool {
+	_, ok := is.find(v)
+	return ok
+}
+
+// add inserts v keeping the order, returns false if v is already a member
+func (is *intset) add(v int64) bool {
+	i, ok := is.find(v)
+	if ok {
+		return false
+	}
+	*is = slices.Insert(*is, i, v)
+	return true
+}
+
+// remove deletes v, returns false if v is not a member
+func (is *intset) remove(v int64) bool {
+	i, ok := is.find(v)
+	if !ok {
+		return false
+	}
+	*is = slices.Delete(*is, i, i+1)
+	return true
+}
+
+// parseSetInt reports whether member can be kept in an intset. Only the
+// canonical form of an integer qualifies, "007" or "+7" must stay strings.
+func parseSetInt(member []byte) (int64, bool) {
+	if len(member) == 0 || len(member) > 20 {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(string(member), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if strconv.FormatInt(v, 10) != string(member) {
+		return 0, false
+	}
+	return v, true
+}
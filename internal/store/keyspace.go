@@ -0,0 +1,337 @@
+package store
+
+import (
+	"hash/maphash"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+	"github.com/myselfBZ/go-redis-clone/pkg/utils"
+)
+
+// SCAN walks the shards in order and the keys of a shard in the order of
+// a hash of their own, indexed by the shard. The cursor is the index of
+// the shard followed by the hash to resume from: unlike a position in a Go
+// map it doesn't move when keys are added or deleted, so every key
+// present for the whole iteration is returned. Keys added or deleted
+// meanwhile may or may not be. A call costs O(log n + COUNT) and only
+// locks the shard it reads.
+
+// bits of the cursor taken by the hash, the rest is the shard index. The
+// hash is exact as a skiplist score.
+const scanHashBits = 53
+
+var scanSeed = maphash.MakeSeed()
+
+func scanHash(key string) uint64 {
+	return maphash.String(scanSeed, key) >> (64 - scanHashBits)
+}
+
+// scanIndex orders keys, or the elements of a collection, by scanHash so
+// a cursor can resume from a hash. Updates to a nil index are ignored,
+// collections only keep one past scanSmallLen elements.
+type scanIndex struct {
+	zsl *skiplist
+}
+
+func newScanIndex() *scanIndex {
+	return &scanIndex{zsl: newSkiplist()}
+}
+
+func (ix *scanIndex) add(elem string) {
+	if ix != nil {
+		ix.zsl.insert(float64(scanHash(elem)), elem)
+	}
+}
+
+func (ix *scanIndex) remove(elem string) {
+	if ix != nil {
+		ix.zsl.delete(float64(scanHash(elem)), elem)
+	}
+}
+
+func (ix *scanIndex) memUsage() int64 {
+	if ix == nil {
+		return 0
+	}
+	return int64(ix.zsl.length) * scanIndexOverhead
+}
+
+// from returns the elements whose hash is from or more, in hash order,
+// count of them unless the index runs out first. Elements sharing a hash
+// are never split between two calls, more than count may be returned for
+// it. next is the hash to resume from, zero once the index is done.
+func (ix *scanIndex) from(from uint64, count int) (elems []string, next uint64) {
+	x := ix.zsl.firstInRange(&scoreRange{min: float64(from), max: math.Inf(1)})
+	for ; x != nil; x = x.level[0].forward {
+		if len(elems) >= count && x.score != x.backward.score {
+			return elems, uint64(x.score)
+		}
+		elems = append(elems, x.member)
+	}
+	return elems, 0
+}
+
+// growScanIndex returns the index of a collection of n elements, built
+// from iter the first time n is past scanSmallLen
+func growScanIndex(ix *scanIndex, n int, iter func(fn func(elem string) bool)) *scanIndex {
+	if ix != nil || n <= scanSmallLen {
+		return ix
+	}
+	ix = newScanIndex()
+	iter(func(elem string) bool {
+		ix.add(elem)
+		return true
+	})
+	return ix
+}
+
+// execScan looks at about COUNT keys per call, MATCH and TYPE filter them
+// afterwards like in redis, so a call may return none with a cursor to go
+// on with. It runs next to other commands and read locks the shards it
+// walks one at a time.
+func execScan(db kVStore, args [][]byte) resp.RespType {
+	keyspace := selectedDB(db)
+	opts, errReply := parseScanArgs(args, "TYPE")
+	if errReply != nil {
+		return errReply
+	}
+
+	now := time.Now()
+	items := &resp.RespBulkStrArr{}
+	cursor, visited := uint64(0), 0
+	from := opts.cursor & (1<<scanHashBits - 1)
+	for i := int(opts.cursor >> scanHashBits); i < numShards; i++ {
+		sh := keyspace.shards[i]
+		sh.mu.RLock()
+		keys, next := sh.scan.from(from, opts.count-visited)
+		visited += len(keys)
+		for _, key := range keys {
+			if sh.expired(key, now) {
+				continue
+			}
+			if opts.pattern != "" && !utils.GlobMatch(opts.pattern, key) {
+				continue
+			}
+			if opts.typ != "" && sh.data[key].typ.String() != opts.typ {
+				continue
+			}
+			items.Append([]byte(key))
+		}
+		sh.mu.RUnlock()
+
+		if next != 0 {
+			cursor = uint64(i)<<scanHashBits | next
+			break
+		}
+		from = 0
+		if visited >= opts.count {
+			if i+1 < numShards {
+				cursor = uint64(i+1) << scanHashBits
+			}
+			break
+		}
+	}
+
+	return &resp.Array{
+		Elems: []resp.RespType{
+			&resp.BulkStr{Data: []byte(strconv.FormatUint(cursor, 10))},
+			items,
+		},
+	}
+}
+
+// execKeys returns every key matching the pattern. It walks the whole
+// keyspace with nothing else running, SCAN is the way to go on big ones.
+func execKeys(db kVStore, args [][]byte) resp.RespType {
+	keyspace := selectedDB(db)
+	pattern := string(args[0])
+	now := time.Now()
+	items := &resp.RespBulkStrArr{}
+	for _, sh := range keyspace.shards {
+		for key := range sh.data {
+			if !sh.expired(key, now) && utils.GlobMatch(pattern, key) {
+				items.Append([]byte(key))
+			}
+		}
+	}
+	return items
+}
+
+func execExists(db kVStore, args [][]byte) resp.RespType {
+	n := 0
+	for _, k := range args {
+		if _, ok := db.get(string(k)); ok {
+			n++
+		}
+	}
+	return &resp.Intiger{Data: int64(n)}
+}
+
+func execType(db kVStore, args [][]byte) resp.RespType {
+	d, ok := db.get(string(args[0]))
+	if !ok {
+		return &resp.SimpleStr{Data: []byte("none")}
+	}
+	return &resp.SimpleStr{Data: []byte(d.typ.String())}
+}
+
+// execTouch counts the keys that exist, looking them up updates their
+// access time for the LRU and LFU policies
+func execTouch(db kVStore, args [][]byte) resp.RespType {
+	return execExists(db, args)
+}
+
+func execRename(db kVStore, args [][]byte) resp.RespType {
+	return rename(db, args, false)
+}
+
+func execRenameNX(db kVStore, args [][]byte) resp.RespType {
+	return rename(db, args, true)
+}
+
+// rename moves the value of the first key to the second along with its
+// TTL, replacing what was there unless nx is set
+func rename(db kVStore, args [][]byte, nx bool) resp.RespType {
+	src, dst := string(args[0]), string(args[1])
+	d, ok := db.get(src)
+	if !ok {
+		return resp.MakeErr("ERR no such key")
+	}
+	if src == dst {
+		if nx {
+			return &resp.Intiger{Data: 0}
+		}
+		return resp.OkReply()
+	}
+	if _, exists := db.get(dst); exists && nx {
+		return &resp.Intiger{Data: 0}
+	}
+
+	at, hasTTL := db.getExpiresAt(src)
+	db.remove(src)
+	db.remove(dst)
+	db.put(dst, d)
+	if hasTTL {
+		db.expire(dst, at)
+	}
+	if nx {
+		return &resp.Intiger{Data: 1}
+	}
+	return resp.OkReply()
+}
+
+// execCopy copies the value of the first key to the second along with its
+// TTL, in the selected database or the one of the DB option
+func execCopy(db kVStore, args [][]byte) resp.RespType {
+	srcDB := selectedDB(db)
+	s := srcDB.s
+	dstDB, replace := srcDB, false
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "REPLACE":
+			replace = true
+		case "DB":
+			if i+1 >= len(args) {
+				return resp.SyntaxErr()
+			}
+			n, errReply := s.parseDB(args[i+1])
+			if errReply != nil {
+				return errReply
+			}
+			dstDB = s.dbs[n]
+			i++
+		default:
+			return resp.SyntaxErr()
+		}
+	}
+	if s.cluster != nil && dstDB != srcDB {
+		return resp.MakeErr("ERR Copying to another database is not allowed in cluster mode")
+	}
+
+	src, dst := string(args[0]), string(args[1])
+	if srcDB == dstDB && src == dst {
+		return resp.MakeErr("ERR source and destination objects are the same")
+	}
+	d, ok := srcDB.get(src)
+	if !ok {
+		return &resp.Intiger{Data: 0}
+	}
+	if _, exists := dstDB.get(dst); exists && !replace {
+		return &resp.Intiger{Data: 0}
+	}
+
+	at, hasTTL := srcDB.getExpiresAt(src)
+	dstDB.remove(dst)
+	dstDB.put(dst, d.clone())
+	if hasTTL {
+		dstDB.expire(dst, at)
+	}
+	dstDB.account(dst)
+	return &resp.Intiger{Data: 1}
+}
+
+// execUnlink deletes keys like DEL, the values too big to be freed right
+// away are freed in the background
+func execUnlink(db kVStore, args [][]byte) resp.RespType {
+	s := storageOf(db)
+	n := 0
+	for _, k := range args {
+		d, ok := db.get(string(k))
+		if !ok {
+			continue
+		}
+		db.remove(string(k))
+		s.lazyFree(d)
+		n++
+	}
+	return &resp.Intiger{Data: int64(n)}
+}
+
+// randomKey picks a key of the database, each with the same probability.
+// Expired keys are picked as well.
+func (db *database) randomKey() (string, bool) {
+	n := db.size()
+	if n == 0 {
+		return "", false
+	}
+	i := rand.IntN(n)
+	for _, sh := range db.shards {
+		if i < len(sh.keys) {
+			return sh.keys[i], true
+		}
+		i -= len(sh.keys)
+	}
+	panic("store: the keys of the shards are out of sync")
+}
+
+// execRandomKey deletes the expired keys it picks and tries again, until
+// it finds a live one or the database is empty
+func execRandomKey(db kVStore, args [][]byte) resp.RespType {
+	keyspace := selectedDB(db)
+	for {
+		key, ok := keyspace.randomKey()
+		if !ok {
+			return &resp.BulkStr{Data: nil}
+		}
+		if _, live := keyspace.get(key); live {
+			return &resp.BulkStr{Data: []byte(key)}
+		}
+	}
+}
+
+func init() {
+	registerCommand("keys", 2, 0, execKeys)
+	registerCommand("scan", -2, cmdReadOnly, execScan).withKeys(0, 0, 0)
+	registerCommand("randomkey", 1, 0, execRandomKey)
+	registerCommand("exists", -2, cmdReadOnly, execExists).withKeys(1, -1, 1)
+	registerCommand("type", 2, cmdReadOnly, execType)
+	registerCommand("touch", -2, cmdReadOnly, execTouch).withKeys(1, -1, 1)
+	registerCommand("rename", 3, cmdWrite, execRename).withKeys(1, 2, 1)
+	registerCommand("renamenx", 3, cmdWrite, execRenameNX).withKeys(1, 2, 1)
+	registerCommand("copy", -3, cmdWrite|cmdAlone, execCopy).withKeys(1, 2, 1)
+	registerCommand("unlink", -2, cmdWrite|cmdFreesMemory, execUnlink).withKeys(1, -1, 1)
+}
@@ -0,0 +1,320 @@
+package store
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+// scan runs one SCAN call and returns the next cursor and the keys
+func scan(t *testing.T, s *Storage, args ...string) (string, []string) {
+	t.Helper()
+	rep := mustExec(t, s, append([]string{"SCAN"}, args...)...)
+	arr, ok := rep.(*resp.Array)
+	if !ok {
+		t.Fatalf("SCAN %v: %q", args, rep.ToBytes())
+	}
+	keys := parseBulkArr(t, arr.Elems[1])
+	return string(arr.Elems[0].(*resp.BulkStr).Data), keys
+}
+
+// parseBulkArr decodes the keys out of a KEYS or SCAN reply
+func parseBulkArr(t *testing.T, rep resp.RespType) []string {
+	t.Helper()
+	var keys []string
+	b := rep.ToBytes()
+	var n int
+	fmt.Sscanf(string(b), "*%d\r\n", &n)
+	b = b[len(fmt.Sprintf("*%d\r\n", n)):]
+	for i := 0; i < n; i++ {
+		var size int
+		fmt.Sscanf(string(b), "$%d\r\n", &size)
+		b = b[len(fmt.Sprintf("$%d\r\n", size)):]
+		keys = append(keys, string(b[:size]))
+		b = b[size+2:]
+	}
+	return keys
+}
+
+func TestScanWhileGrowing(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+
+	const n = 1000
+	for i := 0; i < n; i++ {
+		mustExec(t, s, "SET", fmt.Sprintf("old%d", i), "v")
+	}
+
+	seen := make(map[string]int)
+	cursor, calls := "0", 0
+	for {
+		next, keys := scan(t, s, cursor, "COUNT", "10")
+		for _, k := range keys {
+			seen[k]++
+		}
+		// the keyspace keeps changing between calls
+		for j := 0; j < 20; j++ {
+			mustExec(t, s, "SET", fmt.Sprintf("new%d:%d", calls, j), "v")
+		}
+		mustExec(t, s, "DEL", fmt.Sprintf("new%d:0", calls))
+		calls++
+		if cursor = next; cursor == "0" {
+			break
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		if k := fmt.Sprintf("old%d", i); seen[k] != 1 {
+			t.Fatalf("%s returned %d times", k, seen[k])
+		}
+	}
+	if calls < n/10 {
+		t.Fatalf("%d calls for %d keys with COUNT 10", calls, n)
+	}
+}
+
+// SCAN runs next to writers, locking one shard at a time
+func TestScanConcurrent(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+
+	const n = 1000
+	for i := 0; i < n; i++ {
+		mustExec(t, s, "SET", fmt.Sprintf("old%d", i), "v")
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				key := fmt.Sprintf("new%d:%d", g, i%50)
+				s.Exec(toBytes("SET", key, "v", "PX", "1"))
+				s.Exec(toBytes("DEL", key))
+			}
+		}()
+	}
+
+	seen := make(map[string]int)
+	cursor := "0"
+	for {
+		next, keys := scan(t, s, cursor, "COUNT", "10", "MATCH", "old*")
+		for _, k := range keys {
+			seen[k]++
+		}
+		if cursor = next; cursor == "0" {
+			break
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		if k := fmt.Sprintf("old%d", i); seen[k] != 1 {
+			t.Fatalf("%s returned %d times", k, seen[k])
+		}
+	}
+}
+
+func TestScanFilters(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+	mustExec(t, s, "SET", "user:1", "v")
+	mustExec(t, s, "SET", "user:2", "v")
+	mustExec(t, s, "RPUSH", "user:list", "v")
+	mustExec(t, s, "SET", "other", "v")
+	mustExec(t, s, "SET", "gone", "v")
+	mustExec(t, s, "PEXPIREAT", "gone", "1")
+
+	all := func(args ...string) []string {
+		var keys []string
+		cursor := "0"
+		for {
+			next, batch := scan(t, s, append([]string{cursor}, args...)...)
+			keys = append(keys, batch...)
+			if cursor = next; cursor == "0" {
+				break
+			}
+		}
+		slices.Sort(keys)
+		return keys
+	}
+
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{nil, []string{"other", "user:1", "user:2", "user:list"}},
+		{[]string{"MATCH", "user:[0-9]"}, []string{"user:1", "user:2"}},
+		{[]string{"TYPE", "list"}, []string{"user:list"}},
+		{[]string{"MATCH", "user:*", "TYPE", "STRING", "COUNT", "1"}, []string{"user:1", "user:2"}},
+		{[]string{"TYPE", "nosuchtype"}, nil},
+	}
+	for _, test := range tests {
+		if got := all(test.args...); !slices.Equal(got, test.want) {
+			t.Fatalf("SCAN %v = %v, want %v", test.args, got, test.want)
+		}
+	}
+
+	keys := parseBulkArr(t, mustExec(t, s, "KEYS", `user:\*`))
+	if len(keys) != 0 {
+		t.Fatalf("KEYS with an escaped star = %v", keys)
+	}
+	keys = parseBulkArr(t, mustExec(t, s, "KEYS", "*"))
+	slices.Sort(keys)
+	if !slices.Equal(keys, []string{"other", "user:1", "user:2", "user:list"}) {
+		t.Fatalf("KEYS * = %v", keys)
+	}
+
+	expectErr(t, s, "ERR invalid cursor", "SCAN", "abc")
+	if got := mustExec(t, s, "SCAN", "0", "NOVALUES"); string(got.ToBytes()) != string(resp.SyntaxErr().ToBytes()) {
+		t.Fatalf("SCAN with an HSCAN option: %q", got.ToBytes())
+	}
+}
+
+func TestExistsTypeTouch(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+	mustExec(t, s, "SET", "str", "v")
+	mustExec(t, s, "RPUSH", "list", "a")
+	mustExec(t, s, "ZADD", "zset", "1", "a")
+	mustExec(t, s, "SET", "gone", "v")
+	mustExec(t, s, "PEXPIREAT", "gone", "1")
+
+	tests := []suite{
+		{"EXISTS counts repeated keys", &resp.Intiger{Data: 3}, toBytes("EXISTS", "str", "list", "str", "gone", "missing")},
+		{"TYPE string", &resp.SimpleStr{Data: []byte("string")}, toBytes("TYPE", "str")},
+		{"TYPE list", &resp.SimpleStr{Data: []byte("list")}, toBytes("TYPE", "list")},
+		{"TYPE zset", &resp.SimpleStr{Data: []byte("zset")}, toBytes("TYPE", "zset")},
+		{"TYPE expired", &resp.SimpleStr{Data: []byte("none")}, toBytes("TYPE", "gone")},
+		{"TOUCH", &resp.Intiger{Data: 2}, toBytes("TOUCH", "str", "zset", "missing")},
+	}
+	for _, test := range tests {
+		rep, _ := s.Exec(test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+}
+
+func TestRenameAndCopy(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+	mustExec(t, s, "RPUSH", "src", "a", "b")
+	mustExec(t, s, "EXPIRE", "src", "100")
+	mustExec(t, s, "SET", "dst", "old")
+	mustExec(t, s, "EXPIRE", "dst", "1000")
+	mustExec(t, s, "SET", "plain", "v")
+	mustExec(t, s, "SET", "volatile", "v", "EX", "1000")
+
+	tests := []suite{
+		{"RENAMENX onto an existing key", &resp.Intiger{Data: 0}, toBytes("RENAMENX", "src", "dst")},
+		{"RENAME", resp.OkReply(), toBytes("RENAME", "src", "dst")},
+		{"RENAME keeps the value", bulkArr("a", "b"), toBytes("LRANGE", "dst", "0", "-1")},
+		{"RENAME deletes the source", &resp.Intiger{Data: 0}, toBytes("EXISTS", "src")},
+		{"RENAME a missing key", resp.MakeErr("ERR no such key"), toBytes("RENAME", "src", "dst")},
+		{"RENAME onto itself", resp.OkReply(), toBytes("RENAME", "dst", "dst")},
+		{"RENAMENX", &resp.Intiger{Data: 1}, toBytes("RENAMENX", "plain", "renamed")},
+		{"RENAME drops the TTL of the destination", resp.OkReply(), toBytes("RENAME", "renamed", "volatile")},
+		{"TTL after RENAME", &resp.Intiger{Data: -1}, toBytes("TTL", "volatile")},
+
+		{"COPY", &resp.Intiger{Data: 1}, toBytes("COPY", "dst", "copy")},
+		{"COPY onto an existing key", &resp.Intiger{Data: 0}, toBytes("COPY", "dst", "volatile")},
+		{"COPY REPLACE", &resp.Intiger{Data: 1}, toBytes("COPY", "dst", "volatile", "REPLACE")},
+		{"COPY a missing key", &resp.Intiger{Data: 0}, toBytes("COPY", "missing", "volatile")},
+		{"COPY onto itself", resp.MakeErr("ERR source and destination objects are the same"), toBytes("COPY", "dst", "dst")},
+		{"COPY to another database", &resp.Intiger{Data: 1}, toBytes("COPY", "dst", "dst", "DB", "1")},
+		{"COPY to a missing database", resp.MakeErr("ERR DB index is out of range"), toBytes("COPY", "dst", "x", "DB", "16")},
+		{"COPY with a bad option", resp.SyntaxErr(), toBytes("COPY", "dst", "x", "NOPE")},
+		{"the copy is independent", &resp.Intiger{Data: 3}, toBytes("RPUSH", "copy", "c")},
+		{"the source is left alone", bulkArr("a", "b"), toBytes("LRANGE", "dst", "0", "-1")},
+	}
+	for _, test := range tests {
+		rep, _ := s.Exec(test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+
+	for _, key := range []string{"dst", "copy", "volatile"} {
+		if ttl := mustExec(t, s, "TTL", key).(*resp.Intiger).Data; ttl <= 0 || ttl > 100 {
+			t.Fatalf("%s did not get the TTL of the source, got %d", key, ttl)
+		}
+	}
+	other := Session{db: 1}
+	expectSession(t, s, &other, bulkArr("a", "b"), "LRANGE", "dst", "0", "-1")
+	if ttl := sessionExec(t, s, &other, "TTL", "dst").(*resp.Intiger).Data; ttl <= 0 || ttl > 100 {
+		t.Fatalf("COPY to another database lost the TTL, got %d", ttl)
+	}
+}
+
+func TestUnlink(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+	for i := 0; i < 2*lazyfreeThreshold; i++ {
+		mustExec(t, s, "SADD", "big", fmt.Sprintf("member%d", i))
+	}
+	mustExec(t, s, "SET", "small", "v")
+
+	if n := mustExec(t, s, "UNLINK", "big", "small", "missing").(*resp.Intiger).Data; n != 2 {
+		t.Fatalf("UNLINK deleted %d keys", n)
+	}
+	if n := mustExec(t, s, "EXISTS", "big", "small").(*resp.Intiger).Data; n != 0 {
+		t.Fatalf("%d keys left after UNLINK", n)
+	}
+	waitFor(t, "the big set to be freed", func() bool {
+		return s.lazyfreed.Load() == 1 && s.lazyfreePending.Load() == 0
+	})
+	if used := s.used.Load(); used != 0 {
+		t.Fatalf("%d bytes used after UNLINK", used)
+	}
+}
+
+func TestRandomKey(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+	if got := mustExec(t, s, "RANDOMKEY"); got.(*resp.BulkStr).Data != nil {
+		t.Fatalf("RANDOMKEY on an empty database: %q", got.ToBytes())
+	}
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		mustExec(t, s, "SET", fmt.Sprintf("key%d", i), "v")
+	}
+	// expired keys left for RANDOMKEY to find, PEXPIREAT would delete them
+	for i := 0; i < 100; i++ {
+		mustExec(t, s, "SET", fmt.Sprintf("gone%d", i), "v")
+		s.dbs[0].expire(fmt.Sprintf("gone%d", i), time.UnixMilli(1))
+	}
+	mustExec(t, s, "DEL", "key0", "key1")
+
+	seen := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		key := string(mustExec(t, s, "RANDOMKEY").(*resp.BulkStr).Data)
+		seen[key]++
+	}
+	if len(seen) != n-2 {
+		t.Fatalf("RANDOMKEY returned %d different keys, want %d: %v", len(seen), n-2, seen)
+	}
+	for key, count := range seen {
+		if key == "key0" || key == "key1" || strings.HasPrefix(key, "gone") {
+			t.Fatalf("RANDOMKEY returned %s", key)
+		}
+		// about 111 each
+		if count < 40 {
+			t.Fatalf("RANDOMKEY returned %s %d times out of 2000", key, count)
+		}
+	}
+}
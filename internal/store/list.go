@@ -0,0 +1,545 @@
+package store
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+// lookupList returns the list stored at key. If the key holds another type,
+// the returned reply is a WRONGTYPE error. Missing keys yield (nil, nil).
+func lookupList(db kVStore, key string) (*quicklist, resp.RespType) {
+	d, errReply := lookupTyped(db, key, typeList)
+	if d == nil {
+		return nil, errReply
+	}
+	return d.val.(*quicklist), nil
+}
+
+// deleteEmptyList removes the key once its list holds no elements, lists are
+// never kept around empty
+func deleteEmptyList(db kVStore, key string, ql *quicklist) {
+	if ql.len() == 0 {
+		db.remove(key)
+	}
+}
+
+func parseIndex(raw []byte) (int, bool) {
+	i, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return int(i), true
+}
+
+func push(db kVStore, args [][]byte, head bool, onlyExisting bool) resp.RespType {
+	key := string(args[0])
+	ql, errReply := lookupList(db, key)
+	if errReply != nil {
+		return errReply
+	}
+
+	if ql == nil {
+		if onlyExisting {
+			return &resp.Intiger{Data: 0}
+		}
+		ql = newQuicklist()
+		db.put(key, &dataEntity{typ: typeList, val: ql})
+	}
+
+	for _, v := range args[1:] {
+		if head {
+			ql.pushHead(v)
+		} else {
+			ql.pushTail(v)
+		}
+	}
+
+	return &resp.Intiger{
+		Data: int64(ql.len()),
+	}
+}
+
+func execLPush(db kVStore, args [][]byte) resp.RespType {
+	return push(db, args, true, false)
+}
+
+func execRPush(db kVStore, args [][]byte) resp.RespType {
+	return push(db, args, false, false)
+}
+
+func execLPushX(db kVStore, args [][]byte) resp.RespType {
+	return push(db, args, true, true)
+}
+
+func execRPushX(db kVStore, args [][]byte) resp.RespType {
+	return push(db, args, false, true)
+}
+
+func pop(db kVStore, args [][]byte, head bool) resp.RespType {
+	if len(args) > 2 {
+		return resp.SyntaxErr()
+	}
+
+	key := string(args[0])
+
+	count := -1
+	if len(args) == 2 {
+		c, ok := parseIndex(args[1])
+		if !ok || c < 0 {
+			return resp.MakeErr("ERR value is out of range, must be positive")
+		}
+		count = c
+	}
+
+	ql, errReply := lookupList(db, key)
+	if errReply != nil {
+		return errReply
+	}
+
+	if ql == nil {
+		if count >= 0 {
+			return &resp.NullArray{}
+		}
+		return &resp.BulkStr{Data: nil}
+	}
+
+	popFn := ql.popTail
+	if head {
+		popFn = ql.popHead
+	}
+
+	if count < 0 {
+		v, _ := popFn()
+		deleteEmptyList(db, key, ql)
+		return &resp.BulkStr{Data: v}
+	}
+
+	arr := &resp.RespBulkStrArr{}
+	for range count {
+		v, ok := popFn()
+		if !ok {
+			break
+		}
+		arr.Append(v)
+	}
+	deleteEmptyList(db, key, ql)
+	return arr
+}
+
+func execLPop(db kVStore, args [][]byte) resp.RespType {
+	return pop(db, args, true)
+}
+
+func execRPop(db kVStore, args [][]byte) resp.RespType {
+	return pop(db, args, false)
+}
+
+func execLLen(db kVStore, args [][]byte) resp.RespType {
+	ql, errReply := lookupList(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if ql == nil {
+		return &resp.Intiger{Data: 0}
+	}
+	return &resp.Intiger{
+		Data: int64(ql.len()),
+	}
+}
+
+func execLRange(db kVStore, args [][]byte) resp.RespType {
+	start, ok := parseIndex(args[1])
+	if !ok {
+		return resp.NotInErr()
+	}
+	stop, ok := parseIndex(args[2])
+	if !ok {
+		return resp.NotInErr()
+	}
+
+	ql, errReply := lookupList(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+
+	arr := &resp.RespBulkStrArr{}
+	if ql == nil {
+		return arr
+	}
+
+	start, stop, ok = ql.rangeNormalize(start, stop)
+	if !ok {
+		return arr
+	}
+
+	ql.iterRange(start, stop, func(v []byte) {
+		arr.Append(v)
+	})
+	return arr
+}
+
+func execLIndex(db kVStore, args [][]byte) resp.RespType {
+	i, ok := parseIndex(args[1])
+	if !ok {
+		return resp.NotInErr()
+	}
+
+	ql, errReply := lookupList(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if ql == nil {
+		return &resp.BulkStr{Data: nil}
+	}
+
+	v, _ := ql.index(i)
+	return &resp.BulkStr{
+		Data: v,
+	}
+}
+
+func execLSet(db kVStore, args [][]byte) resp.RespType {
+	i, ok := parseIndex(args[1])
+	if !ok {
+		return resp.NotInErr()
+	}
+
+	ql, errReply := lookupList(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if ql == nil {
+		return resp.MakeErr("ERR no such key")
+	}
+
+	if !ql.set(i, args[2]) {
+		return resp.MakeErr("ERR index out of range")
+	}
+	return resp.OkReply()
+}
+
+func execLRem(db kVStore, args [][]byte) resp.RespType {
+	key := string(args[0])
+	count, ok := parseIndex(args[1])
+	if !ok {
+		return resp.NotInErr()
+	}
+
+	ql, errReply := lookupList(db, key)
+	if errReply != nil {
+		return errReply
+	}
+	if ql == nil {
+		return &resp.Intiger{Data: 0}
+	}
+
+	removed := ql.remove(count, args[2])
+	deleteEmptyList(db, key, ql)
+	return &resp.Intiger{
+		Data: int64(removed),
+	}
+}
+
+func execLTrim(db kVStore, args [][]byte) resp.RespType {
+	key := string(args[0])
+	start, ok := parseIndex(args[1])
+	if !ok {
+		return resp.NotInErr()
+	}
+	stop, ok := parseIndex(args[2])
+	if !ok {
+		return resp.NotInErr()
+	}
+
+	ql, errReply := lookupList(db, key)
+	if errReply != nil {
+		return errReply
+	}
+	if ql == nil {
+		return resp.OkReply()
+	}
+
+	ql.trim(start, stop)
+	deleteEmptyList(db, key, ql)
+	return resp.OkReply()
+}
+
+func execLInsert(db kVStore, args [][]byte) resp.RespType {
+	after := false
+	switch strings.ToUpper(string(args[1])) {
+	case "BEFORE":
+	case "AFTER":
+		after = true
+	default:
+		return resp.SyntaxErr()
+	}
+
+	ql, errReply := lookupList(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if ql == nil {
+		return &resp.Intiger{Data: 0}
+	}
+
+	if !ql.insert(args[2], args[3], after) {
+		return &resp.Intiger{Data: -1}
+	}
+	return &resp.Intiger{
+		Data: int64(ql.len()),
+	}
+}
+
+func execLPos(db kVStore, args [][]byte) resp.RespType {
+	rank, count, maxLen := 1, -1, 0
+
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		if i+1 >= len(args) {
+			return resp.SyntaxErr()
+		}
+		val, ok := parseIndex(args[i+1])
+		if !ok {
+			return resp.NotInErr()
+		}
+		i++
+
+		switch opt {
+		case "RANK":
+			if val == 0 {
+				return resp.MakeErr("ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list")
+			}
+			rank = val
+		case "COUNT":
+			if val < 0 {
+				return resp.MakeErr("ERR COUNT can't be negative")
+			}
+			count = val
+		case "MAXLEN":
+			if val < 0 {
+				return resp.MakeErr("ERR MAXLEN can't be negative")
+			}
+			maxLen = val
+		default:
+			return resp.SyntaxErr()
+		}
+	}
+
+	ql, errReply := lookupList(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+
+	matches := make([]int64, 0)
+	if ql != nil {
+		want := count
+		if want == 0 {
+			want = ql.len()
+		}
+		if want < 0 {
+			want = 1
+		}
+
+		skip := rank - 1
+		if rank < 0 {
+			skip = -rank - 1
+		}
+
+		visit := func(i int, v []byte) bool {
+			if maxLen > 0 {
+				scanned := i + 1
+				if rank < 0 {
+					scanned = ql.len() - i
+				}
+				if scanned > maxLen {
+					return false
+				}
+			}
+			if !bytes.Equal(v, args[1]) {
+				return true
+			}
+			if skip > 0 {
+				skip--
+				return true
+			}
+			matches = append(matches, int64(i))
+			return len(matches) < want
+		}
+
+		if rank > 0 {
+			ql.iter(visit)
+		} else {
+			ql.iterReverse(visit)
+		}
+	}
+
+	if count < 0 {
+		if len(matches) == 0 {
+			return &resp.BulkStr{Data: nil}
+		}
+		return &resp.Intiger{Data: matches[0]}
+	}
+
+	arr := &resp.Array{}
+	for _, m := range matches {
+		arr.Append(&resp.Intiger{Data: m})
+	}
+	return arr
+}
+
+// move pops an element from one end of src and pushes it to one end of dst,
+// it's the shared implementation of LMOVE and RPOPLPUSH
+func move(db kVStore, srcKey, dstKey string, fromHead, toHead bool) resp.RespType {
+	src, errReply := lookupList(db, srcKey)
+	if errReply != nil {
+		return errReply
+	}
+	if src == nil {
+		return &resp.BulkStr{Data: nil}
+	}
+
+	dst, errReply := lookupList(db, dstKey)
+	if errReply != nil {
+		return errReply
+	}
+
+	var v []byte
+	if fromHead {
+		v, _ = src.popHead()
+	} else {
+		v, _ = src.popTail()
+	}
+
+	if dst == nil {
+		dst = newQuicklist()
+		db.put(dstKey, &dataEntity{typ: typeList, val: dst})
+	}
+
+	if toHead {
+		dst.pushHead(v)
+	} else {
+		dst.pushTail(v)
+	}
+
+	deleteEmptyList(db, srcKey, src)
+	return &resp.BulkStr{
+		Data: v,
+	}
+}
+
+func parseDirection(raw []byte) (head bool, ok bool) {
+	switch strings.ToUpper(string(raw)) {
+	case "LEFT":
+		return true, true
+	case "RIGHT":
+		return false, true
+	}
+	return false, false
+}
+
+func execLMove(db kVStore, args [][]byte) resp.RespType {
+	fromHead, ok := parseDirection(args[2])
+	if !ok {
+		return resp.SyntaxErr()
+	}
+	toHead, ok := parseDirection(args[3])
+	if !ok {
+		return resp.SyntaxErr()
+	}
+	return move(db, string(args[0]), string(args[1]), fromHead, toHead)
+}
+
+func execRPopLPush(db kVStore, args [][]byte) resp.RespType {
+	return move(db, string(args[0]), string(args[1]), false, true)
+}
+
+// blockingPop pops from the first non empty list of keys, blocking when
+// they are all empty. It's logged as the matching LPOP or RPOP.
+func blockingPop(db kVStore, args [][]byte, head bool) resp.RespType {
+	keys := args[:len(args)-1]
+	timeout, errReply := parseTimeout(args[len(args)-1])
+	if errReply != nil {
+		return errReply
+	}
+
+	for _, key := range keys {
+		ql, errReply := lookupList(db, string(key))
+		if errReply != nil {
+			return errReply
+		}
+		if ql == nil {
+			continue
+		}
+
+		var v []byte
+		if head {
+			v, _ = ql.popHead()
+			db.propagate(cmdArgv("lpop", key))
+		} else {
+			v, _ = ql.popTail()
+			db.propagate(cmdArgv("rpop", key))
+		}
+		deleteEmptyList(db, string(key), ql)
+
+		reply := &resp.RespBulkStrArr{}
+		reply.Append(key)
+		reply.Append(v)
+		return reply
+	}
+	return &blockOn{keys: keys, timeout: timeout, timeoutReply: &resp.NullArray{}}
+}
+
+func execBLPop(db kVStore, args [][]byte) resp.RespType {
+	return blockingPop(db, args, true)
+}
+
+func execBRPop(db kVStore, args [][]byte) resp.RespType {
+	return blockingPop(db, args, false)
+}
+
+func execBLMove(db kVStore, args [][]byte) resp.RespType {
+	fromHead, ok := parseDirection(args[2])
+	if !ok {
+		return resp.SyntaxErr()
+	}
+	toHead, ok := parseDirection(args[3])
+	if !ok {
+		return resp.SyntaxErr()
+	}
+	timeout, errReply := parseTimeout(args[4])
+	if errReply != nil {
+		return errReply
+	}
+
+	reply := move(db, string(args[0]), string(args[1]), fromHead, toHead)
+	if v, ok := reply.(*resp.BulkStr); ok && v.Data == nil {
+		return &blockOn{keys: args[:1], timeout: timeout, timeoutReply: reply}
+	}
+	db.propagate(cmdArgv("lmove", args[:4]...))
+	return reply
+}
+
+func init() {
+	registerCommand("lpush", -3, cmdWrite, execLPush)
+	registerCommand("rpush", -3, cmdWrite, execRPush)
+	registerCommand("lpushx", -3, cmdWrite, execLPushX)
+	registerCommand("rpushx", -3, cmdWrite, execRPushX)
+	registerCommand("lpop", -2, cmdWrite|cmdFreesMemory, execLPop)
+	registerCommand("rpop", -2, cmdWrite|cmdFreesMemory, execRPop)
+	registerCommand("llen", 2, cmdReadOnly, execLLen)
+	registerCommand("lrange", 4, cmdReadOnly, execLRange)
+	registerCommand("lindex", 3, cmdReadOnly, execLIndex)
+	registerCommand("lset", 4, cmdWrite, execLSet)
+	registerCommand("lrem", 4, cmdWrite|cmdFreesMemory, execLRem)
+	registerCommand("ltrim", 4, cmdWrite|cmdFreesMemory, execLTrim)
+	registerCommand("linsert", 5, cmdWrite, execLInsert)
+	registerCommand("lpos", -3, cmdReadOnly, execLPos)
+	registerCommand("lmove", 5, cmdWrite, execLMove).withKeys(1, 2, 1)
+	registerCommand("rpoplpush", 3, cmdWrite, execRPopLPush).withKeys(1, 2, 1)
+	registerCommand("blpop", -3, cmdWrite|cmdFreesMemory, execBLPop).withKeys(1, -2, 1)
+	registerCommand("brpop", -3, cmdWrite|cmdFreesMemory, execBRPop).withKeys(1, -2, 1)
+	registerCommand("blmove", 6, cmdWrite, execBLMove).withKeys(1, 2, 1)
+}
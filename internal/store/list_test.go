@@ -0,0 +1,96 @@
+package store
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+	"github.com/myselfBZ/go-redis-clone/pkg/utils"
+)
+
+func bulkArr(vals ...string) *resp.RespBulkStrArr {
+	arr := &resp.RespBulkStrArr{}
+	for _, v := range vals {
+		arr.Append([]byte(v))
+	}
+	return arr
+}
+
+func TestExecListPushPop(t *testing.T) {
+	testDb.mu.Lock()
+	defer testDb.mu.Unlock()
+
+	key := utils.RandString(defaultKeyLength)
+	strKey := utils.RandString(defaultKeyLength)
+	testDb.put(strKey, &dataEntity{val: []byte("val")})
+
+	tests := []struct {
+		suite
+		exec execCmd
+	}{
+		{suite{"RPUSH on new key", &resp.Intiger{Data: 3}, toBytes(key, "a", "b", "c")}, execRPush},
+		{suite{"LPUSH on existing key", &resp.Intiger{Data: 4}, toBytes(key, "z")}, execLPush},
+		{suite{"LPUSHX on missing key", &resp.Intiger{Data: 0}, toBytes(key+"missing", "a")}, execLPushX},
+		{suite{"LRANGE whole list", bulkArr("z", "a", "b", "c"), toBytes(key, "0", "-1")}, execLRange},
+		{suite{"LRANGE out of range", bulkArr(), toBytes(key, "10", "20")}, execLRange},
+		{suite{"LLEN", &resp.Intiger{Data: 4}, toBytes(key)}, execLLen},
+		{suite{"LPOP", &resp.BulkStr{Data: []byte("z")}, toBytes(key)}, execLPop},
+		{suite{"RPOP with count", bulkArr("c", "b"), toBytes(key, "2")}, execRPop},
+		{suite{"LPOP with negative count", resp.MakeErr("ERR value is out of range, must be positive"), toBytes(key, "-1")}, execLPop},
+		{suite{"LPOP last element", &resp.BulkStr{Data: []byte("a")}, toBytes(key)}, execLPop},
+		{suite{"LPOP on missing key", &resp.BulkStr{Data: nil}, toBytes(key)}, execLPop},
+		{suite{"LPOP with count on missing key", &resp.NullArray{}, toBytes(key, "1")}, execLPop},
+		{suite{"LPUSH on string key", resp.WrongTypeErr(), toBytes(strKey, "a")}, execLPush},
+		{suite{"LLEN on string key", resp.WrongTypeErr(), toBytes(strKey)}, execLLen},
+	}
+
+	for _, test := range tests {
+		rep := test.exec(testDb, test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+
+	if _, ok := testDb.get(key); ok {
+		t.Fatalf("popping every element did not delete the key")
+	}
+}
+
+func TestExecListModify(t *testing.T) {
+	testDb.mu.Lock()
+	defer testDb.mu.Unlock()
+
+	key := utils.RandString(defaultKeyLength)
+	execRPush(testDb, toBytes(key, "a", "b", "a", "c", "a"))
+
+	tests := []struct {
+		suite
+		exec execCmd
+	}{
+		{suite{"LINDEX negative", &resp.BulkStr{Data: []byte("c")}, toBytes(key, "-2")}, execLIndex},
+		{suite{"LINDEX out of range", &resp.BulkStr{Data: nil}, toBytes(key, "10")}, execLIndex},
+		{suite{"LSET", resp.OkReply(), toBytes(key, "1", "B")}, execLSet},
+		{suite{"LSET out of range", resp.MakeErr("ERR index out of range"), toBytes(key, "10", "B")}, execLSet},
+		{suite{"LSET on missing key", resp.MakeErr("ERR no such key"), toBytes(key+"missing", "0", "B")}, execLSet},
+		{suite{"LREM from tail", &resp.Intiger{Data: 2}, toBytes(key, "-2", "a")}, execLRem},
+		{suite{"LRANGE after LREM", bulkArr("a", "B", "c"), toBytes(key, "0", "-1")}, execLRange},
+		{suite{"LINSERT after", &resp.Intiger{Data: 4}, toBytes(key, "AFTER", "B", "b")}, execLInsert},
+		{suite{"LINSERT missing pivot", &resp.Intiger{Data: -1}, toBytes(key, "BEFORE", "x", "b")}, execLInsert},
+		{suite{"LPOS", &resp.Intiger{Data: 2}, toBytes(key, "b")}, execLPos},
+		{suite{"LTRIM", resp.OkReply(), toBytes(key, "1", "2")}, execLTrim},
+		{suite{"LRANGE after LTRIM", bulkArr("B", "b"), toBytes(key, "0", "-1")}, execLRange},
+		{suite{"LMOVE", &resp.BulkStr{Data: []byte("b")}, toBytes(key, key+"dst", "RIGHT", "LEFT")}, execLMove},
+		{suite{"LTRIM to empty", resp.OkReply(), toBytes(key, "5", "10")}, execLTrim},
+	}
+
+	for _, test := range tests {
+		rep := test.exec(testDb, test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+
+	if _, ok := testDb.get(key); ok {
+		t.Fatalf("LTRIM to an empty range did not delete the key")
+	}
+}
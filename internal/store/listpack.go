@@ -0,0 +1,193 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// listpacks are the compact encoding redis uses for small collections and
+// stream nodes. They are only used by the RDB format here.
+
+const (
+	listpackHeaderSize = 6
+	listpackEOF        = 0xFF
+)
+
+var errBadListpack = errors.New("invalid listpack")
+
+type listpackWriter struct {
+	body  []byte
+	count int
+}
+
+// lpBacklen encodes the size of an entry so a listpack can be walked
+// backwards
+func lpBacklen(l int) []byte {
+	switch {
+	case l <= 127:
+		return []byte{byte(l)}
+	case l < 16383:
+		return []byte{byte(l >> 7), byte(l&127) | 128}
+	case l < 2097151:
+		return []byte{byte(l >> 14), byte((l>>7)&127) | 128, byte(l&127) | 128}
+	case l < 268435455:
+		return []byte{byte(l >> 21), byte((l>>14)&127) | 128, byte((l>>7)&127) | 128, byte(l&127) | 128}
+	}
+	return []byte{byte(l >> 28), byte((l>>21)&127) | 128, byte((l>>14)&127) | 128, byte((l>>7)&127) | 128, byte(l&127) | 128}
+}
+
+func (w *listpackWriter) appendEntry(entry []byte) {
+	w.body = append(w.body, entry...)
+	w.body = append(w.body, lpBacklen(len(entry))...)
+	w.count++
+}
+
+func (w *listpackWriter) appendInt(v int64) {
+	var entry []byte
+	switch {
+	case v >= 0 && v <= 127:
+		entry = []byte{byte(v)}
+	case v >= -4096 && v <= 4095:
+		uv := uint64(v) & 0x1FFF
+		entry = []byte{byte(uv>>8) | 0xC0, byte(uv)}
+	case v >= -32768 && v <= 32767:
+		entry = binary.LittleEndian.AppendUint16([]byte{0xF1}, uint16(v))
+	case v >= -8388608 && v <= 8388607:
+		uv := uint32(v)
+		entry = []byte{0xF2, byte(uv), byte(uv >> 8), byte(uv >> 16)}
+	case v >= -2147483648 && v <= 2147483647:
+		entry = binary.LittleEndian.AppendUint32([]byte{0xF3}, uint32(v))
+	default:
+		entry = binary.LittleEndian.AppendUint64([]byte{0xF4}, uint64(v))
+	}
+	w.appendEntry(entry)
+}
+
+func (w *listpackWriter) appendString(s []byte) {
+	var entry []byte
+	switch {
+	case len(s) < 64:
+		entry = append([]byte{0x80 | byte(len(s))}, s...)
+	case len(s) < 4096:
+		entry = append([]byte{0xE0 | byte(len(s)>>8), byte(len(s))}, s...)
+	default:
+		entry = binary.LittleEndian.AppendUint32([]byte{0xF0}, uint32(len(s)))
+		entry = append(entry, s...)
+	}
+	w.appendEntry(entry)
+}
+
+func (w *listpackWriter) bytes() []byte {
+	total := listpackHeaderSize + len(w.body) + 1
+	buf := make([]byte, 0, total)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(total))
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(min(w.count, 65535)))
+	buf = append(buf, w.body...)
+	return append(buf, listpackEOF)
+}
+
+// decodeListpack returns the elements of a listpack, integers are returned
+// in their decimal form
+func decodeListpack(lp []byte) ([][]byte, error) {
+	if len(lp) < listpackHeaderSize+1 || int(binary.LittleEndian.Uint32(lp)) != len(lp) {
+		return nil, errBadListpack
+	}
+
+	var elems [][]byte
+	p := lp[listpackHeaderSize:]
+	for {
+		if len(p) == 0 {
+			return nil, errBadListpack
+		}
+		if p[0] == listpackEOF {
+			return elems, nil
+		}
+
+		elem, size, err := lpDecodeEntry(p)
+		if err != nil {
+			return nil, err
+		}
+		size += len(lpBacklen(size))
+		if size > len(p) {
+			return nil, errBadListpack
+		}
+		elems = append(elems, elem)
+		p = p[size:]
+	}
+}
+
+// lpDecodeEntry decodes the entry at the start of p, returns its value and
+// the size of its encoding without the backlen
+func lpDecodeEntry(p []byte) ([]byte, int, error) {
+	need := func(n int) error {
+		if len(p) < n {
+			return errBadListpack
+		}
+		return nil
+	}
+	str := func(hdr, n int) ([]byte, int, error) {
+		if err := need(hdr + n); err != nil {
+			return nil, 0, err
+		}
+		return p[hdr : hdr+n], hdr + n, nil
+	}
+	num := func(v int64, size int) ([]byte, int, error) {
+		return strconv.AppendInt(nil, v, 10), size, nil
+	}
+
+	b := p[0]
+	switch {
+	case b&0x80 == 0:
+		return num(int64(b), 1)
+	case b&0xC0 == 0x80:
+		return str(1, int(b&0x3F))
+	case b&0xE0 == 0xC0:
+		if err := need(2); err != nil {
+			return nil, 0, err
+		}
+		uv := int64(b&0x1F)<<8 | int64(p[1])
+		if uv >= 1<<12 {
+			uv -= 1 << 13
+		}
+		return num(uv, 2)
+	case b&0xF0 == 0xE0:
+		if err := need(2); err != nil {
+			return nil, 0, err
+		}
+		return str(2, int(b&0x0F)<<8|int(p[1]))
+	}
+
+	switch b {
+	case 0xF0:
+		if err := need(5); err != nil {
+			return nil, 0, err
+		}
+		return str(5, int(binary.LittleEndian.Uint32(p[1:])))
+	case 0xF1:
+		if err := need(3); err != nil {
+			return nil, 0, err
+		}
+		return num(int64(int16(binary.LittleEndian.Uint16(p[1:]))), 3)
+	case 0xF2:
+		if err := need(4); err != nil {
+			return nil, 0, err
+		}
+		uv := int64(p[1]) | int64(p[2])<<8 | int64(p[3])<<16
+		if uv >= 1<<23 {
+			uv -= 1 << 24
+		}
+		return num(uv, 4)
+	case 0xF3:
+		if err := need(5); err != nil {
+			return nil, 0, err
+		}
+		return num(int64(int32(binary.LittleEndian.Uint32(p[1:]))), 5)
+	case 0xF4:
+		if err := need(9); err != nil {
+			return nil, 0, err
+		}
+		return num(int64(binary.LittleEndian.Uint64(p[1:])), 9)
+	}
+	return nil, 0, errBadListpack
+}
@@ -0,0 +1,365 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+var errBadDump = errors.New("DUMP payload version or checksum are wrong")
+
+// dumpValue serializes the value of d like DUMP does: its RDB encoding
+// followed by the RDB version and a CRC64 of the whole, little endian
+func dumpValue(d *dataEntity) []byte {
+	var buf bytes.Buffer
+	w := &rdbWriter{w: bufio.NewWriter(&buf)}
+	w.writeByte(rdbValueType(d))
+	w.writeValue(d)
+	w.write(binary.LittleEndian.AppendUint16(nil, rdbVersion))
+	w.write(binary.LittleEndian.AppendUint64(nil, w.crc))
+	w.w.Flush()
+	return buf.Bytes()
+}
+
+// restoreValue parses a payload made by DUMP, by us or by redis
+func restoreValue(payload []byte) (*dataEntity, error) {
+	if len(payload) < 11 {
+		return nil, errBadDump
+	}
+	body, trailer := payload[:len(payload)-10], payload[len(payload)-10:]
+	version := binary.LittleEndian.Uint16(trailer)
+	sum := binary.LittleEndian.Uint64(trailer[2:])
+	if version > rdbMaxVersion || sum != crc64Update(0, payload[:len(payload)-8]) {
+		return nil, errBadDump
+	}
+
+	r := &rdbReader{r: bufio.NewReader(bytes.NewReader(body))}
+	typ, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	d, err := r.readEntity(typ)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.r.ReadByte(); err == nil {
+		return nil, errBadRDB
+	}
+	return d, nil
+}
+
+func execDump(db kVStore, args [][]byte) resp.RespType {
+	d, ok := db.get(string(args[0]))
+	if !ok {
+		return &resp.BulkStr{Data: nil}
+	}
+	return &resp.BulkStr{Data: dumpValue(d)}
+}
+
+// execRestore creates a key from a DUMP payload. It's logged with an
+// absolute TTL so a replay doesn't extend it.
+func execRestore(db kVStore, args [][]byte) resp.RespType {
+	key := string(args[0])
+	ttl, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return resp.NotInErr()
+	}
+	if ttl < 0 {
+		return resp.MakeErr("ERR Invalid TTL value, must be >= 0")
+	}
+
+	replace, absTTL := false, false
+	// what the eviction policies know of the key at the source
+	idle, freq := int64(-1), int64(-1)
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); opt {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		case "IDLETIME", "FREQ":
+			if i+1 >= len(args) {
+				return resp.SyntaxErr()
+			}
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return resp.NotInErr()
+			}
+			if opt == "IDLETIME" && n < 0 {
+				return resp.MakeErr("ERR Invalid IDLETIME value, must be >= 0")
+			}
+			if opt == "FREQ" && (n < 0 || n > 255) {
+				return resp.MakeErr("ERR Invalid FREQ value, must be >= 0 and <= 255")
+			}
+			if opt == "IDLETIME" {
+				idle = n
+			} else {
+				freq = n
+			}
+			i++
+		default:
+			return resp.SyntaxErr()
+		}
+	}
+
+	if _, exists := db.get(key); exists && !replace {
+		return resp.MakeErr("BUSYKEY Target key name already exists.")
+	}
+	d, err := restoreValue(args[2])
+	if errors.Is(err, errBadDump) {
+		return resp.MakeErr("ERR " + errBadDump.Error())
+	}
+	if err != nil {
+		return resp.MakeErr("ERR Bad data format")
+	}
+
+	var at time.Time
+	if ttl > 0 {
+		at = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		if absTTL {
+			at = time.UnixMilli(ttl)
+		}
+	}
+	removed := db.remove(key)
+	if !at.IsZero() && time.Now().After(at) {
+		// expired already, all that's left is to drop the key it replaces
+		if removed == 1 {
+			db.propagate(cmdArgv("del", args[0]))
+		} else {
+			db.propagate()
+		}
+		return resp.OkReply()
+	}
+
+	db.put(key, d)
+	if idle >= 0 {
+		d.atime.Store(time.Now().UnixMilli() - idle*1000)
+	}
+	if freq >= 0 {
+		d.freq.Store(uint32(freq))
+	}
+	logged := cmdArgv("restore", args[0], []byte("0"), args[2], []byte("REPLACE"))
+	if !at.IsZero() {
+		db.expire(key, at)
+		logged[2] = strconv.AppendInt(nil, at.UnixMilli(), 10)
+		logged = append(logged, []byte("ABSTTL"))
+	}
+	db.propagate(logged)
+	return resp.OkReply()
+}
+
+// migrateKeys returns the key of MIGRATE, or the ones following KEYS when
+// it's empty
+func migrateKeys(cmd [][]byte) [][]byte {
+	if len(cmd[3]) > 0 {
+		return cmd[3:4]
+	}
+	for i := 6; i < len(cmd); i++ {
+		if strings.EqualFold(string(cmd[i]), "KEYS") {
+			return cmd[i+1:]
+		}
+	}
+	return nil
+}
+
+// execMigrate moves keys to another instance with RESTORE. A key is
+// deleted once the target acknowledged it, unless COPY is given or it was
+// written while the locks were released to wait for the target.
+func execMigrate(db kVStore, args [][]byte) resp.RespType {
+	s := storageOf(db)
+
+	addr := net.JoinHostPort(string(args[0]), string(args[1]))
+	destDB, err := strconv.Atoi(string(args[3]))
+	if err != nil || destDB < 0 {
+		return resp.NotInErr()
+	}
+	ms, err := strconv.ParseInt(string(args[4]), 10, 64)
+	if err != nil {
+		return resp.NotInErr()
+	}
+	timeout := time.Duration(ms) * time.Millisecond
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+
+	copyKeys, replace := false, false
+	var auth [][]byte
+	keys := args[2:3]
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "COPY":
+			copyKeys = true
+		case "REPLACE":
+			replace = true
+		case "AUTH":
+			if i+1 >= len(args) {
+				return resp.SyntaxErr()
+			}
+			auth = cmdArgv("auth", args[i+1])
+			i++
+		case "AUTH2":
+			if i+2 >= len(args) {
+				return resp.SyntaxErr()
+			}
+			auth = cmdArgv("auth", args[i+1], args[i+2])
+			i += 2
+		case "KEYS":
+			if len(args[2]) != 0 {
+				return resp.MakeErr("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			keys = args[i+1:]
+			i = len(args)
+		default:
+			return resp.SyntaxErr()
+		}
+	}
+
+	// the target runs RESTORE on a slot it may only be importing
+	restore := "restore"
+	if s.cluster != nil {
+		restore = "restore-asking"
+	}
+	var cmds [][][]byte
+	if auth != nil {
+		cmds = append(cmds, auth)
+	}
+	if destDB != 0 {
+		cmds = append(cmds, cmdArgv("select", args[3]))
+	}
+	setup := len(cmds)
+
+	var moving [][]byte
+	// what was sent of every key, to tell if it's unchanged afterwards
+	var payloads [][]byte
+	var expiresAt []time.Time
+	now := time.Now()
+	for _, k := range keys {
+		d, ok := db.get(string(k))
+		if !ok {
+			continue
+		}
+		ttl := int64(0)
+		at, ok := db.getExpiresAt(string(k))
+		if ok {
+			ttl = max(at.Sub(now).Milliseconds(), 1)
+		}
+		payload := dumpValue(d)
+		cmd := cmdArgv(restore, k, strconv.AppendInt(nil, ttl, 10), payload)
+		if replace {
+			cmd = append(cmd, []byte("REPLACE"))
+		}
+		cmds = append(cmds, cmd)
+		moving = append(moving, k)
+		payloads = append(payloads, payload)
+		expiresAt = append(expiresAt, at)
+	}
+	if len(moving) == 0 {
+		db.propagate()
+		return &resp.SimpleStr{Data: []byte("NOKEY")}
+	}
+
+	var buf []byte
+	for _, cmd := range cmds {
+		buf = append(buf, encodeCommand(cmd)...)
+	}
+	// the error replies of the target, nil for the commands it accepted
+	var replies []error
+	var errReply, ioErr *resp.RespErr
+	wait := func(fn func()) bool {
+		fn()
+		return true
+	}
+	if ctx, ok := db.(*callCtx); ok {
+		wait = ctx.unlocked
+	}
+	selected := wait(func() {
+		replies, ioErr = migrateRoundTrip(addr, timeout, buf, len(cmds), setup)
+	})
+
+	var deleted [][]byte
+	for i, err := range replies {
+		if err != nil {
+			errReply = resp.MakeErr("ERR Target instance replied with error: " + err.Error())
+			continue
+		}
+		if i < setup || copyKeys || !selected {
+			continue
+		}
+		k := moving[i-setup]
+		d, ok := db.get(string(k))
+		if !ok {
+			continue
+		}
+		at, _ := db.getExpiresAt(string(k))
+		if !at.Equal(expiresAt[i-setup]) || !bytes.Equal(dumpValue(d), payloads[i-setup]) {
+			continue
+		}
+		db.remove(string(k))
+		deleted = append(deleted, k)
+	}
+
+	if len(deleted) > 0 {
+		db.propagate(cmdArgv("del", deleted...))
+	} else {
+		db.propagate()
+	}
+	if ioErr != nil {
+		return ioErr
+	}
+	if errReply != nil {
+		return errReply
+	}
+	return resp.OkReply()
+}
+
+// migrateRoundTrip sends the commands of MIGRATE in buf and reads what the
+// target replied to each, up to the first AUTH or SELECT it refused. The
+// error reply is for the connection failing.
+func migrateRoundTrip(addr string, timeout time.Duration, buf []byte, n, setup int) ([]error, *resp.RespErr) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, resp.MakeErr("IOERR error or timeout connecting to the client")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := conn.Write(buf); err != nil {
+		return nil, resp.MakeErr("IOERR error or timeout writing to target instance")
+	}
+
+	br := bufio.NewReader(conn)
+	var replies []error
+	for i := range n {
+		_, err := readStatus(br)
+		if isIOErr(err) {
+			return replies, resp.MakeErr("IOERR error or timeout reading to target instance")
+		}
+		replies = append(replies, err)
+		// the keys can't be restored if AUTH or SELECT failed
+		if err != nil && i < setup {
+			break
+		}
+	}
+	return replies, nil
+}
+
+// isIOErr tells a broken connection apart from an error reply
+func isIOErr(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func init() {
+	registerCommand("dump", 2, cmdReadOnly, execDump)
+	registerCommand("restore", -4, cmdWrite, execRestore)
+	registerCommand("restore-asking", -4, cmdWrite|cmdAsking, execRestore)
+	registerCommand("migrate", -6, cmdWrite, execMigrate).withGetKeys(migrateKeys)
+}
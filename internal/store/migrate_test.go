@@ -0,0 +1,138 @@
+package store
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+func TestDumpRestore(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+	mustExec(t, s, "SET", "str", "hello")
+	mustExec(t, s, "RPUSH", "list", "a", "b", "c")
+	mustExec(t, s, "HSET", "hash", "f", "v")
+	mustExec(t, s, "SADD", "set", "x", "y")
+	mustExec(t, s, "ZADD", "zset", "1.5", "m")
+	mustExec(t, s, "XADD", "stream", "1-1", "f", "v")
+
+	reads := map[string][]string{
+		"str":    {"GET", "str"},
+		"list":   {"LRANGE", "list", "0", "-1"},
+		"hash":   {"HGETALL", "hash"},
+		"set":    {"SCARD", "set"},
+		"zset":   {"ZRANGE", "zset", "0", "-1", "WITHSCORES"},
+		"stream": {"XRANGE", "stream", "-", "+"},
+	}
+	for key, read := range reads {
+		payload := mustExec(t, s, "DUMP", key).(*resp.BulkStr).Data
+		want := mustExec(t, s, read...).ToBytes()
+		mustExec(t, s, "DEL", key)
+		if rep := mustExec(t, s, "RESTORE", key, "0", string(payload)); string(rep.ToBytes()) != "+OK\r\n" {
+			t.Fatalf("RESTORE %s: %q", key, rep.ToBytes())
+		}
+		if got := mustExec(t, s, read...).ToBytes(); !slices.Equal(got, want) {
+			t.Fatalf("%s restored as %q, want %q", key, got, want)
+		}
+	}
+
+	payload := string(mustExec(t, s, "DUMP", "str").(*resp.BulkStr).Data)
+	expectErr(t, s, "BUSYKEY Target key name already exists.", "RESTORE", "str", "0", payload)
+	mustExec(t, s, "RESTORE", "str", "5000", payload, "REPLACE")
+	if ttl := mustExec(t, s, "PTTL", "str").(*resp.Intiger).Data; ttl <= 0 || ttl > 5000 {
+		t.Fatalf("restored with a TTL of %d", ttl)
+	}
+
+	corrupt := []byte(payload)
+	corrupt[2] ^= 0xff
+	expectErr(t, s, "ERR DUMP payload version or checksum are wrong", "RESTORE", "other", "0", string(corrupt))
+	if rep := mustExec(t, s, "DUMP", "missing"); string(rep.ToBytes()) != "$-1\r\n" {
+		t.Fatalf("DUMP of a missing key: %q", rep.ToBytes())
+	}
+
+	// DUMP of "10" by redis 7, in RDB version 10
+	mustExec(t, s, "RESTORE", "fromredis", "0", "\x00\xc0\n\n\x00n\x9fWE\x0e\xaec\xbb")
+	if rep := mustExec(t, s, "GET", "fromredis"); string(rep.ToBytes()) != "$2\r\n10\r\n" {
+		t.Fatalf("payload of redis restored as %q", rep.ToBytes())
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	src := NewStorage()
+	defer src.Close()
+	dst := NewStorage()
+	defer dst.Close()
+	host, port, _ := net.SplitHostPort(serveTestStorage(t, dst))
+
+	mustExec(t, src, "SET", "k1", "v1")
+	mustExec(t, src, "PEXPIREAT", "k1", "9999999999999")
+	mustExec(t, src, "RPUSH", "k2", "a", "b")
+	mustExec(t, src, "SET", "k3", "v3")
+
+	if rep := mustExec(t, src, "MIGRATE", host, port, "k1", "0", "1000"); string(rep.ToBytes()) != "+OK\r\n" {
+		t.Fatalf("MIGRATE: %q", rep.ToBytes())
+	}
+	if rep := mustExec(t, src, "GET", "k1"); string(rep.ToBytes()) != "$-1\r\n" {
+		t.Fatalf("migrated key left on the source: %q", rep.ToBytes())
+	}
+	if rep := mustExec(t, dst, "GET", "k1"); string(rep.ToBytes()) != "$2\r\nv1\r\n" {
+		t.Fatalf("migrated key on the target: %q", rep.ToBytes())
+	}
+	if at, ok := dst.getExpiresAt("k1"); !ok || at.Sub(time.UnixMilli(9999999999999)).Abs() > time.Second {
+		t.Fatalf("the TTL wasn't migrated: %v", at)
+	}
+
+	mustExec(t, dst, "SET", "k3", "other")
+	rep := mustExec(t, src, "MIGRATE", host, port, "", "0", "1000", "COPY", "KEYS", "k2", "k3", "missing")
+	if string(rep.ToBytes()) != "-ERR Target instance replied with error: BUSYKEY Target key name already exists.\r\n" {
+		t.Fatalf("MIGRATE onto an existing key: %q", rep.ToBytes())
+	}
+	if rep := mustExec(t, src, "LLEN", "k2"); string(rep.ToBytes()) != ":2\r\n" {
+		t.Fatalf("COPY deleted the source key")
+	}
+	if rep := mustExec(t, dst, "LLEN", "k2"); string(rep.ToBytes()) != ":2\r\n" {
+		t.Fatalf("k2 wasn't copied")
+	}
+
+	mustExec(t, src, "MIGRATE", host, port, "k3", "0", "1000", "REPLACE")
+	if rep := mustExec(t, dst, "GET", "k3"); string(rep.ToBytes()) != "$2\r\nv3\r\n" {
+		t.Fatalf("REPLACE didn't replace: %q", rep.ToBytes())
+	}
+	if rep := mustExec(t, src, "MIGRATE", host, port, "k3", "0", "1000"); string(rep.ToBytes()) != "+NOKEY\r\n" {
+		t.Fatalf("MIGRATE of a missing key: %q", rep.ToBytes())
+	}
+}
+
+func TestMigrateKeyWritten(t *testing.T) {
+	src := NewStorage()
+	defer src.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// a target that writes the key on the source before acknowledging it
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Read(make([]byte, 1024))
+		src.Exec(toBytes("APPEND", "k", "!"))
+		conn.Write([]byte("+OK\r\n"))
+	}()
+
+	mustExec(t, src, "SET", "k", "v")
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	if rep := mustExec(t, src, "MIGRATE", host, port, "k", "0", "1000"); string(rep.ToBytes()) != "+OK\r\n" {
+		t.Fatalf("MIGRATE: %q", rep.ToBytes())
+	}
+	if rep := mustExec(t, src, "GET", "k"); string(rep.ToBytes()) != "$2\r\nv!\r\n" {
+		t.Fatalf("a key written during MIGRATE was deleted: %q", rep.ToBytes())
+	}
+}
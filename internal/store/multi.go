@@ -0,0 +1,187 @@
+package store
+
+import (
+	"slices"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+// Watch holds the keys watched by a client for optimistic locking. It's
+// flagged dirty as soon as one of them is modified, which makes the next
+// ExecMulti abort. The zero value watches nothing.
+type Watch struct {
+	keys  []dbKey
+	dirty bool
+}
+
+// Watch starts watching keys of the database of se on behalf of w
+func (s *Storage) Watch(se *Session, w *Watch, keys [][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, k := range keys {
+		key := dbKey{se.db, string(k)}
+		if slices.Contains(w.keys, key) {
+			continue
+		}
+		// a key already expired must not count as modified later on
+		s.dbs[key.db].deleteIfExpired(key.key)
+
+		watchers, ok := s.watched[key]
+		if !ok {
+			watchers = make(map[*Watch]struct{})
+			s.watched[key] = watchers
+		}
+		watchers[w] = struct{}{}
+		w.keys = append(w.keys, key)
+	}
+}
+
+// Unwatch forgets all the keys watched by w and clears its dirty flag
+func (s *Storage) Unwatch(w *Watch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unwatch(w)
+}
+
+func (s *Storage) unwatch(w *Watch) {
+	for _, key := range w.keys {
+		watchers := s.watched[key]
+		delete(watchers, w)
+		if len(watchers) == 0 {
+			delete(s.watched, key)
+		}
+	}
+	w.keys = nil
+	w.dirty = false
+}
+
+// signalModified flags the clients watching key of db and wakes up the
+// commands blocked on it
+func (s *Storage) signalModified(db int, key string) {
+	if !s.observed(db, key) {
+		return
+	}
+	// writers on other shards may signal at the same time
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+	k := dbKey{db, key}
+	for w := range s.watched[k] {
+		w.dirty = true
+	}
+	s.markReady(k)
+}
+
+// Check validates a command without running it, it returns the error
+// reply Exec would give for an unknown command, a wrong arity or keys
+// served by another cluster node, nil if the command can be queued in a
+// transaction. Keys of a migrating slot are looked up when it's run.
+func (s *Storage) Check(cmd [][]byte) resp.RespType {
+	c, errReply := lookupCommand(cmd)
+	if errReply != nil {
+		return errReply
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if errReply := s.clusterRedirect(c.keys(cmd), false); errReply != nil {
+		return errReply
+	}
+	return nil
+}
+
+// ExecMulti runs the commands of a transaction atomically on the database
+// of se and returns their replies. If a key watched by w was modified
+// since it was watched, nothing is run and the reply is a null array. w is
+// unwatched in any case and may be nil. Like Exec, the returned error is
+// ALWAYS ErrClosed.
+func (s *Storage) ExecMulti(se *Session, cmds [][][]byte, w *Watch) (resp.RespType, error) {
+	if s.closed.Load() {
+		return nil, ErrClosed
+	}
+
+	queued := make([]*command, len(cmds))
+	isWrite := false
+	var keys [][]byte
+	for i, cmd := range cmds {
+		c, errReply := lookupCommand(cmd)
+		if errReply != nil {
+			return resp.MakeErr("EXECABORT Transaction discarded because of previous errors."), nil
+		}
+		queued[i] = c
+		isWrite = isWrite || c.is(cmdWrite)
+		keys = append(keys, c.keys(cmd)...)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the keys of a transaction must all be served here, in a single slot
+	errReply := s.clusterRedirect(keys, false)
+	if errReply == nil {
+		errReply = s.migrationRedirect(&callCtx{s: s, db: s.dbs[se.db]}, keys, false)
+	}
+	if errReply != nil {
+		if w != nil {
+			s.unwatch(w)
+		}
+		return errReply, nil
+	}
+
+	if w != nil {
+		defer s.unwatch(w)
+		// watched keys that expired since count as modified
+		for _, key := range w.keys {
+			s.dbs[key.db].deleteIfExpired(key.key)
+		}
+		if w.dirty {
+			return &resp.NullArray{}, nil
+		}
+	}
+
+	if isWrite {
+		errReply := s.denyWrite()
+		if errReply == nil && !s.evict() && slices.ContainsFunc(queued, func(c *command) bool {
+			return c.is(cmdWrite) && !c.is(cmdFreesMemory)
+		}) {
+			errReply = oomErr()
+		}
+		if errReply != nil {
+			return resp.MakeErr("EXECABORT Transaction discarded because of: " + string(errReply.Data)), nil
+		}
+	}
+
+	replies := s.callMulti(se, queued, cmds)
+	s.serveBlocked()
+	return replies, nil
+}
+
+// callMulti runs the commands of a transaction. Their effects are logged
+// and replicated at once, wrapped in MULTI/EXEC so a replay never applies
+// half of it. Must be called with s.mu held.
+func (s *Storage) callMulti(se *Session, queued []*command, cmds [][][]byte) *resp.Array {
+	s.inMulti = true
+	s.multiPropagated = nil
+	replies := &resp.Array{}
+	for i, c := range queued {
+		reply := s.call(se, c, cmds[i])
+		// a transaction can't wait, blocking commands time out right away
+		if b, ok := reply.(*blockOn); ok {
+			reply = b.expire()
+		}
+		replies.Append(reply)
+	}
+	s.inMulti = false
+
+	if len(s.multiPropagated) == 0 {
+		return replies
+	}
+	wrapped := append([][][]byte{cmdArgv("multi")}, s.multiPropagated...)
+	wrapped = append(wrapped, cmdArgv("exec"))
+	s.multiPropagated = nil
+	s.replicate(wrapped)
+	if s.aof != nil && s.aof.err == nil {
+		s.writeAOF(wrapped)
+		s.rewriteIfDue()
+	}
+	return replies
+}
@@ -0,0 +1,145 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+func TestExecMulti(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+	mustExec(t, s, "SET", "balance", "100")
+
+	rep, err := s.ExecMulti(&Session{}, [][][]byte{
+		toBytes("DECRBY", "balance", "30"),
+		toBytes("RPUSH", "history", "-30"),
+		toBytes("LPOP", "balance"),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := entries(
+		&resp.Intiger{Data: 70},
+		&resp.Intiger{Data: 1},
+		resp.WrongTypeErr(),
+	)
+	if !slices.Equal(rep.ToBytes(), want.ToBytes()) {
+		t.Fatalf("got %q, want %q", rep.ToBytes(), want.ToBytes())
+	}
+
+	if errReply := s.Check(toBytes("NOPE")); errReply == nil {
+		t.Fatalf("expected unknown commands to be refused")
+	}
+	if errReply := s.Check(toBytes("GET")); errReply == nil {
+		t.Fatalf("expected a wrong arity to be refused")
+	}
+	if errReply := s.Check(toBytes("GET", "k")); errReply != nil {
+		t.Fatalf("valid command refused: %q", errReply.ToBytes())
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+	mustExec(t, s, "SET", "string", "v")
+	mustExec(t, s, "RPUSH", "list", "a")
+	mustExec(t, s, "SET", "other", "v")
+	mustExec(t, s, "SET", "expiring", "v", "PX", "20")
+
+	tx := [][][]byte{toBytes("INCR", "counter")}
+	tests := []struct {
+		name    string
+		watched string
+		modify  func()
+		aborted bool
+	}{
+		{"untouched", "string", func() { mustExec(t, s, "GET", "string") }, false},
+		{"overwritten", "string", func() { mustExec(t, s, "SET", "string", "w") }, true},
+		{"modified in place", "list", func() { mustExec(t, s, "RPUSH", "list", "b") }, true},
+		{"other key", "string", func() { mustExec(t, s, "SET", "other", "w") }, false},
+		{"deleted", "other", func() { mustExec(t, s, "DEL", "other") }, true},
+		{"created", "missing", func() { mustExec(t, s, "SET", "missing", "v") }, true},
+		{"failed write", "list", func() { mustExec(t, s, "INCR", "list") }, false},
+		{"expired", "expiring", func() { time.Sleep(30 * time.Millisecond) }, true},
+	}
+	for _, test := range tests {
+		w := &Watch{}
+		s.Watch(&Session{}, w, toBytes(test.watched))
+		test.modify()
+
+		rep, err := s.ExecMulti(&Session{}, tx, w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, aborted := rep.(*resp.NullArray)
+		if aborted != test.aborted {
+			t.Fatalf("%s. aborted %v, want %v", test.name, aborted, test.aborted)
+		}
+		if len(s.watched) != 0 {
+			t.Fatalf("%s. keys are still watched after EXEC", test.name)
+		}
+	}
+
+	w := &Watch{}
+	s.Watch(&Session{}, w, toBytes("string"))
+	s.Unwatch(w)
+	mustExec(t, s, "SET", "string", "x")
+	if rep, _ := s.ExecMulti(&Session{}, tx, w); !slices.Equal(rep.ToBytes(), entries(&resp.Intiger{Data: 4}).ToBytes()) {
+		t.Fatalf("unwatched transaction did not run, got %q", rep.ToBytes())
+	}
+}
+
+func TestAOFMulti(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	s := openTestAOF(t, path, FsyncAlways)
+	mustExec(t, s, "SET", "k", "v")
+	s.ExecMulti(&Session{}, [][][]byte{
+		toBytes("SET", "a", "1"),
+		toBytes("GET", "a"),
+		toBytes("SET", "b", "2"),
+	}, nil)
+	s.Close()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	multi := encodeCommand(toBytes("multi"))
+	if !strings.Contains(string(content), string(multi)) {
+		t.Fatalf("transaction was not wrapped in MULTI/EXEC:\n%q", content)
+	}
+
+	// a transaction cut in half by a crash is dropped as a whole
+	cut := strings.TrimSuffix(string(content), string(encodeCommand(toBytes("exec"))))
+	if err := os.WriteFile(path, []byte(cut), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s = openTestAOF(t, path, FsyncNo)
+	defer s.Close()
+
+	tests := []suite{
+		{"GET before the transaction", &resp.BulkStr{Data: []byte("v")}, toBytes("GET", "k")},
+		{"GET in the transaction", &resp.BulkStr{Data: nil}, toBytes("GET", "a")},
+	}
+	for _, test := range tests {
+		rep, _ := s.Exec(test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+
+	truncated, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(truncated), string(multi)) {
+		t.Fatalf("incomplete transaction was not truncated:\n%q", truncated)
+	}
+}
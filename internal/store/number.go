@@ -0,0 +1,53 @@
+package store
+
+import (
+	"math/big"
+	"strings"
+)
+
+// redis keeps float counters as long doubles, a 64 bit mantissa mirrors the
+// x87 extended precision it's using on most platforms
+const longDoublePrec = 64
+
+// parseLongDouble parses a float the way redis' strtold does, rejecting
+// NaN and infinities
+func parseLongDouble(raw []byte) (*big.Float, bool) {
+	s := string(raw)
+	if s == "" || strings.ContainsAny(s, " \t\r\n") {
+		return nil, false
+	}
+	f, _, err := big.ParseFloat(s, 10, longDoublePrec, big.ToNearestEven)
+	if err != nil || f.IsInf() {
+		return nil, false
+	}
+	return f, true
+}
+
+// formatLongDouble formats f like redis' "%.17Lf" followed by trimming the
+// trailing zeroes, e.g. 10.5 and not 10.50000000000000000
+func formatLongDouble(f *big.Float) []byte {
+	s := f.Text('f', 17)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(s, "0")
+		s = strings.TrimSuffix(s, ".")
+	}
+	if s == "-0" {
+		s = "0"
+	}
+	return []byte(s)
+}
+
+// incrByFloat adds incr to cur, the second return value reports whether
+// the result is still a finite long double
+func incrByFloat(cur, incr *big.Float) (*big.Float, bool) {
+	sum := new(big.Float).SetPrec(longDoublePrec).Add(cur, incr)
+	if sum.IsInf() {
+		return nil, false
+	}
+	// big.Float has a practically unbounded exponent, clamp to what a
+	// long double can hold
+	if sum.MantExp(nil) > 16384 {
+		return nil, false
+	}
+	return sum, true
+}
@@ -0,0 +1,347 @@
+package store
+
+import "bytes"
+
+// maximum number of entries held by a single quicklist node
+const quicklistNodeSize = 128
+
+type quicklistNode struct {
+	prev    *quicklistNode
+	next    *quicklistNode
+	entries [][]byte
+}
+
+// quicklist is a doubly linked list of bounded chunks. Pushes and pops at
+// both ends only touch the head or tail chunk, which keeps them O(1) while
+// still storing the elements densely.
+type quicklist struct {
+	head  *quicklistNode
+	tail  *quicklistNode
+	count int
+}
+
+func newQuicklist() *quicklist {
+	return &quicklist{}
+}
+
+func (ql *quicklist) len() int {
+	return ql.count
+}
+
+func (ql *quicklist) pushHead(v []byte) {
+	if ql.head == nil || len(ql.head.entries) >= quicklistNodeSize {
+		n := &quicklistNode{
+			next:    ql.head,
+			entries: make([][]byte, 0, 8),
+		}
+		if ql.head != nil {
+			ql.head.prev = n
+		} else {
+			ql.tail = n
+		}
+		ql.head = n
+	}
+
+	h := ql.head
+	h.entries = append(h.entries, nil)
+	copy(h.entries[1:], h.entries)
+	h.entries[0] = v
+	ql.count++
+}
+
+func (ql *quicklist) pushTail(v []byte) {
+	if ql.tail == nil || len(ql.tail.entries) >= quicklistNodeSize {
+		n := &quicklistNode{
+			prev:    ql.tail,
+			entries: make([][]byte, 0, 8),
+		}
+		if ql.tail != nil {
+			ql.tail.next = n
+		} else {
+			ql.head = n
+		}
+		ql.tail = n
+	}
+
+	ql.tail.entries = append(ql.tail.entries, v)
+	ql.count++
+}
+
+func (ql *quicklist) popHead() ([]byte, bool) {
+	if ql.head == nil {
+		return nil, false
+	}
+	h := ql.head
+	v := h.entries[0]
+	h.entries[0] = nil
+	h.entries = h.entries[1:]
+	ql.count--
+	if len(h.entries) == 0 {
+		ql.unlink(h)
+	}
+	return v, true
+}
+
+func (ql *quicklist) popTail() ([]byte, bool) {
+	if ql.tail == nil {
+		return nil, false
+	}
+	t := ql.tail
+	last := len(t.entries) - 1
+	v := t.entries[last]
+	t.entries[last] = nil
+	t.entries = t.entries[:last]
+	ql.count--
+	if len(t.entries) == 0 {
+		ql.unlink(t)
+	}
+	return v, true
+}
+
+func (ql *quicklist) unlink(n *quicklistNode) {
+	if n.prev != nil {
+		n.prev.next = n.next
+	} else {
+		ql.head = n.next
+	}
+	if n.next != nil {
+		n.next.prev = n.prev
+	} else {
+		ql.tail = n.prev
+	}
+	n.prev, n.next = nil, nil
+}
+
+// normalizeIndex converts a possibly negative index to an absolute one,
+// returns false if it is out of range
+func (ql *quicklist) normalizeIndex(i int) (int, bool) {
+	if i < 0 {
+		i += ql.count
+	}
+	if i < 0 || i >= ql.count {
+		return 0, false
+	}
+	return i, true
+}
+
+// locate finds the node holding the absolute index i, walking from whichever
+// end is closer
+func (ql *quicklist) locate(i int) (*quicklistNode, int) {
+	if i < ql.count/2 {
+		for n := ql.head; n != nil; n = n.next {
+			if i < len(n.entries) {
+				return n, i
+			}
+			i -= len(n.entries)
+		}
+		return nil, 0
+	}
+
+	i = ql.count - 1 - i
+	for n := ql.tail; n != nil; n = n.prev {
+		if i < len(n.entries) {
+			return n, len(n.entries) - 1 - i
+		}
+		i -= len(n.entries)
+	}
+	return nil, 0
+}
+
+func (ql *quicklist) index(i int) ([]byte, bool) {
+	i, ok := ql.normalizeIndex(i)
+	if !ok {
+		return nil, false
+	}
+	n, off := ql.locate(i)
+	return n.entries[off], true
+}
+
+func (ql *quicklist) set(i int, v []byte) bool {
+	i, ok := ql.normalizeIndex(i)
+	if !ok {
+		return false
+	}
+	n, off := ql.locate(i)
+	n.entries[off] = v
+	return true
+}
+
+// rangeNormalize converts redis style start/stop indexes to an inclusive
+// absolute range, returns false if the range is empty
+func (ql *quicklist) rangeNormalize(start, stop int) (int, int, bool) {
+	if start < 0 {
+		start += ql.count
+	}
+	if stop < 0 {
+		stop += ql.count
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > stop || start >= ql.count {
+		return 0, 0, false
+	}
+	if stop >= ql.count {
+		stop = ql.count - 1
+	}
+	return start, stop, true
+}
+
+// iterRange calls fn for every element within the inclusive absolute range
+func (ql *quicklist) iterRange(start, stop int, fn func(v []byte)) {
+	n, off := ql.locate(start)
+	for i := start; i <= stop && n != nil; {
+		for ; off < len(n.entries) && i <= stop; off++ {
+			fn(n.entries[off])
+			i++
+		}
+		n, off = n.next, 0
+	}
+}
+
+// iter walks the list from head to tail until fn returns false
+func (ql *quicklist) iter(fn func(i int, v []byte) bool) {
+	i := 0
+	for n := ql.head; n != nil; n = n.next {
+		for _, v := range n.entries {
+			if !fn(i, v) {
+				return
+			}
+			i++
+		}
+	}
+}
+
+// iterReverse walks the list from tail to head until fn returns false
+func (ql *quicklist) iterReverse(fn func(i int, v []byte) bool) {
+	i := ql.count - 1
+	for n := ql.tail; n != nil; n = n.prev {
+		for j := len(n.entries) - 1; j >= 0; j-- {
+			if !fn(i, n.entries[j]) {
+				return
+			}
+			i--
+		}
+	}
+}
+
+// remove deletes up to count occurrences of v. A positive count removes from
+// head to tail, a negative one from tail to head and 0 removes all of them.
+// Returns the number of removed elements.
+func (ql *quicklist) remove(count int, v []byte) int {
+	limit := count
+	if limit < 0 {
+		limit = -limit
+	}
+	removed := 0
+
+	if count >= 0 {
+		for n := ql.head; n != nil; {
+			next := n.next
+			kept := n.entries[:0]
+			for _, e := range n.entries {
+				if (limit == 0 || removed < limit) && bytes.Equal(e, v) {
+					removed++
+					continue
+				}
+				kept = append(kept, e)
+			}
+			ql.shrinkNode(n, kept)
+			n = next
+		}
+	} else {
+		for n := ql.tail; n != nil; {
+			prev := n.prev
+			kept := make([][]byte, len(n.entries))
+			k := len(kept)
+			for j := len(n.entries) - 1; j >= 0; j-- {
+				e := n.entries[j]
+				if removed < limit && bytes.Equal(e, v) {
+					removed++
+					continue
+				}
+				k--
+				kept[k] = e
+			}
+			ql.shrinkNode(n, kept[k:])
+			n = prev
+		}
+	}
+
+	ql.count -= removed
+	return removed
+}
+
+func (ql *quicklist) shrinkNode(n *quicklistNode, kept [][]byte) {
+	for j := len(kept); j < len(n.entries); j++ {
+		n.entries[j] = nil
+	}
+	n.entries = kept
+	if len(kept) == 0 {
+		ql.unlink(n)
+	}
+}
+
+// trim keeps only the elements within the inclusive redis style range
+func (ql *quicklist) trim(start, stop int) {
+	start, stop, ok := ql.rangeNormalize(start, stop)
+	if !ok {
+		ql.head, ql.tail, ql.count = nil, nil, 0
+		return
+	}
+	fromTail := ql.count - 1 - stop
+	for range start {
+		ql.popHead()
+	}
+	for range fromTail {
+		ql.popTail()
+	}
+}
+
+// insert puts v before or after the first occurrence of pivot.
+// Returns false if pivot was not found.
+func (ql *quicklist) insert(pivot, v []byte, after bool) bool {
+	for n := ql.head; n != nil; n = n.next {
+		for off, e := range n.entries {
+			if !bytes.Equal(e, pivot) {
+				continue
+			}
+			if after {
+				off++
+			}
+			ql.insertAt(n, off, v)
+			return true
+		}
+	}
+	return false
+}
+
+func (ql *quicklist) insertAt(n *quicklistNode, off int, v []byte) {
+	if len(n.entries) >= quicklistNodeSize {
+		// split the node in half so that the insertion stays bounded
+		half := len(n.entries) / 2
+		right := &quicklistNode{
+			prev:    n,
+			next:    n.next,
+			entries: append(make([][]byte, 0, quicklistNodeSize), n.entries[half:]...),
+		}
+		if n.next != nil {
+			n.next.prev = right
+		} else {
+			ql.tail = right
+		}
+		n.next = right
+		for j := half; j < len(n.entries); j++ {
+			n.entries[j] = nil
+		}
+		n.entries = n.entries[:half]
+		if off > half {
+			n, off = right, off-half
+		}
+	}
+
+	n.entries = append(n.entries, nil)
+	copy(n.entries[off+1:], n.entries[off:])
+	n.entries[off] = v
+	ql.count++
+}
@@ -0,0 +1,130 @@
+package store
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func quicklistValues(ql *quicklist) []string {
+	result := make([]string, 0, ql.len())
+	ql.iter(func(_ int, v []byte) bool {
+		result = append(result, string(v))
+		return true
+	})
+	return result
+}
+
+func TestQuicklistPushPop(t *testing.T) {
+	ql := newQuicklist()
+	n := quicklistNodeSize*3 + 7
+
+	for i := range n {
+		ql.pushTail([]byte(strconv.Itoa(i)))
+		ql.pushHead([]byte(strconv.Itoa(-i)))
+	}
+
+	if ql.len() != 2*n {
+		t.Fatalf("expected length %d, got %d", 2*n, ql.len())
+	}
+
+	for i := n - 1; i >= 0; i-- {
+		v, ok := ql.popTail()
+		if !ok || string(v) != strconv.Itoa(i) {
+			t.Fatalf("popTail: expected %d, got %q", i, v)
+		}
+		v, ok = ql.popHead()
+		if !ok || string(v) != strconv.Itoa(-i) {
+			t.Fatalf("popHead: expected %d, got %q", -i, v)
+		}
+	}
+
+	if ql.len() != 0 || ql.head != nil || ql.tail != nil {
+		t.Fatalf("expected an empty list, got length %d", ql.len())
+	}
+
+	if _, ok := ql.popHead(); ok {
+		t.Fatalf("popHead on an empty list succeeded")
+	}
+}
+
+func TestQuicklistIndexAndSet(t *testing.T) {
+	ql := newQuicklist()
+	n := quicklistNodeSize*2 + 3
+	for i := range n {
+		ql.pushTail([]byte(strconv.Itoa(i)))
+	}
+
+	for _, i := range []int{0, 1, quicklistNodeSize, n - 1, -1, -n} {
+		v, ok := ql.index(i)
+		want := i
+		if want < 0 {
+			want += n
+		}
+		if !ok || string(v) != strconv.Itoa(want) {
+			t.Fatalf("index(%d): expected %d, got %q", i, want, v)
+		}
+	}
+
+	if _, ok := ql.index(n); ok {
+		t.Fatalf("index(%d) out of range succeeded", n)
+	}
+
+	if !ql.set(-1, []byte("last")) {
+		t.Fatalf("set(-1) failed")
+	}
+	if v, _ := ql.index(n - 1); string(v) != "last" {
+		t.Fatalf("expected 'last', got %q", v)
+	}
+}
+
+func TestQuicklistRemoveAndTrim(t *testing.T) {
+	ql := newQuicklist()
+	for _, v := range []string{"a", "b", "a", "c", "a", "b"} {
+		ql.pushTail([]byte(v))
+	}
+
+	if r := ql.remove(-2, []byte("a")); r != 2 {
+		t.Fatalf("expected 2 removals, got %d", r)
+	}
+	got := quicklistValues(ql)
+	if want := []string{"a", "b", "c", "b"}; !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	if r := ql.remove(0, []byte("b")); r != 2 {
+		t.Fatalf("expected 2 removals, got %d", r)
+	}
+
+	ql.trim(1, -1)
+	got = quicklistValues(ql)
+	if want := []string{"c"}; !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	ql.trim(5, 10)
+	if ql.len() != 0 {
+		t.Fatalf("expected an empty list after trim, got %v", quicklistValues(ql))
+	}
+}
+
+func TestQuicklistInsert(t *testing.T) {
+	ql := newQuicklist()
+	for i := range quicklistNodeSize {
+		ql.pushTail([]byte(strconv.Itoa(i)))
+	}
+
+	if !ql.insert([]byte("100"), []byte("x"), true) {
+		t.Fatalf("insert after existing pivot failed")
+	}
+	if ql.insert([]byte("nope"), []byte("x"), true) {
+		t.Fatalf("insert with a missing pivot succeeded")
+	}
+
+	if v, _ := ql.index(101); string(v) != "x" {
+		t.Fatalf("expected 'x' at 101, got %q", v)
+	}
+	if ql.len() != quicklistNodeSize+1 {
+		t.Fatalf("expected length %d, got %d", quicklistNodeSize+1, ql.len())
+	}
+}
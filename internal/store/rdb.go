@@ -0,0 +1,319 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc64"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// the snapshot format is RDB version 9, the one written by redis 5 and 6,
+// which every later redis version and most RDB tooling can read
+const rdbVersion = 9
+
+const (
+	rdbTypeString          = 0
+	rdbTypeList            = 1
+	rdbTypeSet             = 2
+	rdbTypeZset            = 3
+	rdbTypeHash            = 4
+	rdbTypeZset2           = 5
+	rdbTypeSetIntset       = 11
+	rdbTypeStreamListpack  = 15
+	rdbTypeHashListpack    = 16
+	rdbTypeZsetListpack    = 17
+	rdbTypeListQuicklist2  = 18
+	rdbTypeStreamListpack2 = 19
+	rdbTypeSetListpack     = 20
+	rdbTypeStreamListpack3 = 21
+)
+
+const (
+	rdbOpSlotInfo     = 0xF4
+	rdbOpFunction2    = 0xF5
+	rdbOpModuleAux    = 0xF7
+	rdbOpIdle         = 0xF8
+	rdbOpFreq         = 0xF9
+	rdbOpAux          = 0xFA
+	rdbOpResizeDB     = 0xFB
+	rdbOpExpireTimeMs = 0xFC
+	rdbOpExpireTime   = 0xFD
+	rdbOpSelectDB     = 0xFE
+	rdbOpEOF          = 0xFF
+)
+
+// special string encodings, flagged by the two high bits of a length
+const (
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+)
+
+// stream entry flags inside a listpack node
+const (
+	streamItemFlagDeleted    = 1
+	streamItemFlagSameFields = 2
+)
+
+// redis checksums RDB files with the Jones CRC-64, reflected, without the
+// initial and final inversion done by hash/crc64
+var crc64Table = crc64.MakeTable(0x95AC9329AC4BC9B5)
+
+func crc64Update(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crc64Table[byte(crc)^b] ^ (crc >> 8)
+	}
+	return crc
+}
+
+type rdbWriter struct {
+	w   *bufio.Writer
+	crc uint64
+	err error
+}
+
+func (w *rdbWriter) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+	w.crc = crc64Update(w.crc, p)
+	_, w.err = w.w.Write(p)
+}
+
+func (w *rdbWriter) writeByte(b byte) {
+	w.write([]byte{b})
+}
+
+func (w *rdbWriter) writeLen(n uint64) {
+	switch {
+	case n < 1<<6:
+		w.writeByte(byte(n))
+	case n < 1<<14:
+		w.write([]byte{byte(n>>8) | 0x40, byte(n)})
+	case n <= math.MaxUint32:
+		w.write(binary.BigEndian.AppendUint32([]byte{0x80}, uint32(n)))
+	default:
+		w.write(binary.BigEndian.AppendUint64([]byte{0x81}, n))
+	}
+}
+
+func (w *rdbWriter) writeString(s []byte) {
+	w.writeLen(uint64(len(s)))
+	w.write(s)
+}
+
+func (w *rdbWriter) writeMillis(t time.Time) {
+	w.write(binary.LittleEndian.AppendUint64(nil, uint64(t.UnixMilli())))
+}
+
+// rawStreamID is the 128 bit big endian form of an ID, used as rax keys
+func rawStreamID(id streamID) []byte {
+	b := binary.BigEndian.AppendUint64(nil, id.ms)
+	return binary.BigEndian.AppendUint64(b, id.seq)
+}
+
+func (w *rdbWriter) writeAux(key, val string) {
+	w.writeByte(rdbOpAux)
+	w.writeString([]byte(key))
+	w.writeString([]byte(val))
+}
+
+// writeRDB serializes snap in the RDB format, keys that expired since the
+// snapshot was taken are left out
+func writeRDB(out io.Writer, snap *snapshot) error {
+	w := &rdbWriter{w: bufio.NewWriter(out)}
+	now := time.Now()
+
+	w.write([]byte("REDIS000" + strconv.Itoa(rdbVersion)))
+	w.writeAux("redis-bits", "64")
+	w.writeAux("ctime", strconv.FormatInt(now.Unix(), 10))
+
+	w.writeAux("repl-stream-db", strconv.Itoa(snap.streamDB))
+
+	for i, db := range snap.dbs {
+		if len(db.data) == 0 {
+			continue
+		}
+		w.writeByte(rdbOpSelectDB)
+		w.writeLen(uint64(i))
+		w.writeByte(rdbOpResizeDB)
+		w.writeLen(uint64(len(db.data)))
+		w.writeLen(uint64(len(db.expires)))
+
+		for _, key := range db.keys() {
+			if at, ok := db.expires[key]; ok {
+				if now.After(at) {
+					continue
+				}
+				w.writeByte(rdbOpExpireTimeMs)
+				w.writeMillis(at)
+			}
+			w.writeEntity([]byte(key), db.data[key])
+		}
+	}
+
+	w.writeByte(rdbOpEOF)
+	w.write(binary.LittleEndian.AppendUint64(nil, w.crc))
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+func (w *rdbWriter) writeEntity(key []byte, d *dataEntity) {
+	w.writeByte(rdbValueType(d))
+	w.writeString(key)
+	w.writeValue(d)
+}
+
+// rdbValueType is the type d is written as
+func rdbValueType(d *dataEntity) byte {
+	switch d.val.(type) {
+	case *quicklist:
+		return rdbTypeList
+	case *hash:
+		return rdbTypeHash
+	case *set:
+		return rdbTypeSet
+	case *zset:
+		return rdbTypeZset2
+	case *stream:
+		return rdbTypeStreamListpack
+	}
+	return rdbTypeString
+}
+
+// writeValue writes the value of d, without its type
+func (w *rdbWriter) writeValue(d *dataEntity) {
+	switch v := d.val.(type) {
+	case []byte:
+		w.writeString(v)
+	case *quicklist:
+		w.writeLen(uint64(v.len()))
+		v.iter(func(_ int, e []byte) bool {
+			w.writeString(e)
+			return true
+		})
+	case *hash:
+		w.writeLen(uint64(v.len()))
+		for field, val := range v.fields {
+			w.writeString([]byte(field))
+			w.writeString(val)
+		}
+	case *set:
+		w.writeLen(uint64(v.len()))
+		v.iter(func(member []byte) bool {
+			w.writeString(member)
+			return true
+		})
+	case *zset:
+		w.writeLen(uint64(v.len()))
+		for x := v.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+			w.writeString([]byte(x.member))
+			w.write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(x.score)))
+		}
+	case *stream:
+		w.writeStream(v)
+	}
+}
+
+// writeStream writes every chunk as a listpack node keyed by the ID of its
+// first entry, followed by the stream metadata and consumer groups
+func (w *rdbWriter) writeStream(s *stream) {
+	w.writeLen(uint64(len(s.log.chunks)))
+	for _, chunk := range s.log.chunks {
+		master := chunk.entries[0]
+		w.writeString(rawStreamID(master.id))
+		w.writeString(streamNodeListpack(master, chunk.entries))
+	}
+
+	w.writeLen(uint64(s.len()))
+	w.writeLen(s.lastID.ms)
+	w.writeLen(s.lastID.seq)
+
+	w.writeLen(uint64(len(s.groups)))
+	for name, g := range s.groups {
+		w.writeString([]byte(name))
+		w.writeLen(g.lastID.ms)
+		w.writeLen(g.lastID.seq)
+
+		w.writeLen(uint64(len(g.pel)))
+		for _, n := range g.pel {
+			w.write(rawStreamID(n.id))
+			w.writeMillis(n.deliveryTime)
+			w.writeLen(uint64(n.deliveryCount))
+		}
+
+		w.writeLen(uint64(len(g.consumers)))
+		for name, c := range g.consumers {
+			w.writeString([]byte(name))
+			w.writeMillis(c.seenTime)
+			w.writeLen(uint64(len(c.pel)))
+			for _, n := range g.pel {
+				if n.consumer == c {
+					w.write(rawStreamID(n.id))
+				}
+			}
+		}
+	}
+}
+
+// streamNodeListpack lays out entries the way redis does: a master entry
+// holding the fields of the first entry, then every entry as flags, ID
+// deltas against the master ID, its fields, unless they are the master
+// ones, and the number of listpack elements it used
+func streamNodeListpack(master *streamEntry, entries []*streamEntry) []byte {
+	lp := &listpackWriter{}
+	numFields := len(master.fields) / 2
+
+	lp.appendInt(int64(len(entries)))
+	lp.appendInt(0)
+	lp.appendInt(int64(numFields))
+	for i := 0; i < len(master.fields); i += 2 {
+		lp.appendString(master.fields[i])
+	}
+	lp.appendInt(0)
+
+	for _, e := range entries {
+		same := sameStreamFields(master, e)
+		flags := int64(0)
+		if same {
+			flags = streamItemFlagSameFields
+		}
+		lp.appendInt(flags)
+		lp.appendInt(int64(e.id.ms - master.id.ms))
+		lp.appendInt(int64(e.id.seq - master.id.seq))
+
+		entryFields := len(e.fields) / 2
+		if same {
+			for i := 1; i < len(e.fields); i += 2 {
+				lp.appendString(e.fields[i])
+			}
+			lp.appendInt(int64(entryFields + 3))
+			continue
+		}
+
+		lp.appendInt(int64(entryFields))
+		for _, f := range e.fields {
+			lp.appendString(f)
+		}
+		lp.appendInt(int64(entryFields*2 + 4))
+	}
+	return lp.bytes()
+}
+
+func sameStreamFields(master, e *streamEntry) bool {
+	if len(master.fields) != len(e.fields) {
+		return false
+	}
+	for i := 0; i < len(e.fields); i += 2 {
+		if string(master.fields[i]) != string(e.fields[i]) {
+			return false
+		}
+	}
+	return true
+}
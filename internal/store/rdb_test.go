@@ -0,0 +1,290 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+func openTestRDB(t *testing.T, path string, params ...SaveParam) *Storage {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.DBFilename = path
+	cfg.AppendFilename = filepath.Join(filepath.Dir(path), "appendonly.aof")
+	cfg.SaveParams = params
+
+	s, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("failed to open the storage: %v", err)
+	}
+	return s
+}
+
+func TestCRC64(t *testing.T) {
+	if got := crc64Update(0, []byte("123456789")); got != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("wrong checksum %x", got)
+	}
+}
+
+func TestRDBSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+
+	s := openTestRDB(t, path)
+	mustExec(t, s, "SET", "string", "hello")
+	mustExec(t, s, "SET", "int", "-12345")
+	mustExec(t, s, "SET", "empty", "")
+	mustExec(t, s, "SET", "session", "abc", "EX", "100")
+	mustExec(t, s, "SET", "gone", "abc", "PX", "1")
+	mustExec(t, s, "RPUSH", "list", "a", "b", "c")
+	mustExec(t, s, "HSET", "hash", "f1", "v1", "f2", "v2")
+	mustExec(t, s, "SADD", "intset", "1", "2", "3")
+	mustExec(t, s, "SADD", "set", "x", "y")
+	mustExec(t, s, "ZADD", "zset", "1.5", "a", "-inf", "b")
+	mustExec(t, s, "XADD", "stream", "1-1", "f", "v1")
+	mustExec(t, s, "XADD", "stream", "1-2", "f", "v2")
+	mustExec(t, s, "XADD", "stream", "2-0", "other", "v3", "g", "v4")
+	mustExec(t, s, "XADD", "stream", "3-0", "f", "v")
+	mustExec(t, s, "XDEL", "stream", "3-0")
+	mustExec(t, s, "XGROUP", "CREATE", "stream", "g", "0")
+	mustExec(t, s, "XGROUP", "CREATECONSUMER", "stream", "g", "bob")
+	mustExec(t, s, "XREADGROUP", "GROUP", "g", "alice", "COUNT", "2", "STREAMS", "stream", ">")
+	time.Sleep(2 * time.Millisecond)
+
+	before := mustExec(t, s, "LASTSAVE").(*resp.Intiger).Data
+	if rep := mustExec(t, s, "SAVE"); !slices.Equal(rep.ToBytes(), resp.OkReply().ToBytes()) {
+		t.Fatalf("SAVE failed: %q", rep.ToBytes())
+	}
+	if after := mustExec(t, s, "LASTSAVE").(*resp.Intiger).Data; after < before {
+		t.Fatalf("LASTSAVE went back from %d to %d", before, after)
+	}
+	s.Close()
+
+	s = openTestRDB(t, path)
+	defer s.Close()
+
+	tests := []suite{
+		{"GET", &resp.BulkStr{Data: []byte("hello")}, toBytes("GET", "string")},
+		{"GET int", &resp.BulkStr{Data: []byte("-12345")}, toBytes("GET", "int")},
+		{"GET empty string", &resp.BulkStr{Data: []byte("")}, toBytes("GET", "empty")},
+		{"GET expired", &resp.BulkStr{Data: nil}, toBytes("GET", "gone")},
+		{"LRANGE", bulkArr("a", "b", "c"), toBytes("LRANGE", "list", "0", "-1")},
+		{"HGET", &resp.BulkStr{Data: []byte("v2")}, toBytes("HGET", "hash", "f2")},
+		{"SMISMEMBER intset", entries(&resp.Intiger{Data: 1}, &resp.Intiger{Data: 1}, &resp.Intiger{Data: 0}), toBytes("SMISMEMBER", "intset", "1", "3", "4")},
+		{"SCARD", &resp.Intiger{Data: 2}, toBytes("SCARD", "set")},
+		{"ZRANGE", bulkArr("b", "-inf", "a", "1.5"), toBytes("ZRANGE", "zset", "0", "-1", "WITHSCORES")},
+		{"XRANGE", entries(
+			entry("1-1", "f", "v1"),
+			entry("1-2", "f", "v2"),
+			entry("2-0", "other", "v3", "g", "v4"),
+		), toBytes("XRANGE", "stream", "-", "+")},
+		{"XADD keeps the last ID", resp.MakeErr("ERR The ID specified in XADD is equal or smaller than the target stream top item"), toBytes("XADD", "stream", "3-0", "f", "v")},
+		{"XPENDING", entries(
+			&resp.Intiger{Data: 2},
+			&resp.BulkStr{Data: []byte("1-1")},
+			&resp.BulkStr{Data: []byte("1-2")},
+			entries(bulkArr("alice", "2")),
+		), toBytes("XPENDING", "stream", "g")},
+		{"XGROUP DELCONSUMER", &resp.Intiger{Data: 0}, toBytes("XGROUP", "DELCONSUMER", "stream", "g", "bob")},
+	}
+	for _, test := range tests {
+		rep, _ := s.Exec(test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+
+	if ttl := mustExec(t, s, "PTTL", "session").(*resp.Intiger).Data; ttl <= 0 || ttl > 100000 {
+		t.Fatalf("TTL was not restored, got %d", ttl)
+	}
+}
+
+func TestRDBBgsave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+
+	s := openTestRDB(t, path, SaveParam{Seconds: 3600, Changes: 1})
+	mustExec(t, s, "SET", "k", "v")
+
+	rep := mustExec(t, s, "BGSAVE")
+	if !slices.Equal(rep.ToBytes(), (&resp.SimpleStr{Data: []byte("Background saving started")}).ToBytes()) {
+		t.Fatalf("BGSAVE failed: %q", rep.ToBytes())
+	}
+	s.waitBgsave()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("BGSAVE did not write the file: %v", err)
+	}
+
+	// the file has the keyspace as it was when the save started
+	s.mu.Lock()
+	if err := s.startBgsave(); err != nil {
+		t.Fatalf("failed to start BGSAVE: %v", err)
+	}
+	s.call(&Session{}, cmdTable["set"], toBytes("SET", "k", "changed"))
+	s.mu.Unlock()
+	s.waitBgsave()
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyPath := filepath.Join(t.TempDir(), "copy.rdb")
+	if err := os.WriteFile(copyPath, saved, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := openTestRDB(t, copyPath)
+	if rep := mustExec(t, c, "GET", "k"); string(rep.ToBytes()) != "$1\r\nv\r\n" {
+		t.Fatalf("write made during BGSAVE saved: %q", rep.ToBytes())
+	}
+	c.Close()
+
+	// a write made after the save is persisted by the save on shutdown
+	mustExec(t, s, "SET", "k2", "v2")
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	s = openTestRDB(t, path)
+	defer s.Close()
+	rep = mustExec(t, s, "GET", "k2")
+	if !slices.Equal(rep.ToBytes(), (&resp.BulkStr{Data: []byte("v2")}).ToBytes()) {
+		t.Fatalf("shutdown did not save, got %q", rep.ToBytes())
+	}
+}
+
+func TestRDBChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+
+	s := openTestRDB(t, path)
+	mustExec(t, s, "SET", "key", "value")
+	mustExec(t, s, "SAVE")
+	s.Close()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(content, []byte("value"))
+	content[i] = 'V'
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.DBFilename = path
+	if _, err := Open(cfg); err == nil {
+		t.Fatalf("expected an error for a corrupted file")
+	}
+}
+
+// TestRDBLoadEncodings loads the compact encodings written by newer redis
+// versions, which the saver itself never produces
+func TestRDBLoadEncodings(t *testing.T) {
+	var buf bytes.Buffer
+	w := &rdbWriter{w: bufio.NewWriter(&buf)}
+	w.write([]byte("REDIS0011"))
+	w.writeByte(rdbOpSelectDB)
+	w.writeLen(0)
+
+	// integer encoded strings
+	w.writeByte(rdbTypeString)
+	w.writeString([]byte("int8"))
+	w.write([]byte{0xC0 | rdbEncInt8, 0xF6})
+	w.writeByte(rdbTypeString)
+	w.writeString([]byte("int32"))
+	w.write(binary.LittleEndian.AppendUint32([]byte{0xC0 | rdbEncInt32}, 100000))
+
+	// ten 'a', compressed as a literal followed by a back reference
+	w.writeByte(rdbTypeString)
+	w.writeString([]byte("lzf"))
+	w.write([]byte{0xC0 | rdbEncLZF})
+	w.writeLen(5)
+	w.writeLen(10)
+	w.write([]byte{0x00, 'a', 0xE0, 0x00, 0x00})
+
+	w.writeByte(rdbTypeSetIntset)
+	w.writeString([]byte("intset"))
+	is := binary.LittleEndian.AppendUint32(nil, 2)
+	is = binary.LittleEndian.AppendUint32(is, 2)
+	is = binary.LittleEndian.AppendUint16(is, uint16(0xFFFF))
+	is = binary.LittleEndian.AppendUint16(is, 7)
+	w.writeString(is)
+
+	lp := &listpackWriter{}
+	lp.appendString([]byte("f"))
+	lp.appendString([]byte("v"))
+	w.writeByte(rdbTypeHashListpack)
+	w.writeString([]byte("hash"))
+	w.writeString(lp.bytes())
+
+	lp = &listpackWriter{}
+	lp.appendString([]byte("m"))
+	lp.appendString([]byte("2.5"))
+	w.writeByte(rdbTypeZsetListpack)
+	w.writeString([]byte("zset"))
+	w.writeString(lp.bytes())
+
+	lp = &listpackWriter{}
+	lp.appendString([]byte("a"))
+	lp.appendInt(-5000)
+	w.writeByte(rdbTypeListQuicklist2)
+	w.writeString([]byte("list"))
+	w.writeLen(2)
+	w.writeLen(2)
+	w.writeString(lp.bytes())
+	w.writeLen(1)
+	w.writeString([]byte("plain"))
+
+	// keys of other databases are skipped
+	w.writeByte(rdbOpSelectDB)
+	w.writeLen(1)
+	w.writeByte(rdbTypeString)
+	w.writeString([]byte("other"))
+	w.writeString([]byte("db"))
+
+	w.writeByte(rdbOpEOF)
+	w.write(make([]byte, 8))
+	w.w.Flush()
+
+	s := NewStorage()
+	defer s.Close()
+	if err := s.readRDB(&buf); err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+
+	tests := []suite{
+		{"GET int8", &resp.BulkStr{Data: []byte("-10")}, toBytes("GET", "int8")},
+		{"GET int32", &resp.BulkStr{Data: []byte("100000")}, toBytes("GET", "int32")},
+		{"GET lzf", &resp.BulkStr{Data: []byte("aaaaaaaaaa")}, toBytes("GET", "lzf")},
+		{"SMEMBERS intset", bulkArr("-1", "7"), toBytes("SMEMBERS", "intset")},
+		{"HGET", &resp.BulkStr{Data: []byte("v")}, toBytes("HGET", "hash", "f")},
+		{"ZSCORE", &resp.BulkStr{Data: []byte("2.5")}, toBytes("ZSCORE", "zset", "m")},
+		{"LRANGE", bulkArr("a", "-5000", "plain"), toBytes("LRANGE", "list", "0", "-1")},
+		{"GET other db", &resp.BulkStr{Data: nil}, toBytes("GET", "other")},
+	}
+	for _, test := range tests {
+		rep, _ := s.Exec(test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+}
+
+func TestParseSaveParams(t *testing.T) {
+	params, err := ParseSaveParams("3600 1 300 100")
+	if err != nil || !slices.Equal(params, []SaveParam{{3600, 1}, {300, 100}}) {
+		t.Fatalf("got %v, err %v", params, err)
+	}
+	if params, err := ParseSaveParams(""); err != nil || params != nil {
+		t.Fatalf("empty params should disable saving, got %v, err %v", params, err)
+	}
+	for _, invalid := range []string{"3600", "a 1", "0 1"} {
+		if _, err := ParseSaveParams(invalid); err == nil {
+			t.Fatalf("expected an error for %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,815 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// newest RDB version the loader understands, the one written by redis 7.4
+const rdbMaxVersion = 12
+
+var errBadRDB = errors.New("invalid RDB format")
+
+type rdbReader struct {
+	r   *bufio.Reader
+	crc uint64
+	// the database the replication stream was on when the file was saved,
+	// from the repl-stream-db aux field
+	streamDB int
+}
+
+func (r *rdbReader) read(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	r.crc = crc64Update(r.crc, buf)
+	return buf, nil
+}
+
+func (r *rdbReader) readByte() (byte, error) {
+	b, err := r.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// readLen reads a length, encoded reports that it's the type of a special
+// string encoding rather than a length
+func (r *rdbReader) readLen() (n uint64, encoded bool, err error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3F), false, nil
+	case 1:
+		next, err := r.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3F)<<8 | uint64(next), false, nil
+	case 3:
+		return uint64(b & 0x3F), true, nil
+	}
+
+	switch b {
+	case 0x80:
+		buf, err := r.read(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(buf)), false, nil
+	case 0x81:
+		buf, err := r.read(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(buf), false, nil
+	}
+	return 0, false, errBadRDB
+}
+
+// readCount reads a plain length, used for element counts and IDs
+func (r *rdbReader) readCount() (uint64, error) {
+	n, encoded, err := r.readLen()
+	if err == nil && encoded {
+		err = errBadRDB
+	}
+	return n, err
+}
+
+func (r *rdbReader) readString() ([]byte, error) {
+	n, encoded, err := r.readLen()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		return r.read(int(n))
+	}
+
+	switch n {
+	case rdbEncInt8:
+		b, err := r.read(1)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int8(b[0])), 10), nil
+	case rdbEncInt16:
+		b, err := r.read(2)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int16(binary.LittleEndian.Uint16(b))), 10), nil
+	case rdbEncInt32:
+		b, err := r.read(4)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int32(binary.LittleEndian.Uint32(b))), 10), nil
+	case rdbEncLZF:
+		clen, err := r.readCount()
+		if err != nil {
+			return nil, err
+		}
+		ulen, err := r.readCount()
+		if err != nil {
+			return nil, err
+		}
+		compressed, err := r.read(int(clen))
+		if err != nil {
+			return nil, err
+		}
+		return lzfDecompress(compressed, int(ulen))
+	}
+	return nil, errBadRDB
+}
+
+func (r *rdbReader) readMillis() (time.Time, error) {
+	b, err := r.read(8)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(int64(binary.LittleEndian.Uint64(b))), nil
+}
+
+func (r *rdbReader) readRawStreamID() (streamID, error) {
+	b, err := r.read(16)
+	if err != nil {
+		return streamID{}, err
+	}
+	return streamID{ms: binary.BigEndian.Uint64(b), seq: binary.BigEndian.Uint64(b[8:])}, nil
+}
+
+func (r *rdbReader) readStreamID() (streamID, error) {
+	ms, err := r.readCount()
+	if err != nil {
+		return streamID{}, err
+	}
+	seq, err := r.readCount()
+	return streamID{ms: ms, seq: seq}, err
+}
+
+// readLegacyDouble reads a score of the old zset encoding, stored as a
+// string prefixed by its length with special lengths for NaN and infinities
+func (r *rdbReader) readLegacyDouble() (float64, error) {
+	n, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	b, err := r.read(int(n))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(b), 64)
+}
+
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	out := make([]byte, 0, outLen)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+
+		// literal run
+		if ctrl < 32 {
+			n := ctrl + 1
+			if i+n > len(in) {
+				return nil, errBadRDB
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+
+		// back reference
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, errBadRDB
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errBadRDB
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errBadRDB
+		}
+		for j := 0; j < n+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != outLen {
+		return nil, errBadRDB
+	}
+	return out, nil
+}
+
+// loadRDB loads the snapshot saved at path, a missing file is an empty
+// dataset
+func (s *Storage) loadRDB(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.readRDB(f); err != nil {
+		return fmt.Errorf("failed to load %s: %w", path, err)
+	}
+	return nil
+}
+
+func (s *Storage) readRDB(in io.Reader) error {
+	return s.readRDBFrom(&rdbReader{r: bufio.NewReader(in)})
+}
+
+// readRDBFrom loads the keys read by r into their databases, which must
+// exist
+func (s *Storage) readRDBFrom(r *rdbReader) error {
+	header, err := r.read(9)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(header, []byte("REDIS")) {
+		return errBadRDB
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 || version > rdbMaxVersion {
+		return fmt.Errorf("unsupported RDB version %q", header[5:])
+	}
+
+	now := time.Now()
+	db := uint64(0)
+	var expireAt time.Time
+	for {
+		op, err := r.readByte()
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case rdbOpEOF:
+			if version < 5 {
+				return nil
+			}
+			want := r.crc
+			sum, err := r.read(8)
+			if err != nil {
+				return err
+			}
+			// a zero checksum means the file was saved with checksums disabled
+			if got := binary.LittleEndian.Uint64(sum); got != 0 && got != want {
+				return errors.New("wrong RDB checksum")
+			}
+			return nil
+		case rdbOpSelectDB:
+			if db, err = r.readCount(); err != nil {
+				return err
+			}
+			if db >= uint64(len(s.dbs)) {
+				return fmt.Errorf("keys of database %d but only %d databases are configured", db, len(s.dbs))
+			}
+			continue
+		case rdbOpResizeDB:
+			if _, err := r.readCount(); err != nil {
+				return err
+			}
+			if _, err := r.readCount(); err != nil {
+				return err
+			}
+			continue
+		case rdbOpSlotInfo:
+			for range 3 {
+				if _, err := r.readCount(); err != nil {
+					return err
+				}
+			}
+			continue
+		case rdbOpAux:
+			key, err := r.readString()
+			if err != nil {
+				return err
+			}
+			val, err := r.readString()
+			if err != nil {
+				return err
+			}
+			if string(key) == "repl-stream-db" {
+				r.streamDB, _ = strconv.Atoi(string(val))
+			}
+			continue
+		case rdbOpExpireTimeMs:
+			if expireAt, err = r.readMillis(); err != nil {
+				return err
+			}
+			continue
+		case rdbOpExpireTime:
+			b, err := r.read(4)
+			if err != nil {
+				return err
+			}
+			expireAt = time.Unix(int64(int32(binary.LittleEndian.Uint32(b))), 0)
+			continue
+		case rdbOpFreq:
+			if _, err := r.readByte(); err != nil {
+				return err
+			}
+			continue
+		case rdbOpIdle:
+			if _, err := r.readCount(); err != nil {
+				return err
+			}
+			continue
+		case rdbOpModuleAux, rdbOpFunction2:
+			return errors.New("RDB files with modules or functions are not supported")
+		}
+
+		key, err := r.readString()
+		if err != nil {
+			return err
+		}
+		d, err := r.readEntity(op)
+		if err != nil {
+			return fmt.Errorf("key %q: %w", key, err)
+		}
+
+		at := expireAt
+		expireAt = time.Time{}
+		if !at.IsZero() && now.After(at) {
+			continue
+		}
+		keyspace := s.dbs[db]
+		sh := keyspace.shardOf(string(key))
+		d.touch(now)
+		sh.set(string(key), d)
+		if !at.IsZero() {
+			sh.expires[string(key)] = at
+		}
+		keyspace.account(string(key))
+	}
+}
+
+func (r *rdbReader) readEntity(typ byte) (*dataEntity, error) {
+	switch typ {
+	case rdbTypeString:
+		v, err := r.readString()
+		return &dataEntity{typ: typeString, val: v}, err
+	case rdbTypeList:
+		ql := newQuicklist()
+		err := r.readElems(1, func(e [][]byte) { ql.pushTail(e[0]) })
+		return &dataEntity{typ: typeList, val: ql}, err
+	case rdbTypeListQuicklist2:
+		ql, err := r.readQuicklist()
+		return &dataEntity{typ: typeList, val: ql}, err
+	case rdbTypeSet:
+		set := newSet()
+		err := r.readElems(1, func(e [][]byte) { set.add(e[0]) })
+		return &dataEntity{typ: typeSet, val: set}, err
+	case rdbTypeSetIntset:
+		set, err := r.readIntset()
+		return &dataEntity{typ: typeSet, val: set}, err
+	case rdbTypeSetListpack:
+		set := newSet()
+		err := r.readListpack(1, func(e [][]byte) error {
+			set.add(e[0])
+			return nil
+		})
+		return &dataEntity{typ: typeSet, val: set}, err
+	case rdbTypeHash:
+		h := newHash()
+		err := r.readElems(2, func(e [][]byte) { h.set(string(e[0]), e[1]) })
+		return &dataEntity{typ: typeHash, val: h}, err
+	case rdbTypeHashListpack:
+		h := newHash()
+		err := r.readListpack(2, func(e [][]byte) error {
+			h.set(string(e[0]), e[1])
+			return nil
+		})
+		return &dataEntity{typ: typeHash, val: h}, err
+	case rdbTypeZset, rdbTypeZset2:
+		zs, err := r.readZset(typ == rdbTypeZset2)
+		return &dataEntity{typ: typeZset, val: zs}, err
+	case rdbTypeZsetListpack:
+		zs := newZset()
+		err := r.readListpack(2, func(e [][]byte) error {
+			score, err := strconv.ParseFloat(string(e[1]), 64)
+			if err != nil {
+				return errBadRDB
+			}
+			zs.add(string(e[0]), score)
+			return nil
+		})
+		return &dataEntity{typ: typeZset, val: zs}, err
+	case rdbTypeStreamListpack, rdbTypeStreamListpack2, rdbTypeStreamListpack3:
+		s, err := r.readStream(typ)
+		return &dataEntity{typ: typeStream, val: s}, err
+	}
+	return nil, fmt.Errorf("unsupported RDB value type %d", typ)
+}
+
+// readElems reads a count of items made of perItem strings each
+func (r *rdbReader) readElems(perItem int, fn func(item [][]byte)) error {
+	n, err := r.readCount()
+	if err != nil {
+		return err
+	}
+	item := make([][]byte, perItem)
+	for range n {
+		for i := range item {
+			if item[i], err = r.readString(); err != nil {
+				return err
+			}
+		}
+		fn(item)
+	}
+	return nil
+}
+
+// readListpack reads a listpack of items made of perItem elements each
+func (r *rdbReader) readListpack(perItem int, fn func(item [][]byte) error) error {
+	lp, err := r.readString()
+	if err != nil {
+		return err
+	}
+	elems, err := decodeListpack(lp)
+	if err != nil {
+		return err
+	}
+	if len(elems)%perItem != 0 {
+		return errBadListpack
+	}
+	for i := 0; i < len(elems); i += perItem {
+		if err := fn(elems[i : i+perItem]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *rdbReader) readQuicklist() (*quicklist, error) {
+	ql := newQuicklist()
+	n, err := r.readCount()
+	if err != nil {
+		return nil, err
+	}
+	for range n {
+		container, err := r.readCount()
+		if err != nil {
+			return nil, err
+		}
+		// a plain node holds a single large element as is
+		if container == 1 {
+			v, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			ql.pushTail(v)
+			continue
+		}
+		err = r.readListpack(1, func(e [][]byte) error {
+			ql.pushTail(e[0])
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ql, nil
+}
+
+func (r *rdbReader) readIntset() (*set, error) {
+	b, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 8 {
+		return nil, errBadRDB
+	}
+	width := int(binary.LittleEndian.Uint32(b))
+	n := int(binary.LittleEndian.Uint32(b[4:]))
+	b = b[8:]
+	if (width != 2 && width != 4 && width != 8) || len(b) != n*width {
+		return nil, errBadRDB
+	}
+
+	set := newSet()
+	for i := 0; i < n; i++ {
+		var v int64
+		switch width {
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(b[i*2:])))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(b[i*4:])))
+		case 8:
+			v = int64(binary.LittleEndian.Uint64(b[i*8:]))
+		}
+		set.add(strconv.AppendInt(nil, v, 10))
+	}
+	return set, nil
+}
+
+func (r *rdbReader) readZset(binaryScores bool) (*zset, error) {
+	zs := newZset()
+	n, err := r.readCount()
+	if err != nil {
+		return nil, err
+	}
+	for range n {
+		member, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		var score float64
+		if binaryScores {
+			b, err := r.read(8)
+			if err != nil {
+				return nil, err
+			}
+			score = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		} else if score, err = r.readLegacyDouble(); err != nil {
+			return nil, err
+		}
+		if math.IsNaN(score) {
+			return nil, errBadRDB
+		}
+		zs.add(string(member), score)
+	}
+	return zs, nil
+}
+
+func (r *rdbReader) readStream(typ byte) (*stream, error) {
+	s := newStream()
+	nodes, err := r.readCount()
+	if err != nil {
+		return nil, err
+	}
+	for range nodes {
+		key, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != 16 {
+			return nil, errBadRDB
+		}
+		master := streamID{ms: binary.BigEndian.Uint64(key), seq: binary.BigEndian.Uint64(key[8:])}
+		lp, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		if err := s.loadStreamNode(master, lp); err != nil {
+			return nil, err
+		}
+	}
+
+	// the length is implied by the entries
+	if _, err := r.readCount(); err != nil {
+		return nil, err
+	}
+	if s.lastID, err = r.readStreamID(); err != nil {
+		return nil, err
+	}
+	if typ >= rdbTypeStreamListpack2 {
+		// first ID, max deleted ID and entries added, not tracked here
+		for range 5 {
+			if _, err := r.readCount(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	groups, err := r.readCount()
+	if err != nil {
+		return nil, err
+	}
+	for range groups {
+		name, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		g, err := r.readConsumerGroup(typ)
+		if err != nil {
+			return nil, err
+		}
+		s.groups[string(name)] = g
+	}
+	return s, nil
+}
+
+// loadStreamNode appends the entries of a listpack node to the stream
+func (s *stream) loadStreamNode(master streamID, lp []byte) error {
+	elems, err := decodeListpack(lp)
+	if err != nil {
+		return err
+	}
+
+	pos := 0
+	next := func() ([]byte, error) {
+		if pos >= len(elems) {
+			return nil, errBadListpack
+		}
+		pos++
+		return elems[pos-1], nil
+	}
+	nextInt := func() (int64, error) {
+		e, err := next()
+		if err != nil {
+			return 0, err
+		}
+		v, err := strconv.ParseInt(string(e), 10, 64)
+		if err != nil {
+			return 0, errBadListpack
+		}
+		return v, nil
+	}
+
+	// master entry: count, deleted count, fields of the master, a terminator
+	if _, err := nextInt(); err != nil {
+		return err
+	}
+	if _, err := nextInt(); err != nil {
+		return err
+	}
+	numFields, err := nextInt()
+	if err != nil {
+		return err
+	}
+	masterFields := make([][]byte, numFields)
+	for i := range masterFields {
+		if masterFields[i], err = next(); err != nil {
+			return err
+		}
+	}
+	if _, err := next(); err != nil {
+		return err
+	}
+
+	for pos < len(elems) {
+		flags, err := nextInt()
+		if err != nil {
+			return err
+		}
+		msDiff, err := nextInt()
+		if err != nil {
+			return err
+		}
+		seqDiff, err := nextInt()
+		if err != nil {
+			return err
+		}
+		e := &streamEntry{id: streamID{ms: master.ms + uint64(msDiff), seq: master.seq + uint64(seqDiff)}}
+
+		if flags&streamItemFlagSameFields != 0 {
+			for _, field := range masterFields {
+				val, err := next()
+				if err != nil {
+					return err
+				}
+				e.fields = append(e.fields, field, val)
+			}
+		} else {
+			n, err := nextInt()
+			if err != nil {
+				return err
+			}
+			for range n * 2 {
+				f, err := next()
+				if err != nil {
+					return err
+				}
+				e.fields = append(e.fields, f)
+			}
+		}
+		// lp-count, only needed to walk the node backwards
+		if _, err := next(); err != nil {
+			return err
+		}
+
+		if flags&streamItemFlagDeleted != 0 {
+			continue
+		}
+		if last := s.log.lastEntry(); last != nil && !last.id.less(e.id) {
+			return errBadRDB
+		}
+		s.log.append(e)
+	}
+	return nil
+}
+
+func (r *rdbReader) readConsumerGroup(typ byte) (*consumerGroup, error) {
+	lastID, err := r.readStreamID()
+	if err != nil {
+		return nil, err
+	}
+	g := newConsumerGroup(lastID)
+	if typ >= rdbTypeStreamListpack2 {
+		// entries read, not tracked here
+		if _, err := r.readCount(); err != nil {
+			return nil, err
+		}
+	}
+
+	pending, err := r.readCount()
+	if err != nil {
+		return nil, err
+	}
+	nacks := make(map[streamID]*streamNACK, pending)
+	for range pending {
+		id, err := r.readRawStreamID()
+		if err != nil {
+			return nil, err
+		}
+		deliveryTime, err := r.readMillis()
+		if err != nil {
+			return nil, err
+		}
+		count, err := r.readCount()
+		if err != nil {
+			return nil, err
+		}
+		n := &streamNACK{id: id, deliveryTime: deliveryTime, deliveryCount: int64(count)}
+		nacks[id] = n
+		g.pel = append(g.pel, n)
+	}
+	slices.SortFunc(g.pel, func(a, b *streamNACK) int {
+		return a.id.compare(b.id)
+	})
+
+	consumers, err := r.readCount()
+	if err != nil {
+		return nil, err
+	}
+	for range consumers {
+		name, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		seenTime, err := r.readMillis()
+		if err != nil {
+			return nil, err
+		}
+		if typ >= rdbTypeStreamListpack3 {
+			// active time, not tracked here
+			if _, err := r.readMillis(); err != nil {
+				return nil, err
+			}
+		}
+		c := g.consumer(string(name), true)
+		c.seenTime = seenTime
+
+		owned, err := r.readCount()
+		if err != nil {
+			return nil, err
+		}
+		for range owned {
+			id, err := r.readRawStreamID()
+			if err != nil {
+				return nil, err
+			}
+			n, ok := nacks[id]
+			if !ok || n.consumer != nil {
+				return nil, errBadRDB
+			}
+			n.assign(c)
+		}
+	}
+
+	for _, n := range g.pel {
+		if n.consumer == nil {
+			return nil, errBadRDB
+		}
+	}
+	return g, nil
+}
@@ -0,0 +1,391 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+const (
+	// a link to the master that stays silent this long is dropped
+	replTimeout = 60 * time.Second
+	// replicas acknowledge their offset this often
+	replAckPeriod = time.Second
+	// delay between two attempts to reach the master
+	replRetryDelay = time.Second
+)
+
+// masterLink is the connection of a replica to its master. Its fields are
+// guarded by Storage.mu except conn writes, which go through wmu.
+type masterLink struct {
+	addr string
+	// connect, connecting, sync or connected, as reported by ROLE
+	state  string
+	lastIO time.Time
+
+	conn net.Conn
+	wmu  sync.Mutex
+
+	// the database the writes of the master run on, its stream selects it
+	// and it's kept across partial resyncs
+	session Session
+
+	stopped bool
+	exit    chan struct{}
+	done    chan struct{}
+}
+
+// stop closes the link, its goroutine exits on its own. Must be called
+// with Storage.mu held.
+func (m *masterLink) stop() {
+	if m.stopped {
+		return
+	}
+	m.stopped = true
+	close(m.exit)
+	if m.conn != nil {
+		m.conn.Close()
+	}
+}
+
+func (m *masterLink) send(args ...string) error {
+	cmd := make([][]byte, len(args))
+	for i, a := range args {
+		cmd[i] = []byte(a)
+	}
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	_, err := m.conn.Write(encodeCommand(cmd))
+	return err
+}
+
+// deadlineReader fails reads on a connection silent for replTimeout
+type deadlineReader struct {
+	conn net.Conn
+}
+
+func (d deadlineReader) Read(p []byte) (int, error) {
+	d.conn.SetReadDeadline(time.Now().Add(replTimeout))
+	return d.conn.Read(p)
+}
+
+// replicaOf starts replicating addr. Must be called with s.mu held.
+func (s *Storage) replicaOf(addr string) {
+	m := &masterLink{
+		addr:  addr,
+		state: "connect",
+		exit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	s.repl.master = m
+	go s.replicaLoop(m)
+	slog.Info("replicating", "master", addr)
+}
+
+// replicaLoop keeps the link to the master up until it's stopped
+func (s *Storage) replicaLoop(m *masterLink) {
+	defer close(m.done)
+	for {
+		err := s.syncWithMaster(m)
+
+		s.mu.Lock()
+		m.state = "connect"
+		stopped := m.stopped
+		s.mu.Unlock()
+		if stopped {
+			return
+		}
+		slog.Error("lost link with master", "master", m.addr, "error", err)
+
+		select {
+		case <-time.After(replRetryDelay):
+		case <-m.exit:
+			return
+		}
+	}
+}
+
+// current tells if m is still the link to the master. Must be called with
+// s.mu held.
+func (s *Storage) current(m *masterLink) bool {
+	return !m.stopped && s.repl.master == m
+}
+
+func (s *Storage) syncWithMaster(m *masterLink) error {
+	conn, err := net.DialTimeout("tcp", m.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	s.mu.Lock()
+	if !s.current(m) {
+		s.mu.Unlock()
+		return nil
+	}
+	m.conn = conn
+	m.state = "connecting"
+	port := s.repl.announcePort
+	replID, offset := s.repl.replID, s.repl.offset+1
+	if s.repl.backlog == nil {
+		// the dataset doesn't come from a master, there's nothing to continue
+		replID, offset = "?", -1
+	}
+	s.mu.Unlock()
+
+	br := bufio.NewReader(deadlineReader{conn})
+	handshake := [][]string{
+		{"PING"},
+		{"REPLCONF", "listening-port", strconv.Itoa(port)},
+		{"REPLCONF", "capa", "psync2"},
+	}
+	for _, cmd := range handshake {
+		if err := m.send(cmd...); err != nil {
+			return err
+		}
+		if _, err := readStatus(br); err != nil {
+			return fmt.Errorf("%s refused by master: %w", cmd[0], err)
+		}
+	}
+
+	if err := m.send("PSYNC", replID, strconv.FormatInt(offset, 10)); err != nil {
+		return err
+	}
+	status, err := readStatus(br)
+	if err != nil {
+		return err
+	}
+
+	switch fields := strings.Fields(status); {
+	case len(fields) == 3 && fields[0] == "FULLRESYNC":
+		masterOffset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad PSYNC reply %q", status)
+		}
+		s.mu.Lock()
+		m.state = "sync"
+		s.mu.Unlock()
+
+		payload, err := readRDBPayload(br)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		if s.current(m) {
+			err = s.loadFromMaster(payload, fields[1], masterOffset)
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		slog.Info("full sync with master done", "master", m.addr, "bytes", len(payload))
+	case len(fields) >= 1 && fields[0] == "CONTINUE":
+		s.mu.Lock()
+		// the master was promoted since, its history goes on under a new id
+		if len(fields) == 2 && fields[1] != s.repl.replID {
+			s.repl.replID2 = s.repl.replID
+			s.repl.secondOffset = s.repl.offset + 1
+			s.repl.replID = fields[1]
+		}
+		s.mu.Unlock()
+		slog.Info("partial resync with master", "master", m.addr, "offset", offset)
+	default:
+		return fmt.Errorf("bad PSYNC reply %q", status)
+	}
+
+	s.mu.Lock()
+	m.state = "connected"
+	m.lastIO = time.Now()
+	s.mu.Unlock()
+
+	stopAcks := make(chan struct{})
+	defer close(stopAcks)
+	go s.ackLoop(m, stopAcks)
+
+	return s.applyStream(m, br)
+}
+
+// readStatus reads a simple string reply, error replies are returned as
+// errors. Masters may send newlines to keep the link alive meanwhile.
+func readStatus(br *bufio.Reader) (string, error) {
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			continue
+		case line[0] == '+':
+			return line[1:], nil
+		case line[0] == '-':
+			return "", errors.New(line[1:])
+		}
+		return "", fmt.Errorf("unexpected reply %q", line)
+	}
+}
+
+// readRDBPayload reads the snapshot of a full sync, sent as a bulk string
+// without the trailing CRLF
+func readRDBPayload(br *bufio.Reader) ([]byte, error) {
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			continue
+		}
+		if line[0] != '$' {
+			return nil, fmt.Errorf("unexpected reply %q", line)
+		}
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("bad snapshot length %q", line)
+		}
+		payload := make([]byte, n)
+		_, err = io.ReadFull(br, payload)
+		return payload, err
+	}
+}
+
+// loadFromMaster replaces the keyspace with the snapshot of a full sync.
+// Must be called with s.mu held.
+func (s *Storage) loadFromMaster(payload []byte, replID string, offset int64) error {
+	dbs, used := s.dbs, s.used.Load()
+	s.dbs = newDatabases(s, len(dbs))
+	s.used.Store(0)
+	rd := &rdbReader{r: bufio.NewReader(bytes.NewReader(payload))}
+	if err := s.readRDBFrom(rd); err != nil {
+		s.dbs = dbs
+		s.used.Store(used)
+		return fmt.Errorf("failed to load the snapshot of the master: %w", err)
+	}
+	for key := range s.watched {
+		s.signalModified(key.db, key.key)
+	}
+	// the stream goes on from the database it was on at the snapshot
+	s.repl.master.session = Session{db: rd.streamDB}
+
+	r := s.repl
+	r.replID, r.replID2 = replID, ""
+	r.offset, r.secondOffset = offset, -1
+	r.backlog = &backlog{size: r.backlogSize}
+	// our replicas hold the old dataset, they must sync again
+	s.dropReplicas()
+
+	s.dirty++
+	if s.aof != nil {
+		// the dataset reaches the AOF with the rewrite
+		s.aof.offset.Store(offset)
+		_ = s.startAOFRewrite()
+	}
+	return nil
+}
+
+func (s *Storage) ackLoop(m *masterLink, stop chan struct{}) {
+	ticker := time.NewTicker(replAckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if s.sendAck(m) != nil {
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// sendAck reports the offset of the replica to its master, along with the
+// offset it has on disk when the AOF is on
+func (s *Storage) sendAck(m *masterLink) error {
+	s.mu.Lock()
+	ack := []string{"REPLCONF", "ACK", strconv.FormatInt(s.repl.offset, 10)}
+	if s.aof != nil {
+		ack = append(ack, "FACK", strconv.FormatInt(s.aofSyncedOffset(), 10))
+	}
+	s.mu.Unlock()
+	return m.send(ack...)
+}
+
+// applyStream runs the writes streamed by the master until the link
+// breaks. Transactions are applied at once when their EXEC comes in, the
+// offset doesn't move in the meantime so a resync restarts them.
+func (s *Storage) applyStream(m *masterLink, br *bufio.Reader) error {
+	var multi [][][]byte
+	var multiRaw []byte
+	inMulti := false
+
+	for command := range resp.Parse(br) {
+		if command.Err != nil {
+			return command.Err
+		}
+		args := command.Args()
+		if len(args) == 0 {
+			continue
+		}
+		raw := encodeCommand(args)
+		name := strings.ToLower(string(args[0]))
+
+		s.mu.Lock()
+		if !s.current(m) {
+			s.mu.Unlock()
+			m.conn.Close()
+			continue
+		}
+		m.lastIO = time.Now()
+
+		switch {
+		case name == "multi":
+			inMulti, multi, multiRaw = true, nil, raw
+		case name == "exec" && inMulti:
+			// the stream is fed first so the AOF records the new offset
+			s.feed(append(multiRaw, raw...))
+			s.applyMulti(m, multi)
+			inMulti, multi, multiRaw = false, nil, nil
+		case inMulti:
+			multi = append(multi, args)
+			multiRaw = append(multiRaw, raw...)
+		case name == "replconf":
+			s.feed(raw)
+			if len(args) > 1 && strings.EqualFold(string(args[1]), "getack") {
+				go s.sendAck(m)
+			}
+		default:
+			s.feed(raw)
+			if c, errReply := lookupCommand(args); errReply == nil {
+				s.call(&m.session, c, args)
+			}
+		}
+		s.mu.Unlock()
+	}
+	return io.EOF
+}
+
+// applyMulti runs a transaction streamed by the master. Must be called
+// with s.mu held.
+func (s *Storage) applyMulti(m *masterLink, cmds [][][]byte) {
+	var queued []*command
+	var valid [][][]byte
+	for _, cmd := range cmds {
+		if c, errReply := lookupCommand(cmd); errReply == nil {
+			queued = append(queued, c)
+			valid = append(valid, cmd)
+		}
+	}
+	s.callMulti(&m.session, queued, valid)
+}
@@ -0,0 +1,368 @@
+package store
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+// masters ping their replicas this often so idle links don't time out
+const replPingPeriod = 10 * time.Second
+
+// Replica is a connection the replication stream is written to
+type Replica interface {
+	// Feed queues b to be written to the replica, it must not block
+	Feed(b []byte)
+	// Close drops the connection, the replica reconnects and syncs again
+	Close()
+}
+
+// replicaState is what the master knows about an attached replica
+type replicaState struct {
+	addr string
+	// the snapshot of a full sync is being serialized, the stream is
+	// buffered in pending until it's sent
+	syncing bool
+	pending []byte
+
+	ackOffset int64
+	// offset the replica has on disk, reported when its AOF is on
+	aofAckOffset int64
+	ackTime      time.Time
+}
+
+// replication is guarded by Storage.mu. A replica shares the history ids
+// and the offset of its master, so its own replicas can continue from it.
+type replication struct {
+	// id of the history the dataset belongs to, and the previous one which
+	// is valid up to secondOffset. A promoted replica keeps serving partial
+	// resyncs to the replicas of its old master this way.
+	replID       string
+	replID2      string
+	secondOffset int64
+	// number of bytes of the stream produced so far
+	offset int64
+
+	// created when the first replica attaches
+	backlog     *backlog
+	backlogSize int
+
+	replicas map[Replica]*replicaState
+	lastPing time.Time
+
+	// signaled by the AOF when writes reach the disk
+	fsynced chan struct{}
+
+	// non nil on replicas
+	master       *masterLink
+	announcePort int
+
+	exit chan struct{}
+	done chan struct{}
+}
+
+func newReplication() *replication {
+	return &replication{
+		replID:       newReplID(),
+		secondOffset: -1,
+		backlogSize:  1 << 20,
+		replicas:     make(map[Replica]*replicaState),
+		fsynced:      make(chan struct{}, 1),
+		announcePort: 6379,
+		exit:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+func newReplID() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// backlog keeps the last bytes of the stream for partial resyncs
+type backlog struct {
+	data []byte
+	size int
+}
+
+func (b *backlog) write(p []byte) {
+	b.data = append(b.data, p...)
+	if len(b.data) > b.size {
+		b.data = b.data[len(b.data)-b.size:]
+	}
+}
+
+// since returns the stream from offset, the offset of the next byte the
+// replica needs, and false if the backlog no longer holds it
+func (r *replication) since(offset int64) ([]byte, bool) {
+	if r.backlog == nil {
+		return nil, false
+	}
+	first := r.offset - int64(len(r.backlog.data)) + 1
+	if offset < first || offset > r.offset+1 {
+		return nil, false
+	}
+	return r.backlog.data[offset-first:], true
+}
+
+// replicate sends the effects of a write to the replicas. Must be called
+// with s.mu held.
+func (s *Storage) replicate(cmds [][][]byte) {
+	if s.repl.master != nil {
+		// replicas pass the stream of their master on as is, see applyStream
+		return
+	}
+	var buf []byte
+	for _, cmd := range cmds {
+		buf = append(buf, encodeCommand(cmd)...)
+	}
+	s.feed(buf)
+}
+
+// feed appends buf to the stream, the offset moves with every write even
+// without replicas. Must be called with s.mu held.
+func (s *Storage) feed(buf []byte) {
+	r := s.repl
+	r.offset += int64(len(buf))
+	if r.backlog == nil {
+		return
+	}
+	r.backlog.write(buf)
+	for replica, st := range r.replicas {
+		if st.syncing {
+			st.pending = append(st.pending, buf...)
+			continue
+		}
+		replica.Feed(buf)
+	}
+}
+
+// Sync attaches replica, which asked to continue the history replID from
+// offset. It's continued from there when the backlog still holds the
+// stream, otherwise a snapshot of the keyspace is sent first. The stream
+// of writes follows in both cases.
+func (s *Storage) Sync(replica Replica, addr string, replID string, offset int64) error {
+	if s.closed.Load() {
+		return ErrClosed
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.repl
+	if r.backlog == nil {
+		r.backlog = &backlog{size: r.backlogSize}
+	}
+	st := &replicaState{addr: addr, ackTime: time.Now()}
+
+	if replID == r.replID || (replID == r.replID2 && offset <= r.secondOffset) {
+		if buf, ok := r.since(offset); ok {
+			replica.Feed([]byte("+CONTINUE " + r.replID + "\r\n"))
+			replica.Feed(bytes.Clone(buf))
+			st.ackOffset = offset - 1
+			r.replicas[replica] = st
+			slog.Info("partial resync accepted", "replica", addr, "offset", offset)
+			return nil
+		}
+	}
+
+	replica.Feed(fmt.Appendf(nil, "+FULLRESYNC %s %d\r\n", r.replID, r.offset))
+	st.syncing = true
+	r.replicas[replica] = st
+	snap := s.snapshot()
+	if r.master != nil {
+		// the stream of our master is passed on as is
+		snap.streamDB = r.master.session.db
+	} else {
+		// the writes following the snapshot start with a SELECT
+		s.logDB = -1
+	}
+	go s.fullSync(replica, st, snap)
+	return nil
+}
+
+func (s *Storage) fullSync(replica Replica, st *replicaState, snap *snapshot) {
+	s.copyKeyspace(snap)
+	var buf bytes.Buffer
+	err := writeRDB(&buf, snap)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseSnapshot(snap)
+	if s.repl.replicas[replica] != st {
+		return
+	}
+	if err != nil {
+		slog.Error("full sync failed", "replica", st.addr, "error", err)
+		delete(s.repl.replicas, replica)
+		replica.Close()
+		return
+	}
+
+	replica.Feed(fmt.Appendf(nil, "$%d\r\n", buf.Len()))
+	replica.Feed(buf.Bytes())
+	if len(st.pending) > 0 {
+		replica.Feed(st.pending)
+	}
+	st.pending = nil
+	st.syncing = false
+	slog.Info("full sync done", "replica", st.addr, "bytes", buf.Len())
+}
+
+// Detach stops streaming to replica
+func (s *Storage) Detach(replica Replica) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.repl.replicas, replica)
+}
+
+// Ack records that replica processed the stream up to offset and has it
+// on disk up to aofOffset
+func (s *Storage) Ack(replica Replica, offset, aofOffset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st, ok := s.repl.replicas[replica]; ok {
+		st.ackOffset = offset
+		st.aofAckOffset = aofOffset
+		st.ackTime = time.Now()
+		s.serveAckWaiters()
+	}
+}
+
+// sortedReplicas returns the attached replicas by address. Must be called
+// with s.mu held.
+func (r *replication) sortedReplicas() []*replicaState {
+	var states []*replicaState
+	for _, st := range r.replicas {
+		states = append(states, st)
+	}
+	slices.SortFunc(states, func(a, b *replicaState) int {
+		return strings.Compare(a.addr, b.addr)
+	})
+	return states
+}
+
+// dropReplicas disconnects every replica. Must be called with s.mu held.
+func (s *Storage) dropReplicas() {
+	for replica := range s.repl.replicas {
+		replica.Close()
+	}
+	clear(s.repl.replicas)
+}
+
+func (s *Storage) replCron() {
+	r := s.repl
+	defer close(r.done)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.mu.Lock()
+			if r.master == nil && len(r.replicas) > 0 && now.Sub(r.lastPing) >= replPingPeriod {
+				s.feed(encodeCommand(cmdArgv("ping")))
+				r.lastPing = now
+			}
+			s.mu.Unlock()
+		case <-r.fsynced:
+			s.mu.Lock()
+			s.serveAckWaiters()
+			s.mu.Unlock()
+		case <-r.exit:
+			return
+		}
+	}
+}
+
+// promote turns a replica into a master. The history of the old master is
+// kept as the second id so its other replicas can continue from here.
+// Must be called with s.mu held.
+func (s *Storage) promote() {
+	r := s.repl
+	r.master.stop()
+	r.master = nil
+	r.replID2 = r.replID
+	r.secondOffset = r.offset + 1
+	r.replID = newReplID()
+	// the stream went on from the database of the master until now, our
+	// next writes select theirs
+	s.logDB = -1
+}
+
+func execReplicaOf(db kVStore, args [][]byte) resp.RespType {
+	s := storageOf(db)
+	r := s.repl
+
+	if s.cluster != nil {
+		return resp.MakeErr("ERR REPLICAOF not allowed in cluster mode.")
+	}
+	host, port := string(args[0]), string(args[1])
+	if strings.EqualFold(host, "no") && strings.EqualFold(port, "one") {
+		if r.master != nil {
+			s.promote()
+			slog.Info("replication stopped, now a master")
+		}
+		return resp.OkReply()
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return resp.MakeErr("ERR Invalid master port")
+	}
+	addr := net.JoinHostPort(host, port)
+	if r.master != nil {
+		if r.master.addr == addr {
+			return &resp.SimpleStr{Data: []byte("OK Already connected to specified master")}
+		}
+		r.master.stop()
+	}
+	s.replicaOf(addr)
+	return resp.OkReply()
+}
+
+func execRole(db kVStore, args [][]byte) resp.RespType {
+	r := storageOf(db).repl
+	if m := r.master; m != nil {
+		host, port, _ := net.SplitHostPort(m.addr)
+		p, _ := strconv.ParseInt(port, 10, 64)
+		return &resp.Array{Elems: []resp.RespType{
+			&resp.BulkStr{Data: []byte("slave")},
+			&resp.BulkStr{Data: []byte(host)},
+			&resp.Intiger{Data: p},
+			&resp.BulkStr{Data: []byte(m.state)},
+			&resp.Intiger{Data: r.offset},
+		}}
+	}
+
+	replicas := &resp.Array{}
+	for _, st := range r.sortedReplicas() {
+		host, port, _ := net.SplitHostPort(st.addr)
+		entry := &resp.RespBulkStrArr{}
+		entry.Append([]byte(host))
+		entry.Append([]byte(port))
+		entry.Append(strconv.AppendInt(nil, st.ackOffset, 10))
+		replicas.Append(entry)
+	}
+	return &resp.Array{Elems: []resp.RespType{
+		&resp.BulkStr{Data: []byte("master")},
+		&resp.Intiger{Data: r.offset},
+		replicas,
+	}}
+}
+
+func init() {
+	registerCommand("replicaof", 3, 0, execReplicaOf)
+	registerCommand("slaveof", 3, 0, execReplicaOf)
+	registerCommand("role", 1, 0, execRole)
+}
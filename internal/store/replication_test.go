@@ -0,0 +1,233 @@
+package store
+
+import (
+	"bytes"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+// connReplica streams to a replica connected to a testMaster
+type connReplica struct {
+	conn net.Conn
+	m    *testMaster
+}
+
+func (r *connReplica) Feed(b []byte) {
+	if bytes.HasPrefix(b, []byte("+FULLRESYNC")) {
+		r.m.mu.Lock()
+		r.m.fullSyncs++
+		r.m.mu.Unlock()
+	}
+	r.conn.Write(b)
+}
+
+func (r *connReplica) Close() {
+	r.conn.Close()
+}
+
+// testMaster serves the replication commands of a storage, like the
+// server does
+type testMaster struct {
+	s  *Storage
+	ln net.Listener
+
+	mu        sync.Mutex
+	conns     []net.Conn
+	fullSyncs int
+}
+
+func startTestMaster(t *testing.T, s *Storage) *testMaster {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &testMaster{s: s, ln: ln}
+	t.Cleanup(func() {
+		ln.Close()
+		m.dropLinks()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			m.mu.Lock()
+			m.conns = append(m.conns, conn)
+			m.mu.Unlock()
+			go m.serve(conn)
+		}
+	}()
+	return m
+}
+
+func (m *testMaster) serve(conn net.Conn) {
+	r := &connReplica{conn: conn, m: m}
+	defer m.s.Detach(r)
+	for command := range resp.Parse(conn) {
+		if command.Err != nil {
+			return
+		}
+		args := command.Args()
+		switch strings.ToLower(string(args[0])) {
+		case "ping":
+			conn.Write([]byte("+PONG\r\n"))
+		case "replconf":
+			if strings.EqualFold(string(args[1]), "ack") {
+				offset, _ := strconv.ParseInt(string(args[2]), 10, 64)
+				var aofOffset int64
+				if len(args) == 5 {
+					aofOffset, _ = strconv.ParseInt(string(args[4]), 10, 64)
+				}
+				m.s.Ack(r, offset, aofOffset)
+				continue
+			}
+			conn.Write([]byte("+OK\r\n"))
+		case "psync":
+			offset, _ := strconv.ParseInt(string(args[2]), 10, 64)
+			m.s.Sync(r, conn.RemoteAddr().String(), string(args[1]), offset)
+		}
+	}
+}
+
+// dropLinks breaks the connections of the replicas
+func (m *testMaster) dropLinks() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, conn := range m.conns {
+		conn.Close()
+	}
+	m.conns = nil
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func replOffset(s *Storage) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.repl.offset
+}
+
+func linkUp(s *Storage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.repl.master != nil && s.repl.master.state == "connected"
+}
+
+func TestReplication(t *testing.T) {
+	master := NewStorage()
+	defer master.Close()
+	m := startTestMaster(t, master)
+	mustExec(t, master, "SET", "before", "1")
+	mustExec(t, master, "SADD", "set", "a", "b", "c")
+
+	replica := NewStorage()
+	defer replica.Close()
+	host, port, _ := net.SplitHostPort(m.ln.Addr().String())
+	mustExec(t, replica, "REPLICAOF", host, port)
+	waitFor(t, "the link to come up", func() bool { return linkUp(replica) })
+
+	mustExec(t, master, "INCR", "before")
+	mustExec(t, master, "RPUSH", "list", "x", "y")
+	mustExec(t, master, "SPOP", "set")
+	master.ExecMulti(&Session{}, [][][]byte{toBytes("SET", "tx", "1"), toBytes("INCR", "tx")}, nil)
+	waitFor(t, "the replica to catch up", func() bool { return replOffset(replica) == replOffset(master) })
+
+	sameOn := func(args ...string) {
+		t.Helper()
+		want, got := mustExec(t, master, args...), mustExec(t, replica, args...)
+		if !slices.Equal(got.ToBytes(), want.ToBytes()) {
+			t.Fatalf("%v: replica has %q, master has %q", args, got.ToBytes(), want.ToBytes())
+		}
+	}
+	sameOn("GET", "before")
+	sameOn("LRANGE", "list", "0", "-1")
+	sameOn("SCARD", "set")
+	sameOn("GET", "tx")
+
+	readOnly := resp.MakeErr("READONLY You can't write against a read only replica.")
+	if rep := mustExec(t, replica, "SET", "k", "v"); !slices.Equal(rep.ToBytes(), readOnly.ToBytes()) {
+		t.Fatalf("replica accepted a write: %q", rep.ToBytes())
+	}
+
+	// a short disconnection is caught up from the backlog
+	m.dropLinks()
+	mustExec(t, master, "SET", "during", "1")
+	waitFor(t, "the link to come back", func() bool {
+		return linkUp(replica) && replOffset(replica) == replOffset(master)
+	})
+	sameOn("GET", "during")
+	m.mu.Lock()
+	fullSyncs := m.fullSyncs
+	m.mu.Unlock()
+	if fullSyncs != 1 {
+		t.Fatalf("expected a partial resync, got %d full syncs", fullSyncs)
+	}
+
+	waitFor(t, "the replica to acknowledge", func() bool {
+		master.mu.Lock()
+		defer master.mu.Unlock()
+		for _, st := range master.repl.replicas {
+			return st.ackOffset == master.repl.offset
+		}
+		return false
+	})
+
+	masterID := master.repl.replID
+	mustExec(t, replica, "REPLICAOF", "NO", "ONE")
+	if rep := mustExec(t, replica, "SET", "k", "v"); !slices.Equal(rep.ToBytes(), resp.OkReply().ToBytes()) {
+		t.Fatalf("promoted replica refused a write: %q", rep.ToBytes())
+	}
+	if replica.repl.replID2 != masterID || replica.repl.replID == masterID {
+		t.Fatalf("promotion must start a new history and keep the old one as the second id")
+	}
+}
+
+func TestBacklog(t *testing.T) {
+	r := newReplication()
+	if _, ok := r.since(1); ok {
+		t.Fatalf("nothing can be continued without a backlog")
+	}
+
+	r.backlog = &backlog{size: 8}
+	feed := func(s string) {
+		r.offset += int64(len(s))
+		r.backlog.write([]byte(s))
+	}
+	feed("abcdef")
+	feed("ghij")
+
+	tests := []struct {
+		offset int64
+		want   string
+		ok     bool
+	}{
+		{3, "cdefghij", true},
+		{7, "ghij", true},
+		{11, "", true},
+		{2, "", false},
+		{12, "", false},
+	}
+	for _, test := range tests {
+		got, ok := r.since(test.offset)
+		if ok != test.ok || string(got) != test.want {
+			t.Fatalf("since(%d) = %q, %v, want %q, %v", test.offset, got, ok, test.want, test.ok)
+		}
+	}
+}
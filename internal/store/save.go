@@ -0,0 +1,281 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+// a failed background save is retried after this delay at the earliest
+const bgsaveRetryDelay = 5 * time.Second
+
+var errBgsaveInProgress = errors.New("Background save already in progress")
+
+// SaveParam triggers a background save once Changes writes were made in
+// the last Seconds seconds
+type SaveParam struct {
+	Seconds int
+	Changes int
+}
+
+// ParseSaveParams parses "<seconds> <changes>" pairs separated by spaces,
+// an empty string disables automatic saves
+func ParseSaveParams(s string) ([]SaveParam, error) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid save params %q, must be pairs of <seconds> <changes>", s)
+	}
+
+	var params []SaveParam
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err1 := strconv.Atoi(fields[i])
+		changes, err2 := strconv.Atoi(fields[i+1])
+		if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+			return nil, fmt.Errorf("invalid save params %q, must be pairs of <seconds> <changes>", s)
+		}
+		params = append(params, SaveParam{Seconds: seconds, Changes: changes})
+	}
+	return params, nil
+}
+
+// rdbSaver is guarded by Storage.mu
+type rdbSaver struct {
+	path   string
+	params []SaveParam
+
+	lastSave time.Time
+	// time and outcome of the last background save
+	lastBgsaveTry time.Time
+	lastBgsaveErr error
+
+	// non nil while a background save is running, closed when it's over
+	bgsaveDone chan struct{}
+	// Storage.dirty when the running background save started
+	dirtyAtStart int64
+	// a BGSAVE SCHEDULE came in while another save was running
+	scheduled bool
+
+	exit chan struct{}
+	done chan struct{}
+}
+
+func newRDBSaver(cfg Config) *rdbSaver {
+	return &rdbSaver{
+		path:     cfg.DBFilename,
+		params:   cfg.SaveParams,
+		lastSave: time.Now(),
+		exit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// shouldSave tells if one of the save params is met or a scheduled save is
+// due. Must be called with Storage.mu held.
+func (s *Storage) shouldSave(now time.Time) bool {
+	r := s.rdb
+	if r.bgsaveDone != nil {
+		return false
+	}
+	if r.scheduled {
+		return true
+	}
+	if r.lastBgsaveErr != nil && now.Sub(r.lastBgsaveTry) < bgsaveRetryDelay {
+		return false
+	}
+	for _, p := range r.params {
+		if s.dirty >= int64(p.Changes) && now.Sub(r.lastSave) > time.Duration(p.Seconds)*time.Second {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Storage) saveCron() {
+	r := s.rdb
+	defer close(r.done)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.mu.Lock()
+			if s.shouldSave(now) {
+				_ = s.startBgsave()
+			}
+			s.mu.Unlock()
+		case <-r.exit:
+			return
+		}
+	}
+}
+
+// startBgsave writes a snapshot of the keyspace to the RDB file in the
+// background. Must be called with s.mu held.
+func (s *Storage) startBgsave() error {
+	r := s.rdb
+	if r.bgsaveDone != nil {
+		return errBgsaveInProgress
+	}
+
+	snap := s.snapshot()
+	r.scheduled = false
+	r.dirtyAtStart = s.dirty
+	r.lastBgsaveTry = time.Now()
+	r.bgsaveDone = make(chan struct{})
+	go s.bgsave(r, snap)
+	return nil
+}
+
+func (s *Storage) bgsave(r *rdbSaver, snap *snapshot) {
+	s.copyKeyspace(snap)
+	err := writeRDBFile(r.path, snap)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseSnapshot(snap)
+
+	close(r.bgsaveDone)
+	r.bgsaveDone = nil
+	r.lastBgsaveErr = err
+	if err != nil {
+		slog.Error("background saving failed", "error", err)
+		return
+	}
+	// writes made while saving are not in the file
+	s.dirty -= r.dirtyAtStart
+	r.lastSave = time.Now()
+	slog.Info("background saving finished", "path", r.path)
+}
+
+// save writes the keyspace to the RDB file. Must be called with s.mu held.
+func (s *Storage) save() error {
+	r := s.rdb
+	if r.bgsaveDone != nil {
+		return errBgsaveInProgress
+	}
+
+	// the lock is held for the whole write, no need for a copy
+	snap := s.collect()
+	if err := writeRDBFile(r.path, snap); err != nil {
+		return err
+	}
+	s.dirty = 0
+	r.lastSave = time.Now()
+	r.lastBgsaveErr = nil
+	return nil
+}
+
+// writeRDBFile writes snap to a temporary file renamed to path once it's
+// on disk, a crash leaves either the old or the new snapshot
+func writeRDBFile(path string, snap *snapshot) error {
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	err = writeRDB(f, snap)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// waitBgsave blocks until the running background save, if any, is over.
+// Must be called without s.mu held.
+func (s *Storage) waitBgsave() {
+	s.mu.Lock()
+	done := s.rdb.bgsaveDone
+	s.mu.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+// bgsaveErr is the reply to write commands while background saves fail,
+// the dataset would otherwise silently stop being persisted
+func (s *Storage) bgsaveErr() *resp.RespErr {
+	if s.rdb == nil || len(s.rdb.params) == 0 || s.rdb.lastBgsaveErr == nil {
+		return nil
+	}
+	return resp.MakeErr("MISCONF Errors writing the RDB snapshot, commands that may modify the data set are disabled: " + s.rdb.lastBgsaveErr.Error())
+}
+
+func lookupSaver(db kVStore) (*Storage, resp.RespType) {
+	s := storageOf(db)
+	if s.rdb == nil {
+		return nil, resp.MakeErr("ERR snapshotting is not configured")
+	}
+	return s, nil
+}
+
+func execSave(db kVStore, args [][]byte) resp.RespType {
+	s, errResp := lookupSaver(db)
+	if errResp != nil {
+		return errResp
+	}
+	if err := s.save(); err != nil {
+		return resp.MakeErr("ERR " + err.Error())
+	}
+	return resp.OkReply()
+}
+
+func execBgsave(db kVStore, args [][]byte) resp.RespType {
+	s, errResp := lookupSaver(db)
+	if errResp != nil {
+		return errResp
+	}
+
+	schedule := false
+	if len(args) > 1 {
+		return resp.SyntaxErr()
+	}
+	if len(args) == 1 {
+		if !strings.EqualFold(string(args[0]), "SCHEDULE") {
+			return resp.SyntaxErr()
+		}
+		schedule = true
+	}
+
+	err := s.startBgsave()
+	if err == errBgsaveInProgress && schedule {
+		s.rdb.scheduled = true
+		return &resp.SimpleStr{Data: []byte("Background saving scheduled")}
+	}
+	if err != nil {
+		return resp.MakeErr("ERR " + err.Error())
+	}
+	return &resp.SimpleStr{Data: []byte("Background saving started")}
+}
+
+func execLastSave(db kVStore, args [][]byte) resp.RespType {
+	s, errResp := lookupSaver(db)
+	if errResp != nil {
+		return errResp
+	}
+	return &resp.Intiger{Data: s.rdb.lastSave.Unix()}
+}
+
+func init() {
+	registerCommand("save", 1, 0, execSave)
+	registerCommand("bgsave", -1, 0, execBgsave)
+	registerCommand("lastsave", 1, 0, execLastSave)
+}
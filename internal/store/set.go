@@ -0,0 +1,602 @@
+package store
+
+import (
+	"math/rand/v2"
+	"slices"
+	"strconv"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+	"github.com/myselfBZ/go-redis-clone/pkg/utils"
+)
+
+// maximum number of members a set keeps in the intset encoding
+const setMaxIntsetEntries = 512
+
+// set starts out intset encoded and converts itself to a hash table as soon
+// as a non-integer member is added or it grows past setMaxIntsetEntries
+type set struct {
+	ints intset
+	// nil while the set is intset encoded, otherwise maps every member to
+	// its index in dense
+	members map[string]int
+	// hash table members packed so random ones can be picked by index
+	dense []string
+	// nil up to scanSmallLen members
+	scan *scanIndex
+}
+
+func newSet() *set {
+	return &set{}
+}
+
+func (s *set) isIntset() bool {
+	return s.members == nil
+}
+
+func (s *set) len() int {
+	if s.isIntset() {
+		return len(s.ints)
+	}
+	return len(s.dense)
+}
+
+func (s *set) convert() {
+	s.members = make(map[string]int, len(s.ints)+1)
+	s.dense = make([]string, 0, len(s.ints)+1)
+	for _, v := range s.ints {
+		s.members[strconv.FormatInt(v, 10)] = len(s.dense)
+		s.dense = append(s.dense, strconv.FormatInt(v, 10))
+	}
+	s.ints = nil
+}
+
+// add inserts member, returns false if it is already in the set
+func (s *set) add(member []byte) bool {
+	if s.isIntset() {
+		if v, ok := parseSetInt(member); ok {
+			if s.ints.contains(v) {
+				return false
+			}
+			if len(s.ints) < setMaxIntsetEntries {
+				s.ints.add(v)
+				s.indexed(string(member))
+				return true
+			}
+		}
+		s.convert()
+	}
+
+	m := string(member)
+	if _, ok := s.members[m]; ok {
+		return false
+	}
+	s.members[m] = len(s.dense)
+	s.dense = append(s.dense, m)
+	s.indexed(m)
+	return true
+}
+
+// indexed adds a new member to the scanIndex, building it once the set is
+// large enough
+func (s *set) indexed(member string) {
+	s.scan.add(member)
+	s.scan = growScanIndex(s.scan, s.len(), s.iterString)
+}
+
+// remove deletes member, returns false if it is not in the set
+func (s *set) remove(member []byte) bool {
+	if s.isIntset() {
+		v, ok := parseSetInt(member)
+		if !ok || !s.ints.remove(v) {
+			return false
+		}
+		s.scan.remove(string(member))
+		return true
+	}
+
+	m := string(member)
+	i, ok := s.members[m]
+	if !ok {
+		return false
+	}
+	// move the last member into the hole
+	last := len(s.dense) - 1
+	s.dense[i] = s.dense[last]
+	s.members[s.dense[i]] = i
+	s.dense[last] = ""
+	s.dense = s.dense[:last]
+	delete(s.members, m)
+	s.scan.remove(m)
+	return true
+}
+
+func (s *set) contains(member []byte) bool {
+	if s.isIntset() {
+		v, ok := parseSetInt(member)
+		return ok && s.ints.contains(v)
+	}
+	_, ok := s.members[string(member)]
+	return ok
+}
+
+// at returns the i-th member in the encoding's own order
+func (s *set) at(i int) []byte {
+	if s.isIntset() {
+		return strconv.AppendInt(nil, s.ints[i], 10)
+	}
+	return []byte(s.dense[i])
+}
+
+// iter calls fn for every member until it returns false
+func (s *set) iter(fn func(member []byte) bool) {
+	for i := range s.len() {
+		if !fn(s.at(i)) {
+			return
+		}
+	}
+}
+
+// iterString is iter with the members as strings
+func (s *set) iterString(fn func(member string) bool) {
+	s.iter(func(member []byte) bool {
+		return fn(string(member))
+	})
+}
+
+func (s *set) toSlice() [][]byte {
+	result := make([][]byte, 0, s.len())
+	s.iter(func(member []byte) bool {
+		result = append(result, member)
+		return true
+	})
+	return result
+}
+
+// randomMember returns a random member of a non-empty set
+func (s *set) randomMember() []byte {
+	return s.at(rand.IntN(s.len()))
+}
+
+// randomMembers returns count distinct random members, or all of them
+// if the set is smaller than count
+func (s *set) randomMembers(count int) [][]byte {
+	n := s.len()
+	if count >= n {
+		return s.toSlice()
+	}
+	// partial Fisher-Yates shuffle over the indexes, only the swapped
+	// positions are remembered
+	swapped := make(map[int]int, count)
+	pos := func(i int) int {
+		if j, ok := swapped[i]; ok {
+			return j
+		}
+		return i
+	}
+	result := make([][]byte, 0, count)
+	for i := range count {
+		j := i + rand.IntN(n-i)
+		pi, pj := pos(i), pos(j)
+		swapped[j] = pi
+		result = append(result, s.at(pj))
+	}
+	return result
+}
+
+// lookupSet returns the set stored at key. If the key holds another type,
+// the returned reply is a WRONGTYPE error. Missing keys yield (nil, nil).
+func lookupSet(db kVStore, key string) (*set, resp.RespType) {
+	d, errReply := lookupTyped(db, key, typeSet)
+	if d == nil {
+		return nil, errReply
+	}
+	return d.val.(*set), nil
+}
+
+// lookupSets returns the sets stored at keys, missing keys are nil entries
+func lookupSets(db kVStore, keys [][]byte) ([]*set, resp.RespType) {
+	sets := make([]*set, len(keys))
+	for i, k := range keys {
+		s, errReply := lookupSet(db, string(k))
+		if errReply != nil {
+			return nil, errReply
+		}
+		sets[i] = s
+	}
+	return sets, nil
+}
+
+func deleteEmptySet(db kVStore, key string, s *set) {
+	if s.len() == 0 {
+		db.remove(key)
+	}
+}
+
+func execSAdd(db kVStore, args [][]byte) resp.RespType {
+	key := string(args[0])
+	s, errReply := lookupSet(db, key)
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil {
+		s = newSet()
+		db.put(key, &dataEntity{typ: typeSet, val: s})
+	}
+
+	added := 0
+	for _, m := range args[1:] {
+		if s.add(m) {
+			added++
+		}
+	}
+	return &resp.Intiger{
+		Data: int64(added),
+	}
+}
+
+func execSRem(db kVStore, args [][]byte) resp.RespType {
+	key := string(args[0])
+	s, errReply := lookupSet(db, key)
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil {
+		return &resp.Intiger{Data: 0}
+	}
+
+	removed := 0
+	for _, m := range args[1:] {
+		if s.remove(m) {
+			removed++
+		}
+	}
+	deleteEmptySet(db, key, s)
+	return &resp.Intiger{
+		Data: int64(removed),
+	}
+}
+
+func execSMembers(db kVStore, args [][]byte) resp.RespType {
+	s, errReply := lookupSet(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	arr := &resp.RespBulkStrArr{}
+	if s == nil {
+		return arr
+	}
+	s.iter(func(member []byte) bool {
+		arr.Append(member)
+		return true
+	})
+	return arr
+}
+
+func execSIsMember(db kVStore, args [][]byte) resp.RespType {
+	s, errReply := lookupSet(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if s != nil && s.contains(args[1]) {
+		return &resp.Intiger{Data: 1}
+	}
+	return &resp.Intiger{Data: 0}
+}
+
+func execSMIsMember(db kVStore, args [][]byte) resp.RespType {
+	s, errReply := lookupSet(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	arr := &resp.Array{}
+	for _, m := range args[1:] {
+		var found int64
+		if s != nil && s.contains(m) {
+			found = 1
+		}
+		arr.Append(&resp.Intiger{Data: found})
+	}
+	return arr
+}
+
+func execSCard(db kVStore, args [][]byte) resp.RespType {
+	s, errReply := lookupSet(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil {
+		return &resp.Intiger{Data: 0}
+	}
+	return &resp.Intiger{
+		Data: int64(s.len()),
+	}
+}
+
+func execSMove(db kVStore, args [][]byte) resp.RespType {
+	srcKey, dstKey := string(args[0]), string(args[1])
+	src, errReply := lookupSet(db, srcKey)
+	if errReply != nil {
+		return errReply
+	}
+	dst, errReply := lookupSet(db, dstKey)
+	if errReply != nil {
+		return errReply
+	}
+
+	if src == nil || !src.contains(args[2]) {
+		return &resp.Intiger{Data: 0}
+	}
+	if srcKey == dstKey {
+		return &resp.Intiger{Data: 1}
+	}
+
+	src.remove(args[2])
+	deleteEmptySet(db, srcKey, src)
+
+	if dst == nil {
+		dst = newSet()
+		db.put(dstKey, &dataEntity{typ: typeSet, val: dst})
+	}
+	dst.add(args[2])
+	return &resp.Intiger{Data: 1}
+}
+
+func setUnion(sets []*set) *set {
+	result := newSet()
+	for _, s := range sets {
+		if s == nil {
+			continue
+		}
+		s.iter(func(member []byte) bool {
+			result.add(member)
+			return true
+		})
+	}
+	return result
+}
+
+func setInter(sets []*set) *set {
+	result := newSet()
+	for _, s := range sets {
+		// intersection with a missing key is always empty
+		if s == nil {
+			return result
+		}
+	}
+
+	// iterate the smallest set and probe the others
+	sorted := slices.Clone(sets)
+	slices.SortFunc(sorted, func(a, b *set) int {
+		return a.len() - b.len()
+	})
+
+	sorted[0].iter(func(member []byte) bool {
+		for _, other := range sorted[1:] {
+			if !other.contains(member) {
+				return true
+			}
+		}
+		result.add(member)
+		return true
+	})
+	return result
+}
+
+func setDiff(sets []*set) *set {
+	result := newSet()
+	if sets[0] == nil {
+		return result
+	}
+
+	sets[0].iter(func(member []byte) bool {
+		for _, other := range sets[1:] {
+			if other != nil && other.contains(member) {
+				return true
+			}
+		}
+		result.add(member)
+		return true
+	})
+	return result
+}
+
+func setAlgebra(db kVStore, keys [][]byte, op func([]*set) *set) resp.RespType {
+	sets, errReply := lookupSets(db, keys)
+	if errReply != nil {
+		return errReply
+	}
+
+	arr := &resp.RespBulkStrArr{}
+	op(sets).iter(func(member []byte) bool {
+		arr.Append(member)
+		return true
+	})
+	return arr
+}
+
+// setAlgebraStore stores the result at the first key, overwriting whatever
+// it held before
+func setAlgebraStore(db kVStore, args [][]byte, op func([]*set) *set) resp.RespType {
+	dstKey := string(args[0])
+	sets, errReply := lookupSets(db, args[1:])
+	if errReply != nil {
+		return errReply
+	}
+
+	result := op(sets)
+	db.remove(dstKey)
+	if result.len() > 0 {
+		db.put(dstKey, &dataEntity{typ: typeSet, val: result})
+	}
+	return &resp.Intiger{
+		Data: int64(result.len()),
+	}
+}
+
+func execSUnion(db kVStore, args [][]byte) resp.RespType {
+	return setAlgebra(db, args, setUnion)
+}
+
+func execSInter(db kVStore, args [][]byte) resp.RespType {
+	return setAlgebra(db, args, setInter)
+}
+
+func execSDiff(db kVStore, args [][]byte) resp.RespType {
+	return setAlgebra(db, args, setDiff)
+}
+
+func execSUnionStore(db kVStore, args [][]byte) resp.RespType {
+	return setAlgebraStore(db, args, setUnion)
+}
+
+func execSInterStore(db kVStore, args [][]byte) resp.RespType {
+	return setAlgebraStore(db, args, setInter)
+}
+
+func execSDiffStore(db kVStore, args [][]byte) resp.RespType {
+	return setAlgebraStore(db, args, setDiff)
+}
+
+func execSRandMember(db kVStore, args [][]byte) resp.RespType {
+	if len(args) > 2 {
+		return resp.SyntaxErr()
+	}
+
+	s, errReply := lookupSet(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+
+	if len(args) == 1 {
+		if s == nil {
+			return &resp.BulkStr{Data: nil}
+		}
+		return &resp.BulkStr{
+			Data: s.randomMember(),
+		}
+	}
+
+	count, ok := parseIndex(args[1])
+	if !ok {
+		return resp.NotInErr()
+	}
+
+	arr := &resp.RespBulkStrArr{}
+	if s == nil || count == 0 {
+		return arr
+	}
+
+	if count > 0 {
+		for _, m := range s.randomMembers(count) {
+			arr.Append(m)
+		}
+		return arr
+	}
+
+	// a negative count allows the same member to be returned multiple times
+	for range -count {
+		arr.Append(s.randomMember())
+	}
+	return arr
+}
+
+func execSPop(db kVStore, args [][]byte) resp.RespType {
+	if len(args) > 2 {
+		return resp.SyntaxErr()
+	}
+
+	key := string(args[0])
+	s, errReply := lookupSet(db, key)
+	if errReply != nil {
+		return errReply
+	}
+
+	if len(args) == 1 {
+		if s == nil {
+			return &resp.BulkStr{Data: nil}
+		}
+		m := s.randomMember()
+		s.remove(m)
+		deleteEmptySet(db, key, s)
+		// the popped member is random, log what was actually removed
+		db.propagate(cmdArgv("srem", args[0], m))
+		return &resp.BulkStr{
+			Data: m,
+		}
+	}
+
+	count, ok := parseIndex(args[1])
+	if !ok || count < 0 {
+		return resp.MakeErr("ERR value is out of range, must be positive")
+	}
+
+	arr := &resp.RespBulkStrArr{}
+	if s == nil {
+		return arr
+	}
+
+	popped := s.randomMembers(count)
+	for _, m := range popped {
+		s.remove(m)
+		arr.Append(m)
+	}
+	deleteEmptySet(db, key, s)
+	if len(popped) > 0 {
+		db.propagate(cmdArgv("srem", append([][]byte{args[0]}, popped...)...))
+	} else {
+		db.propagate()
+	}
+	return arr
+}
+
+// execSScan returns about COUNT members per call, see execHScan
+func execSScan(db kVStore, args [][]byte) resp.RespType {
+	opts, errReply := parseScanArgs(args[1:])
+	if errReply != nil {
+		return errReply
+	}
+
+	s, errReply := lookupSet(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+
+	var members []string
+	var next uint64
+	if s != nil {
+		members, next = scanElements(s.scan, s.iterString, opts.cursor, opts.count)
+	}
+
+	items := &resp.RespBulkStrArr{}
+	for _, m := range members {
+		if opts.pattern == "" || utils.GlobMatch(opts.pattern, m) {
+			items.Append([]byte(m))
+		}
+	}
+
+	return &resp.Array{
+		Elems: []resp.RespType{
+			&resp.BulkStr{Data: []byte(strconv.FormatUint(next, 10))},
+			items,
+		},
+	}
+}
+
+func init() {
+	registerCommand("sadd", -3, cmdWrite, execSAdd)
+	registerCommand("srem", -3, cmdWrite|cmdFreesMemory, execSRem)
+	registerCommand("smembers", 2, cmdReadOnly, execSMembers)
+	registerCommand("sismember", 3, cmdReadOnly, execSIsMember)
+	registerCommand("smismember", -3, cmdReadOnly, execSMIsMember)
+	registerCommand("scard", 2, cmdReadOnly, execSCard)
+	registerCommand("smove", 4, cmdWrite, execSMove).withKeys(1, 2, 1)
+	registerCommand("sunion", -2, cmdReadOnly, execSUnion).withKeys(1, -1, 1)
+	registerCommand("sinter", -2, cmdReadOnly, execSInter).withKeys(1, -1, 1)
+	registerCommand("sdiff", -2, cmdReadOnly, execSDiff).withKeys(1, -1, 1)
+	registerCommand("sunionstore", -3, cmdWrite, execSUnionStore).withKeys(1, -1, 1)
+	registerCommand("sinterstore", -3, cmdWrite, execSInterStore).withKeys(1, -1, 1)
+	registerCommand("sdiffstore", -3, cmdWrite, execSDiffStore).withKeys(1, -1, 1)
+	registerCommand("srandmember", -2, cmdReadOnly, execSRandMember)
+	registerCommand("spop", -2, cmdWrite|cmdFreesMemory, execSPop)
+	registerCommand("sscan", -3, cmdReadOnly, execSScan)
+}
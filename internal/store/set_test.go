@@ -0,0 +1,179 @@
+package store
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+	"github.com/myselfBZ/go-redis-clone/pkg/utils"
+)
+
+func TestSetEncoding(t *testing.T) {
+	s := newSet()
+	for i := range setMaxIntsetEntries {
+		s.add([]byte(strconv.Itoa(setMaxIntsetEntries - i)))
+	}
+	if !s.isIntset() {
+		t.Fatalf("expected an intset encoded set")
+	}
+	if !slices.IsSorted(s.ints) {
+		t.Fatalf("intset is not sorted")
+	}
+
+	s.add([]byte("007"))
+	if s.isIntset() {
+		t.Fatalf("a non canonical integer did not convert the set")
+	}
+	if s.len() != setMaxIntsetEntries+1 || !s.contains([]byte("7")) || !s.contains([]byte("007")) {
+		t.Fatalf("members were lost during the conversion")
+	}
+
+	s = newSet()
+	for i := range setMaxIntsetEntries + 1 {
+		s.add([]byte(strconv.Itoa(i)))
+	}
+	if s.isIntset() {
+		t.Fatalf("expected a hash table encoded set past %d members", setMaxIntsetEntries)
+	}
+}
+
+func TestSetRandomMember(t *testing.T) {
+	s := newSet()
+	for i := range 10 {
+		s.add([]byte("m" + strconv.Itoa(i)))
+	}
+	s.remove([]byte("m3"))
+
+	seen := map[string]int{}
+	for range 9000 {
+		seen[string(s.randomMember())]++
+	}
+	if len(seen) != 9 || seen["m3"] != 0 {
+		t.Fatalf("unexpected members picked: %v", seen)
+	}
+	for m, n := range seen {
+		if n < 700 || n > 1300 {
+			t.Fatalf("%s picked %d times out of 9000", m, n)
+		}
+	}
+
+	picked := s.randomMembers(5)
+	distinct := map[string]bool{}
+	for _, m := range picked {
+		if !s.contains(m) {
+			t.Fatalf("%s is not a member", m)
+		}
+		distinct[string(m)] = true
+	}
+	if len(picked) != 5 || len(distinct) != 5 {
+		t.Fatalf("expected 5 distinct members, got %q", picked)
+	}
+}
+
+func TestExecSets(t *testing.T) {
+	testDb.mu.Lock()
+	defer testDb.mu.Unlock()
+
+	k1, k2, dst := utils.RandString(defaultKeyLength), utils.RandString(defaultKeyLength), utils.RandString(defaultKeyLength)
+	strKey := utils.RandString(defaultKeyLength)
+	testDb.put(strKey, &dataEntity{val: []byte("val")})
+
+	tests := []struct {
+		suite
+		exec execCmd
+	}{
+		{suite{"SADD new members", &resp.Intiger{Data: 3}, toBytes(k1, "3", "1", "2", "1")}, execSAdd},
+		{suite{"SADD second set", &resp.Intiger{Data: 3}, toBytes(k2, "2", "3", "4")}, execSAdd},
+		{suite{"SMEMBERS intset is sorted", bulkArr("1", "2", "3"), toBytes(k1)}, execSMembers},
+		{suite{"SISMEMBER", &resp.Intiger{Data: 1}, toBytes(k1, "2")}, execSIsMember},
+		{suite{"SISMEMBER missing member", &resp.Intiger{Data: 0}, toBytes(k1, "5")}, execSIsMember},
+		{suite{"SCARD", &resp.Intiger{Data: 3}, toBytes(k1)}, execSCard},
+		{suite{"SINTER", bulkArr("2", "3"), toBytes(k1, k2)}, execSInter},
+		{suite{"SINTER with missing key", bulkArr(), toBytes(k1, k2, "missing")}, execSInter},
+		{suite{"SDIFF", bulkArr("1"), toBytes(k1, k2)}, execSDiff},
+		{suite{"SUNION", bulkArr("1", "2", "3", "4"), toBytes(k1, k2)}, execSUnion},
+		{suite{"SUNIONSTORE", &resp.Intiger{Data: 4}, toBytes(dst, k1, k2)}, execSUnionStore},
+		{suite{"SINTERSTORE overwrites", &resp.Intiger{Data: 2}, toBytes(dst, k1, k2)}, execSInterStore},
+		{suite{"SMEMBERS of stored set", bulkArr("2", "3"), toBytes(dst)}, execSMembers},
+		{suite{"SDIFFSTORE empty result", &resp.Intiger{Data: 0}, toBytes(dst, k1, k1)}, execSDiffStore},
+		{suite{"SREM", &resp.Intiger{Data: 2}, toBytes(k1, "1", "2", "9")}, execSRem},
+		{suite{"SMOVE", &resp.Intiger{Data: 1}, toBytes(k1, k2, "3")}, execSMove},
+		{suite{"SPOP count on missing key", bulkArr(), toBytes(k1, "2")}, execSPop},
+		{suite{"SADD on string key", resp.WrongTypeErr(), toBytes(strKey, "a")}, execSAdd},
+		{suite{"SUNION with string key", resp.WrongTypeErr(), toBytes(k2, strKey)}, execSUnion},
+	}
+
+	for _, test := range tests {
+		rep := test.exec(testDb, test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+
+	for _, k := range []string{k1, dst} {
+		if _, ok := testDb.get(k); ok {
+			t.Fatalf("empty set %s was not deleted", k)
+		}
+	}
+}
+
+func TestExecSPopAndSRandMember(t *testing.T) {
+	testDb.mu.Lock()
+	defer testDb.mu.Unlock()
+
+	key := utils.RandString(defaultKeyLength)
+	execSAdd(testDb, toBytes(key, "a", "b", "c", "d", "e"))
+
+	rep := execSRandMember(testDb, toBytes(key, "-8"))
+	if got := rep.ToBytes(); !slices.Equal(got[:4], []byte("*8\r\n")) {
+		t.Fatalf("SRANDMEMBER with negative count: expected 8 elements, got %q", got)
+	}
+
+	rep = execSRandMember(testDb, toBytes(key, "10"))
+	if got := rep.ToBytes(); !slices.Equal(got[:4], []byte("*5\r\n")) {
+		t.Fatalf("SRANDMEMBER with count larger than set: expected 5 elements, got %q", got)
+	}
+
+	execSPop(testDb, toBytes(key, "3"))
+	s, _ := lookupSet(testDb, key)
+	if s.len() != 2 {
+		t.Fatalf("SPOP 3: expected 2 remaining members, got %d", s.len())
+	}
+
+	execSPop(testDb, toBytes(key))
+	execSPop(testDb, toBytes(key))
+	if _, ok := testDb.get(key); ok {
+		t.Fatalf("popping every member did not delete the key")
+	}
+}
+
+func TestSScanCursor(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+
+	const n = 500
+	for i := 0; i < n; i++ {
+		mustExec(t, s, "SADD", "s", "m"+strconv.Itoa(i))
+		mustExec(t, s, "SADD", "ints", strconv.Itoa(i))
+	}
+	added := 0
+	seen, calls := scanCollection(t, s, "SSCAN", "s", 1, func() {
+		mustExec(t, s, "SADD", "s", "new"+strconv.Itoa(added))
+		mustExec(t, s, "SREM", "s", "m0")
+		added++
+	})
+	for i := 1; i < n; i++ {
+		if m := "m" + strconv.Itoa(i); seen[m] != 1 {
+			t.Fatalf("%s returned %d times", m, seen[m])
+		}
+	}
+	if calls < n/20 {
+		t.Fatalf("%d calls for %d members with COUNT 10", calls, n)
+	}
+
+	seen, _ = scanCollection(t, s, "SSCAN", "ints", 1, func() {})
+	if len(seen) != n {
+		t.Fatalf("SSCAN returned %d of %d integers", len(seen), n)
+	}
+}
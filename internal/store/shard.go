@@ -0,0 +1,256 @@
+package store
+
+import (
+	"hash/maphash"
+	"slices"
+	"sync"
+	"time"
+)
+
+// The keyspace is split in shards locked on their own, so commands on
+// different keys run in parallel. A command holds s.mu for reading and
+// the locks of the shards of its keys, taken in shard order so commands
+// on several keys, like DEL k1 k2, can't deadlock and are atomic. The
+// rest, server commands, transactions, blocked commands being served and
+// background jobs, hold s.mu for writing: nothing else runs meanwhile and
+// the shards are used without their locks.
+
+const numShards = 256
+
+var shardSeed = maphash.MakeSeed()
+
+type shard struct {
+	mu      sync.RWMutex
+	data    map[string]*dataEntity
+	expires map[string]time.Time
+	// the keys of data in no particular order, so one can be picked at
+	// random in constant time
+	keys []string
+	// the keys of data by scanHash, for SCAN to resume from a cursor
+	scan *scanIndex
+	// the snapshots to copy the shard for before it's modified, see
+	// snapshot.go
+	pending []*shardCopy
+}
+
+func newShards() []*shard {
+	shards := make([]*shard, numShards)
+	for i := range shards {
+		shards[i] = &shard{
+			data:    make(map[string]*dataEntity),
+			expires: make(map[string]time.Time),
+			scan:    newScanIndex(),
+		}
+	}
+	return shards
+}
+
+func shardIndex(key string) int {
+	return int(maphash.String(shardSeed, key) % numShards)
+}
+
+// set stores d at key. Writes to data go through set and del, they keep
+// keys and scan in sync.
+func (sh *shard) set(key string, d *dataEntity) {
+	sh.copyPending()
+	if old, ok := sh.data[key]; ok {
+		d.pos = old.pos
+	} else {
+		d.pos = len(sh.keys)
+		sh.keys = append(sh.keys, key)
+		sh.scan.add(key)
+	}
+	sh.data[key] = d
+}
+
+// del deletes key along with its TTL. The last key takes its place in
+// keys.
+func (sh *shard) del(key string) {
+	sh.copyPending()
+	d, ok := sh.data[key]
+	if ok {
+		last := len(sh.keys) - 1
+		moved := sh.keys[last]
+		sh.keys[d.pos] = moved
+		sh.data[moved].pos = d.pos
+		sh.keys[last] = ""
+		sh.keys = sh.keys[:last]
+		sh.scan.remove(key)
+	}
+	delete(sh.data, key)
+	delete(sh.expires, key)
+}
+
+// expired tells if key has a TTL in the past, it's still in the shard
+// until it's deleted
+func (sh *shard) expired(key string, now time.Time) bool {
+	at, ok := sh.expires[key]
+	return ok && now.After(at)
+}
+
+// callCtx is what executors run on. It keeps the state of the running
+// command and, when it runs next to others, the shards it locked.
+type callCtx struct {
+	s *Storage
+	// the database selected by the client, SELECT changes it
+	db *database
+	// the shards locked for the command by lockKeys, sorted. Commands run
+	// with s.mu held for writing lock none, every shard is theirs.
+	locked []*shard
+	shared bool
+	// the keys the shards were locked for
+	keys [][]byte
+
+	writing bool
+	// watched keys looked up by the running write command. Values are
+	// modified in place, so a write command is assumed to modify every
+	// key it looks up once it succeeds.
+	touched []string
+	// what the command asked to log instead of itself, see propagate
+	propagated        [][][]byte
+	propagateOverride bool
+	// an AOF rewrite is due, it's started once the command is done
+	rewrite bool
+}
+
+// lockKeys locks the shards of keys in db for a command, for writing if
+// it's a write command. Must be called with s.mu held for reading.
+func (s *Storage) lockKeys(db *database, keys [][]byte, write bool) *callCtx {
+	idx := make([]int, 0, len(keys))
+	for _, k := range keys {
+		idx = append(idx, shardIndex(string(k)))
+	}
+	slices.Sort(idx)
+	idx = slices.Compact(idx)
+
+	ctx := &callCtx{s: s, db: db, shared: true, keys: keys, locked: make([]*shard, len(idx))}
+	for i, n := range idx {
+		sh := db.shards[n]
+		ctx.locked[i] = sh
+		if write {
+			sh.mu.Lock()
+		} else {
+			sh.mu.RLock()
+		}
+	}
+	return ctx
+}
+
+func (ctx *callCtx) unlock(write bool) {
+	for _, sh := range ctx.locked {
+		if write {
+			sh.mu.Unlock()
+		} else {
+			sh.mu.RUnlock()
+		}
+	}
+}
+
+// shard returns the shard of key, which must be one of the keys the
+// command declared when it runs next to others
+func (ctx *callCtx) shard(key string) *shard {
+	sh := ctx.db.shardOf(key)
+	if ctx.shared && !slices.Contains(ctx.locked, sh) {
+		panic("store: " + key + " isn't a key of the running command")
+	}
+	return sh
+}
+
+func (ctx *callCtx) get(key string) (*dataEntity, bool) {
+	sh := ctx.shard(key)
+	if !ctx.writing {
+		// readers share the shard, an expired key is left to writers
+		if sh.expired(key, time.Now()) {
+			return nil, false
+		}
+		en, ok := sh.data[key]
+		if ok {
+			en.touch(time.Now())
+		}
+		return en, ok
+	}
+
+	en, ok := ctx.db.get(key)
+	if !ok {
+		return nil, false
+	}
+	en.touch(time.Now())
+	if ctx.s.observed(ctx.db.id, key) {
+		ctx.touched = append(ctx.touched, key)
+	}
+	return en, ok
+}
+
+// exists tells if key is set, an expired key is left to writers
+func (ctx *callCtx) exists(key string) bool {
+	sh := ctx.shard(key)
+	_, ok := sh.data[key]
+	return ok && !sh.expired(key, time.Now())
+}
+
+func (ctx *callCtx) getExpiresAt(key string) (time.Time, bool) {
+	t, ok := ctx.shard(key).expires[key]
+	return t, ok
+}
+
+func (ctx *callCtx) put(key string, val *dataEntity) int {
+	ctx.shard(key)
+	return ctx.db.put(key, val)
+}
+
+func (ctx *callCtx) putIfExists(key string, val *dataEntity) int {
+	ctx.shard(key)
+	return ctx.db.putIfExists(key, val)
+}
+
+func (ctx *callCtx) putIfAbsent(key string, val *dataEntity) int {
+	ctx.shard(key)
+	return ctx.db.putIfAbsent(key, val)
+}
+
+func (ctx *callCtx) remove(key string) int {
+	ctx.shard(key)
+	return ctx.db.remove(key)
+}
+
+func (ctx *callCtx) persist(key string) int {
+	ctx.shard(key)
+	return ctx.db.persist(key)
+}
+
+func (ctx *callCtx) expire(key string, at time.Time) int {
+	ctx.shard(key)
+	return ctx.db.expire(key, at)
+}
+
+func (ctx *callCtx) propagate(cmds ...[][]byte) {
+	ctx.propagateOverride = true
+	ctx.propagated = append(ctx.propagated, cmds...)
+}
+
+// unlocked runs fn with the locks of the command released, so it can wait
+// on the network without holding up the others. Its keys may be written
+// meanwhile. It tells if the database is still the selected one, a full
+// resync replaces them all. Commands running alone keep every lock.
+func (ctx *callCtx) unlocked(fn func()) bool {
+	if !ctx.shared {
+		fn()
+		return true
+	}
+	ctx.unlock(ctx.writing)
+	ctx.s.mu.RUnlock()
+	fn()
+	ctx.s.mu.RLock()
+	// FLUSHDB and SWAPDB swap the shards of the database
+	ctx.locked = ctx.s.lockKeys(ctx.db, ctx.keys, ctx.writing).locked
+	return ctx.db.id < len(ctx.s.dbs) && ctx.s.dbs[ctx.db.id] == ctx.db
+}
+
+// storageOf returns the storage server commands run on, they always run
+// with s.mu held for writing
+func storageOf(db kVStore) *Storage {
+	if ctx, ok := db.(*callCtx); ok {
+		return ctx.s
+	}
+	return db.(*Storage)
+}
@@ -0,0 +1,85 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+func TestShardedExec(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+
+	const workers, rounds = 8, 200
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				key := fmt.Sprintf("key:%d:%d", w, i)
+				s.Exec(toBytes("SET", key, "v"))
+				s.Exec(toBytes("GET", key))
+				s.Exec(toBytes("INCR", "counter"))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := mustExec(t, s, "GET", "counter"); string(got.ToBytes()) != fmt.Sprintf("$4\r\n%d\r\n", workers*rounds) {
+		t.Fatalf("lost increments, counter = %q", got.ToBytes())
+	}
+	if n := mustExec(t, s, "DEL", "key:0:0", "key:1:0", "key:2:0", "nokey"); n.(*resp.Intiger).Data != 3 {
+		t.Fatalf("DEL = %d, want 3", n.(*resp.Intiger).Data)
+	}
+}
+
+func TestShardedMultiKeyAtomic(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+	mustExec(t, s, "SADD", "a", "m")
+
+	// the member moves back and forth, readers of both keys see it once
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			s.Exec(toBytes("SMOVE", "a", "b", "m"))
+			s.Exec(toBytes("SMOVE", "b", "a", "m"))
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		got := mustExec(t, s, "SUNION", "a", "b")
+		if string(got.ToBytes()) != "*1\r\n$1\r\nm\r\n" {
+			t.Fatalf("SUNION saw %q in the middle of a move", got.ToBytes())
+		}
+	}
+}
+
+func TestShardedUndeclaredKey(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ctx := s.lockKeys(s.dbs[0], toBytes("a"), false)
+	defer ctx.unlock(false)
+
+	other := "b"
+	for i := 0; s.dbs[0].shardOf(other) == s.dbs[0].shardOf("a"); i++ {
+		other = fmt.Sprintf("b%d", i)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("looking up a key the command didn't declare must panic")
+		}
+	}()
+	ctx.get(other)
+}
@@ -0,0 +1,331 @@
+package store
+
+import (
+	"math/rand/v2"
+)
+
+const (
+	skiplistMaxLevel = 32
+	// probability of a node getting promoted to the next level
+	skiplistP = 0.25
+)
+
+type skiplistLevel struct {
+	forward *skiplistNode
+	// number of nodes skipped by following forward, used for ranks
+	span int
+}
+
+type skiplistNode struct {
+	member   string
+	score    float64
+	backward *skiplistNode
+	level    []skiplistLevel
+}
+
+// skiplist keeps the members of a sorted set ordered by (score, member).
+// Every level link stores its span so the rank of a node can be computed
+// while descending.
+type skiplist struct {
+	header *skiplistNode
+	tail   *skiplistNode
+	length int
+	level  int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		header: &skiplistNode{
+			level: make([]skiplistLevel, skiplistMaxLevel),
+		},
+		level: 1,
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+// less reports whether (score, member) sorts before the node
+func (n *skiplistNode) less(score float64, member string) bool {
+	return n.score < score || (n.score == score && n.member < member)
+}
+
+func (zsl *skiplist) insert(score float64, member string) *skiplistNode {
+	var update [skiplistMaxLevel]*skiplistNode
+	var rank [skiplistMaxLevel]int
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		if i < zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.less(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+
+	x = &skiplistNode{
+		member: member,
+		score:  score,
+		level:  make([]skiplistLevel, level),
+	}
+	for i := range level {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+
+	// untouched levels got one more node beneath them
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+	return x
+}
+
+func (zsl *skiplist) deleteNode(x *skiplistNode, update []*skiplistNode) {
+	for i := range zsl.level {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+}
+
+// delete removes the node with the given score and member, returns false
+// if no such node exists
+func (zsl *skiplist) delete(score float64, member string) bool {
+	var update [skiplistMaxLevel]*skiplistNode
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.less(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	x = x.level[0].forward
+	if x != nil && x.score == score && x.member == member {
+		zsl.deleteNode(x, update[:])
+		return true
+	}
+	return false
+}
+
+// updateScore moves the member to its new position, the node is reused if
+// the order does not change
+func (zsl *skiplist) updateScore(curScore float64, member string, newScore float64) *skiplistNode {
+	var update [skiplistMaxLevel]*skiplistNode
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.less(curScore, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	x = x.level[0].forward
+
+	if (x.backward == nil || x.backward.less(newScore, member)) &&
+		(x.level[0].forward == nil || !x.level[0].forward.less(newScore, member)) {
+		x.score = newScore
+		return x
+	}
+
+	zsl.deleteNode(x, update[:])
+	return zsl.insert(newScore, member)
+}
+
+// rank returns the 1 based rank of the member, 0 if it's not found
+func (zsl *skiplist) rank(score float64, member string) int {
+	rank := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			(x.level[i].forward.less(score, member) ||
+				(x.level[i].forward.score == score && x.level[i].forward.member == member)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != zsl.header && x.member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// byRank returns the node at the 1 based rank
+func (zsl *skiplist) byRank(rank int) *skiplistNode {
+	traversed := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+type scoreRange struct {
+	min, max     float64
+	minex, maxex bool
+}
+
+func (r *scoreRange) gteMin(v float64) bool {
+	if r.minex {
+		return v > r.min
+	}
+	return v >= r.min
+}
+
+func (r *scoreRange) lteMax(v float64) bool {
+	if r.maxex {
+		return v < r.max
+	}
+	return v <= r.max
+}
+
+func (r *scoreRange) empty() bool {
+	return r.min > r.max || (r.min == r.max && (r.minex || r.maxex))
+}
+
+// firstInRange returns the first node within the score range
+func (zsl *skiplist) firstInRange(r *scoreRange) *skiplistNode {
+	if r.empty() {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.gteMin(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if x == nil || !r.lteMax(x.score) {
+		return nil
+	}
+	return x
+}
+
+// lastInRange returns the last node within the score range
+func (zsl *skiplist) lastInRange(r *scoreRange) *skiplistNode {
+	if r.empty() {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.lteMax(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+	if x == zsl.header || !r.gteMin(x.score) {
+		return nil
+	}
+	return x
+}
+
+// lexBound is one end of a lex range, inf is -1 for "-" and 1 for "+"
+type lexBound struct {
+	value     string
+	exclusive bool
+	inf       int
+}
+
+type lexRange struct {
+	min, max lexBound
+}
+
+func (r *lexRange) gteMin(v string) bool {
+	switch r.min.inf {
+	case -1:
+		return true
+	case 1:
+		return false
+	}
+	if r.min.exclusive {
+		return v > r.min.value
+	}
+	return v >= r.min.value
+}
+
+func (r *lexRange) lteMax(v string) bool {
+	switch r.max.inf {
+	case 1:
+		return true
+	case -1:
+		return false
+	}
+	if r.max.exclusive {
+		return v < r.max.value
+	}
+	return v <= r.max.value
+}
+
+func (zsl *skiplist) firstInLexRange(r *lexRange) *skiplistNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.gteMin(x.level[i].forward.member) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if x == nil || !r.lteMax(x.member) {
+		return nil
+	}
+	return x
+}
+
+func (zsl *skiplist) lastInLexRange(r *lexRange) *skiplistNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.lteMax(x.level[i].forward.member) {
+			x = x.level[i].forward
+		}
+	}
+	if x == zsl.header || !r.gteMin(x.member) {
+		return nil
+	}
+	return x
+}
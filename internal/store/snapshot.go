@@ -0,0 +1,285 @@
+package store
+
+import (
+	"bytes"
+	"maps"
+	"slices"
+	"time"
+)
+
+// A snapshot is taken without copying the keyspace up front. Taking it
+// only registers a copy of every shard to make, the goroutine serializing
+// it makes them one shard at a time with the shard locked. A command about
+// to write a shard first copies it for the snapshots that didn't yet, so
+// each shard is copied as it was when the snapshot was taken. The copy of
+// a shard holds the entities of the keyspace, not copies of them: they're
+// marked with the snapshot and the first command modifying one in place
+// while the snapshot is being written replaces it with a clone, see
+// database.get.
+
+// snapshot is a point in time copy of the keyspace, it can be serialized
+// in the background while the storage keeps serving commands
+type snapshot struct {
+	// one per database, filled in by copyKeyspace
+	dbs []*dbSnapshot
+	// the database the replication stream is on, saved as repl-stream-db
+	streamDB int
+
+	// entities copied are marked with gen, later snapshots have a higher
+	// one
+	gen uint64
+	// keys expired at that time are left out
+	now time.Time
+	// the copies of the shards of every database
+	copies [][]*shardCopy
+}
+
+type dbSnapshot struct {
+	data    map[string]*dataEntity
+	expires map[string]time.Time
+}
+
+// shardCopy is what a snapshot has of a shard, filled in by take
+type shardCopy struct {
+	snap *snapshot
+	sh   *shard
+	done bool
+
+	data    map[string]*dataEntity
+	expires map[string]time.Time
+}
+
+// snapshot starts a snapshot of the keyspace, it's made by copyKeyspace.
+// Must be called with s.mu held for writing, it takes time linear in the
+// number of shards. The snapshot keeps the entities it has from being
+// modified in place until releaseSnapshot.
+func (s *Storage) snapshot() *snapshot {
+	s.snapGen++
+	snap := &snapshot{gen: s.snapGen, now: time.Now(), copies: make([][]*shardCopy, len(s.dbs))}
+	for i, db := range s.dbs {
+		snap.copies[i] = make([]*shardCopy, len(db.shards))
+		for j, sh := range db.shards {
+			c := &shardCopy{snap: snap, sh: sh}
+			sh.pending = append(sh.pending, c)
+			snap.copies[i][j] = c
+		}
+	}
+	s.snapshots = append(s.snapshots, snap)
+	return snap
+}
+
+// copyKeyspace copies the shards no command copied yet and fills in
+// snap.dbs. It's called on the goroutine serializing the snapshot, with
+// s.mu not held: it locks one shard at a time.
+func (s *Storage) copyKeyspace(snap *snapshot) {
+	snap.dbs = make([]*dbSnapshot, len(snap.copies))
+	for i, copies := range snap.copies {
+		dbSnap := &dbSnapshot{
+			data:    make(map[string]*dataEntity),
+			expires: make(map[string]time.Time),
+		}
+		for _, c := range copies {
+			s.mu.RLock()
+			c.sh.mu.Lock()
+			c.sh.copyPending()
+			c.sh.mu.Unlock()
+			s.mu.RUnlock()
+
+			maps.Copy(dbSnap.data, c.data)
+			maps.Copy(dbSnap.expires, c.expires)
+		}
+		snap.dbs[i] = dbSnap
+	}
+	snap.copies = nil
+}
+
+// releaseSnapshot is called once snap is serialized, the entities it has
+// may be modified in place again. Must be called with s.mu held for
+// writing.
+func (s *Storage) releaseSnapshot(snap *snapshot) {
+	s.snapshots = slices.DeleteFunc(s.snapshots, func(other *snapshot) bool {
+		return other == snap
+	})
+}
+
+// inSnapshot tells if d is part of a snapshot still being written
+func (s *Storage) inSnapshot(d *dataEntity) bool {
+	for _, snap := range s.snapshots {
+		// d is marked with the latest snapshot that copied it, the ones
+		// taken before may have it too
+		if snap.gen <= d.snapGen {
+			return true
+		}
+	}
+	return false
+}
+
+// copyPending copies the shard for the snapshots waiting for it, before
+// it's modified. Must be called with the shard held for writing.
+func (sh *shard) copyPending() {
+	for _, c := range sh.pending {
+		c.take()
+	}
+	sh.pending = nil
+}
+
+func (c *shardCopy) take() {
+	if c.done {
+		return
+	}
+	c.done = true
+	c.data = make(map[string]*dataEntity, len(c.sh.data))
+	c.expires = make(map[string]time.Time)
+	for k, d := range c.sh.data {
+		if at, ok := c.sh.expires[k]; ok {
+			if c.snap.now.After(at) {
+				continue
+			}
+			c.expires[k] = at
+		}
+		d.snapGen = max(d.snapGen, c.snap.gen)
+		c.data[k] = d
+	}
+}
+
+// unshare returns the entity at key, d, to be modified in place. When a
+// snapshot being written has it, a clone takes its place in the shard.
+// Must be called with the shard held for writing.
+func (db *database) unshare(key string, d *dataEntity) *dataEntity {
+	if d.snapGen == 0 || !db.s.inSnapshot(d) {
+		return d
+	}
+	c := d.clone()
+	c.mem = d.mem
+	c.atime.Store(d.atime.Load())
+	c.freq.Store(d.freq.Load())
+	db.shardOf(key).set(key, c)
+	return c
+}
+
+// collect gathers the keys of every shard of every database, expired ones
+// left out. The values are only valid for as long as s.mu is held for
+// writing.
+func (s *Storage) collect() *snapshot {
+	now := time.Now()
+	snap := &snapshot{dbs: make([]*dbSnapshot, len(s.dbs))}
+	for i, db := range s.dbs {
+		dbSnap := &dbSnapshot{
+			data:    make(map[string]*dataEntity, db.size()),
+			expires: make(map[string]time.Time),
+		}
+		for _, sh := range db.shards {
+			for k, d := range sh.data {
+				if at, ok := sh.expires[k]; ok {
+					if now.After(at) {
+						continue
+					}
+					dbSnap.expires[k] = at
+				}
+				dbSnap.data[k] = d
+			}
+		}
+		snap.dbs[i] = dbSnap
+	}
+	return snap
+}
+
+// keys returns the keys of the database sorted, so serializing the same
+// dataset always gives the same output
+func (snap *dbSnapshot) keys() []string {
+	return slices.Sorted(maps.Keys(snap.data))
+}
+
+// clone returns a copy of the entity sharing nothing that is modified in
+// place. List elements, hash values and stream entries are never mutated
+// after they are stored, so they are shared.
+func (d *dataEntity) clone() *dataEntity {
+	c := &dataEntity{typ: d.typ}
+	switch v := d.val.(type) {
+	case []byte:
+		c.val, c.owned = bytes.Clone(v), true
+	case *quicklist:
+		c.val = v.clone()
+	case *hash:
+		c.val = v.clone()
+	case *set:
+		c.val = v.clone()
+	case *zset:
+		c.val = v.clone()
+	case *stream:
+		c.val = v.clone()
+	}
+	return c
+}
+
+func (h *hash) clone() *hash {
+	c := &hash{fields: maps.Clone(h.fields)}
+	c.scan = growScanIndex(nil, c.len(), c.iter)
+	return c
+}
+
+func (s *set) clone() *set {
+	c := &set{
+		ints:    slices.Clone(s.ints),
+		members: maps.Clone(s.members),
+		dense:   slices.Clone(s.dense),
+	}
+	c.scan = growScanIndex(nil, c.len(), c.iterString)
+	return c
+}
+
+func (ql *quicklist) clone() *quicklist {
+	c := newQuicklist()
+	for n := ql.head; n != nil; n = n.next {
+		for _, v := range n.entries {
+			c.pushTail(v)
+		}
+	}
+	return c
+}
+
+func (zs *zset) clone() *zset {
+	c := newZset()
+	for x := zs.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		c.add(x.member, x.score)
+	}
+	return c
+}
+
+func (s *stream) clone() *stream {
+	c := &stream{
+		lastID: s.lastID,
+		groups: make(map[string]*consumerGroup, len(s.groups)),
+	}
+	c.log.length = s.log.length
+	c.log.chunks = make([]*streamChunk, len(s.log.chunks))
+	for i, chunk := range s.log.chunks {
+		c.log.chunks[i] = &streamChunk{entries: slices.Clone(chunk.entries)}
+	}
+	for name, g := range s.groups {
+		c.groups[name] = g.clone()
+	}
+	return c
+}
+
+func (g *consumerGroup) clone() *consumerGroup {
+	c := newConsumerGroup(g.lastID)
+	for name, consumer := range g.consumers {
+		c.consumers[name] = &streamConsumer{
+			name:     name,
+			seenTime: consumer.seenTime,
+			pel:      make(map[streamID]*streamNACK, len(consumer.pel)),
+		}
+	}
+	c.pel = make([]*streamNACK, len(g.pel))
+	for i, n := range g.pel {
+		nack := &streamNACK{
+			id:            n.id,
+			deliveryTime:  n.deliveryTime,
+			deliveryCount: n.deliveryCount,
+		}
+		nack.assign(c.consumers[n.consumer.name])
+		c.pel[i] = nack
+	}
+	return c
+}
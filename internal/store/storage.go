@@ -1,9 +1,12 @@
 package store
 
 import (
+	"errors"
 	"fmt"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/myselfBZ/go-redis-clone/internal/resp"
@@ -23,20 +26,171 @@ type kVStore interface {
 	putIfAbsent(key string, val *dataEntity) int
 	getExpiresAt(key string) (time.Time, bool)
 	get(key string) (*dataEntity, bool)
+	// propagate replaces what is logged to the AOF for the running command.
+	// Executors with non deterministic effects use it to log commands that
+	// replay to the same result. Calling it with nothing logs nothing.
+	propagate(cmds ...[][]byte)
+}
+
+type Config struct {
+	// log write commands to an append only file and replay it on startup
+	AppendOnly     bool
+	AppendFilename string
+	AppendFsync    FsyncPolicy
+	// rewrite the AOF in the background once it grew by this percentage
+	// since the last rewrite and it's at least AutoAOFRewriteMinSize bytes,
+	// zero disables automatic rewrites
+	AutoAOFRewritePercentage int
+	AutoAOFRewriteMinSize    int64
+
+	// RDB snapshot file, loaded on startup unless the AOF is
+	DBFilename string
+	// save a snapshot in the background whenever one of these is met,
+	// none disables automatic saves
+	SaveParams []SaveParam
+
+	// "host:port" of the master to replicate on startup, empty for none
+	ReplicaOf string
+	// port the server listens on, announced to the master
+	Port int
+	// bytes of the replication stream kept for partial resyncs
+	ReplBacklogSize int
+
+	// run as a node of a cluster, serving the slots assigned to it and
+	// redirecting clients to the other nodes for the rest
+	ClusterEnabled bool
+	// where the node keeps its id and its view of the cluster
+	ClusterConfigFile string
+	// a node that doesn't answer for this long is flagged as failing
+	ClusterNodeTimeout time.Duration
+	// address announced to clients and other nodes, the one the links to
+	// the other nodes come from when empty
+	ClusterAnnounceIP string
+
+	// bytes the dataset may use before keys are evicted, zero for no limit
+	MaxMemory       int64
+	MaxMemoryPolicy EvictionPolicy
+	// keys sampled to pick the one to evict, more is closer to a true LRU
+	// or LFU but slower
+	MaxMemorySamples int
+
+	// how many times a second background tasks like the active expiry of
+	// keys run, more is more prompt but uses more CPU when idle
+	Hz int
+
+	// number of databases, clients pick one with SELECT
+	Databases int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		AppendFilename:           "appendonly.aof",
+		AppendFsync:              FsyncEverysec,
+		AutoAOFRewritePercentage: 100,
+		AutoAOFRewriteMinSize:    64 << 20,
+		DBFilename:               "dump.rdb",
+		SaveParams:               []SaveParam{{3600, 1}, {300, 100}, {60, 10000}},
+		Port:                     6379,
+		ReplBacklogSize:          1 << 20,
+		ClusterConfigFile:        "nodes.conf",
+		ClusterNodeTimeout:       15 * time.Second,
+		MaxMemoryPolicy:          NoEviction,
+		MaxMemorySamples:         5,
+		Hz:                       10,
+		Databases:                16,
+	}
+}
+
+// Open creates a storage engine for the given config, loading the data
+// persisted by a previous run. The AOF is loaded when it's enabled and
+// exists, it's more complete than the snapshot, otherwise the snapshot is.
+func Open(cfg Config) (*Storage, error) {
+	if cfg.ClusterEnabled && cfg.ReplicaOf != "" {
+		return nil, errors.New("replicaof is not allowed in cluster mode")
+	}
+	if cfg.Databases < 1 {
+		return nil, errors.New("databases must be at least 1")
+	}
+	s := newStorage(cfg.Hz, cfg.Databases)
+
+	_, err := os.Stat(cfg.AppendFilename)
+	aofExists := err == nil
+	if cfg.AppendOnly && aofExists {
+		err = s.loadAOF(cfg.AppendFilename)
+	} else {
+		err = s.loadRDB(cfg.DBFilename)
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.dirty = 0
+
+	if cfg.AppendOnly {
+		// the AOF is turned on for the first time, it starts out with the
+		// snapshot so it's complete on its own
+		if !aofExists && s.dbSize() > 0 {
+			if err := seedAOF(cfg.AppendFilename, s.collect()); err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+
+		a, err := openAOF(cfg, s.repl.fsynced)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.aof = a
+	}
+
+	if cfg.ClusterEnabled {
+		if err := s.startCluster(cfg); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	s.rdb = newRDBSaver(cfg)
+	go s.saveCron()
+
+	s.mu.Lock()
+	s.maxMemory = cfg.MaxMemory
+	s.evictPolicy = cfg.MaxMemoryPolicy
+	s.evictSamples = max(cfg.MaxMemorySamples, 1)
+	s.repl.announcePort = cfg.Port
+	s.repl.backlogSize = cfg.ReplBacklogSize
+	if cfg.ReplicaOf != "" {
+		s.replicaOf(cfg.ReplicaOf)
+	}
+	s.mu.Unlock()
+	return s, nil
 }
 
 func NewStorage() *Storage {
+	cfg := DefaultConfig()
+	return newStorage(cfg.Hz, cfg.Databases)
+}
+
+// newStorage creates an empty storage with the given number of databases,
+// running its background tasks hz times a second
+func newStorage(hz int, databases int) *Storage {
+	hz = min(max(hz, 1), maxHz)
 	s := &Storage{
 		mu:   sync.RWMutex{},
-		data: make(map[string]*dataEntity),
-		closed: false,
 		janitor: &janitor{
-			interval: time.Minute,
+			interval: time.Second / time.Duration(hz),
 			exit:     make(chan struct{}),
 		},
-		expiringKeys: make(map[string]time.Time),
+		watched:      make(map[dbKey]map[*Watch]struct{}),
+		blocked:      make(map[dbKey][]*waiter),
+		repl:         newReplication(),
+		evictSamples: 5,
+		logDB:        -1,
 	}
+	s.dbs = newDatabases(s, max(databases, 1))
 	go s.startJanitor()
+	go s.replCron()
 	return s
 }
 
@@ -44,6 +198,8 @@ func NewStorage() *Storage {
 type janitor struct {
 	interval time.Duration
 	exit     chan struct{}
+	// the shard the next expire cycle starts from
+	next int
 }
 
 func (j *janitor) run(s *Storage) {
@@ -53,7 +209,7 @@ func (j *janitor) run(s *Storage) {
 	for {
 		select {
 		case <-ticker.C:
-			s.deleteExpired()
+			s.activeExpireCycle(j.interval * expireCycleSlowPct / 100)
 		case <-j.exit:
 			return
 		}
@@ -61,169 +217,501 @@ func (j *janitor) run(s *Storage) {
 }
 
 type Storage struct {
+	// held for reading by the commands running on shards, for writing by
+	// everything else, see shard.go
 	mu      sync.RWMutex
-	data    map[string]*dataEntity
+	dbs     []*database
 	janitor *janitor
-	//accessed by only .Close() and only  .Close()
-	closed 	bool
-
-	expiringKeys map[string]time.Time
+	// set by Close, read by commands of other goroutines
+	closed atomic.Bool
+
+	aof *aof
+	// serializes the logging of the commands running next to each other
+	logMu sync.Mutex
+	// database the commands logged last ran on, -1 when the next ones must
+	// select theirs whatever it is, see withSelect
+	logDB int
+	// guards the flags of watches and readyKeys for the same commands
+	notifyMu sync.Mutex
+
+	// clients watching each key, see Watch
+	watched map[dbKey]map[*Watch]struct{}
+	// the effects of a transaction are logged once it's over
+	inMulti         bool
+	multiPropagated [][][]byte
+
+	// commands blocked on each key in arrival order, and the keys written
+	// since they were last looked at, see ExecBlocking
+	blocked   map[dbKey][]*waiter
+	readyKeys []dbKey
+	// commands waiting for writes to be acknowledged, see WAIT
+	ackWaiters []*waiter
+
+	repl *replication
+	// nil unless the storage runs as a cluster node
+	cluster *clusterState
+
+	// approximate bytes used by the databases and the limit past which
+	// keys are evicted, see evict.go
+	used         atomic.Int64
+	maxMemory    int64
+	evictPolicy  EvictionPolicy
+	evictSamples int
+	evicted      atomic.Int64
+	// keys deleted once expired
+	expired atomic.Int64
+	// the snapshots being written and the generation of the last one, see
+	// snapshot.go
+	snapshots []*snapshot
+	snapGen   uint64
+	// values UNLINK left to free in the background, see lazyFree
+	lazyfreePending atomic.Int64
+	lazyfreed       atomic.Int64
+
+	// number of writes since the last successful save
+	dirty int64
+	// nil for storages created by NewStorage, which persist nothing
+	rdb *rdbSaver
 }
 
 
-// Exec executes the given command. It returns an error ONLY when it's called after the storage is closed.
-// Returned error is ALWAYS ErrClosed.
+// Exec executes the given command on database 0. It returns an error ONLY when it's called after the storage is closed.
+// Returned error is ALWAYS ErrClosed. Blocking commands don't block, they
+// reply as if they timed out when they can't be served right away.
 func (s *Storage) Exec(cmd [][]byte) (resp.RespType, error) {
-	if s.closed {
-		return nil, ErrClosed
+	reply, _, err := s.exec(&Session{}, cmd, false, false)
+	return reply, err
+}
+
+func (s *Storage) exec(se *Session, cmd [][]byte, canBlock bool, asking bool) (resp.RespType, *Blocked, error) {
+	if s.closed.Load() {
+		return nil, nil, ErrClosed
+	}
+
+	c, errReply := lookupCommand(cmd)
+	if errReply != nil {
+		return errReply, nil, nil
 	}
+	if !c.is(cmdWrite|cmdReadOnly) || c.is(cmdAlone) {
+		return s.execAlone(se, c, cmd, canBlock, asking)
+	}
+
+	reply, pending := s.execShared(se, c, cmd, asking)
+	if b, ok := reply.(*blockOn); ok {
+		if !canBlock {
+			return b.expire(), nil, nil
+		}
+		// it did nothing, it's run again alone so its keys can't be
+		// written before it's parked
+		return s.execAlone(se, c, cmd, canBlock, asking)
+	}
+	if pending {
+		s.mu.Lock()
+		s.serveBlocked()
+		s.rewriteIfDue()
+		s.mu.Unlock()
+	}
+	return reply, nil, nil
+}
+
+// execShared runs a command on the shards of its keys, next to the
+// commands on other shards. It tells if blocked commands are to be served
+// or an AOF rewrite is due, which is done with nothing else running.
+func (s *Storage) execShared(se *Session, c *command, cmd [][]byte, asking bool) (resp.RespType, bool) {
+	keys := c.keys(cmd)
+	write := c.is(cmdWrite)
 
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if errReply := s.clusterRedirect(keys, asking || c.is(cmdAsking)); errReply != nil {
+		return errReply, false
+	}
+	if write {
+		if errReply := s.denyWrite(); errReply != nil {
+			return errReply, false
+		}
+		if errReply := s.denyOOM(c); errReply != nil {
+			return errReply, false
+		}
+	}
+
+	ctx := s.lockKeys(s.dbs[se.db], keys, write)
+	if errReply := s.migrationRedirect(ctx, keys, asking || c.is(cmdAsking)); errReply != nil {
+		ctx.unlock(write)
+		return errReply, false
+	}
+	reply := ctx.call(c, cmd)
+	ctx.unlock(write)
+	se.db = ctx.db.id
+
+	s.notifyMu.Lock()
+	ready := len(s.readyKeys) > 0
+	s.notifyMu.Unlock()
+	return reply, ready || ctx.rewrite
+}
+
+// execAlone runs a command with nothing else running
+func (s *Storage) execAlone(se *Session, c *command, cmd [][]byte, canBlock bool, asking bool) (resp.RespType, *Blocked, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := c.keys(cmd)
+	asking = asking || c.is(cmdAsking)
+	if errReply := s.clusterRedirect(keys, asking); errReply != nil {
+		return errReply, nil, nil
+	}
+	if errReply := s.migrationRedirect(&callCtx{s: s, db: s.dbs[se.db]}, keys, asking); errReply != nil {
+		return errReply, nil, nil
+	}
+	if c.is(cmdWrite) {
+		if errReply := s.denyWrite(); errReply != nil {
+			return errReply, nil, nil
+		}
+		if errReply := s.denyOOM(c); errReply != nil {
+			return errReply, nil, nil
+		}
+	}
+
+	reply := s.call(se, c, cmd)
+	if b, ok := reply.(*blockOn); ok {
+		if canBlock {
+			return nil, s.block(se, c, cmd, b), nil
+		}
+		return b.expire(), nil, nil
+	}
+	s.serveBlocked()
+	return reply, nil, nil
+}
+
+func lookupCommand(cmd [][]byte) (*command, *resp.RespErr) {
 	name := strings.ToLower(string(cmd[0]))
 	c, ok := cmdTable[name]
 	if !ok {
-		return resp.MakeErr("ERR invalid command"), nil
+		return nil, resp.MakeErr("ERR invalid command")
 	}
-
 	if !validArity(c.arity, len(cmd)) {
-		return resp.ArgNumErr(name), nil
+		return nil, resp.ArgNumErr(name)
 	}
+	return c, nil
+}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// denyWrite returns the error write commands are refused with when the
+// dataset can't be persisted, nil if they are allowed
+func (s *Storage) denyWrite() *resp.RespErr {
+	if s.repl.master != nil {
+		return resp.MakeErr("READONLY You can't write against a read only replica.")
+	}
+	if s.aof != nil {
+		s.logMu.Lock()
+		err := s.aof.err
+		s.logMu.Unlock()
+		if err != nil {
+			return misconfErr(err)
+		}
+	}
+	return s.bgsaveErr()
+}
 
-	return c.exec(s, cmd[1:]), nil
+// call runs the command on the database of se with nothing else running,
+// se follows a SELECT. Must be called with s.mu held for writing.
+func (s *Storage) call(se *Session, c *command, cmd [][]byte) resp.RespType {
+	ctx := &callCtx{s: s, db: s.dbs[se.db]}
+	reply := ctx.call(c, cmd)
+	se.db = ctx.db.id
+	return reply
 }
 
-func (s *Storage) Close() {
-	s.closed = true
-	close(s.janitor.exit)
-	s.mu.Lock()
-	// clearing up the map
-	s.data = make(map[string]*dataEntity)
-	s.data = make(map[string]*dataEntity)
-	s.mu.Unlock()
+// call runs the command and logs its effects to the AOF. Errors are not
+// logged, executors validate their arguments before touching any data.
+func (ctx *callCtx) call(c *command, cmd [][]byte) resp.RespType {
+	s := ctx.s
+	ctx.writing = c.is(cmdWrite)
+
+	reply := c.exec(ctx, cmd[1:])
+	ctx.writing = false
+
+	if !c.is(cmdWrite) {
+		return reply
+	}
+	for _, key := range c.keys(cmd) {
+		ctx.db.account(string(key))
+	}
+	if _, isErr := reply.(*resp.RespErr); isErr {
+		return reply
+	}
+	if _, blocked := reply.(*blockOn); blocked {
+		return reply
+	}
+
+	cmds := ctx.propagated
+	if !ctx.propagateOverride {
+		cmds = [][][]byte{cmd}
+	}
+	if len(cmds) == 0 {
+		return reply
+	}
+	for _, key := range ctx.touched {
+		s.signalModified(ctx.db.id, key)
+	}
+
+	if ctx.shared {
+		// the shards of the command are still locked, the log has its
+		// writes in the order they're made
+		s.logMu.Lock()
+		defer s.logMu.Unlock()
+	}
+	s.dirty++
+	cmds = s.withSelect(ctx.db.id, cmds)
+	if s.inMulti {
+		s.multiPropagated = append(s.multiPropagated, cmds...)
+		return reply
+	}
+	s.replicate(cmds)
+	if s.aof == nil {
+		return reply
+	}
+	if err := s.writeAOF(cmds); err != nil {
+		return err
+	}
+	if ctx.shared {
+		ctx.rewrite = s.aof.shouldRewrite()
+	} else {
+		s.rewriteIfDue()
+	}
+	return reply
 }
 
-func (s *Storage) startJanitor() {
-	s.janitor.run(s)
+func (s *Storage) writeAOF(cmds [][][]byte) *resp.RespErr {
+	if err := s.aof.write(cmds, s.repl.offset); err != nil {
+		s.aof.err = err
+		return misconfErr(err)
+	}
+	return nil
+}
+
+// rewriteIfDue starts an AOF rewrite once the file grew enough. Must be
+// called with s.mu held for writing.
+func (s *Storage) rewriteIfDue() {
+	if s.aof != nil && s.aof.shouldRewrite() {
+		_ = s.startAOFRewrite()
+	}
 }
 
-func (s *Storage) deleteExpired() {
-	expiredKeys := []string{}
+// propagate is part of kVStore for the executors called on the storage
+// directly, outside of a command there's nothing to log
+func (s *Storage) propagate(cmds ...[][]byte) {}
+
+func (s *Storage) Close() error {
+	s.closed.Store(true)
+	close(s.janitor.exit)
+
+	close(s.repl.exit)
+	<-s.repl.done
+	if s.cluster != nil {
+		s.stopCluster()
+	}
 	s.mu.Lock()
-	for k, expiresAt := range s.expiringKeys {
-		if time.Now().After(expiresAt) {
-			expiredKeys = append(expiredKeys, k)
-		}
+	master := s.repl.master
+	if master != nil {
+		master.stop()
 	}
+	s.dropReplicas()
 	s.mu.Unlock()
+	if master != nil {
+		<-master.done
+	}
 
-	if len(expiredKeys) > 0 {
-		s.mu.Lock()
-		for _, key := range expiredKeys {
-			s.deleteKey(key)
-		}
-		s.mu.Unlock()
+	if s.rdb != nil {
+		close(s.rdb.exit)
+		<-s.rdb.done
+		s.waitBgsave()
 	}
-}
 
-func (s *Storage) deleteKey(key string) {
-	delete(s.data, key)
-	delete(s.expiringKeys, key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeBlocked()
+
+	var err error
+	// like redis, save on shutdown when snapshots are configured
+	if s.rdb != nil && len(s.rdb.params) > 0 {
+		err = s.save()
+	}
+	// clearing up the databases
+	s.dbs = newDatabases(s, len(s.dbs))
+	s.used.Store(0)
+
+	if s.aof != nil {
+		err = errors.Join(err, s.aof.close())
+	}
+	return err
 }
 
-func (s *Storage) deleteIfExpired(key string) {
-	expiresAt, ok := s.expiringKeys[key]
+func (s *Storage) startJanitor() {
+	s.janitor.run(s)
+}
 
-	if !ok {
-		return
+func (db *database) deleteKey(key string) {
+	sh := db.shardOf(key)
+	if d, ok := sh.data[key]; ok {
+		db.addUsed(-d.mem)
 	}
+	sh.del(key)
+	db.s.signalModified(db.id, key)
+}
 
-	if time.Now().After(expiresAt) {
-		s.deleteKey(key)
+func (db *database) deleteIfExpired(key string) {
+	if db.shardOf(key).expired(key, time.Now()) {
+		db.deleteKey(key)
+		db.s.expired.Add(1)
 	}
 }
 
 // -------- basic ops ---------
+// they run on the shard of the key, which the caller holds
 
-func (s *Storage) exists(key string) bool {
-	_, ok := s.data[key]
+func (db *database) exists(key string) bool {
+	_, ok := db.shardOf(key).data[key]
 	return ok
 }
 
-func (s *Storage) get(key string) (*dataEntity, bool) {
-	s.deleteIfExpired(key)
-	en, ok := s.data[key]
-	return en, ok
+// get returns the entity at key for the caller to modify it in place if
+// it likes, see unshare
+func (db *database) get(key string) (*dataEntity, bool) {
+	db.deleteIfExpired(key)
+	sh := db.shardOf(key)
+	en, ok := sh.data[key]
+	if !ok {
+		return nil, false
+	}
+	sh.copyPending()
+	return db.unshare(key, en), true
 }
 
-func (s *Storage) put(key string, val *dataEntity) int {
-	s.data[key] = val
+// observed tells if clients watch key of db or wait for it to be written
+func (s *Storage) observed(db int, key string) bool {
+	k := dbKey{db, key}
+	_, watched := s.watched[k]
+	_, blocked := s.blocked[k]
+	return watched || blocked
+}
+
+func (db *database) put(key string, val *dataEntity) int {
+	sh := db.shardOf(key)
+	if old, ok := sh.data[key]; ok {
+		db.addUsed(-old.mem)
+	}
+	db.addUsed(val.mem)
+	val.touch(time.Now())
+	sh.set(key, val)
+	db.s.signalModified(db.id, key)
 	return 1
 }
 
 // putIfExists updates the existing key and returns 1, if the key does not exist
 // it returns 0 and does nothing
-func (s *Storage) putIfExists(key string, val *dataEntity) int {
-	if !s.exists(key) {
+func (db *database) putIfExists(key string, val *dataEntity) int {
+	db.deleteIfExpired(key)
+	if !db.exists(key) {
 		return 0
 	}
-	_ = s.put(key, val)
+	_ = db.put(key, val)
 	return 1
 }
 
 // putIfAbsent inserts a new key and returns 1, if the key already exists,
 // it returns 0 and does nothing
-func (s *Storage) putIfAbsent(key string, val *dataEntity) int {
-	if s.exists(key) {
+func (db *database) putIfAbsent(key string, val *dataEntity) int {
+	db.deleteIfExpired(key)
+	if db.exists(key) {
 		return 0
 	}
-	_ = s.put(key, val)
+	_ = db.put(key, val)
 	return 1
 }
 
-func (s *Storage) getExpiresAt(key string) (time.Time, bool) {
-	t, ok := s.expiringKeys[key]
+func (db *database) getExpiresAt(key string) (time.Time, bool) {
+	t, ok := db.shardOf(key).expires[key]
 	return t, ok
 }
 
 // remove deletes a key, it retuns 1 on success and 0 if the key does not exist 
-func (s *Storage) remove(key string) int {
-	s.deleteIfExpired(key)
+func (db *database) remove(key string) int {
+	db.deleteIfExpired(key)
 
-	if !s.exists(key) {
+	if !db.exists(key) {
 		return 0
 	}
 
-	delete(s.data, key)
+	db.deleteKey(key)
 	return 1
 }
 
-// persist deletes the key from the expiringKeys map
+// persist deletes the TTL of the key
 // retuns 1 if the key has expiration, 0 if it does not
-func (s *Storage) persist(key string) int {
-	s.deleteIfExpired(key)
+func (db *database) persist(key string) int {
+	db.deleteIfExpired(key)
 
-	if !s.exists(key) {
+	if !db.exists(key) {
 		return 0
 	}
 
-	_, ok := s.expiringKeys[key]
-	if !ok {
+	sh := db.shardOf(key)
+	if _, ok := sh.expires[key]; !ok {
 		return 0
 	}
-	delete(s.expiringKeys, key)
+	sh.copyPending()
+	delete(sh.expires, key)
+	db.s.signalModified(db.id, key)
 	return 1
 }
 
 // expire sets an expiration on the specified key,
 // returns 1 if the key exists, 0 if it does not
-func (s *Storage) expire(key string, at time.Time) int {
-	s.deleteIfExpired(key)
+func (db *database) expire(key string, at time.Time) int {
+	db.deleteIfExpired(key)
 
-	if !s.exists(key) {
+	if !db.exists(key) {
 		return 0
 	}
-	s.expiringKeys[key] = at
+	sh := db.shardOf(key)
+	sh.copyPending()
+	sh.expires[key] = at
+	db.s.signalModified(db.id, key)
 	return 1
 }
+
+// the storage itself is a kVStore on database 0, for the executors
+// called on it directly
+
+func (s *Storage) get(key string) (*dataEntity, bool) {
+	return s.dbs[0].get(key)
+}
+
+func (s *Storage) put(key string, val *dataEntity) int {
+	return s.dbs[0].put(key, val)
+}
+
+func (s *Storage) putIfExists(key string, val *dataEntity) int {
+	return s.dbs[0].putIfExists(key, val)
+}
+
+func (s *Storage) putIfAbsent(key string, val *dataEntity) int {
+	return s.dbs[0].putIfAbsent(key, val)
+}
+
+func (s *Storage) getExpiresAt(key string) (time.Time, bool) {
+	return s.dbs[0].getExpiresAt(key)
+}
+
+func (s *Storage) remove(key string) int {
+	return s.dbs[0].remove(key)
+}
+
+func (s *Storage) persist(key string) int {
+	return s.dbs[0].persist(key)
+}
+
+func (s *Storage) expire(key string, at time.Time) int {
+	return s.dbs[0].expire(key, at)
+}
@@ -0,0 +1,522 @@
+package store
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+type stream struct {
+	log    streamLog
+	lastID streamID
+	groups map[string]*consumerGroup
+}
+
+func newStream() *stream {
+	return &stream{
+		groups: make(map[string]*consumerGroup),
+	}
+}
+
+func (s *stream) len() int {
+	return s.log.length
+}
+
+// nextID generates the ID for XADD, seq is used only if it's not nil
+func (s *stream) nextID(ms uint64, seq *uint64) (streamID, bool) {
+	if seq != nil {
+		return streamID{ms: ms, seq: *seq}, true
+	}
+	if ms > s.lastID.ms {
+		return streamID{ms: ms}, true
+	}
+	return s.lastID.incr()
+}
+
+// lookupStream returns the stream stored at key. If the key holds another
+// type, the returned reply is a WRONGTYPE error. Missing keys yield (nil, nil).
+func lookupStream(db kVStore, key string) (*stream, resp.RespType) {
+	d, errReply := lookupTyped(db, key, typeStream)
+	if d == nil {
+		return nil, errReply
+	}
+	return d.val.(*stream), nil
+}
+
+func invalidStreamIDErr() *resp.RespErr {
+	return resp.MakeErr("ERR Invalid stream ID specified as stream command argument")
+}
+
+func streamEntryReply(e *streamEntry) resp.RespType {
+	fields := &resp.RespBulkStrArr{}
+	for _, f := range e.fields {
+		fields.Append(f)
+	}
+	return &resp.Array{
+		Elems: []resp.RespType{
+			&resp.BulkStr{Data: e.id.bytes()},
+			fields,
+		},
+	}
+}
+
+type trimSpec struct {
+	strategy string
+	approx   bool
+	maxLen   int
+	minID    streamID
+	limit    int
+	hasLimit bool
+}
+
+// parseTrimArgs parses "MAXLEN|MINID [=|~] threshold [LIMIT count]" starting
+// at args[i], returns the index of the first argument it did not consume
+func parseTrimArgs(args [][]byte, i int, spec *trimSpec) (int, resp.RespType) {
+	spec.strategy = strings.ToUpper(string(args[i]))
+	i++
+	if i >= len(args) {
+		return i, resp.SyntaxErr()
+	}
+
+	switch string(args[i]) {
+	case "~":
+		spec.approx = true
+		i++
+	case "=":
+		i++
+	}
+	if i >= len(args) {
+		return i, resp.SyntaxErr()
+	}
+
+	if spec.strategy == "MAXLEN" {
+		maxLen, ok := parseIndex(args[i])
+		if !ok {
+			return i, resp.NotInErr()
+		}
+		if maxLen < 0 {
+			return i, resp.MakeErr("ERR The MAXLEN argument must be >= 0.")
+		}
+		spec.maxLen = maxLen
+	} else {
+		id, ok := parseStreamID(args[i], 0)
+		if !ok {
+			return i, invalidStreamIDErr()
+		}
+		spec.minID = id
+	}
+	i++
+
+	if i+1 < len(args) && strings.ToUpper(string(args[i])) == "LIMIT" {
+		limit, ok := parseIndex(args[i+1])
+		if !ok || limit < 0 {
+			return i, resp.MakeErr("ERR The LIMIT argument must be >= 0.")
+		}
+		if !spec.approx {
+			return i, resp.MakeErr("ERR syntax error, LIMIT cannot be used without the special ~ option")
+		}
+		spec.limit = limit
+		spec.hasLimit = true
+		i += 2
+	}
+
+	if spec.approx && !spec.hasLimit {
+		spec.limit = 100 * streamChunkSize
+	}
+	return i, nil
+}
+
+func (s *stream) trim(spec *trimSpec) int {
+	remove := func(e *streamEntry, remaining int) bool {
+		return remaining > spec.maxLen
+	}
+	if spec.strategy == "MINID" {
+		remove = func(e *streamEntry, _ int) bool {
+			return e.id.less(spec.minID)
+		}
+	}
+	return s.log.trim(remove, spec.approx, spec.limit)
+}
+
+// trimArgv is the exact trim that leaves s as it is now. Approximate trims
+// depend on how the entries are laid out in chunks, so they are never logged.
+func trimArgv(key []byte, s *stream) [][]byte {
+	first := s.log.firstEntry()
+	if first == nil {
+		return cmdArgv("xtrim", key, []byte("MAXLEN"), []byte("="), []byte("0"))
+	}
+	return cmdArgv("xtrim", key, []byte("MINID"), []byte("="), first.id.bytes())
+}
+
+func execXAdd(db kVStore, args [][]byte) resp.RespType {
+	key := string(args[0])
+	noMkStream := false
+	var trim *trimSpec
+
+	i := 1
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NOMKSTREAM":
+			noMkStream = true
+		case "MAXLEN", "MINID":
+			trim = &trimSpec{}
+			next, errReply := parseTrimArgs(args, i, trim)
+			if errReply != nil {
+				return errReply
+			}
+			i = next - 1
+		default:
+			break options
+		}
+	}
+
+	if i >= len(args) || (len(args)-i-1)%2 != 0 || len(args)-i-1 == 0 {
+		return resp.ArgNumErr("xadd")
+	}
+
+	var ms uint64
+	var seq *uint64
+	rawID := string(args[i])
+	if rawID == "*" {
+		ms = uint64(time.Now().UnixMilli())
+	} else {
+		msPart, seqPart, hasSeq := strings.Cut(rawID, "-")
+		var err error
+		ms, err = strconv.ParseUint(msPart, 10, 64)
+		if err != nil {
+			return invalidStreamIDErr()
+		}
+		if !hasSeq {
+			seq = new(uint64)
+		} else if seqPart != "*" {
+			v, err := strconv.ParseUint(seqPart, 10, 64)
+			if err != nil {
+				return invalidStreamIDErr()
+			}
+			seq = &v
+		}
+	}
+
+	s, errReply := lookupStream(db, key)
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil && noMkStream {
+		return &resp.BulkStr{Data: nil}
+	}
+
+	if seq != nil && ms == 0 && *seq == 0 {
+		return resp.MakeErr("ERR The ID specified in XADD must be greater than 0-0")
+	}
+
+	created := s == nil
+	if created {
+		s = newStream()
+	}
+
+	// "ms-*" can't go back in time, "*" falls back to the top item's ms
+	if rawID != "*" && ms < s.lastID.ms {
+		return resp.MakeErr("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	}
+
+	id, ok := s.nextID(ms, seq)
+	if !ok {
+		return resp.MakeErr("ERR The stream has exhausted the last possible ID, unable to add more items")
+	}
+	if !s.lastID.less(id) {
+		return resp.MakeErr("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	}
+
+	if created {
+		db.put(key, &dataEntity{typ: typeStream, val: s})
+	}
+
+	fields := make([][]byte, len(args)-i-1)
+	copy(fields, args[i+1:])
+	s.log.append(&streamEntry{id: id, fields: fields})
+	s.lastID = id
+
+	// log the generated ID rather than "*"
+	db.propagate(append(cmdArgv("xadd", args[0], id.bytes()), fields...))
+	if trim != nil && s.trim(trim) > 0 {
+		db.propagate(trimArgv(args[0], s))
+	}
+
+	return &resp.BulkStr{
+		Data: id.bytes(),
+	}
+}
+
+// parseRangeID parses a XRANGE bound: "-", "+", an ID with an optional
+// sequence or an exclusive "(id"
+func parseRangeID(raw []byte, isStart bool) (streamID, bool) {
+	switch string(raw) {
+	case "-":
+		return minStreamID, true
+	case "+":
+		return maxStreamID, true
+	}
+
+	exclusive := len(raw) > 0 && raw[0] == '('
+	if exclusive {
+		raw = raw[1:]
+	}
+
+	missingSeq := uint64(0)
+	if !isStart {
+		missingSeq = maxStreamID.seq
+	}
+	id, ok := parseStreamID(raw, missingSeq)
+	if !ok {
+		return id, false
+	}
+
+	if exclusive {
+		if isStart {
+			return id.incr()
+		}
+		return id.decr()
+	}
+	return id, true
+}
+
+func xrange(db kVStore, args [][]byte, rev bool) resp.RespType {
+	startRaw, endRaw := args[1], args[2]
+	if rev {
+		startRaw, endRaw = endRaw, startRaw
+	}
+
+	start, ok := parseRangeID(startRaw, true)
+	if !ok {
+		return invalidStreamIDErr()
+	}
+	end, ok := parseRangeID(endRaw, false)
+	if !ok {
+		return invalidStreamIDErr()
+	}
+
+	count := -1
+	if len(args) > 3 {
+		if len(args) != 5 || strings.ToUpper(string(args[3])) != "COUNT" {
+			return resp.SyntaxErr()
+		}
+		c, ok := parseIndex(args[4])
+		if !ok {
+			return resp.NotInErr()
+		}
+		count = max(c, 0)
+	}
+
+	s, errReply := lookupStream(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+
+	arr := &resp.Array{}
+	if s == nil || count == 0 || end.less(start) {
+		return arr
+	}
+
+	collect := func(e *streamEntry) bool {
+		arr.Append(streamEntryReply(e))
+		return count < 0 || len(arr.Elems) < count
+	}
+	if rev {
+		s.log.iterReverse(start, end, collect)
+	} else {
+		s.log.iter(start, end, collect)
+	}
+	return arr
+}
+
+func execXRange(db kVStore, args [][]byte) resp.RespType {
+	return xrange(db, args, false)
+}
+
+func execXRevRange(db kVStore, args [][]byte) resp.RespType {
+	return xrange(db, args, true)
+}
+
+func execXLen(db kVStore, args [][]byte) resp.RespType {
+	s, errReply := lookupStream(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil {
+		return &resp.Intiger{Data: 0}
+	}
+	return &resp.Intiger{
+		Data: int64(s.len()),
+	}
+}
+
+func execXDel(db kVStore, args [][]byte) resp.RespType {
+	ids := make([]streamID, len(args)-1)
+	for i, raw := range args[1:] {
+		id, ok := parseStreamID(raw, 0)
+		if !ok {
+			return invalidStreamIDErr()
+		}
+		ids[i] = id
+	}
+
+	s, errReply := lookupStream(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil {
+		return &resp.Intiger{Data: 0}
+	}
+
+	deleted := 0
+	for _, id := range ids {
+		if s.log.delete(id) {
+			deleted++
+		}
+	}
+	return &resp.Intiger{
+		Data: int64(deleted),
+	}
+}
+
+func execXTrim(db kVStore, args [][]byte) resp.RespType {
+	strategy := strings.ToUpper(string(args[1]))
+	if strategy != "MAXLEN" && strategy != "MINID" {
+		return resp.SyntaxErr()
+	}
+
+	spec := &trimSpec{}
+	i, errReply := parseTrimArgs(args, 1, spec)
+	if errReply != nil {
+		return errReply
+	}
+	if i != len(args) {
+		return resp.SyntaxErr()
+	}
+
+	s, errReply := lookupStream(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil {
+		return &resp.Intiger{Data: 0}
+	}
+
+	deleted := s.trim(spec)
+	if deleted > 0 {
+		db.propagate(trimArgv(args[0], s))
+	} else {
+		db.propagate()
+	}
+	return &resp.Intiger{
+		Data: int64(deleted),
+	}
+}
+
+// parseStreamsArg splits "key [key ...] id [id ...]" following STREAMS
+func parseStreamsArg(args [][]byte) ([][]byte, [][]byte, resp.RespType) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, nil, resp.MakeErr("ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")
+	}
+	half := len(args) / 2
+	return args[:half], args[half:], nil
+}
+
+// streamsKeys returns the keys following STREAMS in XREAD and XREADGROUP
+func streamsKeys(cmd [][]byte) [][]byte {
+	for i, arg := range cmd {
+		if strings.EqualFold(string(arg), "STREAMS") {
+			keys, _, _ := parseStreamsArg(cmd[i+1:])
+			return keys
+		}
+	}
+	return nil
+}
+
+func execXRead(db kVStore, args [][]byte) resp.RespType {
+	count := -1
+	i := 0
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		if opt == "STREAMS" {
+			break
+		}
+		if opt != "COUNT" || i+1 >= len(args) {
+			return resp.SyntaxErr()
+		}
+		c, ok := parseIndex(args[i+1])
+		if !ok {
+			return resp.NotInErr()
+		}
+		count = c
+		i++
+	}
+	if i >= len(args) {
+		return resp.SyntaxErr()
+	}
+
+	keys, rawIDs, errReply := parseStreamsArg(args[i+1:])
+	if errReply != nil {
+		return errReply
+	}
+
+	result := &resp.Array{}
+	for j, k := range keys {
+		s, errReply := lookupStream(db, string(k))
+		if errReply != nil {
+			return errReply
+		}
+
+		var after streamID
+		if string(rawIDs[j]) == "$" {
+			if s == nil {
+				continue
+			}
+			after = s.lastID
+		} else {
+			id, ok := parseStreamID(rawIDs[j], 0)
+			if !ok {
+				return invalidStreamIDErr()
+			}
+			after = id
+		}
+
+		if s == nil {
+			continue
+		}
+		start, ok := after.incr()
+		if !ok {
+			continue
+		}
+
+		entries := &resp.Array{}
+		s.log.iter(start, maxStreamID, func(e *streamEntry) bool {
+			entries.Append(streamEntryReply(e))
+			return count <= 0 || len(entries.Elems) < count
+		})
+		if len(entries.Elems) == 0 {
+			continue
+		}
+		result.Append(&resp.Array{
+			Elems: []resp.RespType{&resp.BulkStr{Data: k}, entries},
+		})
+	}
+
+	if len(result.Elems) == 0 {
+		return &resp.NullArray{}
+	}
+	return result
+}
+
+func init() {
+	registerCommand("xadd", -5, cmdWrite, execXAdd)
+	registerCommand("xrange", -4, cmdReadOnly, execXRange)
+	registerCommand("xrevrange", -4, cmdReadOnly, execXRevRange)
+	registerCommand("xlen", 2, cmdReadOnly, execXLen)
+	registerCommand("xdel", -3, cmdWrite|cmdFreesMemory, execXDel)
+	registerCommand("xtrim", -4, cmdWrite|cmdFreesMemory, execXTrim)
+	registerCommand("xread", -4, cmdReadOnly, execXRead).withGetKeys(streamsKeys)
+}
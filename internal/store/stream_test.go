@@ -0,0 +1,192 @@
+package store
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+	"github.com/myselfBZ/go-redis-clone/pkg/utils"
+)
+
+func entry(id string, fields ...string) *resp.Array {
+	return &resp.Array{
+		Elems: []resp.RespType{&resp.BulkStr{Data: []byte(id)}, bulkArr(fields...)},
+	}
+}
+
+func entries(elems ...resp.RespType) *resp.Array {
+	return &resp.Array{Elems: elems}
+}
+
+func TestStreamLog(t *testing.T) {
+	var l streamLog
+	n := streamChunkSize*3 + 5
+	for i := 1; i <= n; i++ {
+		l.append(&streamEntry{id: streamID{ms: uint64(i)}})
+	}
+
+	var got []uint64
+	l.iter(streamID{ms: 126}, streamID{ms: 131}, func(e *streamEntry) bool {
+		got = append(got, e.id.ms)
+		return true
+	})
+	if !slices.Equal(got, []uint64{126, 127, 128, 129, 130, 131}) {
+		t.Fatalf("iter across chunks returned %v", got)
+	}
+
+	got = got[:0]
+	l.iterReverse(streamID{ms: 127}, streamID{ms: 129, seq: 5}, func(e *streamEntry) bool {
+		got = append(got, e.id.ms)
+		return true
+	})
+	if !slices.Equal(got, []uint64{129, 128, 127}) {
+		t.Fatalf("iterReverse across chunks returned %v", got)
+	}
+
+	if !l.delete(streamID{ms: 128}) || l.delete(streamID{ms: 128}) {
+		t.Fatalf("delete did not report the entry correctly")
+	}
+	if _, ok := l.get(streamID{ms: 128}); ok {
+		t.Fatalf("deleted entry is still found")
+	}
+
+	// approximate trimming only drops whole chunks
+	deleted := l.trim(func(e *streamEntry, remaining int) bool { return remaining > 200 }, true, 0)
+	if deleted != streamChunkSize-1 || l.length != n-streamChunkSize {
+		t.Fatalf("approx trim deleted %d, length %d", deleted, l.length)
+	}
+	deleted = l.trim(func(e *streamEntry, remaining int) bool { return remaining > 200 }, false, 0)
+	if l.length != 200 || l.firstEntry().id.ms != uint64(n-199) || deleted != n-streamChunkSize-200 {
+		t.Fatalf("exact trim left %d entries starting at %s", l.length, l.firstEntry().id)
+	}
+}
+
+func TestExecStream(t *testing.T) {
+	testDb.mu.Lock()
+	defer testDb.mu.Unlock()
+
+	key := utils.RandString(defaultKeyLength)
+	strKey := utils.RandString(defaultKeyLength)
+	testDb.put(strKey, &dataEntity{val: []byte("val")})
+
+	tests := []struct {
+		suite
+		exec execCmd
+	}{
+		{suite{"XADD explicit ID", &resp.BulkStr{Data: []byte("1-1")}, toBytes(key, "1-1", "a", "1")}, execXAdd},
+		{suite{"XADD auto sequence", &resp.BulkStr{Data: []byte("1-2")}, toBytes(key, "1-*", "b", "2")}, execXAdd},
+		{suite{"XADD ms only", &resp.BulkStr{Data: []byte("2-0")}, toBytes(key, "2", "c", "3")}, execXAdd},
+		{suite{"XADD smaller ID", resp.MakeErr("ERR The ID specified in XADD is equal or smaller than the target stream top item"), toBytes(key, "1-5", "d", "4")}, execXAdd},
+		{suite{"XADD 0-0", resp.MakeErr("ERR The ID specified in XADD must be greater than 0-0"), toBytes(key, "0-0", "d", "4")}, execXAdd},
+		{suite{"XADD odd fields", resp.ArgNumErr("xadd"), toBytes(key, "3-0", "d")}, execXAdd},
+		{suite{"XADD NOMKSTREAM missing key", &resp.BulkStr{Data: nil}, toBytes(utils.RandString(defaultKeyLength), "NOMKSTREAM", "*", "a", "1")}, execXAdd},
+		{suite{"XADD with MAXLEN", &resp.BulkStr{Data: []byte("3-0")}, toBytes(key, "MAXLEN", "=", "3", "3-0", "d", "4")}, execXAdd},
+		{suite{"XLEN", &resp.Intiger{Data: 3}, toBytes(key)}, execXLen},
+		{suite{"XRANGE", entries(entry("1-2", "b", "2"), entry("2-0", "c", "3"), entry("3-0", "d", "4")), toBytes(key, "-", "+")}, execXRange},
+		{suite{"XRANGE exclusive with COUNT", entries(entry("2-0", "c", "3")), toBytes(key, "(1-2", "+", "COUNT", "1")}, execXRange},
+		{suite{"XRANGE ms only end", entries(entry("1-2", "b", "2")), toBytes(key, "-", "1")}, execXRange},
+		{suite{"XREVRANGE", entries(entry("3-0", "d", "4"), entry("2-0", "c", "3")), toBytes(key, "+", "2")}, execXRevRange},
+		{suite{"XRANGE invalid ID", invalidStreamIDErr(), toBytes(key, "x", "+")}, execXRange},
+		{suite{"XREAD", entries(entries(&resp.BulkStr{Data: []byte(key)}, entries(entry("3-0", "d", "4")))), toBytes("STREAMS", key, "2-0")}, execXRead},
+		{suite{"XREAD nothing new", &resp.NullArray{}, toBytes("STREAMS", key, "$")}, execXRead},
+		{suite{"XDEL", &resp.Intiger{Data: 1}, toBytes(key, "2-0", "9-9")}, execXDel},
+		{suite{"XTRIM MINID", &resp.Intiger{Data: 1}, toBytes(key, "MINID", "3")}, execXTrim},
+		{suite{"XTRIM LIMIT without ~", resp.MakeErr("ERR syntax error, LIMIT cannot be used without the special ~ option"), toBytes(key, "MAXLEN", "1", "LIMIT", "1")}, execXTrim},
+		{suite{"XLEN after trimming", &resp.Intiger{Data: 1}, toBytes(key)}, execXLen},
+		{suite{"XADD on string key", resp.WrongTypeErr(), toBytes(strKey, "*", "a", "1")}, execXAdd},
+		{suite{"XLEN on string key", resp.WrongTypeErr(), toBytes(strKey)}, execXLen},
+	}
+
+	for _, test := range tests {
+		rep := test.exec(testDb, test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+}
+
+func TestExecStreamGroups(t *testing.T) {
+	testDb.mu.Lock()
+	defer testDb.mu.Unlock()
+
+	key := utils.RandString(defaultKeyLength)
+	keyBulk := &resp.BulkStr{Data: []byte(key)}
+	ok := &resp.SimpleStr{Data: []byte("OK")}
+
+	tests := []struct {
+		suite
+		exec execCmd
+	}{
+		{suite{"XGROUP CREATE missing key", resp.MakeErr("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."), toBytes("CREATE", key, "g", "$")}, execXGroup},
+		{suite{"XGROUP CREATE MKSTREAM", ok, toBytes("CREATE", key, "g", "$", "MKSTREAM")}, execXGroup},
+		{suite{"XGROUP CREATE existing", resp.MakeErr("BUSYGROUP Consumer Group name already exists"), toBytes("CREATE", key, "g", "0")}, execXGroup},
+		{suite{"XADD 1", &resp.BulkStr{Data: []byte("1-0")}, toBytes(key, "1-0", "f", "1")}, execXAdd},
+		{suite{"XADD 2", &resp.BulkStr{Data: []byte("2-0")}, toBytes(key, "2-0", "f", "2")}, execXAdd},
+		{suite{"XADD 3", &resp.BulkStr{Data: []byte("3-0")}, toBytes(key, "3-0", "f", "3")}, execXAdd},
+		{suite{"XREADGROUP new entries", entries(entries(keyBulk, entries(entry("1-0", "f", "1"), entry("2-0", "f", "2")))), toBytes("GROUP", "g", "alice", "COUNT", "2", "STREAMS", key, ">")}, execXReadGroup},
+		{suite{"XREADGROUP other consumer", entries(entries(keyBulk, entries(entry("3-0", "f", "3")))), toBytes("GROUP", "g", "bob", "STREAMS", key, ">")}, execXReadGroup},
+		{suite{"XREADGROUP nothing new", &resp.NullArray{}, toBytes("GROUP", "g", "bob", "STREAMS", key, ">")}, execXReadGroup},
+		{suite{"XREADGROUP history", entries(entries(keyBulk, entries(entry("2-0", "f", "2")))), toBytes("GROUP", "g", "alice", "STREAMS", key, "1-0")}, execXReadGroup},
+		{suite{"XREADGROUP missing group", noGroupErr(key, "nope"), toBytes("GROUP", "nope", "alice", "STREAMS", key, ">")}, execXReadGroup},
+		{suite{"XPENDING summary", entries(
+			&resp.Intiger{Data: 3},
+			&resp.BulkStr{Data: []byte("1-0")},
+			&resp.BulkStr{Data: []byte("3-0")},
+			entries(bulkArr("alice", "2"), bulkArr("bob", "1")),
+		), toBytes(key, "g")}, execXPending},
+		{suite{"XACK", &resp.Intiger{Data: 1}, toBytes(key, "g", "1-0", "9-0")}, execXAck},
+		{suite{"XCLAIM", entries(entry("3-0", "f", "3")), toBytes(key, "g", "alice", "0", "3-0")}, execXClaim},
+		{suite{"XCLAIM JUSTID not pending", bulkArr(), toBytes(key, "g", "alice", "0", "1-0", "JUSTID")}, execXClaim},
+		{suite{"XDEL pending entry", &resp.Intiger{Data: 1}, toBytes(key, "2-0")}, execXDel},
+		{suite{"XAUTOCLAIM", entries(
+			&resp.BulkStr{Data: []byte("0-0")},
+			bulkArr("3-0"),
+			bulkArr("2-0"),
+		), toBytes(key, "g", "bob", "0", "-", "JUSTID")}, execXAutoClaim},
+		{suite{"XPENDING after claims", entries(
+			&resp.Intiger{Data: 1},
+			&resp.BulkStr{Data: []byte("3-0")},
+			&resp.BulkStr{Data: []byte("3-0")},
+			entries(bulkArr("bob", "1")),
+		), toBytes(key, "g")}, execXPending},
+		{suite{"XGROUP DELCONSUMER", &resp.Intiger{Data: 1}, toBytes("DELCONSUMER", key, "g", "bob")}, execXGroup},
+		{suite{"XGROUP SETID", ok, toBytes("SETID", key, "g", "0")}, execXGroup},
+		{suite{"XREADGROUP NOACK after SETID", entries(entries(keyBulk, entries(entry("1-0", "f", "1")))), toBytes("GROUP", "g", "carol", "COUNT", "1", "NOACK", "STREAMS", key, ">")}, execXReadGroup},
+		{suite{"XGROUP DESTROY", &resp.Intiger{Data: 1}, toBytes("DESTROY", key, "g")}, execXGroup},
+		{suite{"XACK missing group", &resp.Intiger{Data: 0}, toBytes(key, "g", "1-0")}, execXAck},
+	}
+
+	for _, test := range tests {
+		rep := test.exec(testDb, test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+}
+
+func TestExecXPendingExtended(t *testing.T) {
+	testDb.mu.Lock()
+	defer testDb.mu.Unlock()
+
+	key := utils.RandString(defaultKeyLength)
+	execXAdd(testDb, toBytes(key, "1-0", "f", "1"))
+	execXAdd(testDb, toBytes(key, "2-0", "f", "2"))
+	execXGroup(testDb, toBytes("CREATE", key, "g", "0"))
+	execXReadGroup(testDb, toBytes("GROUP", "g", "alice", "STREAMS", key, ">"))
+	execXClaim(testDb, toBytes(key, "g", "alice", "0", "2-0", "RETRYCOUNT", "5"))
+
+	rep, isArr := execXPending(testDb, toBytes(key, "g", "-", "+", "10", "alice")).(*resp.Array)
+	if !isArr || len(rep.Elems) != 2 {
+		t.Fatalf("XPENDING returned %q", rep.ToBytes())
+	}
+
+	second := rep.Elems[1].(*resp.Array)
+	if string(second.Elems[0].ToBytes()) != "$3\r\n2-0\r\n" || string(second.Elems[3].ToBytes()) != ":5\r\n" {
+		t.Fatalf("XPENDING entry did not match, got %q", second.ToBytes())
+	}
+
+	rep = execXPending(testDb, toBytes(key, "g", "IDLE", "60000", "-", "+", "10")).(*resp.Array)
+	if len(rep.Elems) != 0 {
+		t.Fatalf("XPENDING IDLE returned fresh entries: %q", rep.ToBytes())
+	}
+}
@@ -0,0 +1,781 @@
+package store
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+// streamNACK is an entry delivered to a consumer but not acknowledged yet
+type streamNACK struct {
+	id            streamID
+	consumer      *streamConsumer
+	deliveryTime  time.Time
+	deliveryCount int64
+}
+
+func (n *streamNACK) idle(now time.Time) int64 {
+	return max(now.Sub(n.deliveryTime).Milliseconds(), 0)
+}
+
+type streamConsumer struct {
+	name     string
+	seenTime time.Time
+	pel      map[streamID]*streamNACK
+}
+
+type consumerGroup struct {
+	lastID streamID
+	// pending entries of all the consumers, sorted by ID
+	pel       []*streamNACK
+	consumers map[string]*streamConsumer
+}
+
+func newConsumerGroup(lastID streamID) *consumerGroup {
+	return &consumerGroup{
+		lastID:    lastID,
+		consumers: make(map[string]*streamConsumer),
+	}
+}
+
+func (g *consumerGroup) findPending(id streamID) (int, bool) {
+	return slices.BinarySearchFunc(g.pel, id, func(n *streamNACK, id streamID) int {
+		return n.id.compare(id)
+	})
+}
+
+func (g *consumerGroup) pending(id streamID) *streamNACK {
+	i, found := g.findPending(id)
+	if !found {
+		return nil
+	}
+	return g.pel[i]
+}
+
+// deliver records id as pending for c, taking it over from whoever owned it
+func (g *consumerGroup) deliver(id streamID, c *streamConsumer, now time.Time) *streamNACK {
+	i, found := g.findPending(id)
+	if found {
+		n := g.pel[i]
+		n.assign(c)
+		n.deliveryTime = now
+		n.deliveryCount++
+		return n
+	}
+
+	n := &streamNACK{id: id, deliveryTime: now, deliveryCount: 1}
+	n.assign(c)
+	g.pel = slices.Insert(g.pel, i, n)
+	return n
+}
+
+func (n *streamNACK) assign(c *streamConsumer) {
+	if n.consumer != nil {
+		delete(n.consumer.pel, n.id)
+	}
+	n.consumer = c
+	c.pel[n.id] = n
+}
+
+func (g *consumerGroup) ack(id streamID) bool {
+	i, found := g.findPending(id)
+	if !found {
+		return false
+	}
+	delete(g.pel[i].consumer.pel, id)
+	g.pel = slices.Delete(g.pel, i, i+1)
+	return true
+}
+
+func (g *consumerGroup) consumer(name string, create bool) *streamConsumer {
+	c, ok := g.consumers[name]
+	if !ok && create {
+		c = &streamConsumer{
+			name:     name,
+			seenTime: time.Now(),
+			pel:      make(map[streamID]*streamNACK),
+		}
+		g.consumers[name] = c
+	}
+	return c
+}
+
+func (g *consumerGroup) deleteConsumer(name string) int {
+	c, ok := g.consumers[name]
+	if !ok {
+		return 0
+	}
+	pending := len(c.pel)
+	for id := range c.pel {
+		g.ack(id)
+	}
+	delete(g.consumers, name)
+	return pending
+}
+
+func noGroupErr(key, group string) *resp.RespErr {
+	return resp.MakeErr(fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s'", key, group))
+}
+
+// lookupGroup returns the stream at key and its group, replying NOGROUP if
+// either is missing
+func lookupGroup(db kVStore, key, group string) (*stream, *consumerGroup, resp.RespType) {
+	s, errReply := lookupStream(db, key)
+	if errReply != nil {
+		return nil, nil, errReply
+	}
+	if s == nil || s.groups[group] == nil {
+		return nil, nil, noGroupErr(key, group)
+	}
+	return s, s.groups[group], nil
+}
+
+// parseGroupID parses the ID given to XGROUP CREATE and SETID, "$" means
+// the last ID of the stream
+func parseGroupID(s *stream, raw []byte) (streamID, bool) {
+	if string(raw) == "$" {
+		return s.lastID, true
+	}
+	return parseStreamID(raw, 0)
+}
+
+func execXGroup(db kVStore, args [][]byte) resp.RespType {
+	sub := strings.ToUpper(string(args[0]))
+	if len(args) < 3 {
+		return resp.MakeErr(fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'", sub))
+	}
+	key, groupName := string(args[1]), string(args[2])
+
+	s, errReply := lookupStream(db, key)
+	if errReply != nil {
+		return errReply
+	}
+
+	switch sub {
+	case "CREATE":
+		if len(args) < 4 {
+			return resp.ArgNumErr("xgroup|create")
+		}
+		mkStream := false
+		for i := 4; i < len(args); i++ {
+			switch strings.ToUpper(string(args[i])) {
+			case "MKSTREAM":
+				mkStream = true
+			case "ENTRIESREAD":
+				// lag tracking is not implemented, the value is accepted and ignored
+				if i+1 >= len(args) {
+					return resp.SyntaxErr()
+				}
+				i++
+			default:
+				return resp.SyntaxErr()
+			}
+		}
+
+		if s == nil {
+			if !mkStream {
+				return resp.MakeErr("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+			}
+			s = newStream()
+			db.put(key, &dataEntity{typ: typeStream, val: s})
+		}
+
+		id, ok := parseGroupID(s, args[3])
+		if !ok {
+			return invalidStreamIDErr()
+		}
+		if _, exists := s.groups[groupName]; exists {
+			return resp.MakeErr("BUSYGROUP Consumer Group name already exists")
+		}
+		s.groups[groupName] = newConsumerGroup(id)
+		return &resp.SimpleStr{Data: []byte("OK")}
+	}
+
+	if s == nil {
+		return resp.MakeErr("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+	}
+
+	if sub == "DESTROY" {
+		if len(args) != 3 {
+			return resp.ArgNumErr("xgroup|destroy")
+		}
+		if _, ok := s.groups[groupName]; !ok {
+			return &resp.Intiger{Data: 0}
+		}
+		delete(s.groups, groupName)
+		return &resp.Intiger{Data: 1}
+	}
+
+	g := s.groups[groupName]
+	if g == nil {
+		return resp.MakeErr(fmt.Sprintf("NOGROUP No such consumer group '%s' for key name '%s'", groupName, key))
+	}
+
+	switch sub {
+	case "SETID":
+		if len(args) != 4 && len(args) != 6 {
+			return resp.ArgNumErr("xgroup|setid")
+		}
+		id, ok := parseGroupID(s, args[3])
+		if !ok {
+			return invalidStreamIDErr()
+		}
+		g.lastID = id
+		return &resp.SimpleStr{Data: []byte("OK")}
+	case "CREATECONSUMER":
+		if len(args) != 4 {
+			return resp.ArgNumErr("xgroup|createconsumer")
+		}
+		if g.consumer(string(args[3]), false) != nil {
+			return &resp.Intiger{Data: 0}
+		}
+		g.consumer(string(args[3]), true)
+		return &resp.Intiger{Data: 1}
+	case "DELCONSUMER":
+		if len(args) != 4 {
+			return resp.ArgNumErr("xgroup|delconsumer")
+		}
+		return &resp.Intiger{
+			Data: int64(g.deleteConsumer(string(args[3]))),
+		}
+	}
+
+	return resp.MakeErr(fmt.Sprintf("ERR unknown subcommand '%s'", sub))
+}
+
+func execXReadGroup(db kVStore, args [][]byte) resp.RespType {
+	if strings.ToUpper(string(args[0])) != "GROUP" {
+		return resp.SyntaxErr()
+	}
+	groupName, consumerName := string(args[1]), string(args[2])
+
+	count := 0
+	noAck := false
+	i := 3
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		if opt == "STREAMS" {
+			break
+		}
+		switch {
+		case opt == "NOACK":
+			noAck = true
+		case opt == "COUNT" && i+1 < len(args):
+			c, ok := parseIndex(args[i+1])
+			if !ok {
+				return resp.NotInErr()
+			}
+			count = max(c, 0)
+			i++
+		default:
+			return resp.SyntaxErr()
+		}
+	}
+	if i >= len(args) {
+		return resp.SyntaxErr()
+	}
+
+	keys, rawIDs, errReply := parseStreamsArg(args[i+1:])
+	if errReply != nil {
+		return errReply
+	}
+
+	// validate everything before touching any group
+	type groupRead struct {
+		s     *stream
+		g     *consumerGroup
+		after streamID
+		isNew bool
+	}
+	reads := make([]groupRead, len(keys))
+	for j, k := range keys {
+		s, g, errReply := lookupGroup(db, string(k), groupName)
+		if errReply != nil {
+			return errReply
+		}
+		reads[j] = groupRead{s: s, g: g}
+		if string(rawIDs[j]) == ">" {
+			reads[j].isNew = true
+			continue
+		}
+		id, ok := parseStreamID(rawIDs[j], 0)
+		if !ok {
+			return invalidStreamIDErr()
+		}
+		reads[j].after = id
+	}
+
+	now := time.Now()
+	result := &resp.Array{}
+	for j, r := range reads {
+		c := r.g.consumer(consumerName, true)
+		c.seenTime = now
+
+		entries := &resp.Array{}
+		if r.isNew {
+			start, ok := r.g.lastID.incr()
+			if ok {
+				r.s.log.iter(start, maxStreamID, func(e *streamEntry) bool {
+					entries.Append(streamEntryReply(e))
+					r.g.lastID = e.id
+					if !noAck {
+						r.g.deliver(e.id, c, now)
+					}
+					return count == 0 || len(entries.Elems) < count
+				})
+			}
+			if len(entries.Elems) == 0 {
+				continue
+			}
+		} else {
+			ids := make([]streamID, 0, len(c.pel))
+			for id := range c.pel {
+				if r.after.less(id) {
+					ids = append(ids, id)
+				}
+			}
+			slices.SortFunc(ids, streamID.compare)
+			if count > 0 && len(ids) > count {
+				ids = ids[:count]
+			}
+			for _, id := range ids {
+				entries.Append(pendingEntryReply(r.s, id))
+			}
+		}
+
+		result.Append(&resp.Array{
+			Elems: []resp.RespType{&resp.BulkStr{Data: keys[j]}, entries},
+		})
+	}
+
+	if len(result.Elems) == 0 {
+		return &resp.NullArray{}
+	}
+	return result
+}
+
+// pendingEntryReply replies with the entry behind a pending ID. Entries
+// deleted since they were delivered are sent with no fields.
+func pendingEntryReply(s *stream, id streamID) resp.RespType {
+	e, ok := s.log.get(id)
+	if !ok {
+		return &resp.Array{
+			Elems: []resp.RespType{&resp.BulkStr{Data: id.bytes()}, &resp.NullArray{}},
+		}
+	}
+	return streamEntryReply(e)
+}
+
+func execXAck(db kVStore, args [][]byte) resp.RespType {
+	ids := make([]streamID, len(args)-2)
+	for i, raw := range args[2:] {
+		id, ok := parseStreamID(raw, 0)
+		if !ok {
+			return invalidStreamIDErr()
+		}
+		ids[i] = id
+	}
+
+	s, errReply := lookupStream(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil || s.groups[string(args[1])] == nil {
+		return &resp.Intiger{Data: 0}
+	}
+
+	g := s.groups[string(args[1])]
+	acked := 0
+	for _, id := range ids {
+		if g.ack(id) {
+			acked++
+		}
+	}
+	return &resp.Intiger{
+		Data: int64(acked),
+	}
+}
+
+func execXPending(db kVStore, args [][]byte) resp.RespType {
+	key, groupName := string(args[0]), string(args[1])
+
+	if len(args) == 2 {
+		_, g, errReply := lookupGroup(db, key, groupName)
+		if errReply != nil {
+			return errReply
+		}
+		return pendingSummary(g)
+	}
+
+	var minIdle int64
+	i := 2
+	if strings.ToUpper(string(args[i])) == "IDLE" {
+		if len(args) < 4 {
+			return resp.SyntaxErr()
+		}
+		v, err := strconv.ParseInt(string(args[3]), 10, 64)
+		if err != nil {
+			return resp.NotInErr()
+		}
+		minIdle = v
+		i = 4
+	}
+	if len(args)-i != 3 && len(args)-i != 4 {
+		return resp.SyntaxErr()
+	}
+
+	start, ok := parseRangeID(args[i], true)
+	if !ok {
+		return invalidStreamIDErr()
+	}
+	end, ok := parseRangeID(args[i+1], false)
+	if !ok {
+		return invalidStreamIDErr()
+	}
+	count, ok := parseIndex(args[i+2])
+	if !ok {
+		return resp.NotInErr()
+	}
+	consumerName := ""
+	if len(args)-i == 4 {
+		consumerName = string(args[i+3])
+	}
+
+	_, g, errReply := lookupGroup(db, key, groupName)
+	if errReply != nil {
+		return errReply
+	}
+
+	now := time.Now()
+	arr := &resp.Array{}
+	from, _ := g.findPending(start)
+	for _, n := range g.pel[from:] {
+		if len(arr.Elems) >= count || end.less(n.id) {
+			break
+		}
+		if consumerName != "" && n.consumer.name != consumerName {
+			continue
+		}
+		if n.idle(now) < minIdle {
+			continue
+		}
+		arr.Append(&resp.Array{
+			Elems: []resp.RespType{
+				&resp.BulkStr{Data: n.id.bytes()},
+				&resp.BulkStr{Data: []byte(n.consumer.name)},
+				&resp.Intiger{Data: n.idle(now)},
+				&resp.Intiger{Data: n.deliveryCount},
+			},
+		})
+	}
+	return arr
+}
+
+func pendingSummary(g *consumerGroup) resp.RespType {
+	if len(g.pel) == 0 {
+		return &resp.Array{
+			Elems: []resp.RespType{
+				&resp.Intiger{Data: 0},
+				&resp.BulkStr{Data: nil},
+				&resp.BulkStr{Data: nil},
+				&resp.NullArray{},
+			},
+		}
+	}
+
+	names := make([]string, 0, len(g.consumers))
+	for name, c := range g.consumers {
+		if len(c.pel) > 0 {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	perConsumer := &resp.Array{}
+	for _, name := range names {
+		pair := &resp.RespBulkStrArr{}
+		pair.Append([]byte(name))
+		pair.Append([]byte(strconv.Itoa(len(g.consumers[name].pel))))
+		perConsumer.Append(pair)
+	}
+
+	return &resp.Array{
+		Elems: []resp.RespType{
+			&resp.Intiger{Data: int64(len(g.pel))},
+			&resp.BulkStr{Data: g.pel[0].id.bytes()},
+			&resp.BulkStr{Data: g.pel[len(g.pel)-1].id.bytes()},
+			perConsumer,
+		},
+	}
+}
+
+type claimOptions struct {
+	deliveryTime time.Time
+	retryCount   int64
+	hasRetry     bool
+	force        bool
+	justID       bool
+	lastID       *streamID
+}
+
+// claim transfers the pending entry id to c if it has been idle for at least
+// minIdle. Entries no longer in the stream are dropped from the PEL and
+// reported with deleted set.
+func (g *consumerGroup) claim(s *stream, id streamID, c *streamConsumer, minIdle int64, opts *claimOptions, now time.Time) (claimed *streamNACK, deleted bool) {
+	n := g.pending(id)
+	if n == nil {
+		if !opts.force {
+			return nil, false
+		}
+		if _, ok := s.log.get(id); !ok {
+			return nil, false
+		}
+		n = g.deliver(id, c, now)
+		n.deliveryCount = 0
+	} else if n.idle(now) < minIdle {
+		return nil, false
+	}
+
+	if _, ok := s.log.get(id); !ok {
+		g.ack(id)
+		return nil, true
+	}
+
+	n.assign(c)
+	n.deliveryTime = opts.deliveryTime
+	switch {
+	case opts.hasRetry:
+		n.deliveryCount = opts.retryCount
+	case !opts.justID:
+		n.deliveryCount++
+	}
+	return n, false
+}
+
+func claimReply(s *stream, ids []streamID, justID bool) resp.RespType {
+	if justID {
+		arr := &resp.RespBulkStrArr{}
+		for _, id := range ids {
+			arr.Append(id.bytes())
+		}
+		return arr
+	}
+	arr := &resp.Array{}
+	for _, id := range ids {
+		e, _ := s.log.get(id)
+		arr.Append(streamEntryReply(e))
+	}
+	return arr
+}
+
+func execXClaim(db kVStore, args [][]byte) resp.RespType {
+	key, groupName := string(args[0]), string(args[1])
+	minIdle, err := strconv.ParseInt(string(args[3]), 10, 64)
+	if err != nil {
+		return resp.MakeErr("ERR Invalid min-idle-time argument for XCLAIM")
+	}
+	minIdle = max(minIdle, 0)
+
+	now := time.Now()
+	opts := &claimOptions{deliveryTime: now}
+
+	i := 4
+	var ids []streamID
+	for ; i < len(args); i++ {
+		id, ok := parseStreamID(args[i], 0)
+		if !ok {
+			break
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return invalidStreamIDErr()
+	}
+
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		switch opt {
+		case "FORCE":
+			opts.force = true
+			continue
+		case "JUSTID":
+			opts.justID = true
+			continue
+		}
+		if i+1 >= len(args) {
+			return resp.SyntaxErr()
+		}
+		i++
+		switch opt {
+		case "IDLE", "TIME", "RETRYCOUNT":
+			v, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				return resp.NotInErr()
+			}
+			switch opt {
+			case "IDLE":
+				opts.deliveryTime = now.Add(-time.Duration(v) * time.Millisecond)
+			case "TIME":
+				opts.deliveryTime = time.UnixMilli(v)
+			default:
+				opts.retryCount = v
+				opts.hasRetry = true
+			}
+		case "LASTID":
+			id, ok := parseStreamID(args[i], 0)
+			if !ok {
+				return invalidStreamIDErr()
+			}
+			opts.lastID = &id
+		default:
+			return resp.MakeErr(fmt.Sprintf("ERR Unrecognized XCLAIM option '%s'", args[i-1]))
+		}
+	}
+	if opts.deliveryTime.After(now) {
+		opts.deliveryTime = now
+	}
+
+	s, g, errReply := lookupGroup(db, key, groupName)
+	if errReply != nil {
+		return errReply
+	}
+
+	db.propagate()
+	if opts.lastID != nil && g.lastID.less(*opts.lastID) {
+		g.lastID = *opts.lastID
+		db.propagate(cmdArgv("xgroup", []byte("SETID"), args[0], args[1], g.lastID.bytes()))
+	}
+
+	c := claimingConsumer(db, g, args)
+	c.seenTime = now
+
+	var claimed []streamID
+	for _, id := range ids {
+		n, gone := g.claim(s, id, c, minIdle, opts, now)
+		if n != nil {
+			claimed = append(claimed, id)
+		}
+		propagateClaim(db, args, n, gone, id)
+	}
+	return claimReply(s, claimed, opts.justID)
+}
+
+// claimingConsumer returns the consumer given to XCLAIM and XAUTOCLAIM,
+// creating it if needed
+func claimingConsumer(db kVStore, g *consumerGroup, args [][]byte) *streamConsumer {
+	if c := g.consumer(string(args[2]), false); c != nil {
+		return c
+	}
+	db.propagate(cmdArgv("xgroup", []byte("CREATECONSUMER"), args[0], args[1], args[2]))
+	return g.consumer(string(args[2]), true)
+}
+
+// propagateClaim logs the outcome of claiming id as a forced XCLAIM with the
+// delivery time and count it ended up with, so the idle check isn't redone
+// on replay. args are the arguments of the claiming command.
+func propagateClaim(db kVStore, args [][]byte, n *streamNACK, gone bool, id streamID) {
+	if gone {
+		db.propagate(cmdArgv("xack", args[0], args[1], id.bytes()))
+		return
+	}
+	if n == nil {
+		return
+	}
+	db.propagate(cmdArgv("xclaim", args[0], args[1], args[2], []byte("0"), id.bytes(),
+		[]byte("TIME"), []byte(strconv.FormatInt(n.deliveryTime.UnixMilli(), 10)),
+		[]byte("RETRYCOUNT"), []byte(strconv.FormatInt(n.deliveryCount, 10)),
+		[]byte("FORCE"), []byte("JUSTID"),
+	))
+}
+
+func execXAutoClaim(db kVStore, args [][]byte) resp.RespType {
+	key, groupName := string(args[0]), string(args[1])
+	minIdle, err := strconv.ParseInt(string(args[3]), 10, 64)
+	if err != nil {
+		return resp.MakeErr("ERR Invalid min-idle-time argument for XAUTOCLAIM")
+	}
+	minIdle = max(minIdle, 0)
+
+	start, ok := parseRangeID(args[4], true)
+	if !ok {
+		return invalidStreamIDErr()
+	}
+
+	now := time.Now()
+	opts := &claimOptions{deliveryTime: now}
+	count := 100
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "JUSTID":
+			opts.justID = true
+		case "COUNT":
+			if i+1 >= len(args) {
+				return resp.SyntaxErr()
+			}
+			i++
+			c, ok := parseIndex(args[i])
+			if !ok || c < 1 {
+				return resp.MakeErr("ERR COUNT must be > 0")
+			}
+			count = c
+		default:
+			return resp.SyntaxErr()
+		}
+	}
+
+	s, g, errReply := lookupGroup(db, key, groupName)
+	if errReply != nil {
+		return errReply
+	}
+
+	db.propagate()
+	c := claimingConsumer(db, g, args)
+	c.seenTime = now
+
+	// like redis, bound the work done in a single call to count*10 entries
+	attempts := count * 10
+	var claimed []streamID
+	deleted := &resp.RespBulkStrArr{}
+	i, _ := g.findPending(start)
+	for attempts > 0 && len(claimed) < count && i < len(g.pel) {
+		id := g.pel[i].id
+		attempts--
+		n, gone := g.claim(s, id, c, minIdle, opts, now)
+		propagateClaim(db, args, n, gone, id)
+		if gone {
+			// the entry left the PEL, i already points at the next one
+			deleted.Append(id.bytes())
+			continue
+		}
+		if n != nil {
+			claimed = append(claimed, id)
+		}
+		i++
+	}
+
+	next := minStreamID
+	if i < len(g.pel) {
+		next = g.pel[i].id
+	}
+
+	return &resp.Array{
+		Elems: []resp.RespType{
+			&resp.BulkStr{Data: next.bytes()},
+			claimReply(s, claimed, opts.justID),
+			deleted,
+		},
+	}
+}
+
+func init() {
+	registerCommand("xgroup", -2, cmdWrite, execXGroup).withKeys(2, 2, 1)
+	registerCommand("xreadgroup", -7, cmdWrite, execXReadGroup).withGetKeys(streamsKeys)
+	registerCommand("xack", -4, cmdWrite|cmdFreesMemory, execXAck)
+	registerCommand("xpending", -3, cmdReadOnly, execXPending)
+	registerCommand("xclaim", -6, cmdWrite, execXClaim)
+	registerCommand("xautoclaim", -6, cmdWrite, execXAutoClaim)
+}
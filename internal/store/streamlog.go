@@ -0,0 +1,276 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maximum number of entries held by a single stream chunk
+const streamChunkSize = 128
+
+type streamID struct {
+	ms  uint64
+	seq uint64
+}
+
+var (
+	minStreamID = streamID{}
+	maxStreamID = streamID{ms: math.MaxUint64, seq: math.MaxUint64}
+)
+
+func (id streamID) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+func (id streamID) bytes() []byte {
+	return []byte(id.String())
+}
+
+func (id streamID) compare(other streamID) int {
+	switch {
+	case id.ms < other.ms:
+		return -1
+	case id.ms > other.ms:
+		return 1
+	case id.seq < other.seq:
+		return -1
+	case id.seq > other.seq:
+		return 1
+	}
+	return 0
+}
+
+func (id streamID) less(other streamID) bool {
+	return id.compare(other) < 0
+}
+
+// incr returns the smallest ID greater than id, false on overflow
+func (id streamID) incr() (streamID, bool) {
+	if id.seq == math.MaxUint64 {
+		if id.ms == math.MaxUint64 {
+			return id, false
+		}
+		return streamID{ms: id.ms + 1}, true
+	}
+	return streamID{ms: id.ms, seq: id.seq + 1}, true
+}
+
+// decr returns the greatest ID smaller than id, false on underflow
+func (id streamID) decr() (streamID, bool) {
+	if id.seq == 0 {
+		if id.ms == 0 {
+			return id, false
+		}
+		return streamID{ms: id.ms - 1, seq: math.MaxUint64}, true
+	}
+	return streamID{ms: id.ms, seq: id.seq - 1}, true
+}
+
+// parseStreamID parses "ms-seq". When the sequence is omitted it's filled
+// with missingSeq, which lets range starts and ends pick 0 or the maximum.
+func parseStreamID(raw []byte, missingSeq uint64) (streamID, bool) {
+	s := string(raw)
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return streamID{}, false
+	}
+	if !hasSeq {
+		return streamID{ms: ms, seq: missingSeq}, true
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return streamID{}, false
+	}
+	return streamID{ms: ms, seq: seq}, true
+}
+
+type streamEntry struct {
+	id streamID
+	// field value pairs, flattened
+	fields [][]byte
+}
+
+type streamChunk struct {
+	entries []*streamEntry
+}
+
+func (c *streamChunk) first() streamID {
+	return c.entries[0].id
+}
+
+// streamLog is an append-only log of entries ordered by ID. Entries are kept
+// in bounded chunks, so appends and trims from the head only touch the
+// chunks at the ends and lookups are two binary searches.
+type streamLog struct {
+	chunks []*streamChunk
+	length int
+}
+
+func (l *streamLog) append(e *streamEntry) {
+	n := len(l.chunks)
+	if n == 0 || len(l.chunks[n-1].entries) >= streamChunkSize {
+		l.chunks = append(l.chunks, &streamChunk{
+			entries: make([]*streamEntry, 0, streamChunkSize),
+		})
+		n++
+	}
+	c := l.chunks[n-1]
+	c.entries = append(c.entries, e)
+	l.length++
+}
+
+// seek returns the position of the first entry with an ID >= id
+func (l *streamLog) seek(id streamID) (chunk int, off int) {
+	chunk, found := slices.BinarySearchFunc(l.chunks, id, func(c *streamChunk, id streamID) int {
+		return c.first().compare(id)
+	})
+	if found {
+		return chunk, 0
+	}
+	// the entry is in the previous chunk, if any
+	if chunk == 0 {
+		return 0, 0
+	}
+	chunk--
+	off, _ = slices.BinarySearchFunc(l.chunks[chunk].entries, id, func(e *streamEntry, id streamID) int {
+		return e.id.compare(id)
+	})
+	if off == len(l.chunks[chunk].entries) {
+		return chunk + 1, 0
+	}
+	return chunk, off
+}
+
+func (l *streamLog) get(id streamID) (*streamEntry, bool) {
+	chunk, off := l.seek(id)
+	if chunk >= len(l.chunks) {
+		return nil, false
+	}
+	e := l.chunks[chunk].entries[off]
+	return e, e.id == id
+}
+
+// delete removes the entry with the given ID, returns false if it does not exist
+func (l *streamLog) delete(id streamID) bool {
+	chunk, off := l.seek(id)
+	if chunk >= len(l.chunks) || l.chunks[chunk].entries[off].id != id {
+		return false
+	}
+	c := l.chunks[chunk]
+	c.entries = slices.Delete(c.entries, off, off+1)
+	if len(c.entries) == 0 {
+		l.chunks = slices.Delete(l.chunks, chunk, chunk+1)
+	}
+	l.length--
+	return true
+}
+
+// iter walks the entries within [start, end] in ascending order until fn
+// returns false
+func (l *streamLog) iter(start, end streamID, fn func(e *streamEntry) bool) {
+	chunk, off := l.seek(start)
+	for ; chunk < len(l.chunks); chunk, off = chunk+1, 0 {
+		for _, e := range l.chunks[chunk].entries[off:] {
+			if end.less(e.id) {
+				return
+			}
+			if !fn(e) {
+				return
+			}
+		}
+	}
+}
+
+// iterReverse walks the entries within [start, end] in descending order
+// until fn returns false
+func (l *streamLog) iterReverse(start, end streamID, fn func(e *streamEntry) bool) {
+	chunk, off := l.seek(end)
+	// seek points at the first entry >= end, step back if it's past end
+	if chunk >= len(l.chunks) || end.less(l.chunks[chunk].entries[off].id) {
+		if off > 0 {
+			off--
+		} else {
+			chunk--
+			if chunk < 0 {
+				return
+			}
+			off = len(l.chunks[chunk].entries) - 1
+		}
+	}
+
+	for ; chunk >= 0; chunk-- {
+		entries := l.chunks[chunk].entries
+		if off < 0 {
+			off = len(entries) - 1
+		}
+		for ; off >= 0; off-- {
+			e := entries[off]
+			if e.id.less(start) {
+				return
+			}
+			if !fn(e) {
+				return
+			}
+		}
+	}
+}
+
+func (l *streamLog) firstEntry() *streamEntry {
+	if len(l.chunks) == 0 {
+		return nil
+	}
+	return l.chunks[0].entries[0]
+}
+
+func (l *streamLog) lastEntry() *streamEntry {
+	if len(l.chunks) == 0 {
+		return nil
+	}
+	c := l.chunks[len(l.chunks)-1]
+	return c.entries[len(c.entries)-1]
+}
+
+// trim deletes entries from the head while remove returns true for them.
+// With approx set only whole chunks are deleted, limit caps the number of
+// deleted entries when it's positive. Returns the number of deleted entries.
+func (l *streamLog) trim(remove func(e *streamEntry, remaining int) bool, approx bool, limit int) int {
+	deleted := 0
+	for len(l.chunks) > 0 {
+		c := l.chunks[0]
+
+		if approx {
+			last := c.entries[len(c.entries)-1]
+			if !remove(last, l.length-len(c.entries)+1) {
+				break
+			}
+			if limit > 0 && deleted+len(c.entries) > limit {
+				break
+			}
+			deleted += len(c.entries)
+			l.length -= len(c.entries)
+			l.chunks = l.chunks[1:]
+			continue
+		}
+
+		n := 0
+		for n < len(c.entries) && remove(c.entries[n], l.length-n) {
+			if limit > 0 && deleted+n >= limit {
+				break
+			}
+			n++
+		}
+		deleted += n
+		l.length -= n
+		if n < len(c.entries) {
+			c.entries = slices.Delete(c.entries, 0, n)
+			break
+		}
+		l.chunks = l.chunks[1:]
+	}
+	return deleted
+}
@@ -0,0 +1,294 @@
+package store
+
+import (
+	"bytes"
+	"math/big"
+	"slices"
+	"strconv"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+// Strings are stored as []byte, the arguments of the commands storing them
+// are kept as is. The commands modifying part of a string first copy it
+// to a buffer of its own, the argument may be in a pending log, and write
+// that one in place from then on. Replies are serialized once the locks
+// are released, so the commands replying with such a string reply with a
+// copy.
+
+// checkStringLength refuses strings longer than the longest bulk string
+// a client may send
+func checkStringLength(size int64) *resp.RespErr {
+	if size > resp.MAX_BULK_SIZE {
+		return resp.MakeErr("ERR string exceeds maximum allowed size (proto-max-bulk-len)")
+	}
+	return nil
+}
+
+// storeString stores val at key, d being the entity there or nil when the
+// key is missing. The TTL is kept.
+func storeString(db kVStore, key string, d *dataEntity, val []byte) {
+	if d == nil {
+		db.put(key, &dataEntity{typ: typeString, val: val})
+		return
+	}
+	d.val, d.owned = val, false
+}
+
+// writableString returns the string at key to be written in place, zero
+// padded to size bytes when it's shorter. d is the entity at key, the key
+// is created when it's nil.
+func writableString(db kVStore, key string, d *dataEntity, size int64) []byte {
+	if d == nil {
+		d = &dataEntity{typ: typeString, val: []byte{}, owned: true}
+		db.put(key, d)
+	}
+	buf := d.val.([]byte)
+	switch n := int(size) - len(buf); {
+	case !d.owned:
+		next := make([]byte, max(len(buf), int(size)))
+		copy(next, buf)
+		buf = next
+	case n > 0:
+		buf = slices.Grow(buf, n)[:size]
+		clear(buf[size-int64(n):])
+	}
+	d.val, d.owned = buf, true
+	return buf
+}
+
+// stringReply returns val, part of the string of d, to reply with. A
+// string of its own may be written once the lock is released, it's
+// copied.
+func stringReply(d *dataEntity, val []byte) []byte {
+	if d.owned {
+		return bytes.Clone(val)
+	}
+	return val
+}
+
+func execMGet(db kVStore, args [][]byte) resp.RespType {
+	result := &resp.Array{}
+	for _, k := range args {
+		d, ok := db.get(string(k))
+		if !ok || d.typ != typeString {
+			result.Append(&resp.BulkStr{Data: nil})
+			continue
+		}
+		result.Append(&resp.BulkStr{Data: stringReply(d, d.val.([]byte))})
+	}
+	return result
+}
+
+func execMSet(db kVStore, args [][]byte) resp.RespType {
+	if len(args)%2 != 0 {
+		return resp.ArgNumErr("mset")
+	}
+	for i := 0; i < len(args); i += 2 {
+		key := string(args[i])
+		db.put(key, &dataEntity{typ: typeString, val: args[i+1]})
+		db.persist(key)
+	}
+	return resp.OkReply()
+}
+
+// execMSetNX sets the keys only if none of them exists. Their shards are
+// all locked, no other command sees some of them set.
+func execMSetNX(db kVStore, args [][]byte) resp.RespType {
+	if len(args)%2 != 0 {
+		return resp.ArgNumErr("msetnx")
+	}
+	for i := 0; i < len(args); i += 2 {
+		if _, ok := db.get(string(args[i])); ok {
+			return &resp.Intiger{Data: 0}
+		}
+	}
+	for i := 0; i < len(args); i += 2 {
+		db.put(string(args[i]), &dataEntity{typ: typeString, val: args[i+1]})
+	}
+	return &resp.Intiger{Data: 1}
+}
+
+func execSetNX(db kVStore, args [][]byte) resp.RespType {
+	entity := &dataEntity{typ: typeString, val: args[1]}
+	return &resp.Intiger{Data: int64(db.putIfAbsent(string(args[0]), entity))}
+}
+
+func execSetEx(db kVStore, args [][]byte) resp.RespType {
+	ms, errReply := parseExpire(args[1], "EX", "setex", true)
+	if errReply != nil {
+		return errReply
+	}
+	return setGeneric(db, string(args[0]), args[2], "", "EX", ms, false)
+}
+
+func execPSetEx(db kVStore, args [][]byte) resp.RespType {
+	ms, errReply := parseExpire(args[1], "PX", "psetex", true)
+	if errReply != nil {
+		return errReply
+	}
+	return setGeneric(db, string(args[0]), args[2], "", "PX", ms, false)
+}
+
+func execGetSet(db kVStore, args [][]byte) resp.RespType {
+	return setGeneric(db, string(args[0]), args[1], "", "", 0, true)
+}
+
+func execGetDel(db kVStore, args [][]byte) resp.RespType {
+	key := string(args[0])
+	d, errReply := lookupTyped(db, key, typeString)
+	if errReply != nil {
+		return errReply
+	}
+	if d == nil {
+		return &resp.BulkStr{Data: nil}
+	}
+	db.remove(key)
+	return &resp.BulkStr{Data: d.val.([]byte)}
+}
+
+func execStrLen(db kVStore, args [][]byte) resp.RespType {
+	d, errReply := lookupTyped(db, string(args[0]), typeString)
+	if errReply != nil {
+		return errReply
+	}
+	if d == nil {
+		return &resp.Intiger{Data: 0}
+	}
+	return &resp.Intiger{Data: int64(len(d.val.([]byte)))}
+}
+
+func execAppend(db kVStore, args [][]byte) resp.RespType {
+	key := string(args[0])
+	d, errReply := lookupTyped(db, key, typeString)
+	if errReply != nil {
+		return errReply
+	}
+	if d == nil {
+		db.put(key, &dataEntity{typ: typeString, val: args[1]})
+		return &resp.Intiger{Data: int64(len(args[1]))}
+	}
+
+	n := len(d.val.([]byte))
+	if errReply := checkStringLength(int64(n) + int64(len(args[1]))); errReply != nil {
+		return errReply
+	}
+	buf := writableString(db, key, d, int64(n+len(args[1])))
+	copy(buf[n:], args[1])
+	return &resp.Intiger{Data: int64(len(buf))}
+}
+
+// execGetRange returns the substring between two inclusive offsets,
+// negative ones counting from the end
+func execGetRange(db kVStore, args [][]byte) resp.RespType {
+	start, err1 := strconv.ParseInt(string(args[1]), 10, 64)
+	end, err2 := strconv.ParseInt(string(args[2]), 10, 64)
+	if err1 != nil || err2 != nil {
+		return resp.NotInErr()
+	}
+	d, errReply := lookupTyped(db, string(args[0]), typeString)
+	if errReply != nil {
+		return errReply
+	}
+	if d == nil {
+		return &resp.BulkStr{Data: []byte{}}
+	}
+
+	val := d.val.([]byte)
+	n := int64(len(val))
+	if start < 0 && end < 0 && start > end {
+		return &resp.BulkStr{Data: []byte{}}
+	}
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if end < 0 {
+		end = max(n+end, 0)
+	}
+	end = min(end, n-1)
+	if start > end || n == 0 {
+		return &resp.BulkStr{Data: []byte{}}
+	}
+	return &resp.BulkStr{Data: stringReply(d, val[start:end+1])}
+}
+
+// execSetRange overwrites the string from offset on, padding it with
+// zero bytes when it's shorter than offset
+func execSetRange(db kVStore, args [][]byte) resp.RespType {
+	key, val := string(args[0]), args[2]
+	offset, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return resp.NotInErr()
+	}
+	if offset < 0 {
+		return resp.MakeErr("ERR offset is out of range")
+	}
+	d, errReply := lookupTyped(db, key, typeString)
+	if errReply != nil {
+		return errReply
+	}
+
+	var cur []byte
+	if d != nil {
+		cur = d.val.([]byte)
+	}
+	if len(val) == 0 {
+		// nothing to write, a missing key isn't created
+		return &resp.Intiger{Data: int64(len(cur))}
+	}
+	if errReply := checkStringLength(offset + int64(len(val))); errReply != nil {
+		return errReply
+	}
+
+	buf := writableString(db, key, d, offset+int64(len(val)))
+	copy(buf[offset:], val)
+	return &resp.Intiger{Data: int64(len(buf))}
+}
+
+// execIncrByFloat adds a float to the value at key, formatted like redis
+// formats its long doubles. It's logged as a SET of the result, so a
+// replay doesn't depend on the precision of the replica.
+func execIncrByFloat(db kVStore, args [][]byte) resp.RespType {
+	key := string(args[0])
+	incr, ok := parseLongDouble(args[1])
+	if !ok {
+		return resp.NotFloatErr()
+	}
+	d, errReply := lookupTyped(db, key, typeString)
+	if errReply != nil {
+		return errReply
+	}
+
+	cur := new(big.Float).SetPrec(longDoublePrec)
+	if d != nil {
+		cur, ok = parseLongDouble(d.val.([]byte))
+		if !ok {
+			return resp.NotFloatErr()
+		}
+	}
+	sum, ok := incrByFloat(cur, incr)
+	if !ok {
+		return resp.MakeErr("ERR increment would produce NaN or Infinity")
+	}
+
+	val := formatLongDouble(sum)
+	storeString(db, key, d, val)
+	db.propagate(cmdArgv("set", []byte(key), val, []byte("KEEPTTL")))
+	return &resp.BulkStr{Data: val}
+}
+
+func init() {
+	registerCommand("mget", -2, cmdReadOnly, execMGet).withKeys(1, -1, 1)
+	registerCommand("mset", -3, cmdWrite, execMSet).withKeys(1, -1, 2)
+	registerCommand("msetnx", -3, cmdWrite, execMSetNX).withKeys(1, -1, 2)
+	registerCommand("setnx", 3, cmdWrite, execSetNX)
+	registerCommand("setex", 4, cmdWrite, execSetEx)
+	registerCommand("psetex", 4, cmdWrite, execPSetEx)
+	registerCommand("getset", 3, cmdWrite, execGetSet)
+	registerCommand("getdel", 2, cmdWrite|cmdFreesMemory, execGetDel)
+	registerCommand("strlen", 2, cmdReadOnly, execStrLen)
+	registerCommand("append", 3, cmdWrite, execAppend)
+	registerCommand("getrange", 4, cmdReadOnly, execGetRange)
+	registerCommand("setrange", 4, cmdWrite, execSetRange)
+	registerCommand("incrbyfloat", 3, cmdWrite, execIncrByFloat)
+}
@@ -0,0 +1,182 @@
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+	"github.com/myselfBZ/go-redis-clone/pkg/utils"
+)
+
+func TestExecString(t *testing.T) {
+	testDb.mu.Lock()
+	defer testDb.mu.Unlock()
+
+	key := utils.RandString(defaultKeyLength)
+	other := utils.RandString(defaultKeyLength)
+	float := utils.RandString(defaultKeyLength)
+	listKey := utils.RandString(defaultKeyLength)
+	testDb.put(listKey, &dataEntity{typ: typeList, val: newQuicklist()})
+
+	tests := []struct {
+		suite
+		exec execCmd
+	}{
+		{suite{"APPEND new key", &resp.Intiger{Data: 5}, toBytes(key, "Hello")}, execAppend},
+		{suite{"APPEND", &resp.Intiger{Data: 11}, toBytes(key, " World")}, execAppend},
+		{suite{"STRLEN", &resp.Intiger{Data: 11}, toBytes(key)}, execStrLen},
+		{suite{"STRLEN missing key", &resp.Intiger{Data: 0}, toBytes(other)}, execStrLen},
+		{suite{"GETRANGE", &resp.BulkStr{Data: []byte("Hello")}, toBytes(key, "0", "4")}, execGetRange},
+		{suite{"GETRANGE negative", &resp.BulkStr{Data: []byte("orld")}, toBytes(key, "-4", "-1")}, execGetRange},
+		{suite{"GETRANGE past the end", &resp.BulkStr{Data: []byte("World")}, toBytes(key, "6", "100")}, execGetRange},
+		{suite{"GETRANGE start after end", &resp.BulkStr{Data: []byte("")}, toBytes(key, "5", "2")}, execGetRange},
+		{suite{"GETRANGE negative start after end", &resp.BulkStr{Data: []byte("")}, toBytes(key, "-1", "-5")}, execGetRange},
+		{suite{"SETRANGE", &resp.Intiger{Data: 11}, toBytes(key, "6", "Redis")}, execSetRange},
+		{suite{"SETRANGE wrote", &resp.BulkStr{Data: []byte("Hello Redis")}, toBytes(key)}, execGet},
+		{suite{"SETRANGE pads with zeroes", &resp.Intiger{Data: 5}, toBytes(other, "3", "ab")}, execSetRange},
+		{suite{"SETRANGE padded", &resp.BulkStr{Data: []byte("\x00\x00\x00ab")}, toBytes(other)}, execGet},
+		{suite{"SETRANGE empty value", &resp.Intiger{Data: 0}, toBytes("missing", "10", "")}, execSetRange},
+		{suite{"SETRANGE negative offset", resp.MakeErr("ERR offset is out of range"), toBytes(key, "-1", "a")}, execSetRange},
+		{suite{"SETRANGE past 512MB", resp.MakeErr("ERR string exceeds maximum allowed size (proto-max-bulk-len)"), toBytes(key, "536870911", "ab")}, execSetRange},
+		{suite{"GETSET", &resp.BulkStr{Data: []byte("Hello Redis")}, toBytes(key, "new")}, execGetSet},
+		{suite{"GETDEL", &resp.BulkStr{Data: []byte("new")}, toBytes(key)}, execGetDel},
+		{suite{"GETDEL deleted", &resp.BulkStr{Data: nil}, toBytes(key)}, execGetDel},
+		{suite{"SETNX", &resp.Intiger{Data: 1}, toBytes(key, "v")}, execSetNX},
+		{suite{"SETNX existing key", &resp.Intiger{Data: 0}, toBytes(key, "w")}, execSetNX},
+		{suite{"SETEX", resp.OkReply(), toBytes(key, "100", "v")}, execSetEx},
+		{suite{"TTL after SETEX", &resp.Intiger{Data: 100}, toBytes(key)}, execTtl},
+		{suite{"SETEX zero", resp.MakeErr("ERR invalid expire time in 'setex' command"), toBytes(key, "0", "v")}, execSetEx},
+		{suite{"PSETEX", resp.OkReply(), toBytes(key, "5000", "v")}, execPSetEx},
+		{suite{"TTL after PSETEX", &resp.Intiger{Data: 5}, toBytes(key)}, execTtl},
+		{suite{"GETSET drops the TTL", &resp.BulkStr{Data: []byte("v")}, toBytes(key, "v")}, execGetSet},
+		{suite{"TTL after GETSET", &resp.Intiger{Data: -1}, toBytes(key)}, execTtl},
+
+		{suite{"INCRBYFLOAT new key", &resp.BulkStr{Data: []byte("10.5")}, toBytes(float, "10.5")}, execIncrByFloat},
+		{suite{"INCRBYFLOAT", &resp.BulkStr{Data: []byte("10.6")}, toBytes(float, "0.1")}, execIncrByFloat},
+		{suite{"INCRBYFLOAT negative", &resp.BulkStr{Data: []byte("5.6")}, toBytes(float, "-5")}, execIncrByFloat},
+		{suite{"INCRBYFLOAT to an integer", &resp.BulkStr{Data: []byte("6")}, toBytes(float, "0.4")}, execIncrByFloat},
+		{suite{"INCRBYFLOAT exponent", &resp.BulkStr{Data: []byte("5006")}, toBytes(float, "5.0e3")}, execIncrByFloat},
+		{suite{"INCRBYFLOAT invalid increment", resp.NotFloatErr(), toBytes(float, "abc")}, execIncrByFloat},
+		{suite{"INCRBYFLOAT on a string", resp.NotFloatErr(), toBytes(other, "1")}, execIncrByFloat},
+		{suite{"INCRBYFLOAT to infinity", resp.MakeErr("ERR increment would produce NaN or Infinity"), toBytes(float, "1e5000")}, execIncrByFloat},
+
+		{suite{"MSET odd arguments", resp.ArgNumErr("mset"), toBytes("a", "1", "b")}, execMSet},
+		{suite{"MSETNX odd arguments", resp.ArgNumErr("msetnx"), toBytes("a")}, execMSetNX},
+		{suite{"MGET", entries(&resp.BulkStr{Data: []byte("5006")}, &resp.BulkStr{Data: nil}, &resp.BulkStr{Data: nil}), toBytes(float, "missing", listKey)}, execMGet},
+
+		{suite{"APPEND on a list", resp.WrongTypeErr(), toBytes(listKey, "a")}, execAppend},
+		{suite{"GETRANGE on a list", resp.WrongTypeErr(), toBytes(listKey, "0", "1")}, execGetRange},
+		{suite{"GETDEL on a list", resp.WrongTypeErr(), toBytes(listKey)}, execGetDel},
+	}
+
+	for _, test := range tests {
+		rep := test.exec(testDb, test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+}
+
+func TestMSet(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+	mustExec(t, s, "SET", "a", "old", "EX", "100")
+
+	tests := []suite{
+		{"MSET", resp.OkReply(), toBytes("MSET", "a", "1", "b", "2")},
+		{"MSET drops the TTL", &resp.Intiger{Data: -1}, toBytes("TTL", "a")},
+		{"MSETNX with an existing key", &resp.Intiger{Data: 0}, toBytes("MSETNX", "c", "3", "a", "x")},
+		{"MSETNX set nothing", &resp.Intiger{Data: 0}, toBytes("EXISTS", "c")},
+		{"MSETNX", &resp.Intiger{Data: 1}, toBytes("MSETNX", "c", "3", "d", "4")},
+		{"MGET", bulkArr("1", "2", "3", "4"), toBytes("MGET", "a", "b", "c", "d")},
+	}
+	for _, test := range tests {
+		rep, _ := s.Exec(test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+}
+
+// MGET never sees part of the keys of an MSETNX set
+func TestMSetNXAtomic(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+
+	const rounds = 200
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			a, b := fmt.Sprintf("a%d", i), fmt.Sprintf("b%d", i)
+			s.Exec(toBytes("MSETNX", a, "1", b, "1"))
+		}
+	}()
+
+	for i := 0; i < rounds; i++ {
+		a, b := fmt.Sprintf("a%d", i), fmt.Sprintf("b%d", i)
+		rep := string(mustExec(t, s, "MGET", a, b).ToBytes())
+		if strings.Count(rep, "$-1") == 1 {
+			t.Fatalf("MGET saw half of an MSETNX: %q", rep)
+		}
+	}
+	wg.Wait()
+}
+
+func TestAOFIncrByFloat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	s := openTestAOF(t, path, FsyncAlways)
+	mustExec(t, s, "SET", "f", "1", "EX", "100")
+	mustExec(t, s, "INCRBYFLOAT", "f", "0.1")
+	mustExec(t, s, "APPEND", "s", "ab")
+	mustExec(t, s, "APPEND", "s", "cd")
+	mustExec(t, s, "SETRANGE", "s", "6", "ef")
+	s.Close()
+
+	s = openTestAOF(t, path, FsyncNo)
+	defer s.Close()
+	tests := []suite{
+		{"INCRBYFLOAT", &resp.BulkStr{Data: []byte("1.1")}, toBytes("GET", "f")},
+		{"INCRBYFLOAT keeps the TTL", &resp.Intiger{Data: 100}, toBytes("TTL", "f")},
+		{"APPEND and SETRANGE", &resp.BulkStr{Data: []byte("abcd\x00\x00ef")}, toBytes("GET", "s")},
+	}
+	for _, test := range tests {
+		rep, _ := s.Exec(test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+}
+
+func TestStringInPlace(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+
+	// the value shares its backing array with the next argument, like the
+	// arguments of a parsed command
+	buf := []byte("SETvalnext")
+	if _, err := s.Exec([][]byte{buf[:3], []byte("k"), buf[3:6]}); err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, s, "APPEND", "k", "!!")
+	if string(buf) != "SETvalnext" {
+		t.Fatalf("APPEND wrote over the arguments of SET: %q", buf)
+	}
+
+	get := mustExec(t, s, "GET", "k")
+	getRange := mustExec(t, s, "GETRANGE", "k", "0", "2")
+	mustExec(t, s, "SETRANGE", "k", "0", "XYZ")
+	mustExec(t, s, "APPEND", "k", "?")
+	if string(get.ToBytes()) != "$5\r\nval!!\r\n" || string(getRange.ToBytes()) != "$3\r\nval\r\n" {
+		t.Fatalf("replies changed by later writes: %q %q", get.ToBytes(), getRange.ToBytes())
+	}
+	if rep := mustExec(t, s, "GET", "k"); string(rep.ToBytes()) != "$6\r\nXYZ!!?\r\n" {
+		t.Fatalf("GET: %q", rep.ToBytes())
+	}
+}
@@ -1,5 +1,132 @@
 package store
 
+import (
+	"sync/atomic"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+type valueType uint8
+
+// typeString is the zero value, entities created without a tag are strings
+const (
+	typeString valueType = iota
+	typeList
+	typeHash
+	typeSet
+	typeZset
+	typeStream
+)
+
+func (t valueType) String() string {
+	switch t {
+	case typeList:
+		return "list"
+	case typeHash:
+		return "hash"
+	case typeSet:
+		return "set"
+	case typeZset:
+		return "zset"
+	case typeStream:
+		return "stream"
+	}
+	return "string"
+}
+
+type encoding uint8
+
+const (
+	encRaw encoding = iota
+	encInt
+	encQuicklist
+	encHashtable
+	encIntset
+	encSkiplist
+	encStream
+)
+
+func (e encoding) String() string {
+	switch e {
+	case encInt:
+		return "int"
+	case encQuicklist:
+		return "quicklist"
+	case encHashtable:
+		return "hashtable"
+	case encIntset:
+		return "intset"
+	case encSkiplist:
+		return "skiplist"
+	case encStream:
+		return "stream"
+	}
+	return "raw"
+}
+
+// dataEntity is a value stored under a key. typ tells which concrete type
+// val holds:
+//
+//	typeString -> []byte
+//	typeList   -> *quicklist
+//	typeHash   -> hash
+//	typeSet    -> *set
+//	typeZset   -> *zset
+//	typeStream -> *stream
 type dataEntity struct {
-	val interface{}
+	typ valueType
+	// the string value is a buffer of its own rather than an argument of
+	// the command that stored it, it may be written in place
+	owned bool
+	val   interface{}
+	// the latest snapshot that has the entity, see unshare
+	snapGen uint64
+	// bytes the entity is counted for in Storage.used, see account
+	mem int64
+	// last access in unix ms and LFU counter, see touch
+	atime atomic.Int64
+	freq  atomic.Uint32
+	// index of the key in the keys of its shard, see shard.set
+	pos int
+}
+
+// encoding reports how the value is laid out in memory. Sets convert from
+// intset to hashtable on their own, so it's derived from the value rather
+// than kept in sync on every write.
+func (d *dataEntity) encoding() encoding {
+	switch v := d.val.(type) {
+	case []byte:
+		if _, ok := parseSetInt(v); ok {
+			return encInt
+		}
+		return encRaw
+	case *quicklist:
+		return encQuicklist
+	case *hash:
+		return encHashtable
+	case *set:
+		if v.isIntset() {
+			return encIntset
+		}
+		return encHashtable
+	case *zset:
+		return encSkiplist
+	case *stream:
+		return encStream
+	}
+	return encRaw
+}
+
+// lookupTyped returns the entity stored at key if it holds a value of type t.
+// If the key holds another type, the returned reply is a WRONGTYPE error.
+// Missing keys yield (nil, nil).
+func lookupTyped(db kVStore, key string, t valueType) (*dataEntity, resp.RespType) {
+	d, ok := db.get(key)
+	if !ok {
+		return nil, nil
+	}
+	if d.typ != t {
+		return nil, resp.WrongTypeErr()
+	}
+	return d, nil
 }
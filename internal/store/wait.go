@@ -0,0 +1,137 @@
+package store
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+// parseWaitTimeout parses the timeout of WAIT and WAITAOF, in
+// milliseconds, zero blocks forever
+func parseWaitTimeout(raw []byte) (time.Duration, *resp.RespErr) {
+	ms, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil {
+		return 0, resp.MakeErr("ERR timeout is not an integer or out of range")
+	}
+	if ms < 0 {
+		return 0, resp.MakeErr("ERR timeout is negative")
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// ackedBy returns the number of replicas that acknowledged the stream up
+// to offset, or that have it on disk when onDisk is set. Must be called
+// with s.mu held.
+func (s *Storage) ackedBy(offset int64, onDisk bool) int64 {
+	n := int64(0)
+	for _, st := range s.repl.replicas {
+		acked := st.ackOffset
+		if onDisk {
+			acked = st.aofAckOffset
+		}
+		if acked >= offset {
+			n++
+		}
+	}
+	return n
+}
+
+// aofSyncedOffset returns the replication offset the AOF has on disk. The
+// parts of the stream that wrote nothing to it, like pings, count as on
+// disk once everything before them is. Must be called with s.mu held.
+func (s *Storage) aofSyncedOffset() int64 {
+	if fsynced := s.aof.fsyncedOffset.Load(); fsynced < s.aof.offset.Load() {
+		return fsynced
+	}
+	return s.repl.offset
+}
+
+// requestAcks asks the replicas for their offset right away rather than
+// on their next periodic acknowledgement. Must be called with s.mu held.
+func (s *Storage) requestAcks() {
+	if len(s.repl.replicas) > 0 {
+		s.replicate([][][]byte{cmdArgv("replconf", []byte("GETACK"), []byte("*"))})
+	}
+}
+
+// execWait blocks until numreplicas replicas acknowledged every write made
+// so far, it replies with the number of replicas that did
+func execWait(db kVStore, args [][]byte) resp.RespType {
+	s := storageOf(db)
+	if s.repl.master != nil {
+		return resp.MakeErr("ERR WAIT cannot be used with replica instances.")
+	}
+	numReplicas, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil {
+		return resp.NotInErr()
+	}
+	timeout, errReply := parseWaitTimeout(args[1])
+	if errReply != nil {
+		return errReply
+	}
+
+	target := s.repl.offset
+	poll := func(timedOut bool) resp.RespType {
+		acked := s.ackedBy(target, false)
+		if acked >= numReplicas || timedOut {
+			return &resp.Intiger{Data: acked}
+		}
+		return nil
+	}
+	if reply := poll(false); reply != nil {
+		return reply
+	}
+	s.requestAcks()
+	return &blockOn{poll: poll, timeout: timeout}
+}
+
+// execWaitAOF blocks until every write made so far is fsynced to the local
+// AOF, if numlocal is set, and to the AOF of numreplicas replicas. It
+// replies with the number of local and replica AOFs that have them.
+func execWaitAOF(db kVStore, args [][]byte) resp.RespType {
+	s := storageOf(db)
+	if s.repl.master != nil {
+		return resp.MakeErr("ERR WAITAOF cannot be used with replica instances.")
+	}
+	numLocal, err1 := strconv.ParseInt(string(args[0]), 10, 64)
+	numReplicas, err2 := strconv.ParseInt(string(args[1]), 10, 64)
+	if err1 != nil || err2 != nil {
+		return resp.NotInErr()
+	}
+	timeout, errReply := parseWaitTimeout(args[2])
+	if errReply != nil {
+		return errReply
+	}
+	if numLocal > 0 && s.aof == nil {
+		return resp.MakeErr("ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled.")
+	}
+
+	target := s.repl.offset
+	poll := func(timedOut bool) resp.RespType {
+		local := int64(0)
+		if s.aof != nil && s.aofSyncedOffset() >= target {
+			local = 1
+		}
+		acked := s.ackedBy(target, true)
+		if (local >= numLocal && acked >= numReplicas) || timedOut {
+			return &resp.Array{Elems: []resp.RespType{
+				&resp.Intiger{Data: local},
+				&resp.Intiger{Data: acked},
+			}}
+		}
+		return nil
+	}
+	if reply := poll(false); reply != nil {
+		return reply
+	}
+	if numReplicas > 0 {
+		s.requestAcks()
+	}
+	return &blockOn{poll: poll, timeout: timeout}
+}
+
+func init() {
+	registerCommand("wait", 3, 0, execWait)
+	registerCommand("waitaof", 4, 0, execWaitAOF)
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+)
+
+func TestWait(t *testing.T) {
+	master := NewStorage()
+	defer master.Close()
+	m := startTestMaster(t, master)
+
+	tests := []suite{
+		{"WAIT for nobody", &resp.Intiger{Data: 0}, toBytes("WAIT", "0", "0")},
+		{"WAIT without replicas", &resp.Intiger{Data: 0}, toBytes("WAIT", "1", "10")},
+		{"WAIT negative timeout", resp.MakeErr("ERR timeout is negative"), toBytes("WAIT", "1", "-1")},
+		{"WAITAOF without AOF", resp.MakeErr("ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled."), toBytes("WAITAOF", "1", "0", "0")},
+	}
+	for _, test := range tests {
+		rep, _ := master.Exec(test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+
+	timedOut := mustBlock(t, master, "WAIT", "1", "20")
+	expectReply(t, timedOut, &resp.Intiger{Data: 0})
+
+	replica := openTestAOF(t, filepath.Join(t.TempDir(), "appendonly.aof"), FsyncAlways)
+	defer replica.Close()
+	host, port, _ := net.SplitHostPort(m.ln.Addr().String())
+	mustExec(t, replica, "REPLICAOF", host, port)
+	waitFor(t, "the link to come up", func() bool { return linkUp(replica) })
+
+	mustExec(t, master, "SET", "k", "v")
+	wait := mustBlock(t, master, "WAIT", "1", "0")
+	expectReply(t, wait, &resp.Intiger{Data: 1})
+
+	mustExec(t, master, "SET", "k", "w")
+	waitAOF := mustBlock(t, master, "WAITAOF", "0", "1", "0")
+	expectReply(t, waitAOF, entries(&resp.Intiger{Data: 0}, &resp.Intiger{Data: 1}))
+
+	if rep := mustExec(t, replica, "WAIT", "0", "0"); !slices.Equal(rep.ToBytes(), resp.MakeErr("ERR WAIT cannot be used with replica instances.").ToBytes()) {
+		t.Fatalf("WAIT ran on a replica: %q", rep.ToBytes())
+	}
+}
+
+func TestWaitAOF(t *testing.T) {
+	s := openTestAOF(t, filepath.Join(t.TempDir(), "appendonly.aof"), FsyncEverysec)
+	defer s.Close()
+
+	mustExec(t, s, "SET", "k", "v")
+	b := mustBlock(t, s, "WAITAOF", "1", "0", "0")
+	expectReply(t, b, entries(&resp.Intiger{Data: 1}, &resp.Intiger{Data: 0}))
+
+	rep := mustExec(t, s, "WAITAOF", "1", "0", "0")
+	if !slices.Equal(rep.ToBytes(), entries(&resp.Intiger{Data: 1}, &resp.Intiger{Data: 0}).ToBytes()) {
+		t.Fatalf("writes already on disk must not block, got %q", rep.ToBytes())
+	}
+}
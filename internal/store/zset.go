@@ -0,0 +1,1126 @@
+package store
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+	"github.com/myselfBZ/go-redis-clone/pkg/utils"
+)
+
+// zset pairs a skiplist ordered by score with a dict for O(1) score lookups
+type zset struct {
+	dict map[string]float64
+	zsl  *skiplist
+	// nil up to scanSmallLen members
+	scan *scanIndex
+}
+
+func newZset() *zset {
+	return &zset{
+		dict: make(map[string]float64),
+		zsl:  newSkiplist(),
+	}
+}
+
+func (zs *zset) len() int {
+	return len(zs.dict)
+}
+
+// add inserts the member or updates its score, returns true if it's a new member
+func (zs *zset) add(member string, score float64) bool {
+	cur, ok := zs.dict[member]
+	if !ok {
+		zs.zsl.insert(score, member)
+		zs.dict[member] = score
+		zs.scan.add(member)
+		zs.scan = growScanIndex(zs.scan, zs.len(), zs.iter)
+		return true
+	}
+	if cur != score {
+		zs.zsl.updateScore(cur, member, score)
+		zs.dict[member] = score
+	}
+	return false
+}
+
+func (zs *zset) remove(member string) bool {
+	score, ok := zs.dict[member]
+	if !ok {
+		return false
+	}
+	zs.zsl.delete(score, member)
+	delete(zs.dict, member)
+	zs.scan.remove(member)
+	return true
+}
+
+// iter calls fn for every member until it returns false
+func (zs *zset) iter(fn func(member string) bool) {
+	for m := range zs.dict {
+		if !fn(m) {
+			return
+		}
+	}
+}
+
+// rank returns the 0 based rank of the member, counting from the highest
+// score if rev is set
+func (zs *zset) rank(member string, rev bool) (int, bool) {
+	score, ok := zs.dict[member]
+	if !ok {
+		return 0, false
+	}
+	r := zs.zsl.rank(score, member)
+	if rev {
+		return zs.len() - r, true
+	}
+	return r - 1, true
+}
+
+// formatScore formats a score the way redis does, integers are printed
+// without an exponent
+func formatScore(score float64) []byte {
+	switch {
+	case math.IsInf(score, 1):
+		return []byte("inf")
+	case math.IsInf(score, -1):
+		return []byte("-inf")
+	case score == math.Trunc(score) && math.Abs(score) < 1<<53:
+		return strconv.AppendInt(nil, int64(score), 10)
+	}
+	return strconv.AppendFloat(nil, score, 'g', -1, 64)
+}
+
+func parseScore(raw []byte) (float64, bool) {
+	f, err := strconv.ParseFloat(string(raw), 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, false
+	}
+	return f, true
+}
+
+// parseScoreRange parses score bounds such as "1", "(1", "-inf" and "+inf"
+func parseScoreRange(minRaw, maxRaw []byte) (*scoreRange, resp.RespType) {
+	r := &scoreRange{}
+	var ok bool
+
+	minStr, maxStr := minRaw, maxRaw
+	if len(minStr) > 0 && minStr[0] == '(' {
+		r.minex = true
+		minStr = minStr[1:]
+	}
+	if len(maxStr) > 0 && maxStr[0] == '(' {
+		r.maxex = true
+		maxStr = maxStr[1:]
+	}
+
+	if r.min, ok = parseScore(minStr); !ok {
+		return nil, resp.MakeErr("ERR min or max is not a float")
+	}
+	if r.max, ok = parseScore(maxStr); !ok {
+		return nil, resp.MakeErr("ERR min or max is not a float")
+	}
+	return r, nil
+}
+
+func parseLexBound(raw []byte) (lexBound, bool) {
+	if len(raw) == 0 {
+		return lexBound{}, false
+	}
+	switch raw[0] {
+	case '-':
+		return lexBound{inf: -1}, len(raw) == 1
+	case '+':
+		return lexBound{inf: 1}, len(raw) == 1
+	case '(':
+		return lexBound{value: string(raw[1:]), exclusive: true}, true
+	case '[':
+		return lexBound{value: string(raw[1:])}, true
+	}
+	return lexBound{}, false
+}
+
+// parseLexRange parses lex bounds such as "[a", "(a", "-" and "+"
+func parseLexRange(minRaw, maxRaw []byte) (*lexRange, resp.RespType) {
+	lo, ok := parseLexBound(minRaw)
+	if !ok {
+		return nil, resp.MakeErr("ERR min or max not valid string range item")
+	}
+	hi, ok := parseLexBound(maxRaw)
+	if !ok {
+		return nil, resp.MakeErr("ERR min or max not valid string range item")
+	}
+	return &lexRange{min: lo, max: hi}, nil
+}
+
+// lookupZset returns the sorted set stored at key. If the key holds another
+// type, the returned reply is a WRONGTYPE error. Missing keys yield (nil, nil).
+func lookupZset(db kVStore, key string) (*zset, resp.RespType) {
+	d, errReply := lookupTyped(db, key, typeZset)
+	if d == nil {
+		return nil, errReply
+	}
+	return d.val.(*zset), nil
+}
+
+func deleteEmptyZset(db kVStore, key string, zs *zset) {
+	if zs.len() == 0 {
+		db.remove(key)
+	}
+}
+
+// storeZset replaces whatever dst holds with zs, or deletes it if zs is empty
+func storeZset(db kVStore, dst string, zs *zset) {
+	db.remove(dst)
+	if zs.len() > 0 {
+		db.put(dst, &dataEntity{typ: typeZset, val: zs})
+	}
+}
+
+func execZAdd(db kVStore, args [][]byte) resp.RespType {
+	key := string(args[0])
+
+	var nx, xx, gt, lt, ch, incr bool
+	i := 1
+flags:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break flags
+		}
+	}
+
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return resp.SyntaxErr()
+	}
+
+	if nx && xx {
+		return resp.IncompOptionsErr("XX", "NX")
+	}
+
+	if (gt && nx) || (lt && nx) || (gt && lt) {
+		return resp.MakeErr("ERR GT, LT, and/or NX options at the same time are not compatible")
+	}
+
+	if incr && len(pairs) > 2 {
+		return resp.MakeErr("ERR INCR option supports a single increment-element pair")
+	}
+
+	scores := make([]float64, len(pairs)/2)
+	for j := range scores {
+		score, ok := parseScore(pairs[2*j])
+		if !ok {
+			return resp.NotFloatErr()
+		}
+		scores[j] = score
+	}
+
+	zs, errReply := lookupZset(db, key)
+	if errReply != nil {
+		return errReply
+	}
+
+	if zs == nil {
+		if xx {
+			if incr {
+				return &resp.BulkStr{Data: nil}
+			}
+			return &resp.Intiger{Data: 0}
+		}
+		zs = newZset()
+		db.put(key, &dataEntity{typ: typeZset, val: zs})
+	}
+
+	added, updated := 0, 0
+	var incrResult []byte
+
+	for j, score := range scores {
+		member := string(pairs[2*j+1])
+		cur, exists := zs.dict[member]
+
+		if exists {
+			if nx {
+				continue
+			}
+			if incr {
+				score += cur
+				if math.IsNaN(score) {
+					deleteEmptyZset(db, key, zs)
+					return resp.MakeErr("ERR resulting score is not a number (NaN)")
+				}
+			}
+			if (gt && score <= cur) || (lt && score >= cur) {
+				continue
+			}
+			if score != cur {
+				zs.add(member, score)
+				updated++
+			}
+		} else {
+			if xx {
+				continue
+			}
+			zs.add(member, score)
+			added++
+		}
+		incrResult = formatScore(score)
+	}
+
+	deleteEmptyZset(db, key, zs)
+
+	if incr {
+		return &resp.BulkStr{Data: incrResult}
+	}
+	if ch {
+		return &resp.Intiger{Data: int64(added + updated)}
+	}
+	return &resp.Intiger{Data: int64(added)}
+}
+
+func execZIncrBy(db kVStore, args [][]byte) resp.RespType {
+	return execZAdd(db, [][]byte{args[0], []byte("INCR"), args[1], args[2]})
+}
+
+func execZRem(db kVStore, args [][]byte) resp.RespType {
+	key := string(args[0])
+	zs, errReply := lookupZset(db, key)
+	if errReply != nil {
+		return errReply
+	}
+	if zs == nil {
+		return &resp.Intiger{Data: 0}
+	}
+
+	removed := 0
+	for _, m := range args[1:] {
+		if zs.remove(string(m)) {
+			removed++
+		}
+	}
+	deleteEmptyZset(db, key, zs)
+	return &resp.Intiger{
+		Data: int64(removed),
+	}
+}
+
+func execZCard(db kVStore, args [][]byte) resp.RespType {
+	zs, errReply := lookupZset(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if zs == nil {
+		return &resp.Intiger{Data: 0}
+	}
+	return &resp.Intiger{
+		Data: int64(zs.len()),
+	}
+}
+
+func execZScore(db kVStore, args [][]byte) resp.RespType {
+	zs, errReply := lookupZset(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if zs == nil {
+		return &resp.BulkStr{Data: nil}
+	}
+	score, ok := zs.dict[string(args[1])]
+	if !ok {
+		return &resp.BulkStr{Data: nil}
+	}
+	return &resp.BulkStr{
+		Data: formatScore(score),
+	}
+}
+
+func execZMScore(db kVStore, args [][]byte) resp.RespType {
+	zs, errReply := lookupZset(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+
+	arr := &resp.RespBulkStrArr{}
+	for _, m := range args[1:] {
+		if zs == nil {
+			arr.Append(nil)
+			continue
+		}
+		score, ok := zs.dict[string(m)]
+		if !ok {
+			arr.Append(nil)
+			continue
+		}
+		arr.Append(formatScore(score))
+	}
+	return arr
+}
+
+func zrank(db kVStore, args [][]byte, rev bool) resp.RespType {
+	withScore := false
+	if len(args) == 3 {
+		if strings.ToUpper(string(args[2])) != "WITHSCORE" {
+			return resp.SyntaxErr()
+		}
+		withScore = true
+	} else if len(args) > 3 {
+		return resp.SyntaxErr()
+	}
+
+	zs, errReply := lookupZset(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+
+	var rank int
+	ok := false
+	if zs != nil {
+		rank, ok = zs.rank(string(args[1]), rev)
+	}
+
+	if !ok {
+		if withScore {
+			return &resp.NullArray{}
+		}
+		return &resp.BulkStr{Data: nil}
+	}
+
+	if withScore {
+		return &resp.Array{
+			Elems: []resp.RespType{
+				&resp.Intiger{Data: int64(rank)},
+				&resp.BulkStr{Data: formatScore(zs.dict[string(args[1])])},
+			},
+		}
+	}
+	return &resp.Intiger{
+		Data: int64(rank),
+	}
+}
+
+func execZRank(db kVStore, args [][]byte) resp.RespType {
+	return zrank(db, args, false)
+}
+
+func execZRevRank(db kVStore, args [][]byte) resp.RespType {
+	return zrank(db, args, true)
+}
+
+const (
+	zrangeByRank = iota
+	zrangeByScore
+	zrangeByLex
+)
+
+type zrangeSpec struct {
+	by         int
+	rev        bool
+	offset     int
+	limit      int
+	withScores bool
+	// start and stop as given, for BYSCORE/BYLEX with REV start is the max
+	start, stop []byte
+}
+
+// parseZRangeOptions parses "[BYSCORE|BYLEX] [REV] [LIMIT offset count]
+// [WITHSCORES]" into spec, store is set for ZRANGESTORE which does not
+// accept WITHSCORES
+func parseZRangeOptions(args [][]byte, spec *zrangeSpec, store bool) resp.RespType {
+	hasLimit := false
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "BYSCORE":
+			if spec.by == zrangeByLex {
+				return resp.SyntaxErr()
+			}
+			spec.by = zrangeByScore
+		case "BYLEX":
+			if spec.by == zrangeByScore {
+				return resp.SyntaxErr()
+			}
+			spec.by = zrangeByLex
+		case "REV":
+			spec.rev = true
+		case "WITHSCORES":
+			if store {
+				return resp.SyntaxErr()
+			}
+			spec.withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return resp.SyntaxErr()
+			}
+			offset, ok := parseIndex(args[i+1])
+			if !ok {
+				return resp.NotInErr()
+			}
+			limit, ok := parseIndex(args[i+2])
+			if !ok {
+				return resp.NotInErr()
+			}
+			spec.offset, spec.limit = offset, limit
+			hasLimit = true
+			i += 2
+		default:
+			return resp.SyntaxErr()
+		}
+	}
+
+	if hasLimit && spec.by == zrangeByRank {
+		return resp.MakeErr("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+	if spec.withScores && spec.by == zrangeByLex {
+		return resp.MakeErr("ERR syntax error, WITHSCORES not supported in combination with BYLEX")
+	}
+	return nil
+}
+
+// rangeNodes returns the nodes selected by spec in reply order
+func (zs *zset) rangeNodes(spec *zrangeSpec) ([]*skiplistNode, resp.RespType) {
+	nodes := make([]*skiplistNode, 0)
+
+	if spec.by == zrangeByRank {
+		start, ok := parseIndex(spec.start)
+		if !ok {
+			return nil, resp.NotInErr()
+		}
+		stop, ok := parseIndex(spec.stop)
+		if !ok {
+			return nil, resp.NotInErr()
+		}
+
+		length := zs.len()
+		if start < 0 {
+			start += length
+		}
+		if stop < 0 {
+			stop += length
+		}
+		start = max(start, 0)
+		if start > stop || start >= length {
+			return nodes, nil
+		}
+		stop = min(stop, length-1)
+
+		var x *skiplistNode
+		if spec.rev {
+			x = zs.zsl.byRank(length - start)
+		} else {
+			x = zs.zsl.byRank(start + 1)
+		}
+		for n := stop - start + 1; n > 0 && x != nil; n-- {
+			nodes = append(nodes, x)
+			if spec.rev {
+				x = x.backward
+			} else {
+				x = x.level[0].forward
+			}
+		}
+		return nodes, nil
+	}
+
+	minRaw, maxRaw := spec.start, spec.stop
+	if spec.rev {
+		minRaw, maxRaw = maxRaw, minRaw
+	}
+
+	var x *skiplistNode
+	var inRange func(n *skiplistNode) bool
+
+	if spec.by == zrangeByScore {
+		r, errReply := parseScoreRange(minRaw, maxRaw)
+		if errReply != nil {
+			return nil, errReply
+		}
+		if spec.rev {
+			x = zs.zsl.lastInRange(r)
+			inRange = func(n *skiplistNode) bool { return r.gteMin(n.score) }
+		} else {
+			x = zs.zsl.firstInRange(r)
+			inRange = func(n *skiplistNode) bool { return r.lteMax(n.score) }
+		}
+	} else {
+		r, errReply := parseLexRange(minRaw, maxRaw)
+		if errReply != nil {
+			return nil, errReply
+		}
+		if spec.rev {
+			x = zs.zsl.lastInLexRange(r)
+			inRange = func(n *skiplistNode) bool { return r.gteMin(n.member) }
+		} else {
+			x = zs.zsl.firstInLexRange(r)
+			inRange = func(n *skiplistNode) bool { return r.lteMax(n.member) }
+		}
+	}
+
+	next := func(n *skiplistNode) *skiplistNode {
+		if spec.rev {
+			return n.backward
+		}
+		return n.level[0].forward
+	}
+
+	if spec.offset < 0 {
+		return nodes, nil
+	}
+	for skip := spec.offset; skip > 0 && x != nil; skip-- {
+		x = next(x)
+	}
+
+	for limit := spec.limit; x != nil && limit != 0 && inRange(x); limit-- {
+		nodes = append(nodes, x)
+		x = next(x)
+	}
+	return nodes, nil
+}
+
+func zrangeReply(nodes []*skiplistNode, withScores bool) resp.RespType {
+	arr := &resp.RespBulkStrArr{}
+	for _, n := range nodes {
+		arr.Append([]byte(n.member))
+		if withScores {
+			arr.Append(formatScore(n.score))
+		}
+	}
+	return arr
+}
+
+func zrangeGeneric(db kVStore, key string, spec *zrangeSpec) resp.RespType {
+	zs, errReply := lookupZset(db, key)
+	if errReply != nil {
+		return errReply
+	}
+	if zs == nil {
+		return &resp.RespBulkStrArr{}
+	}
+
+	nodes, errReply := zs.rangeNodes(spec)
+	if errReply != nil {
+		return errReply
+	}
+	return zrangeReply(nodes, spec.withScores)
+}
+
+func execZRange(db kVStore, args [][]byte) resp.RespType {
+	spec := &zrangeSpec{start: args[1], stop: args[2], limit: -1}
+	if errReply := parseZRangeOptions(args[3:], spec, false); errReply != nil {
+		return errReply
+	}
+	return zrangeGeneric(db, string(args[0]), spec)
+}
+
+func execZRangeStore(db kVStore, args [][]byte) resp.RespType {
+	spec := &zrangeSpec{start: args[2], stop: args[3], limit: -1}
+	if errReply := parseZRangeOptions(args[4:], spec, true); errReply != nil {
+		return errReply
+	}
+
+	src, errReply := lookupZset(db, string(args[1]))
+	if errReply != nil {
+		return errReply
+	}
+
+	result := newZset()
+	if src != nil {
+		nodes, errReply := src.rangeNodes(spec)
+		if errReply != nil {
+			return errReply
+		}
+		for _, n := range nodes {
+			result.add(n.member, n.score)
+		}
+	}
+
+	storeZset(db, string(args[0]), result)
+	return &resp.Intiger{
+		Data: int64(result.len()),
+	}
+}
+
+// legacyZRange handles ZREVRANGE, ZRANGEBYSCORE and the like. They only
+// differ from ZRANGE in the implied BY and REV options.
+func legacyZRange(db kVStore, args [][]byte, by int, rev bool) resp.RespType {
+	spec := &zrangeSpec{by: by, rev: rev, start: args[1], stop: args[2], limit: -1}
+	if errReply := parseZRangeOptions(args[3:], spec, false); errReply != nil {
+		return errReply
+	}
+	// the options must not change the implied range type
+	if spec.by != by || spec.rev != rev {
+		return resp.SyntaxErr()
+	}
+	return zrangeGeneric(db, string(args[0]), spec)
+}
+
+func execZRevRange(db kVStore, args [][]byte) resp.RespType {
+	return legacyZRange(db, args, zrangeByRank, true)
+}
+
+func execZRangeByScore(db kVStore, args [][]byte) resp.RespType {
+	return legacyZRange(db, args, zrangeByScore, false)
+}
+
+func execZRevRangeByScore(db kVStore, args [][]byte) resp.RespType {
+	return legacyZRange(db, args, zrangeByScore, true)
+}
+
+func execZRangeByLex(db kVStore, args [][]byte) resp.RespType {
+	return legacyZRange(db, args, zrangeByLex, false)
+}
+
+func execZRevRangeByLex(db kVStore, args [][]byte) resp.RespType {
+	return legacyZRange(db, args, zrangeByLex, true)
+}
+
+func zcount(db kVStore, args [][]byte, by int) resp.RespType {
+	zs, errReply := lookupZset(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+
+	var first, last *skiplistNode
+	if by == zrangeByScore {
+		r, errReply := parseScoreRange(args[1], args[2])
+		if errReply != nil {
+			return errReply
+		}
+		if zs != nil {
+			first, last = zs.zsl.firstInRange(r), zs.zsl.lastInRange(r)
+		}
+	} else {
+		r, errReply := parseLexRange(args[1], args[2])
+		if errReply != nil {
+			return errReply
+		}
+		if zs != nil {
+			first, last = zs.zsl.firstInLexRange(r), zs.zsl.lastInLexRange(r)
+		}
+	}
+
+	if first == nil || last == nil {
+		return &resp.Intiger{Data: 0}
+	}
+
+	count := zs.zsl.rank(last.score, last.member) - zs.zsl.rank(first.score, first.member) + 1
+	return &resp.Intiger{
+		Data: int64(max(count, 0)),
+	}
+}
+
+func execZCount(db kVStore, args [][]byte) resp.RespType {
+	return zcount(db, args, zrangeByScore)
+}
+
+func execZLexCount(db kVStore, args [][]byte) resp.RespType {
+	return zcount(db, args, zrangeByLex)
+}
+
+func zremRange(db kVStore, args [][]byte, by int) resp.RespType {
+	key := string(args[0])
+	spec := &zrangeSpec{by: by, start: args[1], stop: args[2], limit: -1}
+
+	zs, errReply := lookupZset(db, key)
+	if errReply != nil {
+		return errReply
+	}
+
+	// validate the range even if the key does not exist
+	tmp := zs
+	if tmp == nil {
+		tmp = newZset()
+	}
+	nodes, errReply := tmp.rangeNodes(spec)
+	if errReply != nil {
+		return errReply
+	}
+
+	for _, n := range nodes {
+		zs.remove(n.member)
+	}
+	if zs != nil {
+		deleteEmptyZset(db, key, zs)
+	}
+	return &resp.Intiger{
+		Data: int64(len(nodes)),
+	}
+}
+
+func execZRemRangeByRank(db kVStore, args [][]byte) resp.RespType {
+	return zremRange(db, args, zrangeByRank)
+}
+
+func execZRemRangeByScore(db kVStore, args [][]byte) resp.RespType {
+	return zremRange(db, args, zrangeByScore)
+}
+
+func execZRemRangeByLex(db kVStore, args [][]byte) resp.RespType {
+	return zremRange(db, args, zrangeByLex)
+}
+
+func zpop(db kVStore, args [][]byte, highest bool) resp.RespType {
+	if len(args) > 2 {
+		return resp.SyntaxErr()
+	}
+
+	key := string(args[0])
+	count := 1
+	if len(args) == 2 {
+		c, ok := parseIndex(args[1])
+		if !ok || c < 0 {
+			return resp.MakeErr("ERR value is out of range, must be positive")
+		}
+		count = c
+	}
+
+	zs, errReply := lookupZset(db, key)
+	if errReply != nil {
+		return errReply
+	}
+
+	arr := &resp.RespBulkStrArr{}
+	if zs == nil {
+		return arr
+	}
+
+	for ; count > 0 && zs.len() > 0; count-- {
+		x := zs.zsl.header.level[0].forward
+		if highest {
+			x = zs.zsl.tail
+		}
+		member, score := x.member, x.score
+		zs.remove(member)
+		arr.Append([]byte(member))
+		arr.Append(formatScore(score))
+	}
+	deleteEmptyZset(db, key, zs)
+	return arr
+}
+
+func execZPopMin(db kVStore, args [][]byte) resp.RespType {
+	return zpop(db, args, false)
+}
+
+func execZPopMax(db kVStore, args [][]byte) resp.RespType {
+	return zpop(db, args, true)
+}
+
+// zsetInput is a source of ZUNIONSTORE/ZINTERSTORE, plain sets are accepted
+// with every member scoring 1
+type zsetInput struct {
+	zs     *zset
+	s      *set
+	weight float64
+}
+
+func (in *zsetInput) len() int {
+	switch {
+	case in.zs != nil:
+		return in.zs.len()
+	case in.s != nil:
+		return in.s.len()
+	}
+	return 0
+}
+
+func (in *zsetInput) score(member string) (float64, bool) {
+	switch {
+	case in.zs != nil:
+		score, ok := in.zs.dict[member]
+		return score, ok
+	case in.s != nil:
+		return 1, in.s.contains([]byte(member))
+	}
+	return 0, false
+}
+
+func (in *zsetInput) iter(fn func(member string, score float64)) {
+	switch {
+	case in.zs != nil:
+		for m, score := range in.zs.dict {
+			fn(m, score)
+		}
+	case in.s != nil:
+		in.s.iter(func(member []byte) bool {
+			fn(string(member), 1)
+			return true
+		})
+	}
+}
+
+// weighted multiplies the score by the input weight, 0 * inf is 0 in redis
+func (in *zsetInput) weighted(score float64) float64 {
+	v := score * in.weight
+	if math.IsNaN(v) {
+		return 0
+	}
+	return v
+}
+
+func aggregate(op string, acc, v float64) float64 {
+	switch op {
+	case "MIN":
+		return min(acc, v)
+	case "MAX":
+		return max(acc, v)
+	}
+	sum := acc + v
+	if math.IsNaN(sum) {
+		return 0
+	}
+	return sum
+}
+
+// zsetOpKeys returns the keys of ZUNION and ZINTER, or of their STORE
+// variants which take the destination first
+func zsetOpKeys(store bool) func(cmd [][]byte) [][]byte {
+	return func(cmd [][]byte) [][]byte {
+		var keys [][]byte
+		i := 1
+		if store {
+			keys = append(keys, cmd[1])
+			i = 2
+		}
+		numKeys, ok := parseIndex(cmd[i])
+		if !ok || numKeys < 0 || numKeys > len(cmd)-i-1 {
+			return keys
+		}
+		return append(keys, cmd[i+1:i+1+numKeys]...)
+	}
+}
+
+// zsetOp parses "numkeys key [key ...] [WEIGHTS weight ...] [AGGREGATE
+// SUM|MIN|MAX] [WITHSCORES]" and computes the union or intersection
+func zsetOp(db kVStore, name string, args [][]byte, union bool, store bool) (*zset, bool, resp.RespType) {
+	numKeys, ok := parseIndex(args[0])
+	if !ok {
+		return nil, false, resp.NotInErr()
+	}
+	if numKeys < 1 {
+		return nil, false, resp.MakeErr("ERR at least 1 input key is needed for '" + name + "' command")
+	}
+	if numKeys > len(args)-1 {
+		return nil, false, resp.SyntaxErr()
+	}
+
+	inputs := make([]*zsetInput, numKeys)
+	for i, k := range args[1 : numKeys+1] {
+		in := &zsetInput{weight: 1}
+		d, ok := db.get(string(k))
+		if ok {
+			switch d.typ {
+			case typeZset:
+				in.zs = d.val.(*zset)
+			case typeSet:
+				in.s = d.val.(*set)
+			default:
+				return nil, false, resp.WrongTypeErr()
+			}
+		}
+		inputs[i] = in
+	}
+
+	agg := "SUM"
+	withScores := false
+	rest := args[numKeys+1:]
+	for i := 0; i < len(rest); i++ {
+		switch strings.ToUpper(string(rest[i])) {
+		case "WEIGHTS":
+			if i+numKeys >= len(rest) {
+				return nil, false, resp.SyntaxErr()
+			}
+			for j := range numKeys {
+				w, ok := parseScore(rest[i+1+j])
+				if !ok {
+					return nil, false, resp.MakeErr("ERR weight value is not a float")
+				}
+				inputs[j].weight = w
+			}
+			i += numKeys
+		case "AGGREGATE":
+			if i+1 >= len(rest) {
+				return nil, false, resp.SyntaxErr()
+			}
+			agg = strings.ToUpper(string(rest[i+1]))
+			if agg != "SUM" && agg != "MIN" && agg != "MAX" {
+				return nil, false, resp.SyntaxErr()
+			}
+			i++
+		case "WITHSCORES":
+			if store {
+				return nil, false, resp.SyntaxErr()
+			}
+			withScores = true
+		default:
+			return nil, false, resp.SyntaxErr()
+		}
+	}
+
+	scores := make(map[string]float64)
+	if union {
+		for _, in := range inputs {
+			in.iter(func(member string, score float64) {
+				v := in.weighted(score)
+				if acc, ok := scores[member]; ok {
+					scores[member] = aggregate(agg, acc, v)
+				} else {
+					scores[member] = v
+				}
+			})
+		}
+	} else {
+		smallest := inputs[0]
+		for _, in := range inputs[1:] {
+			if in.len() < smallest.len() {
+				smallest = in
+			}
+		}
+		// the accumulation still happens in input order
+		smallest.iter(func(member string, _ float64) {
+			var acc float64
+			for i, in := range inputs {
+				score, ok := in.score(member)
+				if !ok {
+					return
+				}
+				v := in.weighted(score)
+				if i == 0 {
+					acc = v
+				} else {
+					acc = aggregate(agg, acc, v)
+				}
+			}
+			scores[member] = acc
+		})
+	}
+
+	result := newZset()
+	for m, score := range scores {
+		result.add(m, score)
+	}
+	return result, withScores, nil
+}
+
+func execZUnionStore(db kVStore, args [][]byte) resp.RespType {
+	result, _, errReply := zsetOp(db, "zunionstore", args[1:], true, true)
+	if errReply != nil {
+		return errReply
+	}
+	storeZset(db, string(args[0]), result)
+	return &resp.Intiger{
+		Data: int64(result.len()),
+	}
+}
+
+func execZInterStore(db kVStore, args [][]byte) resp.RespType {
+	result, _, errReply := zsetOp(db, "zinterstore", args[1:], false, true)
+	if errReply != nil {
+		return errReply
+	}
+	storeZset(db, string(args[0]), result)
+	return &resp.Intiger{
+		Data: int64(result.len()),
+	}
+}
+
+func zsetOpReply(result *zset, withScores bool) resp.RespType {
+	nodes := make([]*skiplistNode, 0, result.len())
+	for x := result.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		nodes = append(nodes, x)
+	}
+	return zrangeReply(nodes, withScores)
+}
+
+func execZUnion(db kVStore, args [][]byte) resp.RespType {
+	result, withScores, errReply := zsetOp(db, "zunion", args, true, false)
+	if errReply != nil {
+		return errReply
+	}
+	return zsetOpReply(result, withScores)
+}
+
+func execZInter(db kVStore, args [][]byte) resp.RespType {
+	result, withScores, errReply := zsetOp(db, "zinter", args, false, false)
+	if errReply != nil {
+		return errReply
+	}
+	return zsetOpReply(result, withScores)
+}
+
+// execZScan returns about COUNT members with their scores per call, see
+// execHScan
+func execZScan(db kVStore, args [][]byte) resp.RespType {
+	opts, errReply := parseScanArgs(args[1:])
+	if errReply != nil {
+		return errReply
+	}
+
+	zs, errReply := lookupZset(db, string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+
+	var members []string
+	var next uint64
+	if zs != nil {
+		members, next = scanElements(zs.scan, zs.iter, opts.cursor, opts.count)
+	}
+
+	items := &resp.RespBulkStrArr{}
+	for _, m := range members {
+		if opts.pattern != "" && !utils.GlobMatch(opts.pattern, m) {
+			continue
+		}
+		items.Append([]byte(m))
+		items.Append(formatScore(zs.dict[m]))
+	}
+
+	return &resp.Array{
+		Elems: []resp.RespType{
+			&resp.BulkStr{Data: []byte(strconv.FormatUint(next, 10))},
+			items,
+		},
+	}
+}
+
+func init() {
+	registerCommand("zadd", -4, cmdWrite, execZAdd)
+	registerCommand("zincrby", 4, cmdWrite, execZIncrBy)
+	registerCommand("zrem", -3, cmdWrite|cmdFreesMemory, execZRem)
+	registerCommand("zcard", 2, cmdReadOnly, execZCard)
+	registerCommand("zscore", 3, cmdReadOnly, execZScore)
+	registerCommand("zmscore", -3, cmdReadOnly, execZMScore)
+	registerCommand("zrank", -3, cmdReadOnly, execZRank)
+	registerCommand("zrevrank", -3, cmdReadOnly, execZRevRank)
+	registerCommand("zrange", -4, cmdReadOnly, execZRange)
+	registerCommand("zrangestore", -5, cmdWrite, execZRangeStore).withKeys(1, 2, 1)
+	registerCommand("zrevrange", -4, cmdReadOnly, execZRevRange)
+	registerCommand("zrangebyscore", -4, cmdReadOnly, execZRangeByScore)
+	registerCommand("zrevrangebyscore", -4, cmdReadOnly, execZRevRangeByScore)
+	registerCommand("zrangebylex", -4, cmdReadOnly, execZRangeByLex)
+	registerCommand("zrevrangebylex", -4, cmdReadOnly, execZRevRangeByLex)
+	registerCommand("zcount", 4, cmdReadOnly, execZCount)
+	registerCommand("zlexcount", 4, cmdReadOnly, execZLexCount)
+	registerCommand("zremrangebyrank", 4, cmdWrite|cmdFreesMemory, execZRemRangeByRank)
+	registerCommand("zremrangebyscore", 4, cmdWrite|cmdFreesMemory, execZRemRangeByScore)
+	registerCommand("zremrangebylex", 4, cmdWrite|cmdFreesMemory, execZRemRangeByLex)
+	registerCommand("zpopmin", -2, cmdWrite|cmdFreesMemory, execZPopMin)
+	registerCommand("zpopmax", -2, cmdWrite|cmdFreesMemory, execZPopMax)
+	registerCommand("zunionstore", -4, cmdWrite, execZUnionStore).withGetKeys(zsetOpKeys(true))
+	registerCommand("zinterstore", -4, cmdWrite, execZInterStore).withGetKeys(zsetOpKeys(true))
+	registerCommand("zunion", -3, cmdReadOnly, execZUnion).withGetKeys(zsetOpKeys(false))
+	registerCommand("zinter", -3, cmdReadOnly, execZInter).withGetKeys(zsetOpKeys(false))
+	registerCommand("zscan", -3, cmdReadOnly, execZScan)
+}
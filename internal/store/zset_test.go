@@ -0,0 +1,171 @@
+package store
+
+import (
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/myselfBZ/go-redis-clone/internal/resp"
+	"github.com/myselfBZ/go-redis-clone/pkg/utils"
+)
+
+func TestSkiplistRanks(t *testing.T) {
+	zs := newZset()
+	for i := range 1000 {
+		zs.add(strconv.Itoa(i), float64(rand.IntN(100)))
+	}
+	for i := 0; i < 1000; i += 3 {
+		zs.remove(strconv.Itoa(i))
+	}
+	for i := 0; i < 1000; i += 7 {
+		zs.add(strconv.Itoa(i), float64(rand.IntN(100)))
+	}
+
+	if zs.zsl.length != zs.len() {
+		t.Fatalf("skiplist length %d does not match dict length %d", zs.zsl.length, zs.len())
+	}
+
+	rank := 1
+	var prev *skiplistNode
+	for x := zs.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		if prev != nil && !prev.less(x.score, x.member) {
+			t.Fatalf("nodes out of order: (%v, %s) before (%v, %s)", prev.score, prev.member, x.score, x.member)
+		}
+		if x.backward != prev {
+			t.Fatalf("broken backward link at rank %d", rank)
+		}
+		if r := zs.zsl.rank(x.score, x.member); r != rank {
+			t.Fatalf("expected rank %d for %s, got %d", rank, x.member, r)
+		}
+		if n := zs.zsl.byRank(rank); n != x {
+			t.Fatalf("byRank(%d) returned the wrong node", rank)
+		}
+		prev = x
+		rank++
+	}
+	if zs.zsl.tail != prev {
+		t.Fatalf("tail does not point to the last node")
+	}
+}
+
+func TestExecZset(t *testing.T) {
+	testDb.mu.Lock()
+	defer testDb.mu.Unlock()
+
+	key := utils.RandString(defaultKeyLength)
+	strKey := utils.RandString(defaultKeyLength)
+	testDb.put(strKey, &dataEntity{val: []byte("val")})
+
+	tests := []struct {
+		suite
+		exec execCmd
+	}{
+		{suite{"ZADD new members", &resp.Intiger{Data: 4}, toBytes(key, "1", "a", "2", "b", "3", "c", "4", "d")}, execZAdd},
+		{suite{"ZADD NX and XX", resp.IncompOptionsErr("XX", "NX"), toBytes(key, "NX", "XX", "1", "a")}, execZAdd},
+		{suite{"ZADD GT and LT", resp.MakeErr("ERR GT, LT, and/or NX options at the same time are not compatible"), toBytes(key, "GT", "LT", "1", "a")}, execZAdd},
+		{suite{"ZADD invalid score", resp.NotFloatErr(), toBytes(key, "abc", "a")}, execZAdd},
+		{suite{"ZADD GT CH lower score", &resp.Intiger{Data: 0}, toBytes(key, "GT", "CH", "0", "a")}, execZAdd},
+		{suite{"ZADD GT CH higher score", &resp.Intiger{Data: 1}, toBytes(key, "GT", "CH", "5", "a")}, execZAdd},
+		{suite{"ZADD XX on new member", &resp.Intiger{Data: 0}, toBytes(key, "XX", "1", "z")}, execZAdd},
+		{suite{"ZADD INCR", &resp.BulkStr{Data: []byte("6.5")}, toBytes(key, "INCR", "1.5", "a")}, execZAdd},
+		{suite{"ZADD INCR aborted by NX", &resp.BulkStr{Data: nil}, toBytes(key, "NX", "INCR", "1", "a")}, execZAdd},
+		{suite{"ZINCRBY", &resp.BulkStr{Data: []byte("5")}, toBytes(key, "-1.5", "a")}, execZIncrBy},
+		{suite{"ZRANGE", bulkArr("b", "c", "d", "a"), toBytes(key, "0", "-1")}, execZRange},
+		{suite{"ZRANGE REV WITHSCORES", bulkArr("a", "5", "d", "4"), toBytes(key, "0", "1", "REV", "WITHSCORES")}, execZRange},
+		{suite{"ZRANGE BYSCORE LIMIT", bulkArr("c", "d"), toBytes(key, "(2", "+inf", "BYSCORE", "LIMIT", "0", "2")}, execZRange},
+		{suite{"ZRANGE BYSCORE REV", bulkArr("d", "c"), toBytes(key, "4", "3", "BYSCORE", "REV")}, execZRange},
+		{suite{"ZRANGE LIMIT without BY", resp.MakeErr("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX"), toBytes(key, "0", "1", "LIMIT", "0", "1")}, execZRange},
+		{suite{"ZRANGEBYSCORE invalid range", resp.MakeErr("ERR min or max is not a float"), toBytes(key, "x", "1")}, execZRangeByScore},
+		{suite{"ZRANK", &resp.Intiger{Data: 3}, toBytes(key, "a")}, execZRank},
+		{suite{"ZREVRANK", &resp.Intiger{Data: 0}, toBytes(key, "a")}, execZRevRank},
+		{suite{"ZRANK missing member", &resp.BulkStr{Data: nil}, toBytes(key, "z")}, execZRank},
+		{suite{"ZSCORE", &resp.BulkStr{Data: []byte("2")}, toBytes(key, "b")}, execZScore},
+		{suite{"ZCOUNT", &resp.Intiger{Data: 3}, toBytes(key, "2", "(5")}, execZCount},
+		{suite{"ZPOPMIN", bulkArr("b", "2"), toBytes(key)}, execZPopMin},
+		{suite{"ZPOPMAX with count", bulkArr("a", "5", "d", "4"), toBytes(key, "2")}, execZPopMax},
+		{suite{"ZREM last member", &resp.Intiger{Data: 1}, toBytes(key, "c", "z")}, execZRem},
+		{suite{"ZCARD on missing key", &resp.Intiger{Data: 0}, toBytes(key)}, execZCard},
+		{suite{"ZADD on string key", resp.WrongTypeErr(), toBytes(strKey, "1", "a")}, execZAdd},
+	}
+
+	for _, test := range tests {
+		rep := test.exec(testDb, test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+
+	if _, ok := testDb.get(key); ok {
+		t.Fatalf("removing every member did not delete the key")
+	}
+}
+
+func TestExecZsetLexAndStore(t *testing.T) {
+	testDb.mu.Lock()
+	defer testDb.mu.Unlock()
+
+	k1, k2, setKey, dst := utils.RandString(defaultKeyLength), utils.RandString(defaultKeyLength), utils.RandString(defaultKeyLength), utils.RandString(defaultKeyLength)
+	execZAdd(testDb, toBytes(k1, "0", "a", "0", "b", "0", "c", "0", "d"))
+	execZAdd(testDb, toBytes(k2, "1", "b", "2", "c", "3", "x"))
+	execSAdd(testDb, toBytes(setKey, "c", "y"))
+
+	tests := []struct {
+		suite
+		exec execCmd
+	}{
+		{suite{"ZRANGEBYLEX", bulkArr("b", "c"), toBytes(k1, "(a", "[c")}, execZRangeByLex},
+		{suite{"ZRANGE BYLEX REV LIMIT", bulkArr("b", "a"), toBytes(k1, "[c", "-", "BYLEX", "REV", "LIMIT", "1", "2")}, execZRange},
+		{suite{"ZLEXCOUNT", &resp.Intiger{Data: 4}, toBytes(k1, "-", "+")}, execZLexCount},
+		{suite{"ZRANGEBYLEX invalid range", resp.MakeErr("ERR min or max not valid string range item"), toBytes(k1, "a", "c")}, execZRangeByLex},
+		{suite{"ZRANGESTORE", &resp.Intiger{Data: 2}, toBytes(dst, k1, "1", "2")}, execZRangeStore},
+		{suite{"ZRANGE stored", bulkArr("b", "c"), toBytes(dst, "0", "-1")}, execZRange},
+		{suite{"ZUNIONSTORE with WEIGHTS", &resp.Intiger{Data: 5}, toBytes(dst, "2", k1, k2, "WEIGHTS", "1", "10")}, execZUnionStore},
+		{suite{"ZRANGE union", bulkArr("a", "0", "d", "0", "b", "10", "c", "20", "x", "30"), toBytes(dst, "0", "-1", "WITHSCORES")}, execZRange},
+		{suite{"ZINTERSTORE with set and MAX", &resp.Intiger{Data: 1}, toBytes(dst, "3", k1, k2, setKey, "AGGREGATE", "MAX")}, execZInterStore},
+		{suite{"ZRANGE inter", bulkArr("c", "2"), toBytes(dst, "0", "-1", "WITHSCORES")}, execZRange},
+		{suite{"ZUNIONSTORE without keys", resp.MakeErr("ERR at least 1 input key is needed for 'zunionstore' command"), toBytes(dst, "0", k1)}, execZUnionStore},
+		{suite{"ZREMRANGEBYSCORE", &resp.Intiger{Data: 4}, toBytes(k1, "-inf", "0")}, execZRemRangeByScore},
+		{suite{"ZREMRANGEBYRANK", &resp.Intiger{Data: 2}, toBytes(k2, "0", "1")}, execZRemRangeByRank},
+	}
+
+	for _, test := range tests {
+		rep := test.exec(testDb, test.raw)
+		if !slices.Equal(rep.ToBytes(), test.expected.ToBytes()) {
+			t.Fatalf("%s. Response did not match. got '%q', want '%q'", test.name, string(rep.ToBytes()), string(test.expected.ToBytes()))
+		}
+	}
+
+	if _, ok := testDb.get(k1); ok {
+		t.Fatalf("ZREMRANGEBYSCORE of every member did not delete the key")
+	}
+}
+
+func TestZScanCursor(t *testing.T) {
+	s := NewStorage()
+	defer s.Close()
+
+	const n = 500
+	for i := 0; i < n; i++ {
+		mustExec(t, s, "ZADD", "z", strconv.Itoa(i), "m"+strconv.Itoa(i))
+	}
+	added := 0
+	seen, calls := scanCollection(t, s, "ZSCAN", "z", 2, func() {
+		mustExec(t, s, "ZADD", "z", "1", "new"+strconv.Itoa(added))
+		mustExec(t, s, "ZREM", "z", "m0")
+		added++
+	})
+	for i := 1; i < n; i++ {
+		if m := "m" + strconv.Itoa(i); seen[m] != 1 {
+			t.Fatalf("%s returned %d times", m, seen[m])
+		}
+	}
+	if calls < n/20 {
+		t.Fatalf("%d calls for %d members with COUNT 10", calls, n)
+	}
+
+	want := "*2\r\n$1\r\n0\r\n*2\r\n$3\r\nm42\r\n$2\r\n42\r\n"
+	if got := mustExec(t, s, "ZSCAN", "z", "0", "MATCH", "m42", "COUNT", "1000"); string(got.ToBytes()) != want {
+		t.Fatalf("ZSCAN with a large COUNT: %q", got.ToBytes())
+	}
+}
@@ -0,0 +1,98 @@
+package utils
+
+// GlobMatch reports whether s matches the redis style glob pattern.
+// Supported syntax: '*' any sequence, '?' any single byte, '[abc]' and
+// '[a-z]' classes ('^' negates a class) and '\' to escape the next byte.
+//
+// On a mismatch only the last '*' seen absorbs one more byte: every other
+// token matches a single byte, so whatever an earlier star could absorb
+// the last one can as well. Matching is O(len(pattern)*len(s)) at worst,
+// patterns like "*a*a*a*b" can't blow up on long keys.
+func GlobMatch(pattern, s string) bool {
+	p, i := 0, 0
+	star, starI := -1, 0
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			star, starI = p, i
+			p++
+			continue
+		}
+		if p < len(pattern) {
+			if matched, next := matchByte(pattern, p, s[i]); matched {
+				p, i = next, i+1
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		starI++
+		p, i = star+1, starI
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchByte matches c against the token of pattern at p, anything but a
+// star. It returns the result and where the next token starts.
+func matchByte(pattern string, p int, c byte) (bool, int) {
+	switch pattern[p] {
+	case '?':
+		return true, p + 1
+	case '[':
+		matched, rest := matchClass(pattern[p+1:], c)
+		return matched, len(pattern) - len(rest)
+	case '\\':
+		if p+1 < len(pattern) {
+			return pattern[p+1] == c, p + 2
+		}
+	}
+	return pattern[p] == c, p + 1
+}
+
+// matchClass matches c against the class that starts right after '['.
+// It returns the result and the pattern remaining after the closing ']'.
+func matchClass(pattern string, c byte) (bool, string) {
+	not := false
+	if len(pattern) > 0 && pattern[0] == '^' {
+		not = true
+		pattern = pattern[1:]
+	}
+
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) >= 2:
+			if pattern[1] == c {
+				matched = true
+			}
+			pattern = pattern[2:]
+		case len(pattern) >= 3 && pattern[1] == '-' && pattern[2] != ']':
+			lo, hi := pattern[0], pattern[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if c >= lo && c <= hi {
+				matched = true
+			}
+			pattern = pattern[3:]
+		default:
+			if pattern[0] == c {
+				matched = true
+			}
+			pattern = pattern[1:]
+		}
+	}
+
+	// skip the closing bracket, an unterminated class is treated as closed
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+
+	if not {
+		matched = !matched
+	}
+	return matched, pattern
+}
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h*llo", "hello world", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"user:*:name", "user:42:name", true},
+		{"user:*:name", "user:42:email", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`[\]]`, "]", true},
+		{"a**b", "axxb", true},
+		{"", "", true},
+		{"", "a", false},
+		{"*a*b", "xaxxb", true},
+		{"*a*b", "xaxxbc", false},
+		{"a*b*c", "abbbc", true},
+		{"*?", "", false},
+		{"[a-", "a", true},
+		{`a\`, `a\`, true},
+	}
+
+	for _, test := range tests {
+		if got := GlobMatch(test.pattern, test.s); got != test.want {
+			t.Errorf("GlobMatch(%q, %q) = %v, want %v", test.pattern, test.s, got, test.want)
+		}
+	}
+}
+
+func TestGlobMatchBacktracking(t *testing.T) {
+	pattern := strings.Repeat("*a", 30) + "b"
+	s := strings.Repeat("a", 10000)
+	if GlobMatch(pattern, s) {
+		t.Fatalf("GlobMatch(%q, %q) = true", pattern, s)
+	}
+}